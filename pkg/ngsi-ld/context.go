@@ -1,31 +1,66 @@
 package ngsi
 
+import (
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
 //ContextRegistry is where Context Sources register the information that they can provide
 type ContextRegistry interface {
 	GetContextSourcesForQuery(query Query) []ContextSource
 	GetContextSourcesForEntity(entityID string) []ContextSource
 	GetContextSourcesForEntityType(entityType string) []ContextSource
 
+	ContextSource(registrationID string) (ContextSource, bool)
+	ContextSources() []ContextSource
+
 	Register(source ContextSource)
+	RegisterIfAbsent(source ContextSource) bool
+	Unregister(registrationID string)
+}
+
+//RegisteredContextSource is implemented by context sources that have a registration ID. The
+//ID can be used to look up or unregister the source in a ContextRegistry. Sources that do
+//not implement this interface are given a generated ID when they are registered.
+type RegisteredContextSource interface {
+	RegistrationID() string
 }
 
 //NewContextRegistry initializes and returns a new default context registry without
-//any registered context sources
+//any registered context sources. The default registry is safe for concurrent use.
 func NewContextRegistry() ContextRegistry {
 	return &registry{}
 }
 
+type registeredSource struct {
+	id     string
+	source ContextSource
+}
+
 type registry struct {
-	sources []ContextSource
+	mu      sync.RWMutex
+	sources []registeredSource
+
+	//storeMu serialises writes to the store, which are done without holding mu so that slow
+	//storage never blocks lookups
+	storeMu      sync.Mutex
+	store        RegistrationStore
+	onStoreError func(error)
 }
 
 func (r *registry) GetContextSourcesForEntity(entityID string) []ContextSource {
 	matchingSources := []ContextSource{}
 
-	// TODO: Fix potential race issue
+	now := time.Now()
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
 	for _, src := range r.sources {
-		if src.ProvidesEntitiesWithMatchingID(entityID) {
-			matchingSources = append(matchingSources, src)
+		if sourceIsUsable(src.source, now) && src.source.ProvidesEntitiesWithMatchingID(entityID) {
+			matchingSources = append(matchingSources, src.source)
 		}
 	}
 
@@ -35,10 +70,14 @@ func (r *registry) GetContextSourcesForEntity(entityID string) []ContextSource {
 func (r *registry) GetContextSourcesForEntityType(entityType string) []ContextSource {
 	matchingSources := []ContextSource{}
 
-	// TODO: Fix potential race issue
+	now := time.Now()
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
 	for _, src := range r.sources {
-		if src.ProvidesType(entityType) {
-			matchingSources = append(matchingSources, src)
+		if sourceIsUsable(src.source, now) && src.source.ProvidesType(entityType) {
+			matchingSources = append(matchingSources, src.source)
 		}
 	}
 
@@ -50,27 +89,162 @@ func (r *registry) GetContextSourcesForQuery(query Query) []ContextSource {
 
 	entityTypeNames := query.EntityTypes()
 	entityAttributeNames := query.EntityAttributes()
+	now := time.Now()
 
-	// TODO: Fix potential race issue
-	for _, src := range r.sources {
-		for _, typeName := range entityTypeNames {
-			if typeName == "" || src.ProvidesType(typeName) {
-				for _, attributeName := range entityAttributeNames {
-					if attributeName == "" || src.ProvidesAttribute(attributeName) {
-						matchingSources = append(matchingSources, src)
-						break
-					}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, registered := range r.sources {
+		src := registered.source
+		if !sourceIsUsable(src, now) {
+			continue
+		}
+
+		if reg, ok := sourceRegistration(src); ok && !registrationCanMatchQuery(reg, query) {
+			continue
+		}
+
+		if sourceMatchesQuery(src, entityTypeNames, entityAttributeNames) {
+			matchingSources = append(matchingSources, src)
+		}
+	}
+
+	return matchingSources
+}
+
+//sourceMatchesQuery returns true if a source provides any of the queried types and any of the
+//queried attributes, so that a source that provides several of them is only queried once
+func sourceMatchesQuery(src ContextSource, entityTypeNames, entityAttributeNames []string) bool {
+	for _, typeName := range entityTypeNames {
+		if typeName == "" || src.ProvidesType(typeName) {
+			for _, attributeName := range entityAttributeNames {
+				if attributeName == "" || src.ProvidesAttribute(attributeName) {
+					return true
 				}
 			}
 		}
 	}
 
-	return matchingSources
+	return false
+}
+
+func (r *registry) ContextSource(registrationID string) (ContextSource, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, src := range r.sources {
+		if src.id == registrationID {
+			return src.source, true
+		}
+	}
+
+	return nil, false
+}
+
+func (r *registry) ContextSources() []ContextSource {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	sources := make([]ContextSource, 0, len(r.sources))
+	for _, src := range r.sources {
+		sources = append(sources, src.source)
+	}
+
+	return sources
 }
 
+//Register adds a context source to the registry. A source with the same registration ID
+//as an already registered source replaces the existing one.
 func (r *registry) Register(source ContextSource) {
-	// TODO: Fix potential race issue
-	r.sources = append(r.sources, source)
+	id := registrationIDFor(source)
+
+	r.mu.Lock()
+	r.replaceOrAppend(id, source)
+	r.mu.Unlock()
+
+	r.persist(id)
+}
+
+//RegisterIfAbsent adds a context source to the registry unless a source with the same
+//registration ID is already registered, in which case false is returned. The check and the
+//registration are done atomically.
+func (r *registry) RegisterIfAbsent(source ContextSource) bool {
+	id := registrationIDFor(source)
+
+	r.mu.Lock()
+	for _, src := range r.sources {
+		if src.id == id {
+			r.mu.Unlock()
+			return false
+		}
+	}
+
+	r.sources = append(r.sources, registeredSource{id: id, source: source})
+	r.mu.Unlock()
+
+	r.persist(id)
+
+	return true
+}
+
+//registrationIDFor returns the registration ID of a source, or a generated ID if it has none
+func registrationIDFor(source ContextSource) string {
+	if rcs, ok := source.(RegisteredContextSource); ok && rcs.RegistrationID() != "" {
+		return rcs.RegistrationID()
+	}
+
+	return "urn:ngsi-ld:ContextSourceRegistration:" + uuid.New().String()
+}
+
+func (r *registry) replaceOrAppend(id string, source ContextSource) {
+	for idx := range r.sources {
+		if r.sources[idx].id == id {
+			r.sources[idx].source = source
+			return
+		}
+	}
+
+	r.sources = append(r.sources, registeredSource{id: id, source: source})
+}
+
+func (r *registry) Unregister(registrationID string) {
+	r.mu.Lock()
+
+	sources := make([]registeredSource, 0, len(r.sources))
+	for _, src := range r.sources {
+		if src.id != registrationID {
+			sources = append(sources, src)
+		}
+	}
+
+	r.sources = sources
+	r.mu.Unlock()
+
+	r.persist(registrationID)
+}
+
+//wrappedContextSource is implemented by context sources that decorate another source
+type wrappedContextSource interface {
+	unwrap() ContextSource
+}
+
+//unwrapSource looks through any wrappers around a context source, starting with the source
+//itself, and returns the first source that matches. Nil is returned if no source matches.
+func unwrapSource(src ContextSource, matches func(ContextSource) bool) ContextSource {
+	for src != nil {
+		if matches(src) {
+			return src
+		}
+
+		wrapped, ok := src.(wrappedContextSource)
+		if !ok {
+			break
+		}
+
+		src = wrapped.unwrap()
+	}
+
+	return nil
 }
 
 //ContextSource provides query and subscription support for a set of entities
@@ -79,8 +253,15 @@ type ContextSource interface {
 	ProvidesEntitiesWithMatchingID(entityID string) bool
 	ProvidesType(typeName string) bool
 
+	AppendEntityAttributes(entityID string, request Request) (*UpdateResult, error)
 	CreateEntity(typeName, entityID string, request Request) error
+	DeleteEntity(entityID string, request Request) error
 	GetEntities(query Query, callback QueryEntitiesCallback) error
 	RetrieveEntity(entityID string, request Request) (Entity, error)
 	UpdateEntityAttributes(entityID string, request Request) error
+
+	CreateEntities(request Request) (*BatchOperationResult, error)
+	UpsertEntities(request Request) (*BatchOperationResult, error)
+	UpdateEntities(request Request) (*BatchOperationResult, error)
+	DeleteEntities(request Request) (*BatchOperationResult, error)
 }
@@ -0,0 +1,123 @@
+package ngsi
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+type identifiedMockCtxSource struct {
+	mockCtxSource
+	id string
+}
+
+func (s *identifiedMockCtxSource) RegistrationID() string {
+	return s.id
+}
+
+func TestUnregisterContextSource(t *testing.T) {
+	ctxReg := NewContextRegistry()
+	ctxReg.Register(&identifiedMockCtxSource{mockCtxSource: mockCtxSource{typeName: "Beach"}, id: "reg1"})
+	ctxReg.Register(&identifiedMockCtxSource{mockCtxSource: mockCtxSource{typeName: "Beach"}, id: "reg2"})
+
+	if len(ctxReg.GetContextSourcesForEntityType("Beach")) != 2 {
+		t.Error("Expected two registered context sources for type Beach.")
+	}
+
+	ctxReg.Unregister("reg1")
+
+	if _, found := ctxReg.ContextSource("reg1"); found {
+		t.Error("Unregistered context source should not be found.")
+	}
+
+	if _, found := ctxReg.ContextSource("reg2"); !found {
+		t.Error("Context source reg2 should still be registered.")
+	}
+
+	if len(ctxReg.ContextSources()) != 1 {
+		t.Error("Unexpected number of registered context sources. ", len(ctxReg.ContextSources()), " != 1")
+	}
+}
+
+func TestRegisterWithExistingIDReplacesContextSource(t *testing.T) {
+	ctxReg := NewContextRegistry()
+	ctxReg.Register(&identifiedMockCtxSource{mockCtxSource: mockCtxSource{typeName: "Beach"}, id: "reg1"})
+	ctxReg.Register(&identifiedMockCtxSource{mockCtxSource: mockCtxSource{typeName: "Road"}, id: "reg1"})
+
+	if len(ctxReg.ContextSources()) != 1 || len(ctxReg.GetContextSourcesForEntityType("Road")) != 1 {
+		t.Error("Re-registering a context source should replace the existing registration.")
+	}
+}
+
+func TestContextRegistryIsSafeForConcurrentUse(t *testing.T) {
+	ctxReg := NewContextRegistry()
+	wg := sync.WaitGroup{}
+
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+
+		go func(i int) {
+			defer wg.Done()
+			id := fmt.Sprintf("reg%d", i)
+			ctxReg.Register(&identifiedMockCtxSource{mockCtxSource: mockCtxSource{typeName: "Beach"}, id: id})
+			if i%2 == 1 {
+				ctxReg.Unregister(id)
+			}
+		}(i)
+
+		go func() {
+			defer wg.Done()
+			req, _ := http.NewRequest("GET", createURL("/entities", "type=Beach"), nil)
+			query, _ := newQueryFromParameters(req, []string{"Beach"}, []string{""}, "")
+			ctxReg.GetContextSourcesForQuery(query)
+			ctxReg.GetContextSourcesForEntity("urn:ngsi-ld:Beach:omaha")
+		}()
+	}
+
+	wg.Wait()
+
+	if len(ctxReg.ContextSources()) != 5 {
+		t.Error("Unexpected number of registered context sources. ", len(ctxReg.ContextSources()), " != 5")
+	}
+}
+
+func TestSourceRegisteredForSeveralQueriedTypesIsOnlyReturnedOnce(t *testing.T) {
+	reg, _ := NewCsourceRegistrationFromJSON([]byte(`{"type":"ContextSourceRegistration",
+		"information":[{"entities":[{"type":"Beach"},{"type":"Lake"}]}],
+		"endpoint":"http://lolcathost"}`))
+	src, _ := NewRemoteContextSource(reg)
+
+	ctxReg := NewContextRegistry()
+	ctxReg.Register(src)
+
+	req, _ := http.NewRequest("GET", createURL("/entities", "type=Beach,Lake"), nil)
+	query, _ := newQueryFromParameters(req, []string{"Beach", "Lake"}, []string{""}, "")
+
+	if len(ctxReg.GetContextSourcesForQuery(query)) != 1 {
+		t.Error("A source that provides both queried types should only be returned once.")
+	}
+}
+
+func TestRegisterIfAbsentOnlyRegistersOnce(t *testing.T) {
+	ctxReg := NewContextRegistry()
+	wg := sync.WaitGroup{}
+	var registered int32
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if ctxReg.RegisterIfAbsent(&identifiedMockCtxSource{mockCtxSource: mockCtxSource{typeName: "Beach"}, id: "reg1"}) {
+				atomic.AddInt32(&registered, 1)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if registered != 1 || len(ctxReg.ContextSources()) != 1 {
+		t.Error("Exactly one of the concurrent registrations should succeed, not ", registered)
+	}
+}
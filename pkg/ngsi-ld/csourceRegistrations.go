@@ -5,10 +5,12 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
-	"net/http/httputil"
 	"net/url"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/iot-for-tillgenglighet/ngsi-ld-golang/pkg/ngsi-ld/errors"
@@ -17,7 +19,9 @@ import (
 
 //CsourceRegistration is a wrapper for information about a registered context source
 type CsourceRegistration interface {
+	ID() string
 	Endpoint() string
+	ExpiresAt() *time.Time
 	ProvidesAttribute(attributeName string) bool
 	ProvidesEntitiesWithMatchingID(entityID string) bool
 	ProvidesType(typeName string) bool
@@ -37,18 +41,295 @@ func NewRegisterContextSourceHandler(ctxReg ContextRegistry) http.HandlerFunc {
 			return
 		}
 
+		if err = normalizeRegistration(reg, body, r); err != nil {
+			reportContextError(w, err)
+			return
+		}
+
+		if registrationExpired(reg, time.Now()) {
+			errors.ReportNewBadRequestData(w, "The expiresAt of a new registration must be in the future.")
+			return
+		}
+
 		remoteCtxSrc, _ := NewRemoteContextSource(reg)
 
-		ctxReg.Register(remoteCtxSrc)
+		if !ctxReg.RegisterIfAbsent(remoteCtxSrc) {
+			errors.ReportNewAlreadyExists(w, fmt.Sprintf("A registration with id %s already exists", reg.ID()))
+			return
+		}
 
 		jsonBytes, _ := json.Marshal(remoteCtxSrc)
 
-		w.WriteHeader(http.StatusCreated)
+		w.Header().Add("Location", strings.TrimSuffix(r.URL.Path, "/")+"/"+reg.ID())
 		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
 		w.Write(jsonBytes)
 	})
 }
 
+//NewQueryContextSourceRegistrationsHandler handles GET requests for csource registrations. The
+//registrations can be filtered using the type, id, idPattern and attrs parameters.
+func NewQueryContextSourceRegistrationsHandler(ctxReg ContextRegistry) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := normalizeRequest(r); err != nil {
+			reportContextError(w, err)
+			return
+		}
+
+		params := queryParameters(r)
+
+		var typeNames, entityIDs, attributeNames []string
+		if types := params.Get("type"); types != "" {
+			typeNames = strings.Split(types, ",")
+		}
+		if ids := params.Get("id"); ids != "" {
+			entityIDs = strings.Split(ids, ",")
+		}
+		if attrs := params.Get("attrs"); attrs != "" {
+			attributeNames = strings.Split(attrs, ",")
+		}
+
+		var idPattern *regexp.Regexp
+		if pattern := params.Get("idPattern"); pattern != "" {
+			var err error
+			idPattern, err = regexp.CompilePOSIX(pattern)
+			if err != nil {
+				errors.ReportNewBadRequestData(w, "Invalid idPattern: "+err.Error())
+				return
+			}
+		}
+
+		registrations := []CsourceRegistration{}
+
+		for _, src := range ctxReg.ContextSources() {
+			reg, ok := sourceRegistration(src)
+			if !ok {
+				continue
+			}
+
+			if registrationMatches(reg, typeNames, entityIDs, idPattern, attributeNames) {
+				registrations = append(registrations, reg)
+			}
+		}
+
+		sort.Slice(registrations, func(i, j int) bool {
+			return registrations[i].ID() < registrations[j].ID()
+		})
+
+		bytes, err := json.MarshalIndent(registrations, "", "  ")
+		if err != nil {
+			errors.ReportNewInternalError(w, "Failed to encode response.")
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.Write(bytes)
+	})
+}
+
+func registrationMatches(reg CsourceRegistration, typeNames, entityIDs []string, idPattern *regexp.Regexp, attributeNames []string) bool {
+	matchesAny := func(values []string, provides func(string) bool) bool {
+		if len(values) == 0 {
+			return true
+		}
+		for _, v := range values {
+			if provides(v) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if !matchesAny(typeNames, reg.ProvidesType) ||
+		!matchesAny(entityIDs, reg.ProvidesEntitiesWithMatchingID) ||
+		!matchesAny(attributeNames, reg.ProvidesAttribute) {
+		return false
+	}
+
+	if idPattern != nil {
+		csr, ok := reg.(*ctxSrcReg)
+		if !ok {
+			return true
+		}
+
+		// Registrations that do not list the IDs of their entities may provide entities that
+		// match the pattern, so only registrations where no listed ID matches are filtered out
+		for _, info := range csr.Information {
+			if len(info.Entities) == 0 {
+				return true
+			}
+
+			for _, entity := range info.Entities {
+				if entity.ID == nil || idPattern.MatchString(*entity.ID) {
+					return true
+				}
+			}
+		}
+
+		return false
+	}
+
+	return true
+}
+
+//registrationProvider is implemented by context sources that are created from a registration
+type registrationProvider interface {
+	Registration() CsourceRegistration
+}
+
+//sourceRegistration returns the registration of a context source, looking through any wrappers
+func sourceRegistration(src ContextSource) (CsourceRegistration, bool) {
+	rp, ok := unwrapSource(src, func(s ContextSource) bool {
+		_, ok := s.(registrationProvider)
+		return ok
+	}).(registrationProvider)
+	if !ok {
+		return nil, false
+	}
+
+	return rp.Registration(), true
+}
+
+func registrationIDFromPath(path string) string {
+	registrationsIdx := strings.Index(path, "/csourceRegistrations/")
+	if registrationsIdx == -1 {
+		return ""
+	}
+	return strings.TrimSuffix(path[registrationsIdx+22:], "/")
+}
+
+//NewRetrieveContextSourceRegistrationHandler handles GET requests for a single csource registration
+func NewRetrieveContextSourceRegistrationHandler(ctxReg ContextRegistry) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		registrationID := registrationIDFromPath(r.URL.Path)
+
+		if registrationID == "" {
+			errors.ReportNewBadRequestData(
+				w,
+				"The supplied URL is invalid.",
+			)
+			return
+		}
+
+		src, found := ctxReg.ContextSource(registrationID)
+		reg, hasRegistration := sourceRegistration(src)
+
+		if !found || !hasRegistration {
+			errors.ReportNewResourceNotFound(w, fmt.Sprintf("No registration found with id %s", registrationID))
+			return
+		}
+
+		bytes, _ := json.MarshalIndent(reg, "", "  ")
+
+		w.Header().Add("Content-Type", "application/json")
+		w.Write(bytes)
+	})
+}
+
+//NewUpdateContextSourceRegistrationHandler handles PATCH requests for csource registrations
+func NewUpdateContextSourceRegistrationHandler(ctxReg ContextRegistry) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		registrationID := registrationIDFromPath(r.URL.Path)
+
+		if registrationID == "" {
+			errors.ReportNewBadRequestData(
+				w,
+				"The supplied URL is invalid.",
+			)
+			return
+		}
+
+		src, found := ctxReg.ContextSource(registrationID)
+		current, hasRegistration := sourceRegistration(src)
+
+		if !found || !hasRegistration {
+			errors.ReportNewResourceNotFound(w, fmt.Sprintf("No registration found with id %s", registrationID))
+			return
+		}
+
+		body, _ := ioutil.ReadAll(r.Body)
+		reg, err := patchCsourceRegistration(current, body)
+
+		if err != nil {
+			errors.ReportNewBadRequestData(
+				w,
+				"Failed to update registration: "+err.Error(),
+			)
+			return
+		}
+
+		if registrationExpired(reg, time.Now()) {
+			errors.ReportNewBadRequestData(w, "The expiresAt of an updated registration must be in the future.")
+			return
+		}
+
+		remoteCtxSrc, _ := NewRemoteContextSource(reg)
+		ctxReg.Register(remoteCtxSrc)
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+//patchCsourceRegistration merges a registration fragment into a registration. Members in
+//the fragment replace the existing members, and members set to null are removed.
+func patchCsourceRegistration(current CsourceRegistration, patch []byte) (CsourceRegistration, error) {
+	fragment := map[string]json.RawMessage{}
+	err := json.Unmarshal(patch, &fragment)
+	if err != nil {
+		return nil, err
+	}
+
+	if id, ok := fragment["id"]; ok {
+		newID := ""
+		if json.Unmarshal(id, &newID) != nil || newID != current.ID() {
+			return nil, fmt.Errorf("the id of a registration can not be changed")
+		}
+	}
+
+	currentBytes, err := json.Marshal(current)
+	if err != nil {
+		return nil, err
+	}
+
+	merged := map[string]json.RawMessage{}
+	json.Unmarshal(currentBytes, &merged)
+
+	for key, value := range fragment {
+		if string(value) == "null" {
+			delete(merged, key)
+		} else {
+			merged[key] = value
+		}
+	}
+
+	mergedBytes, _ := json.Marshal(merged)
+	return NewCsourceRegistrationFromJSON(mergedBytes)
+}
+
+//NewDeleteContextSourceRegistrationHandler handles DELETE requests for csource registrations
+func NewDeleteContextSourceRegistrationHandler(ctxReg ContextRegistry) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		registrationID := registrationIDFromPath(r.URL.Path)
+
+		if registrationID == "" {
+			errors.ReportNewBadRequestData(
+				w,
+				"The supplied URL is invalid.",
+			)
+			return
+		}
+
+		if _, found := ctxReg.ContextSource(registrationID); !found {
+			errors.ReportNewResourceNotFound(w, fmt.Sprintf("No registration found with id %s", registrationID))
+			return
+		}
+
+		ctxReg.Unregister(registrationID)
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
 type remoteResponse struct {
 	responseCode int
 	headers      http.Header
@@ -78,12 +359,91 @@ func (rr *remoteResponse) WriteHeader(responseCode int) {
 
 //NewRemoteContextSource creates an instance of a ContextSource by wrapping a CsourceRegistration
 func NewRemoteContextSource(registration CsourceRegistration) (ContextSource, error) {
-	return &remoteContextSource{ID: uuid.New().String(), registration: registration}, nil
+	id := registration.ID()
+	if id == "" {
+		id = uuid.New().String()
+	}
+	return &remoteContextSource{ID: id, registration: registration, config: remoteSourceConfig(registration)}, nil
 }
 
 type remoteContextSource struct {
 	ID           string `json:"id"`
 	registration CsourceRegistration
+	config       RemoteSourceConfig
+}
+
+//RegistrationID returns the ID that this context source is registered with
+func (rcs *remoteContextSource) RegistrationID() string {
+	return rcs.ID
+}
+
+//Registration returns the registration that this context source was created from
+func (rcs *remoteContextSource) Registration() CsourceRegistration {
+	return rcs.registration
+}
+
+//Available returns false while the circuit breaker for the endpoint of this context source is
+//open, because requests to it or health checks of it have failed too many times in a row
+func (rcs *remoteContextSource) Available() bool {
+	u, err := url.Parse(rcs.registration.Endpoint())
+	if err != nil {
+		return true
+	}
+
+	return circuitBreakerFor(u).available(time.Now())
+}
+
+//recordHealthCheck feeds the outcome of a health check to the circuit breaker for the endpoint
+//of the context source. The breaker opens after failureThreshold consecutive failures, and
+//closes again as soon as a health check or a request succeeds.
+func (rcs *remoteContextSource) recordHealthCheck(healthy bool, failureThreshold int) {
+	u, err := url.Parse(rcs.registration.Endpoint())
+	if err != nil {
+		return
+	}
+
+	circuitBreakerFor(u).record(healthy, time.Now(), failureThreshold, rcs.config.OpenDuration)
+}
+
+func (rcs *remoteContextSource) AppendEntityAttributes(entityID string, r Request) (*UpdateResult, error) {
+	u, _ := url.Parse(rcs.registration.Endpoint())
+	req := r.Request()
+
+	req.URL.Host = u.Host
+	req.URL.Scheme = u.Scheme
+
+	forwardedHost := req.Header.Get("Host")
+	if forwardedHost != "" {
+		req.Header.Set("X-Forwarded-Host", forwardedHost)
+	}
+	req.Host = u.Host
+
+	// Change the User-Agent header to something more appropriate
+	req.Header.Add("User-Agent", "ngsi-context-broker/0.1")
+	// We do not want to propagate the Accept-Encoding header to prevent compression
+	req.Header.Del("Accept-Encoding")
+
+	response, err := rcs.proxy(u, req)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to append attributes to entity %s: %w", entityID, err)
+	}
+
+	// A 207 response means that some of the attributes were not appended, and
+	// the details about which and why are found in the response body
+	if response.responseCode == http.StatusMultiStatus {
+		result := &UpdateResult{}
+		err = json.Unmarshal(response.bytes, result)
+		if err != nil {
+			return nil, fmt.Errorf(
+				"failed to unmarshal update result for entity %s from %s: %s",
+				entityID, string(response.bytes), err.Error(),
+			)
+		}
+		return result, nil
+	}
+
+	return nil, nil
 }
 
 func (rcs *remoteContextSource) CreateEntity(typeName, entityID string, r Request) error {
@@ -102,16 +462,48 @@ func (rcs *remoteContextSource) CreateEntity(typeName, entityID string, r Reques
 	// Change the User-Agent header to something more appropriate
 	req.Header.Add("User-Agent", "ngsi-context-broker/0.1")
 
-	response, err := proxyToRemote(u, req)
+	response, err := rcs.proxy(u, req)
 
 	if err != nil {
-		return fmt.Errorf("attempt to create %s entity failed with status code %d: %s", typeName, response.responseCode, err.Error())
+		return requestFailure(fmt.Sprintf("attempt to create %s entity", typeName), response, err)
 	}
 
 	return err
 }
 
+func (rcs *remoteContextSource) DeleteEntity(entityID string, r Request) error {
+	u, _ := url.Parse(rcs.registration.Endpoint())
+	req := r.Request()
+
+	req.URL.Host = u.Host
+	req.URL.Scheme = u.Scheme
+
+	forwardedHost := req.Header.Get("Host")
+	if forwardedHost != "" {
+		req.Header.Set("X-Forwarded-Host", forwardedHost)
+	}
+	req.Host = u.Host
+
+	// Change the User-Agent header to something more appropriate
+	req.Header.Add("User-Agent", "ngsi-context-broker/0.1")
+
+	_, err := rcs.proxy(u, req)
+
+	if err != nil {
+		return fmt.Errorf("failed to delete entity %s: %w", entityID, err)
+	}
+
+	return nil
+}
+
 func (rcs *remoteContextSource) GetEntities(query Query, callback QueryEntitiesCallback) error {
+	_, err := rcs.getEntities(query, callback)
+	return err
+}
+
+//getEntities forwards a query to the remote context source and also returns the total number of
+//matching entities, if the remote source reported it in a NGSILD-Results-Count header
+func (rcs *remoteContextSource) getEntities(query Query, callback QueryEntitiesCallback) (*uint64, error) {
 	u, _ := url.Parse(rcs.registration.Endpoint())
 	req := query.Request()
 
@@ -130,7 +522,7 @@ func (rcs *remoteContextSource) GetEntities(query Query, callback QueryEntitiesC
 	// We do not want to propagate the Accept-Encoding header to prevent compression
 	req.Header.Del("Accept-Encoding")
 
-	response, err := proxyToRemote(u, req)
+	response, err := rcs.proxy(u, req)
 
 	// If the response code is 200 we can just unmarshal the payload
 	// and pass the individual entitites to the supplied callback.
@@ -150,9 +542,13 @@ func (rcs *remoteContextSource) GetEntities(query Query, callback QueryEntitiesC
 				}
 			}
 		}
+
+		if count, parseErr := strconv.ParseUint(response.Header().Get(NGSILDResultsCountHeader), 10, 64); parseErr == nil {
+			return &count, err
+		}
 	}
 
-	return err
+	return nil, err
 }
 
 func (rcs *remoteContextSource) UpdateEntityAttributes(entityID string, r Request) error {
@@ -171,10 +567,10 @@ func (rcs *remoteContextSource) UpdateEntityAttributes(entityID string, r Reques
 	// Change the User-Agent header to something more appropriate
 	req.Header.Add("User-Agent", "ngsi-context-broker/0.1")
 
-	_, err := proxyToRemote(u, req)
+	_, err := rcs.proxy(u, req)
 
 	if err != nil {
-		return fmt.Errorf("failed to patch entity %s: %s", entityID, err.Error())
+		return fmt.Errorf("failed to patch entity %s: %w", entityID, err)
 	}
 
 	return nil
@@ -210,10 +606,10 @@ func (rcs *remoteContextSource) RetrieveEntity(entityID string, r Request) (Enti
 	// We do not want to propagate the Accept-Encoding header to prevent compression
 	req.Header.Del("Accept-Encoding")
 
-	response, err := proxyToRemote(u, req)
+	response, err := rcs.proxy(u, req)
 
 	if err != nil {
-		return nil, fmt.Errorf("failed to retrieve entity %s: %s", entityID, err.Error())
+		return nil, fmt.Errorf("failed to retrieve entity %s: %w", entityID, err)
 	}
 
 	var entity interface{}
@@ -233,40 +629,147 @@ func (rcs *remoteContextSource) RetrieveEntity(entityID string, r Request) (Enti
 	return nil, fmt.Errorf("unexpected response code from retrieve entity %s: %d != 200", entityID, response.responseCode)
 }
 
-func proxyToRemote(u *url.URL, req *http.Request) (remoteResponse, error) {
-	response := remoteResponse{}
-	proxy := httputil.NewSingleHostReverseProxy(u)
-	proxy.ServeHTTP(&response, req)
+func (rcs *remoteContextSource) CreateEntities(r Request) (*BatchOperationResult, error) {
+	return rcs.forwardBatchOperation(batchOperationCreate, r)
+}
 
-	var err error
+func (rcs *remoteContextSource) UpsertEntities(r Request) (*BatchOperationResult, error) {
+	return rcs.forwardBatchOperation(batchOperationUpsert, r)
+}
 
-	if response.responseCode >= http.StatusBadRequest {
-		if len(response.bytes) > 0 {
-			err = fmt.Errorf("%s", string(response.bytes))
-		} else {
-			err = fmt.Errorf("received %d response with empty body", response.responseCode)
+func (rcs *remoteContextSource) UpdateEntities(r Request) (*BatchOperationResult, error) {
+	return rcs.forwardBatchOperation(batchOperationUpdate, r)
+}
+
+func (rcs *remoteContextSource) DeleteEntities(r Request) (*BatchOperationResult, error) {
+	return rcs.forwardBatchOperation(batchOperationDelete, r)
+}
+
+func (rcs *remoteContextSource) forwardBatchOperation(operation string, r Request) (*BatchOperationResult, error) {
+	entityIDs, err := BatchEntityIDs(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode entities in batch %s request: %s", operation, err.Error())
+	}
+
+	u, _ := url.Parse(rcs.registration.Endpoint())
+	req := r.Request()
+
+	req.URL.Host = u.Host
+	req.URL.Scheme = u.Scheme
+
+	forwardedHost := req.Header.Get("Host")
+	if forwardedHost != "" {
+		req.Header.Set("X-Forwarded-Host", forwardedHost)
+	}
+	req.Host = u.Host
+
+	// Change the User-Agent header to something more appropriate
+	req.Header.Add("User-Agent", "ngsi-context-broker/0.1")
+	// We do not want to propagate the Accept-Encoding header to prevent compression
+	req.Header.Del("Accept-Encoding")
+
+	response, err := rcs.proxy(u, req)
+
+	if err != nil {
+		return nil, requestFailure(fmt.Sprintf("batch %s operation", operation), response, err)
+	}
+
+	result := &BatchOperationResult{}
+
+	if response.responseCode == http.StatusMultiStatus {
+		err = json.Unmarshal(response.bytes, result)
+		if err != nil {
+			return nil, fmt.Errorf(
+				"failed to unmarshal batch operation result from %s: %s", string(response.bytes), err.Error(),
+			)
 		}
+		return result, nil
 	}
 
-	return response, err
+	// Any other successful response means that all the entities were processed
+	result.Success = entityIDs
+
+	return result, nil
+}
+
+const (
+	//RegistrationModeInclusive means that the context source provides entities in addition to
+	//those of other sources. This is the default mode.
+	RegistrationModeInclusive = "inclusive"
+	//RegistrationModeExclusive means that the context source is the only provider of the
+	//registered entities and attributes
+	RegistrationModeExclusive = "exclusive"
+	//RegistrationModeRedirect means that requests for the registered information should be
+	//redirected to the context source
+	RegistrationModeRedirect = "redirect"
+	//RegistrationModeAuxiliary means that the context source only provides supplementary
+	//information and should never be the target of updates
+	RegistrationModeAuxiliary = "auxiliary"
+)
+
+var registrationModes = []string{
+	RegistrationModeInclusive, RegistrationModeExclusive, RegistrationModeRedirect, RegistrationModeAuxiliary,
+}
+
+//registrationOperations are the operations and operation groups that may be listed in the
+//operations member of a registration
+var registrationOperations = []string{
+	"createEntity", "updateEntity", "appendAttrs", "updateAttrs", "deleteAttrs", "deleteEntity",
+	"createBatch", "upsertBatch", "updateBatch", "deleteBatch",
+	"upsertTemporal", "appendAttrsTemporal", "deleteAttrsTemporal", "updateAttrsTemporal",
+	"deleteAttrInstanceTemporal", "deleteTemporal",
+	"mergeEntity", "replaceEntity", "replaceAttrs", "mergeBatch",
+	"retrieveEntity", "queryEntity", "queryBatch", "retrieveTemporal", "queryTemporal",
+	"retrieveEntityTypes", "retrieveEntityTypeDetails", "retrieveEntityTypeInfo",
+	"retrieveAttrTypes", "retrieveAttrTypeDetails", "retrieveAttrTypeInfo",
+	"createSubscription", "updateSubscription", "retrieveSubscription", "querySubscription", "deleteSubscription",
+	"federationOps", "updateOps", "retrieveOps", "redirectionOps",
 }
 
 type ctxSrcReg struct {
-	Type        string          `json:"type"`
-	Information []ctxSrcRegInfo `json:"information"`
-	Endpt       string          `json:"endpoint"`
+	RegID               string          `json:"id"`
+	Type                string          `json:"type"`
+	RegistrationName    string          `json:"registrationName,omitempty"`
+	Description         string          `json:"description,omitempty"`
+	Information         []ctxSrcRegInfo `json:"information"`
+	Tenant              string          `json:"tenant,omitempty"`
+	ObservationInterval *timeInterval   `json:"observationInterval,omitempty"`
+	ManagementInterval  *timeInterval   `json:"managementInterval,omitempty"`
+	Loc                 json.RawMessage `json:"location,omitempty"`
+	Expires             string          `json:"expiresAt,omitempty"`
+	Endpt               string          `json:"endpoint"`
+	ContextSourceInfo   []KeyValuePair  `json:"contextSourceInfo,omitempty"`
+	Mode                string          `json:"mode,omitempty"`
+	Operations          []string        `json:"operations,omitempty"`
+
+	expiresAt *time.Time
+	location  geojson.GeoJSONGeometry
+}
+
+func (csr *ctxSrcReg) ID() string {
+	return csr.RegID
 }
 
 func (csr *ctxSrcReg) Endpoint() string {
 	return csr.Endpt
 }
 
+//ExpiresAt returns the time when the registration expires, or nil if it never expires
+func (csr *ctxSrcReg) ExpiresAt() *time.Time {
+	return csr.expiresAt
+}
+
+//ProvidesAttribute returns true if any of the registered information includes the attribute.
+//Information without any property or relationship names provides all attributes.
 func (csr *ctxSrcReg) ProvidesAttribute(attributeName string) bool {
 	for _, reginfo := range csr.Information {
-		for _, attr := range reginfo.Properties {
-			if attr == attributeName {
-				return true
-			}
+		if len(reginfo.PropertyNames) == 0 && len(reginfo.RelationshipNames) == 0 {
+			return true
+		}
+
+		if containsString(reginfo.PropertyNames, attributeName) ||
+			containsString(reginfo.RelationshipNames, attributeName) {
+			return true
 		}
 	}
 	return false
@@ -275,7 +778,11 @@ func (csr *ctxSrcReg) ProvidesAttribute(attributeName string) bool {
 func (csr *ctxSrcReg) ProvidesEntitiesWithMatchingID(entityID string) bool {
 	for _, reginfo := range csr.Information {
 		for _, entity := range reginfo.Entities {
-			if entity.regexpForID != nil && entity.regexpForID.MatchString(entityID) {
+			if entity.ID != nil {
+				if *entity.ID == entityID {
+					return true
+				}
+			} else if entity.regexpForID != nil && entity.regexpForID.MatchString(entityID) {
 				return true
 			}
 		}
@@ -294,32 +801,148 @@ func (csr *ctxSrcReg) ProvidesType(typeName string) bool {
 	return false
 }
 
-type entityInfo struct {
-	IDPattern   *string `json:"idPattern,omitempty"`
-	regexpForID *regexp.Regexp
+//canMatchQuery returns false if the location or the time intervals of the registration show
+//that the context source can not have any entities that match the geo or temporal query
+func (csr *ctxSrcReg) canMatchQuery(query Query) bool {
+	if query.IsGeoQuery() && csr.location != nil && !locationCanMatch(csr.location, query.Geo()) {
+		return false
+	}
+
+	if query.IsTemporalQuery() {
+		interval := csr.ObservationInterval
+		if query.Temporal().TimeProperty != TemporalPropertyObservedAt {
+			interval = csr.ManagementInterval
+		}
+
+		if interval != nil && !interval.overlaps(query.Temporal()) {
+			return false
+		}
+	}
+
+	return true
+}
+
+//locationCanMatch returns false only when no geometry within the location of a registration
+//could possibly fulfill the geo-query. Relations that can not be ruled out are assumed to match.
+func locationCanMatch(location geojson.GeoJSONGeometry, gq *GeoQuery) bool {
+	if gq == nil || gq.Geometry == nil {
+		return true
+	}
+
+	switch gq.GeoRel {
+	case GeoSpatialRelationNearPoint:
+		distance, maxDistance := gq.Distance()
+		if maxDistance {
+			return geojson.DistanceBetween(location, gq.Geometry) <= float64(distance)
+		}
+	case GeoSpatialRelationDisjoint:
+		return !geojson.Within(location, gq.Geometry)
+	case GeoSpatialRelationWithin, GeoSpatialRelationContains, GeoSpatialRelationIntersects,
+		GeoSpatialRelationEquals, GeoSpatialRelationOverlaps:
+		return geojson.Intersects(location, gq.Geometry)
+	}
+
+	return true
+}
 
-	Type string `json:"type"`
+//registrationCanMatchQuery returns false if the registration rules out any matches for the query
+func registrationCanMatchQuery(reg CsourceRegistration, query Query) bool {
+	if csr, ok := reg.(*ctxSrcReg); ok {
+		return csr.canMatchQuery(query)
+	}
+	return true
+}
+
+type timeInterval struct {
+	StartAt string `json:"startAt"`
+	EndAt   string `json:"endAt,omitempty"`
+
+	start time.Time
+	end   *time.Time
+}
+
+func (ti *timeInterval) compile() error {
+	var err error
+
+	ti.start, err = time.Parse(time.RFC3339Nano, ti.StartAt)
+	if err != nil {
+		return fmt.Errorf("invalid startAt %s: %s", ti.StartAt, err.Error())
+	}
+
+	if ti.EndAt != "" {
+		end, err := time.Parse(time.RFC3339Nano, ti.EndAt)
+		if err != nil {
+			return fmt.Errorf("invalid endAt %s: %s", ti.EndAt, err.Error())
+		}
+
+		if end.Before(ti.start) {
+			return fmt.Errorf("endAt %s is before startAt %s", ti.EndAt, ti.StartAt)
+		}
+
+		ti.end = &end
+	}
+
+	return nil
+}
+
+//overlaps returns true if any point in time in the interval could match the temporal query
+func (ti *timeInterval) overlaps(tq *TemporalQuery) bool {
+	switch tq.TimeRel {
+	case TemporalRelationBefore:
+		return ti.start.Before(tq.TimeAt)
+	case TemporalRelationAfter:
+		return ti.end == nil || ti.end.After(tq.TimeAt)
+	case TemporalRelationBetween:
+		return ti.start.Before(tq.EndTimeAt) && (ti.end == nil || !ti.end.Before(tq.TimeAt))
+	}
+
+	return true
 }
 
 type ctxSrcRegInfo struct {
-	Entities   []entityInfo `json:"entities"`
-	Properties []string     `json:"properties"`
+	Entities          []EntityInfo `json:"entities,omitempty"`
+	PropertyNames     []string     `json:"propertyNames,omitempty"`
+	RelationshipNames []string     `json:"relationshipNames,omitempty"`
+}
+
+//UnmarshalJSON also accepts the properties member used by earlier versions of this package,
+//so that registrations that were saved before the member was renamed can still be loaded
+func (info *ctxSrcRegInfo) UnmarshalJSON(data []byte) error {
+	type plainInfo ctxSrcRegInfo
+
+	tmp := struct {
+		plainInfo
+		Properties []string `json:"properties"`
+	}{}
+
+	err := json.Unmarshal(data, &tmp)
+	if err != nil {
+		return err
+	}
+
+	*info = ctxSrcRegInfo(tmp.plainInfo)
+
+	if len(info.PropertyNames) == 0 {
+		info.PropertyNames = tmp.Properties
+	}
+
+	return nil
+}
+
+func newCsourceRegistrationID() string {
+	return "urn:ngsi-ld:ContextSourceRegistration:" + uuid.New().String()
 }
 
 //NewCsourceRegistration creates and returns a concrete implementation of the CsourceRegistration interface
 func NewCsourceRegistration(entityTypeName string, attributeNames []string, endpoint string, idpattern *string) (CsourceRegistration, error) {
-	regInfo := ctxSrcRegInfo{Entities: []entityInfo{}, Properties: attributeNames}
-	einfo := &entityInfo{Type: entityTypeName, IDPattern: idpattern}
-	if idpattern != nil {
-		var err error
-		einfo.regexpForID, err = regexp.CompilePOSIX(*idpattern)
-		if err != nil {
-			return nil, err
-		}
+	regInfo := ctxSrcRegInfo{Entities: []EntityInfo{}, PropertyNames: attributeNames}
+	einfo := &EntityInfo{Type: entityTypeName, IDPattern: idpattern}
+	if err := einfo.compile(); err != nil {
+		return nil, err
 	}
 	regInfo.Entities = append(regInfo.Entities, *einfo)
 
-	reg := &ctxSrcReg{Type: "ContextSourceRegistration", Endpt: endpoint}
+	reg := &ctxSrcReg{RegID: newCsourceRegistrationID(), Type: "ContextSourceRegistration", Endpt: endpoint}
 	reg.Information = []ctxSrcRegInfo{regInfo}
 
 	return reg, nil
@@ -334,22 +957,107 @@ func NewCsourceRegistrationFromJSON(jsonBytes []byte) (CsourceRegistration, erro
 		return nil, err
 	}
 
-	for infoIdx := range registration.Information {
-		info := &registration.Information[infoIdx]
+	if registration.RegID == "" {
+		registration.RegID = newCsourceRegistrationID()
+	}
+
+	err = registration.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return registration, nil
+}
+
+//validate checks the contents of a registration and compiles the members that are needed
+//to match it against requests, such as idPatterns, time intervals and the location
+func (csr *ctxSrcReg) validate() error {
+	if csr.Type != "ContextSourceRegistration" {
+		return fmt.Errorf("registration type must be ContextSourceRegistration")
+	}
+
+	if csr.Endpt == "" {
+		return fmt.Errorf("a registration must have an endpoint")
+	}
+
+	if _, err := url.Parse(csr.Endpt); err != nil {
+		return fmt.Errorf("invalid endpoint %s: %s", csr.Endpt, err.Error())
+	}
+
+	if len(csr.Information) == 0 {
+		return fmt.Errorf("a registration must contain at least one information entry")
+	}
+
+	for infoIdx := range csr.Information {
+		info := &csr.Information[infoIdx]
+
+		if len(info.Entities) == 0 && len(info.PropertyNames) == 0 && len(info.RelationshipNames) == 0 {
+			return fmt.Errorf("information entries must contain entities, propertyNames or relationshipNames")
+		}
 
 		for entityIdx := range info.Entities {
 			entity := &info.Entities[entityIdx]
 
-			if entity.IDPattern != nil {
-				entity.regexpForID, err = regexp.CompilePOSIX(*entity.IDPattern)
-				if err != nil {
-					return nil, err
-				}
+			if entity.Type == "" {
+				return fmt.Errorf("entities in a registration must have a type")
+			}
+
+			if err := entity.compile(); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, interval := range []*timeInterval{csr.ObservationInterval, csr.ManagementInterval} {
+		if interval != nil {
+			if err := interval.compile(); err != nil {
+				return err
 			}
 		}
 	}
 
-	// TODO: More validation ...
+	if len(csr.Loc) > 0 {
+		geometry := struct {
+			Type        string          `json:"type"`
+			Coordinates json.RawMessage `json:"coordinates"`
+		}{}
 
-	return registration, nil
+		err := json.Unmarshal(csr.Loc, &geometry)
+		if err == nil {
+			csr.location, err = geojson.CreateGeoJSONGeometry(geometry.Type, geometry.Coordinates)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid location: %s", err.Error())
+		}
+	}
+
+	if csr.Expires != "" {
+		expiresAt, err := time.Parse(time.RFC3339Nano, csr.Expires)
+		if err != nil {
+			return fmt.Errorf("invalid expiresAt %s: %s", csr.Expires, err.Error())
+		}
+		csr.expiresAt = &expiresAt
+	}
+
+	for _, info := range csr.ContextSourceInfo {
+		if info.Key == "" {
+			return fmt.Errorf("contextSourceInfo entries must have a key")
+		}
+	}
+
+	if err := validateRemoteSourceConfig(csr.ContextSourceInfo); err != nil {
+		return err
+	}
+
+	if csr.Mode != "" && !containsString(registrationModes, csr.Mode) {
+		return fmt.Errorf("unknown registration mode %s", csr.Mode)
+	}
+
+	for _, operation := range csr.Operations {
+		if !containsString(registrationOperations, operation) {
+			return fmt.Errorf("unknown operation %s", operation)
+		}
+	}
+
+	return nil
 }
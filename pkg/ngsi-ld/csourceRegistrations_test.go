@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"regexp"
+	"strings"
 	"testing"
 
 	"github.com/iot-for-tillgenglighet/ngsi-ld-golang/pkg/datamodels/fiware"
@@ -33,6 +35,113 @@ func TestRegisterContextSource(t *testing.T) {
 	}
 }
 
+func registerTestContextSource(ctxRegistry ContextRegistry, typeName string, endpoint string) string {
+	registrationBody, _ := NewCsourceRegistration(typeName, []string{"x"}, endpoint, nil)
+	jsonBytes, _ := json.Marshal(registrationBody)
+	req, _ := http.NewRequest("POST", createURL("/csourceRegistrations"), bytes.NewBuffer(jsonBytes))
+	w := httptest.NewRecorder()
+
+	NewRegisterContextSourceHandler(ctxRegistry).ServeHTTP(w, req)
+
+	return w.Header().Get("Location")
+}
+
+func TestRegisterContextSourceReturnsLocation(t *testing.T) {
+	ctxRegistry := NewContextRegistry()
+	location := registerTestContextSource(ctxRegistry, "Point", "lolcathost")
+
+	if !strings.HasPrefix(location, "/ngsi-ld/v1/csourceRegistrations/urn:ngsi-ld:ContextSourceRegistration:") {
+		t.Error("Unexpected Location header: ", location)
+	}
+
+	req, _ := http.NewRequest("GET", "http://localhost:8080"+location, nil)
+	w := httptest.NewRecorder()
+	NewRetrieveContextSourceRegistrationHandler(ctxRegistry).ServeHTTP(w, req)
+
+	registration := map[string]interface{}{}
+	json.Unmarshal(w.Body.Bytes(), &registration)
+
+	if w.Code != http.StatusOK || registration["endpoint"] != "lolcathost" {
+		t.Error("Unexpected registration retrieved: ", w.Code, w.Body.String())
+	}
+}
+
+func TestQueryContextSourceRegistrationsByType(t *testing.T) {
+	ctxRegistry := NewContextRegistry()
+	registerTestContextSource(ctxRegistry, "Point", "lolcathost")
+	registerTestContextSource(ctxRegistry, "Beach", "beachhost")
+
+	req, _ := http.NewRequest("GET", createURL("/csourceRegistrations", "type=Beach"), nil)
+	w := httptest.NewRecorder()
+	NewQueryContextSourceRegistrationsHandler(ctxRegistry).ServeHTTP(w, req)
+
+	registrations := []map[string]interface{}{}
+	json.Unmarshal(w.Body.Bytes(), &registrations)
+
+	if len(registrations) != 1 || registrations[0]["endpoint"] != "beachhost" {
+		t.Error("Unexpected registrations returned: ", w.Body.String())
+	}
+}
+
+func TestUpdateContextSourceRegistrationEndpoint(t *testing.T) {
+	ctxRegistry := NewContextRegistry()
+	location := registerTestContextSource(ctxRegistry, "Point", "lolcathost")
+
+	req, _ := http.NewRequest("PATCH", "http://localhost:8080"+location, bytes.NewBuffer([]byte(`{"endpoint":"newhost"}`)))
+	w := httptest.NewRecorder()
+	NewUpdateContextSourceRegistrationHandler(ctxRegistry).ServeHTTP(w, req)
+
+	if w.Code != http.StatusNoContent {
+		t.Error("Wrong status code returned. ", w.Code, " != expected 204")
+	}
+
+	sources := ctxRegistry.ContextSources()
+	reg, _ := sourceRegistration(sources[0])
+
+	if len(sources) != 1 || reg.Endpoint() != "newhost" || !reg.ProvidesType("Point") {
+		t.Error("The registration was not updated as expected.")
+	}
+}
+
+func TestUpdateContextSourceRegistrationWithExpiresAtInThePastFails(t *testing.T) {
+	ctxRegistry := NewContextRegistry()
+	location := registerTestContextSource(ctxRegistry, "Point", "lolcathost")
+
+	for _, patch := range []string{`{"expiresAt":"2020-01-01T00:00:00Z"}`, `{"expiresAt":"tomorrow"}`} {
+		req, _ := http.NewRequest("PATCH", "http://localhost:8080"+location, bytes.NewBuffer([]byte(patch)))
+		w := httptest.NewRecorder()
+		NewUpdateContextSourceRegistrationHandler(ctxRegistry).ServeHTTP(w, req)
+
+		if w.Code != http.StatusBadRequest {
+			t.Error("Wrong status code returned. ", w.Code, " != expected 400")
+		}
+	}
+
+	reg, _ := sourceRegistration(ctxRegistry.ContextSources()[0])
+	if reg.ExpiresAt() != nil {
+		t.Error("The registration should not have been updated.")
+	}
+}
+
+func TestDeleteContextSourceRegistration(t *testing.T) {
+	ctxRegistry := NewContextRegistry()
+	location := registerTestContextSource(ctxRegistry, "Point", "lolcathost")
+
+	for _, expectedCode := range []int{http.StatusNoContent, http.StatusNotFound} {
+		req, _ := http.NewRequest("DELETE", "http://localhost:8080"+location, nil)
+		w := httptest.NewRecorder()
+		NewDeleteContextSourceRegistrationHandler(ctxRegistry).ServeHTTP(w, req)
+
+		if w.Code != expectedCode {
+			t.Error("Wrong status code returned. ", w.Code, " != expected ", expectedCode)
+		}
+	}
+
+	if len(ctxRegistry.ContextSources()) != 0 {
+		t.Error("The registration was not removed from the registry.")
+	}
+}
+
 func TestRegisterContextSourceWithIDPatternMatch(t *testing.T) {
 	regex := fmt.Sprintf("^%s.+", fiware.DeviceIDPrefix)
 	registrationBody, _ := NewCsourceRegistration("A", []string{"a"}, "lolcathost", &regex)
@@ -84,6 +193,52 @@ func TestThatRequestsWithIDPatternMatchAreForwardedToRemoteContext(t *testing.T)
 	}
 }
 
+func TestThatDeleteRequestsAreForwardedToRemoteContext(t *testing.T) {
+	mockService := setupMockServiceThatReturns(204, "application/ld+json", "")
+	defer mockService.Close()
+
+	regex := "urn:ngsi-ld:TypeA:.+"
+	registration, _ := NewCsourceRegistration("TypeA", []string{"a"}, mockService.URL, &regex)
+	ctxRegistry := NewContextRegistry()
+	remoteSource, _ := NewRemoteContextSource(registration)
+	ctxRegistry.Register(remoteSource)
+
+	entityID := "urn:ngsi-ld:TypeA:myentity"
+	req, _ := http.NewRequest("DELETE", "https://localhost/ngsi-ld/v1/entities/"+entityID, nil)
+	w := httptest.NewRecorder()
+
+	NewDeleteEntityHandler(ctxRegistry).ServeHTTP(w, req)
+
+	if w.Code != http.StatusNoContent {
+		t.Error("Wrong status code returned. ", w.Code, " != expected 204")
+	}
+}
+
+func TestThatAppendResultsFromRemoteContextAreRelayed(t *testing.T) {
+	updateResult := `{"updated":["waterTemperature"],"notUpdated":[{"attributeName":"name","reason":"exists"}]}`
+	mockService := setupMockServiceThatReturns(207, "application/json", updateResult)
+	defer mockService.Close()
+
+	regex := "urn:ngsi-ld:Beach:.+"
+	registration, _ := NewCsourceRegistration("Beach", []string{"name", "waterTemperature"}, mockService.URL, &regex)
+	ctxRegistry := NewContextRegistry()
+	remoteSource, _ := NewRemoteContextSource(registration)
+	ctxRegistry.Register(remoteSource)
+
+	entityID := "urn:ngsi-ld:Beach:omaha"
+	body := `{"name":{"type":"Property","value":"Omaha"},"waterTemperature":{"type":"Property","value":7.2}}`
+	req, _ := http.NewRequest(
+		"POST", "https://localhost/ngsi-ld/v1/entities/"+entityID+"/attrs?options=noOverwrite", bytes.NewBufferString(body),
+	)
+	w := httptest.NewRecorder()
+
+	NewAppendEntityAttributesHandler(ctxRegistry).ServeHTTP(w, req)
+
+	if w.Code != http.StatusMultiStatus {
+		t.Error("Wrong status code returned. ", w.Code, " != expected 207")
+	}
+}
+
 func TestThatRequestsAreForwardedToRemoteContext(t *testing.T) {
 	mockService := setupMockServiceThatReturns(200, "application/ld+json", snowHeightResponseJSON)
 	defer mockService.Close()
@@ -180,3 +335,137 @@ func setupMockServiceThatReturns(responseCode int, contentType, body string) *ht
 		}
 	}))
 }
+
+const fullRegistrationJSON string = `{
+	"id": "urn:ngsi-ld:ContextSourceRegistration:parking",
+	"type": "ContextSourceRegistration",
+	"registrationName": "Parking in Sundsvall",
+	"information": [{
+		"entities": [
+			{"id": "urn:ngsi-ld:OffStreetParking:1", "type": "OffStreetParking"},
+			{"idPattern": "^urn:ngsi-ld:OnStreetParking:.+", "type": "OnStreetParking"}
+		],
+		"propertyNames": ["availableSpotNumber"],
+		"relationshipNames": ["refParkingSite"]
+	}],
+	"tenant": "sundsvall",
+	"observationInterval": {"startAt": "2020-01-01T00:00:00Z", "endAt": "2020-12-31T23:59:59Z"},
+	"location": {"type": "Polygon", "coordinates": [[[17.2,62.3],[17.4,62.3],[17.4,62.5],[17.2,62.5],[17.2,62.3]]]},
+	"endpoint": "http://parking.example.com",
+	"contextSourceInfo": [{"key": "source", "value": "municipality"}],
+	"mode": "inclusive",
+	"operations": ["retrieveOps", "createEntity"]
+}`
+
+func TestCompleteRegistrationModel(t *testing.T) {
+	reg, err := NewCsourceRegistrationFromJSON([]byte(fullRegistrationJSON))
+	if err != nil {
+		t.Error("Failed to parse registration: ", err.Error())
+		return
+	}
+
+	if !reg.ProvidesEntitiesWithMatchingID("urn:ngsi-ld:OffStreetParking:1") ||
+		reg.ProvidesEntitiesWithMatchingID("urn:ngsi-ld:OffStreetParking:2") ||
+		!reg.ProvidesEntitiesWithMatchingID("urn:ngsi-ld:OnStreetParking:7") {
+		t.Error("Registration did not match entity ids as expected.")
+	}
+
+	if !reg.ProvidesAttribute("refParkingSite") || reg.ProvidesAttribute("name") {
+		t.Error("Registration did not match attributes as expected.")
+	}
+
+	jsonBytes, _ := json.Marshal(reg)
+	if !strings.Contains(string(jsonBytes), `"operations":["retrieveOps","createEntity"]`) {
+		t.Error("Operations were not kept when marshalling the registration: ", string(jsonBytes))
+	}
+}
+
+func TestRegistrationsWithLegacyPropertiesCanBeLoaded(t *testing.T) {
+	reg, err := NewCsourceRegistrationFromJSON([]byte(`{"type":"ContextSourceRegistration",
+		"information":[{"entities":[{"type":"Road"}],"properties":["surfaceType"]}],"endpoint":"lolcathost"}`))
+
+	if err != nil || !reg.ProvidesAttribute("surfaceType") {
+		t.Error("Failed to load registration with a properties member.")
+	}
+}
+
+func TestInvalidRegistrationsAreRejected(t *testing.T) {
+	valid := map[string]interface{}{}
+	json.Unmarshal([]byte(fullRegistrationJSON), &valid)
+
+	invalidMembers := map[string]string{
+		"type":                `"Registration"`,
+		"endpoint":            `""`,
+		"information":         `[]`,
+		"mode":                `"sometimes"`,
+		"operations":          `["makeCoffee"]`,
+		"location":            `{"type": "Point", "coordinates": "here"}`,
+		"observationInterval": `{"startAt": "2020-12-31T00:00:00Z", "endAt": "2020-01-01T00:00:00Z"}`,
+	}
+
+	for member, value := range invalidMembers {
+		registration := map[string]interface{}{}
+		for k, v := range valid {
+			registration[k] = v
+		}
+
+		var invalidValue interface{}
+		json.Unmarshal([]byte(value), &invalidValue)
+		registration[member] = invalidValue
+
+		jsonBytes, _ := json.Marshal(registration)
+		if _, err := NewCsourceRegistrationFromJSON(jsonBytes); err == nil {
+			t.Error("Registration with invalid ", member, " should be rejected.")
+		}
+	}
+}
+
+func TestQueriesSkipSourcesOutsideRegisteredLocationAndInterval(t *testing.T) {
+	reg, _ := NewCsourceRegistrationFromJSON([]byte(fullRegistrationJSON))
+	src, _ := NewRemoteContextSource(reg)
+	ctxRegistry := NewContextRegistry()
+	ctxRegistry.Register(src)
+
+	sourcesForQuery := func(params ...string) int {
+		req, _ := http.NewRequest("GET", createURL("/entities", params...), nil)
+		q, err := newQueryFromParameters(req, []string{"OffStreetParking"}, []string{""}, "")
+		if err != nil {
+			t.Fatal("Failed to create query: ", err.Error())
+		}
+		return len(ctxRegistry.GetContextSourcesForQuery(q))
+	}
+
+	if sourcesForQuery("georel=near;maxDistance==2000", "geometry=Point", "coordinates=[17.3,62.4]") != 1 {
+		t.Error("A geo-query within the registered location should use the source.")
+	}
+
+	if sourcesForQuery("georel=near;maxDistance==2000", "geometry=Point", "coordinates=[8,40]") != 0 {
+		t.Error("A geo-query far from the registered location should skip the source.")
+	}
+
+	if sourcesForQuery("timerel=after", "timeAt=2021-06-01T00:00:00Z") != 0 {
+		t.Error("A temporal query after the observation interval should skip the source.")
+	}
+
+	if sourcesForQuery("timerel=before", "timeAt=2020-06-01T00:00:00Z") != 1 {
+		t.Error("A temporal query overlapping the observation interval should use the source.")
+	}
+}
+
+func TestRegistrationIDPatternFilterMatchesRegisteredIDs(t *testing.T) {
+	byID, _ := NewCsourceRegistrationFromJSON([]byte(`{"type":"ContextSourceRegistration",
+		"information":[{"entities":[{"id":"urn:ngsi-ld:Beach:omaha","type":"Beach"}]}],"endpoint":"lolcathost"}`))
+	byPattern, _ := NewCsourceRegistrationFromJSON([]byte(`{"type":"ContextSourceRegistration",
+		"information":[{"entities":[{"idPattern":"^urn:ngsi-ld:Beach:.+","type":"Beach"}]}],"endpoint":"lolcathost"}`))
+
+	beaches := regexp.MustCompile("^urn:ngsi-ld:Beach:o.+")
+	roads := regexp.MustCompile("^urn:ngsi-ld:Road:.+")
+
+	if !registrationMatches(byID, nil, nil, beaches, nil) || registrationMatches(byID, nil, nil, roads, nil) {
+		t.Error("The idPattern should be matched against the registered entity ids.")
+	}
+
+	if !registrationMatches(byPattern, nil, nil, beaches, nil) {
+		t.Error("A registration with an idPattern may provide matching entities and should be included.")
+	}
+}
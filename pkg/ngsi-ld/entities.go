@@ -4,6 +4,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/iot-for-tillgenglighet/ngsi-ld-golang/pkg/ngsi-ld/errors"
@@ -19,27 +21,77 @@ type Entity interface {
 //entities matching the query that has been passed in
 type QueryEntitiesCallback func(entity Entity) error
 
+//UpdateResult is returned by context sources to report which attributes that were
+//appended or updated, and which that were not (and why)
+type UpdateResult struct {
+	Updated    []string            `json:"updated"`
+	NotUpdated []NotUpdatedDetails `json:"notUpdated"`
+}
+
+//NotUpdatedDetails contains the name of an attribute that was not updated and the reason for it
+type NotUpdatedDetails struct {
+	AttributeName string `json:"attributeName"`
+	Reason        string `json:"reason"`
+}
+
+//NGSILDWarningHeader is used to report context sources that failed during a query that
+//still returned the results from the other sources
+const NGSILDWarningHeader string = "NGSILD-Warning"
+
+//NGSILDResultsCountHeader contains the total number of matching entities when a query is made
+//with count=true
+const NGSILDResultsCountHeader string = "NGSILD-Results-Count"
+
+//QueryHandlerOption is used to change the behaviour of a query handler
+type QueryHandlerOption func(*queryHandlerConfig)
+
+type queryHandlerConfig struct {
+	partialResults bool
+}
+
+//WithPartialResults makes a query handler respond with the entities from the context sources
+//that succeeded when some, but not all, of the sources fail. The failed sources are reported
+//in NGSILD-Warning headers. Without this option any failing source fails the whole query.
+func WithPartialResults() QueryHandlerOption {
+	return func(cfg *queryHandlerConfig) {
+		cfg.partialResults = true
+	}
+}
+
 //NewQueryEntitiesHandler handles GET requests for NGSI entitites
-func NewQueryEntitiesHandler(ctxReg ContextRegistry) http.HandlerFunc {
+func NewQueryEntitiesHandler(ctxReg ContextRegistry, options ...QueryHandlerOption) http.HandlerFunc {
+	cfg := &queryHandlerConfig{}
+	for _, option := range options {
+		option(cfg)
+	}
+
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ldContext, err := normalizeRequest(r)
+		if err != nil {
+			reportContextError(w, err)
+			return
+		}
+
 		// Default entity converter doesn't actually convert anything
 		entityConverter := func(e interface{}) interface{} { return e }
 
+		params := queryParameters(r)
+
 		responseContentType := "application/ld+json;charset=utf-8"
 		var geoJSONFeatureCollection *geojson.GeoJSONFeatureCollection
 
 		// Check Accept to find out what kind of data the client wants
 		for _, acceptableType := range r.Header["Accept"] {
 			if strings.HasPrefix(acceptableType, geojson.ContentType) {
-				options := r.URL.Query().Get("options")
+				options := params.Get("options")
 				geoJSONFeatureCollection = geojson.NewGeoJSONFeatureCollection([]geojson.GeoJSONFeature{}, true)
 				entityConverter = geojson.NewEntityConverter("location", options == "keyValues", geoJSONFeatureCollection)
 				responseContentType = geojson.ContentTypeWithCharset
 			}
 		}
 
-		entityTypeNames := r.URL.Query().Get("type")
-		attributeNames := r.URL.Query().Get("attrs")
+		entityTypeNames := params.Get("type")
+		attributeNames := params.Get("attrs")
 
 		if entityTypeNames == "" && attributeNames == "" {
 			errors.ReportNewBadRequestData(
@@ -52,7 +104,7 @@ func NewQueryEntitiesHandler(ctxReg ContextRegistry) http.HandlerFunc {
 		entityTypes := strings.Split(entityTypeNames, ",")
 		attributes := strings.Split(attributeNames, ",")
 
-		q := r.URL.Query().Get("q")
+		q := params.Get("q")
 		query, err := newQueryFromParameters(r, entityTypes, attributes, q)
 		if err != nil {
 			errors.ReportNewBadRequestData(
@@ -61,37 +113,47 @@ func NewQueryEntitiesHandler(ctxReg ContextRegistry) http.HandlerFunc {
 			return
 		}
 
-		contextSources := ctxReg.GetContextSourcesForQuery(query)
+		if query.PaginationLimit() > QueryMaxPaginationLimit {
+			errors.ReportNewTooManyResults(
+				w,
+				fmt.Sprintf("The limit may not be larger than %d.", QueryMaxPaginationLimit),
+			)
+			return
+		}
+
+		contextSources := sourcesForReading(ctxReg.GetContextSourcesForQuery(query))
 
 		var entities = []Entity{}
-		var entityCount = uint64(0)
-		var entityMaxCount = uint64(18446744073709551615) // uint64 max
 
-		if query.PaginationLimit() > 0 {
-			entityMaxCount = query.PaginationLimit()
-		}
+		offset := query.PaginationOffset()
+		limit := query.PaginationLimit()
+		count := params.Get("count") == "true"
 
-		for _, source := range contextSources {
-			err = source.GetEntities(query, func(entity Entity) error {
-				if entityCount < entityMaxCount {
-					entities = append(entities, entityConverter(entity))
-					entityCount++
-				}
-				return nil
-			})
-			if err != nil {
-				break
-			}
+		result := queryContextSources(r.Context(), query, contextSources, offset, limit, count)
+		found, failures := result.entities, result.failures
+
+		if r.Context().Err() != nil {
+			// The client has gone away, so there is no one left to respond to
+			return
 		}
 
-		if err != nil {
-			errors.ReportNewInternalError(
+		if len(failures) > 0 && (!cfg.partialResults || len(failures) == len(contextSources)) {
+			reportSourceError(
 				w,
-				"An internal error was encountered when trying to get entities from the context source: "+err.Error(),
+				"An internal error was encountered when trying to get entities from the context source: ",
+				failures[0].err, errors.ReportNewInternalError,
 			)
 			return
 		}
 
+		for _, failure := range failures {
+			w.Header().Add(NGSILDWarningHeader, failure.warning())
+		}
+
+		for _, entity := range found {
+			entities = append(entities, entityConverter(compactEntity(entity, ldContext)))
+		}
+
 		var bytes []byte
 
 		if geoJSONFeatureCollection != nil {
@@ -106,14 +168,50 @@ func NewQueryEntitiesHandler(ctxReg ContextRegistry) http.HandlerFunc {
 		}
 
 		w.Header().Add("Content-Type", responseContentType)
-		// TODO: Add a RFC 8288 Link header with information about previous and/or next page if they exist
+
+		if result.total != nil {
+			w.Header().Add(NGSILDResultsCountHeader, strconv.FormatUint(*result.total, 10))
+		}
+
+		for _, link := range paginationLinks(r, offset, limit, result.more) {
+			w.Header().Add("Link", link)
+		}
+
 		w.Write(bytes)
 	})
 }
 
+//paginationLinks returns RFC 8288 links to the previous and next pages of a query, if they exist
+func paginationLinks(r *http.Request, offset, limit uint64, more bool) []string {
+	links := []string{}
+
+	link := func(offset uint64, rel string) string {
+		rawQuery := replacePaginationParameters(r.URL.RawQuery, offset, limit)
+		return fmt.Sprintf("<%s?%s>; rel=\"%s\"", r.URL.Path, rawQuery, rel)
+	}
+
+	if offset > 0 {
+		prev := uint64(0)
+		if offset > limit {
+			prev = offset - limit
+		}
+		links = append(links, link(prev, "prev"))
+	}
+
+	if more {
+		links = append(links, link(offset+limit, "next"))
+	}
+
+	return links
+}
+
 //NewUpdateEntityAttributesHandler handles PATCH requests for NGSI entitity attributes
 func NewUpdateEntityAttributesHandler(ctxReg ContextRegistry) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := normalizeRequest(r); err != nil {
+			reportContextError(w, err)
+			return
+		}
 
 		// TODO: Replace this string manipulation with a callback that can use the http router's
 		//		 functionality to extract URL params ...
@@ -131,17 +229,20 @@ func NewUpdateEntityAttributesHandler(ctxReg ContextRegistry) http.HandlerFunc {
 		entityID := r.URL.Path[entitiesIdx+10 : attrsIdx]
 
 		request := newRequestWrapper(r)
-		contextSources := ctxReg.GetContextSourcesForEntity(entityID)
+		contextSources := sourcesForWriting(ctxReg.GetContextSourcesForEntity(entityID))
 
 		if len(contextSources) == 0 {
-			w.WriteHeader(http.StatusNotFound)
+			errors.ReportNewResourceNotFound(
+				w,
+				fmt.Sprintf("No context sources found matching the provided entity id %s", entityID),
+			)
 			return
 		}
 
 		for _, source := range contextSources {
 			err := source.UpdateEntityAttributes(entityID, request)
 			if err != nil {
-				errors.ReportNewInvalidRequest(w, "Unable to update entity attributes: "+err.Error())
+				reportSourceError(w, "Unable to update entity attributes: ", err, errors.ReportNewInvalidRequest)
 				return
 			}
 		}
@@ -150,9 +251,119 @@ func NewUpdateEntityAttributesHandler(ctxReg ContextRegistry) http.HandlerFunc {
 	})
 }
 
+//NewAppendEntityAttributesHandler handles POST requests for NGSI entity attributes
+func NewAppendEntityAttributesHandler(ctxReg ContextRegistry) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := normalizeRequest(r); err != nil {
+			reportContextError(w, err)
+			return
+		}
+
+		path := strings.TrimSuffix(r.URL.Path, "/")
+		entitiesIdx := strings.Index(path, "/entities/")
+		attrsIdx := strings.LastIndex(path, "/attrs")
+
+		if entitiesIdx == -1 || attrsIdx == -1 || attrsIdx < entitiesIdx || !strings.HasSuffix(path, "/attrs") {
+			errors.ReportNewBadRequestData(
+				w,
+				"The supplied URL is invalid.",
+			)
+			return
+		}
+
+		entityID := path[entitiesIdx+10 : attrsIdx]
+
+		request := newRequestWrapper(r)
+
+		fragment := map[string]json.RawMessage{}
+		err := request.DecodeBodyInto(&fragment)
+		if err != nil {
+			errors.ReportNewInvalidRequest(
+				w,
+				fmt.Sprintf("Unable to decode request payload: %s", err.Error()),
+			)
+			return
+		}
+
+		contextSources := sourcesForWriting(ctxReg.GetContextSourcesForEntity(entityID))
+
+		if len(contextSources) == 0 {
+			errors.ReportNewResourceNotFound(
+				w,
+				fmt.Sprintf("No context sources found matching the provided entity id %s", entityID),
+			)
+			return
+		}
+
+		updated := map[string]bool{}
+		notUpdated := map[string]string{}
+
+		for _, source := range contextSources {
+			result, err := source.AppendEntityAttributes(entityID, request)
+			if err != nil {
+				reportSourceError(w, "Unable to append entity attributes: ", err, errors.ReportNewInvalidRequest)
+				return
+			}
+
+			// A nil result means that the source appended all the attributes in the request
+			if result == nil {
+				for attributeName := range fragment {
+					if attributeName != "id" && attributeName != "type" && attributeName != "@context" {
+						updated[attributeName] = true
+					}
+				}
+				continue
+			}
+
+			for _, attributeName := range result.Updated {
+				updated[attributeName] = true
+			}
+
+			for _, nu := range result.NotUpdated {
+				notUpdated[nu.AttributeName] = nu.Reason
+			}
+		}
+
+		result := UpdateResult{Updated: []string{}, NotUpdated: []NotUpdatedDetails{}}
+
+		for attributeName := range updated {
+			result.Updated = append(result.Updated, attributeName)
+		}
+
+		for attributeName, reason := range notUpdated {
+			if !updated[attributeName] {
+				result.NotUpdated = append(result.NotUpdated, NotUpdatedDetails{
+					AttributeName: attributeName, Reason: reason,
+				})
+			}
+		}
+
+		if len(result.NotUpdated) == 0 {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		sort.Strings(result.Updated)
+		sort.Slice(result.NotUpdated, func(i, j int) bool {
+			return result.NotUpdated[i].AttributeName < result.NotUpdated[j].AttributeName
+		})
+
+		bytes, _ := json.MarshalIndent(result, "", "  ")
+
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusMultiStatus)
+		w.Write(bytes)
+	})
+}
+
 //NewCreateEntityHandler handles incoming POST requests for NGSI entities
 func NewCreateEntityHandler(ctxReg ContextRegistry) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := normalizeRequest(r); err != nil {
+			reportContextError(w, err)
+			return
+		}
+
 		request := newRequestWrapper(r)
 
 		entity := &types.BaseEntity{}
@@ -164,7 +375,7 @@ func NewCreateEntityHandler(ctxReg ContextRegistry) http.HandlerFunc {
 			)
 		}
 
-		contextSources := ctxReg.GetContextSourcesForEntityType(entity.Type)
+		contextSources := sourcesForWriting(ctxReg.GetContextSourcesForEntityType(entity.Type))
 
 		if len(contextSources) == 0 {
 			errors.ReportNewInvalidRequest(
@@ -177,7 +388,7 @@ func NewCreateEntityHandler(ctxReg ContextRegistry) http.HandlerFunc {
 		for _, source := range contextSources {
 			err := source.CreateEntity(entity.Type, entity.ID, request)
 			if err != nil {
-				errors.ReportNewInvalidRequest(w, "Failed to create entity: "+err.Error())
+				reportSourceError(w, "Failed to create entity: ", err, errors.ReportNewInvalidRequest)
 				return
 			}
 		}
@@ -189,6 +400,12 @@ func NewCreateEntityHandler(ctxReg ContextRegistry) http.HandlerFunc {
 //NewRetrieveEntityHandler retrieves entity by ID.
 func NewRetrieveEntityHandler(ctxReg ContextRegistry) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ldContext, err := normalizeRequest(r)
+		if err != nil {
+			reportContextError(w, err)
+			return
+		}
+
 		entitiesIdx := strings.Index(r.URL.Path, "/entities/")
 
 		if entitiesIdx == -1 {
@@ -201,35 +418,99 @@ func NewRetrieveEntityHandler(ctxReg ContextRegistry) http.HandlerFunc {
 
 		entityID := r.URL.Path[entitiesIdx+10 : len(r.URL.Path)]
 
-		contextSources := ctxReg.GetContextSourcesForEntity(entityID)
+		contextSources := sourcesForReading(ctxReg.GetContextSourcesForEntity(entityID))
 
 		if len(contextSources) == 0 {
-			w.WriteHeader(http.StatusNotFound)
+			errors.ReportNewResourceNotFound(
+				w,
+				fmt.Sprintf("No context sources found matching the provided entity id %s", entityID),
+			)
 			return
 		}
 
 		request := newRequestWrapper(r)
 
-		var entity Entity
-		var err error
+		// Several sources may provide different attributes of the same entity, so the
+		// fragments are collected from all of them and merged into a single entity. Entities
+		// from redirect sources are passed on as they are, unless there are other fragments.
+		fragments := []Entity{}
+		redirected := []Entity{}
+		var firstErr error
 
 		for _, source := range contextSources {
-			entity, err = source.RetrieveEntity(entityID, request)
+			fragment, err := source.RetrieveEntity(entityID, request)
 			if err != nil {
-				errors.ReportNewInvalidRequest(w, "Failed to find entity: "+err.Error())
-				return
+				if firstErr == nil {
+					firstErr = err
+				}
+				continue
 			}
-			break
+
+			if fragment != nil && isRedirectSource(source) {
+				redirected = append(redirected, fragment)
+			} else if fragment != nil {
+				fragments = append(fragments, fragment)
+			}
+		}
+
+		if len(fragments) == 0 && len(redirected) > 0 {
+			fragments = redirected[:1]
+		}
+
+		if len(fragments) == 0 && firstErr != nil {
+			reportSourceError(w, "Failed to find entity: ", firstErr, errors.ReportNewInvalidRequest)
+			return
 		}
 
-		if entity == nil {
-			w.WriteHeader(http.StatusNotFound)
+		if len(fragments) == 0 {
+			errors.ReportNewResourceNotFound(w, fmt.Sprintf("No entity found with id %s", entityID))
 			return
 		}
 
+		entity := compactEntity(mergeEntities(fragments)[0], ldContext)
+
 		bytes, _ := json.Marshal(entity)
 
 		w.Header().Add("Content-Type", "application/ld+json;charset=utf-8")
 		w.Write(bytes)
 	})
 }
+
+//NewDeleteEntityHandler handles DELETE requests for NGSI entities
+func NewDeleteEntityHandler(ctxReg ContextRegistry) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entitiesIdx := strings.Index(r.URL.Path, "/entities/")
+
+		if entitiesIdx == -1 {
+			errors.ReportNewBadRequestData(
+				w,
+				"The supplied URL is invalid.",
+			)
+			return
+		}
+
+		entityID := r.URL.Path[entitiesIdx+10 : len(r.URL.Path)]
+
+		contextSources := sourcesForWriting(ctxReg.GetContextSourcesForEntity(entityID))
+
+		if len(contextSources) == 0 {
+			errors.ReportNewResourceNotFound(
+				w,
+				fmt.Sprintf("No context sources found matching the provided entity id %s", entityID),
+			)
+			return
+		}
+
+		request := newRequestWrapper(r)
+
+		for _, source := range contextSources {
+			err := source.DeleteEntity(entityID, request)
+			if err != nil {
+				reportSourceError(w, "Failed to delete entity: ", err, errors.ReportNewInvalidRequest)
+				return
+			}
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
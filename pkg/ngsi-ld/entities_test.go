@@ -13,6 +13,8 @@ import (
 
 	"github.com/iot-for-tillgenglighet/ngsi-ld-golang/pkg/datamodels/fiware"
 	ngsierrors "github.com/iot-for-tillgenglighet/ngsi-ld-golang/pkg/ngsi-ld/errors"
+	"github.com/iot-for-tillgenglighet/ngsi-ld-golang/pkg/ngsi-ld/geojson"
+	"github.com/iot-for-tillgenglighet/ngsi-ld-golang/pkg/ngsi-ld/jsonld"
 	"github.com/iot-for-tillgenglighet/ngsi-ld-golang/pkg/ngsi-ld/types"
 )
 
@@ -33,6 +35,12 @@ func createURL(path string, params ...string) string {
 }
 
 func TestMain(m *testing.M) {
+	// The tests must not depend on the FIWARE context being reachable, and the names that are
+	// used by the tests are all relative to the default vocabulary anyway
+	ContextLoader = jsonld.NewStaticLoader(map[string][]byte{
+		"https://schema.lab.fiware.org/ld/context": []byte(`{"@context":{}}`),
+	}, nil)
+
 	os.Exit(m.Run())
 }
 
@@ -216,13 +224,13 @@ func TestGetEntitiesWithGeoQueryNearPoint(t *testing.T) {
 	}
 }
 
-func TestGetEntitiesWithGeoQueryWithinRect(t *testing.T) {
+func TestGetEntitiesWithGeoQueryWithinPolygon(t *testing.T) {
 	req, _ := http.NewRequest("GET", createURL(
 		"/entitites",
 		"type=RoadSegment",
 		"georel=within",
 		"geometry=Polygon",
-		"coordinates=[[8,40],[9,41],[10,42]]"),
+		"coordinates=[[[8,40],[10,40],[10,42],[8,42],[8,40]],[[8.5,40.5],[9,40.5],[9,41],[8.5,40.5]]]"),
 		nil)
 	w := httptest.NewRecorder()
 	contextRegistry := NewContextRegistry()
@@ -246,9 +254,65 @@ func TestGetEntitiesWithGeoQueryWithinRect(t *testing.T) {
 			t.Error("Geospatial relation not correctly saved in geo query (" + geo.GeoRel + " != within)")
 		}
 
-		lon0, lat0, lon1, lat1, _ := geo.Rectangle()
-		if lon0 != 8 || lat0 != 40 || lon1 != 10 || lat1 != 42 {
-			t.Error("Bad coordinates in GeoQuery rect")
+		polygon, ok := geo.Geometry.(*geojson.GeoJSONPropertyPolygon)
+		if !ok {
+			t.Error("Expected a Polygon geometry in the GeoQuery")
+		} else if len(polygon.Coordinates) != 2 || polygon.Coordinates[0][2] != [2]float64{10, 42} {
+			t.Error("Bad coordinates in GeoQuery polygon")
+		}
+	}
+}
+
+func TestGetEntitiesWithGeoQueryNearMinDistance(t *testing.T) {
+	req, _ := http.NewRequest("GET", createURL(
+		"/entitites",
+		"type=RoadSegment",
+		"georel=near%3BminDistance%3D%3D500",
+		"geometry=LineString",
+		"coordinates=[[8,40],[9,41]]"),
+		nil)
+	w := httptest.NewRecorder()
+	contextRegistry := NewContextRegistry()
+	contextSource := newMockedContextSource("RoadSegment", "")
+	contextRegistry.Register(contextSource)
+
+	NewQueryEntitiesHandler(contextRegistry).ServeHTTP(w, req)
+
+	if w.Code != 200 {
+		t.Error("Unexpected response code", w.Code, w.Body.String())
+		return
+	}
+
+	geo := contextSource.generatedQuery.Geo()
+	distance, isMaxDistance := geo.Distance()
+	if distance != 500 || isMaxDistance {
+		t.Error("Unexpected distance parsed from geo query:", distance, isMaxDistance)
+	}
+
+	if geo.Geometry.GeoPropertyType() != "LineString" {
+		t.Error("Unexpected geometry type in geo query:", geo.Geometry.GeoPropertyType())
+	}
+}
+
+func TestGetEntitiesWithInvalidGeoQueryFails(t *testing.T) {
+	invalidQueries := [][]string{
+		{"georel=near", "geometry=Point", "coordinates=[8,40]"},
+		{"georel=near;farAway==12", "geometry=Point", "coordinates=[8,40]"},
+		{"georel=within", "geometry=Polygon", "coordinates=[[8,40],[9,41],[10,42]]"},
+		{"georel=intersects", "geometry=Circle", "coordinates=[8,40]"},
+		{"georel=adjacent", "geometry=Point", "coordinates=[8,40]"},
+		{"georel=equals", "geometry=Point"},
+	}
+
+	for _, params := range invalidQueries {
+		req, _ := http.NewRequest("GET", createURL("/entitites", append([]string{"type=RoadSegment"}, params...)...), nil)
+		w := httptest.NewRecorder()
+		contextRegistry, _ := newContextRegistryWithSourceForType("RoadSegment")
+
+		NewQueryEntitiesHandler(contextRegistry).ServeHTTP(w, req)
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected geo-query %v to fail with a bad request, but got %d", params, w.Code)
 		}
 	}
 }
@@ -272,6 +336,28 @@ func TestRetrieveEntity(t *testing.T) {
 	}
 }
 
+func TestRetrieveEntityWithNoContextSourcesReportsNotFound(t *testing.T) {
+	req, _ := http.NewRequest("GET", createURL("/entities/urn:ngsi-ld:Device:unknown"), nil)
+	w := httptest.NewRecorder()
+
+	NewRetrieveEntityHandler(NewContextRegistry()).ServeHTTP(w, req)
+
+	if w.Code != http.StatusNotFound || !strings.Contains(w.Body.String(), "ResourceNotFound") {
+		t.Error("Expected a ResourceNotFound problem: ", w.Code, w.Body.String())
+	}
+}
+
+func TestGetEntitiesWithTooLargeLimitFails(t *testing.T) {
+	req, _ := http.NewRequest("GET", createURL("/entities", "type=Device", "limit=5000"), nil)
+	w := httptest.NewRecorder()
+
+	NewQueryEntitiesHandler(NewContextRegistry()).ServeHTTP(w, req)
+
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "TooManyResults") {
+		t.Error("Expected a TooManyResults problem: ", w.Code, w.Body.String())
+	}
+}
+
 func TestUpdateEntitityAttributes(t *testing.T) {
 	deviceID := fiware.DeviceIDPrefix + "mydevice"
 	jsonBytes, _ := json.Marshal(e("testvalue"))
@@ -289,6 +375,130 @@ func TestUpdateEntitityAttributes(t *testing.T) {
 	}
 }
 
+func TestDeleteEntity(t *testing.T) {
+	deviceID := fiware.DeviceIDPrefix + "mydevice"
+	req, _ := http.NewRequest("DELETE", createURL("/entities/"+deviceID), nil)
+	w := httptest.NewRecorder()
+	contextRegistry := NewContextRegistry()
+	contextSource := newMockedContextSource("Device", "")
+	contextRegistry.Register(contextSource)
+
+	NewDeleteEntityHandler(contextRegistry).ServeHTTP(w, req)
+
+	if contextSource.deletedEntity != deviceID {
+		t.Errorf("Deleted entity %s does not match expected entity %s", contextSource.deletedEntity, deviceID)
+	}
+
+	if w.Code != http.StatusNoContent {
+		t.Error("Wrong response code when deleting entity. ", w.Code, " is not ", http.StatusNoContent)
+	}
+}
+
+func TestDeleteEntityFailsWithNoContextSources(t *testing.T) {
+	deviceID := fiware.DeviceIDPrefix + "mydevice"
+	req, _ := http.NewRequest("DELETE", createURL("/entities/"+deviceID), nil)
+	w := httptest.NewRecorder()
+
+	NewDeleteEntityHandler(NewContextRegistry()).ServeHTTP(w, req)
+
+	if w.Code != http.StatusNotFound {
+		t.Error("Wrong response code when deleting entity with no context sources. ", w.Code, " is not ", http.StatusNotFound)
+	}
+
+	contentType := w.Header().Get("Content-Type")
+	if contentType != ngsierrors.ProblemReportContentType {
+		t.Errorf("Wrong content type when reporting error. %s is not %s!", contentType, ngsierrors.ProblemReportContentType)
+	}
+}
+
+func TestDeleteEntityHandlesFailureFromContextSource(t *testing.T) {
+	deviceID := fiware.DeviceIDPrefix + "mydevice"
+	req, _ := http.NewRequest("DELETE", createURL("/entities/"+deviceID), nil)
+	w := httptest.NewRecorder()
+	contextRegistry := NewContextRegistry()
+	contextSource := newMockedContextSource("Device", "")
+	contextSource.deleteEntityShouldFailWithError = errors.New("failure")
+	contextRegistry.Register(contextSource)
+
+	NewDeleteEntityHandler(contextRegistry).ServeHTTP(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Error("Wrong response code when the context source fails to delete entity. ", w.Code, " is not ", http.StatusBadRequest)
+	}
+
+	if contextSource.deletedEntity != "" {
+		t.Error("The entity should not have been deleted.")
+	}
+}
+
+func TestAppendEntityAttributes(t *testing.T) {
+	deviceID := fiware.DeviceIDPrefix + "mydevice"
+	jsonBytes, _ := json.Marshal(map[string]interface{}{"waterTemperature": types.NewNumberProperty(7.2)})
+
+	req, _ := http.NewRequest("POST", createURL("/entities/"+deviceID+"/attrs"), bytes.NewBuffer(jsonBytes))
+	w := httptest.NewRecorder()
+	contextRegistry := NewContextRegistry()
+	contextSource := newMockedContextSource("", "waterTemperature")
+	contextRegistry.Register(contextSource)
+
+	NewAppendEntityAttributesHandler(contextRegistry).ServeHTTP(w, req)
+
+	if contextSource.appendedEntity != deviceID {
+		t.Error("Appended entity did not match expectations. ", contextSource.appendedEntity, " != ", deviceID)
+	}
+
+	if w.Code != http.StatusNoContent {
+		t.Error("Wrong response code when appending attributes. ", w.Code, " is not ", http.StatusNoContent)
+	}
+}
+
+func TestAppendEntityAttributesWithNoOverwrite(t *testing.T) {
+	deviceID := fiware.DeviceIDPrefix + "mydevice"
+	jsonBytes, _ := json.Marshal(map[string]interface{}{
+		"waterTemperature": types.NewNumberProperty(7.2),
+		"name":             types.NewTextProperty("Stranden"),
+	})
+
+	req, _ := http.NewRequest(
+		"POST", createURL("/entities/"+deviceID+"/attrs/", "options=noOverwrite"), bytes.NewBuffer(jsonBytes),
+	)
+	w := httptest.NewRecorder()
+	contextRegistry := NewContextRegistry()
+	contextSource := newMockedContextSource("", "name")
+	contextSource.existingAttributes = []string{"name"}
+	contextRegistry.Register(contextSource)
+
+	NewAppendEntityAttributesHandler(contextRegistry).ServeHTTP(w, req)
+
+	if w.Code != http.StatusMultiStatus {
+		t.Error("Wrong response code when appending attributes. ", w.Code, " is not ", http.StatusMultiStatus)
+		return
+	}
+
+	result := UpdateResult{}
+	json.Unmarshal(w.Body.Bytes(), &result)
+
+	if len(result.Updated) != 1 || result.Updated[0] != "waterTemperature" {
+		t.Errorf("Unexpected list of updated attributes: %v", result.Updated)
+	}
+
+	if len(result.NotUpdated) != 1 || result.NotUpdated[0].AttributeName != "name" {
+		t.Errorf("Unexpected list of attributes that were not updated: %v", result.NotUpdated)
+	}
+}
+
+func TestAppendEntityAttributesFailsWithNoContextSources(t *testing.T) {
+	deviceID := fiware.DeviceIDPrefix + "mydevice"
+	req, _ := http.NewRequest("POST", createURL("/entities/"+deviceID+"/attrs"), bytes.NewBufferString("{}"))
+	w := httptest.NewRecorder()
+
+	NewAppendEntityAttributesHandler(NewContextRegistry()).ServeHTTP(w, req)
+
+	if w.Code != http.StatusNotFound {
+		t.Error("Wrong response code when appending attributes with no context sources. ", w.Code, " is not ", http.StatusNotFound)
+	}
+}
+
 type mockEntity struct {
 	Value string
 }
@@ -323,17 +533,61 @@ type mockCtxSource struct {
 	attributeName string
 	entities      []Entity
 
+	existingAttributes []string
+	failingEntities    []string
+
 	createEntityShouldFailWithError error
+	deleteEntityShouldFailWithError error
 
 	queriedDevice     string
+	appendedEntity    string
 	createdEntity     string
 	createdEntityType string
+	deletedEntity     string
 	patchedEntity     string
 	retrievedEntity   string
 
+	batchOperations  []string
+	batchEntityCount int
+
 	generatedQuery Query
 }
 
+func (s *mockCtxSource) AppendEntityAttributes(entityID string, r Request) (*UpdateResult, error) {
+	s.appendedEntity = entityID
+
+	attributes := map[string]interface{}{}
+	err := r.DecodeBodyInto(&attributes)
+	if err != nil {
+		return nil, err
+	}
+
+	if !RequestHasOption(r, OptionNoOverwrite) {
+		return nil, nil
+	}
+
+	result := &UpdateResult{}
+
+	for attributeName := range attributes {
+		exists := false
+		for _, existing := range s.existingAttributes {
+			if existing == attributeName {
+				exists = true
+			}
+		}
+
+		if exists {
+			result.NotUpdated = append(result.NotUpdated, NotUpdatedDetails{
+				AttributeName: attributeName, Reason: "attribute already exists",
+			})
+		} else {
+			result.Updated = append(result.Updated, attributeName)
+		}
+	}
+
+	return result, nil
+}
+
 func (s *mockCtxSource) CreateEntity(typeName, entityID string, r Request) error {
 	if s.createEntityShouldFailWithError == nil {
 		s.createdEntity = entityID
@@ -346,6 +600,63 @@ func (s *mockCtxSource) CreateEntity(typeName, entityID string, r Request) error
 	return s.createEntityShouldFailWithError
 }
 
+func (s *mockCtxSource) CreateEntities(r Request) (*BatchOperationResult, error) {
+	return s.executeBatch(batchOperationCreate, r)
+}
+
+func (s *mockCtxSource) UpsertEntities(r Request) (*BatchOperationResult, error) {
+	return s.executeBatch(batchOperationUpsert, r)
+}
+
+func (s *mockCtxSource) UpdateEntities(r Request) (*BatchOperationResult, error) {
+	return s.executeBatch(batchOperationUpdate, r)
+}
+
+func (s *mockCtxSource) DeleteEntities(r Request) (*BatchOperationResult, error) {
+	return s.executeBatch(batchOperationDelete, r)
+}
+
+func (s *mockCtxSource) executeBatch(operation string, r Request) (*BatchOperationResult, error) {
+	s.batchOperations = append(s.batchOperations, operation)
+
+	entityIDs, err := BatchEntityIDs(r)
+	if err != nil {
+		return nil, err
+	}
+
+	s.batchEntityCount += len(entityIDs)
+
+	result := &BatchOperationResult{}
+
+	for _, entityID := range entityIDs {
+		failed := false
+		for _, failing := range s.failingEntities {
+			if failing == entityID {
+				failed = true
+			}
+		}
+
+		if failed {
+			result.Errors = append(result.Errors, BatchEntityError{
+				EntityID: entityID, Error: ngsierrors.NewBadRequestData("failure"),
+			})
+		} else {
+			result.Success = append(result.Success, entityID)
+		}
+	}
+
+	return result, nil
+}
+
+func (s *mockCtxSource) DeleteEntity(entityID string, r Request) error {
+	if s.deleteEntityShouldFailWithError != nil {
+		return s.deleteEntityShouldFailWithError
+	}
+
+	s.deletedEntity = entityID
+	return nil
+}
+
 func (s *mockCtxSource) GetEntities(q Query, cb QueryEntitiesCallback) error {
 
 	s.generatedQuery = q
@@ -0,0 +1,321 @@
+package ngsi
+
+import (
+	"bytes"
+	"encoding/json"
+	stderrors "errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/iot-for-tillgenglighet/ngsi-ld-golang/pkg/ngsi-ld/errors"
+	"github.com/iot-for-tillgenglighet/ngsi-ld-golang/pkg/ngsi-ld/types"
+)
+
+//BatchOperationResult is returned from batch operations to report which entities were
+//successfully processed and which that failed
+type BatchOperationResult struct {
+	Success []string           `json:"success"`
+	Errors  []BatchEntityError `json:"errors"`
+}
+
+//BatchEntityError contains the id of an entity that failed a batch operation, and why
+type BatchEntityError struct {
+	EntityID string                `json:"entityId"`
+	Error    errors.ProblemDetails `json:"error"`
+}
+
+//UnmarshalJSON is called when a BatchEntityError should be deserialized from JSON
+func (bee *BatchEntityError) UnmarshalJSON(data []byte) error {
+	tmp := struct {
+		EntityID string                     `json:"entityId"`
+		Error    *errors.ProblemDetailsImpl `json:"error"`
+	}{}
+
+	err := json.Unmarshal(data, &tmp)
+	if err != nil {
+		return err
+	}
+
+	bee.EntityID = tmp.EntityID
+	if tmp.Error != nil {
+		bee.Error = tmp.Error
+	}
+
+	return nil
+}
+
+//add records the outcome of a batch operation for a single entity
+func (bor *BatchOperationResult) add(entityID string, err error) {
+	if err != nil {
+		bor.Errors = append(bor.Errors, BatchEntityError{EntityID: entityID, Error: errors.NewBadRequestData(err.Error())})
+	} else {
+		bor.Success = append(bor.Success, entityID)
+	}
+}
+
+const (
+	batchOperationCreate = "create"
+	batchOperationUpsert = "upsert"
+	batchOperationUpdate = "update"
+	batchOperationDelete = "delete"
+)
+
+//NewBatchCreateEntitiesHandler handles POST requests to /entityOperations/create
+func NewBatchCreateEntitiesHandler(ctxReg ContextRegistry) http.HandlerFunc {
+	return newBatchOperationHandler(ctxReg, batchOperationCreate)
+}
+
+//NewBatchUpsertEntitiesHandler handles POST requests to /entityOperations/upsert
+func NewBatchUpsertEntitiesHandler(ctxReg ContextRegistry) http.HandlerFunc {
+	return newBatchOperationHandler(ctxReg, batchOperationUpsert)
+}
+
+//NewBatchUpdateEntitiesHandler handles POST requests to /entityOperations/update
+func NewBatchUpdateEntitiesHandler(ctxReg ContextRegistry) http.HandlerFunc {
+	return newBatchOperationHandler(ctxReg, batchOperationUpdate)
+}
+
+//NewBatchDeleteEntitiesHandler handles POST requests to /entityOperations/delete
+func NewBatchDeleteEntitiesHandler(ctxReg ContextRegistry) http.HandlerFunc {
+	return newBatchOperationHandler(ctxReg, batchOperationDelete)
+}
+
+//batchItem is an entity, or an entity id for delete operations, that is part of a batch request
+type batchItem struct {
+	id   string
+	body json.RawMessage
+}
+
+//batchForSource collects the items that should be forwarded to a single context source
+type batchForSource struct {
+	source ContextSource
+	items  []batchItem
+}
+
+func newBatchOperationHandler(ctxReg ContextRegistry, operation string) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := normalizeRequest(r); err != nil {
+			reportContextError(w, err)
+			return
+		}
+
+		request := newRequestWrapper(r)
+
+		payload := []json.RawMessage{}
+		err := request.DecodeBodyInto(&payload)
+		if err != nil {
+			errors.ReportNewInvalidRequest(
+				w,
+				fmt.Sprintf("Unable to decode request payload: %s", err.Error()),
+			)
+			return
+		}
+
+		result := &BatchOperationResult{Success: []string{}, Errors: []BatchEntityError{}}
+		failed := map[string]bool{}
+
+		reportFailure := func(entityID string, problem errors.ProblemDetails) {
+			if !failed[entityID] {
+				failed[entityID] = true
+				result.Errors = append(result.Errors, BatchEntityError{EntityID: entityID, Error: problem})
+			}
+		}
+
+		batches := []*batchForSource{}
+		batchIndex := map[ContextSource]*batchForSource{}
+		processed := []string{}
+
+		for _, itemBytes := range payload {
+			item, typeName, err := newBatchItem(operation, itemBytes)
+			if err != nil {
+				reportFailure(item.id, errors.NewBadRequestData(err.Error()))
+				continue
+			}
+
+			var contextSources []ContextSource
+			if operation == batchOperationCreate || operation == batchOperationUpsert {
+				contextSources = sourcesForWriting(ctxReg.GetContextSourcesForEntityType(typeName))
+			} else {
+				contextSources = sourcesForWriting(ctxReg.GetContextSourcesForEntity(item.id))
+			}
+
+			if len(contextSources) == 0 {
+				reportFailure(item.id, errors.NewBadRequestData(
+					fmt.Sprintf("No context sources found matching the entity %s", item.id),
+				))
+				continue
+			}
+
+			processed = append(processed, item.id)
+
+			for _, source := range contextSources {
+				key := innermostSource(source)
+				batch, ok := batchIndex[key]
+				if !ok {
+					batch = &batchForSource{source: source}
+					batchIndex[key] = batch
+					batches = append(batches, batch)
+				}
+				batch.items = append(batch.items, item)
+			}
+		}
+
+		for _, batch := range batches {
+			sourceResult, err := forwardBatchToSource(operation, batch, r)
+			if err != nil {
+				var problem errors.ProblemDetails = errors.NewInvalidRequest(
+					fmt.Sprintf("Batch %s operation failed: %s", operation, err.Error()),
+				)
+
+				var failure *errors.ProblemError
+				if stderrors.As(err, &failure) {
+					problem = failure.Problem
+				}
+
+				for _, item := range batch.items {
+					reportFailure(item.id, problem)
+				}
+				continue
+			}
+
+			for _, entityError := range sourceResult.Errors {
+				reportFailure(entityError.EntityID, entityError.Error)
+			}
+		}
+
+		for _, entityID := range processed {
+			if !failed[entityID] {
+				result.Success = append(result.Success, entityID)
+			}
+		}
+
+		if len(result.Errors) == 0 {
+			if operation == batchOperationCreate {
+				bytes, _ := json.MarshalIndent(result.Success, "", "  ")
+				w.Header().Add("Content-Type", "application/json")
+				w.WriteHeader(http.StatusCreated)
+				w.Write(bytes)
+			} else {
+				w.WriteHeader(http.StatusNoContent)
+			}
+			return
+		}
+
+		bytes, err := json.MarshalIndent(result, "", "  ")
+		if err != nil {
+			errors.ReportNewInternalError(w, "Failed to encode response.")
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusMultiStatus)
+		w.Write(bytes)
+	})
+}
+
+func newBatchItem(operation string, itemBytes json.RawMessage) (batchItem, string, error) {
+	item := batchItem{body: itemBytes}
+
+	if operation == batchOperationDelete {
+		err := json.Unmarshal(itemBytes, &item.id)
+		if err != nil {
+			return item, "", fmt.Errorf("failed to decode entity id from %s", string(itemBytes))
+		}
+		return item, "", nil
+	}
+
+	entity := &types.BaseEntity{}
+	err := json.Unmarshal(itemBytes, entity)
+	if err != nil {
+		return item, "", fmt.Errorf("failed to decode entity from %s", string(itemBytes))
+	}
+
+	item.id = entity.ID
+
+	if entity.ID == "" {
+		return item, "", fmt.Errorf("entities in a batch %s operation must have an id", operation)
+	}
+
+	if entity.Type == "" && operation != batchOperationUpdate {
+		return item, "", fmt.Errorf("entities in a batch %s operation must have a type", operation)
+	}
+
+	return item, entity.Type, nil
+}
+
+//forwardBatchToSource creates a new request with the subset of the batch that is handled by
+//the source and passes it on to the appropriate batch operation
+func forwardBatchToSource(operation string, batch *batchForSource, r *http.Request) (*BatchOperationResult, error) {
+	items := []json.RawMessage{}
+	for _, item := range batch.items {
+		items = append(items, item.body)
+	}
+
+	body, err := json.Marshal(items)
+	if err != nil {
+		return nil, err
+	}
+
+	req := r.Clone(r.Context())
+	req.Body = ioutil.NopCloser(bytes.NewBuffer(body))
+	req.ContentLength = int64(len(body))
+
+	request := newRequestWrapper(req)
+	source := batch.source
+
+	var result *BatchOperationResult
+
+	switch operation {
+	case batchOperationCreate:
+		result, err = source.CreateEntities(request)
+	case batchOperationUpsert:
+		result, err = source.UpsertEntities(request)
+	case batchOperationUpdate:
+		result, err = source.UpdateEntities(request)
+	case batchOperationDelete:
+		result, err = source.DeleteEntities(request)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if result == nil {
+		result = &BatchOperationResult{}
+	}
+
+	return result, nil
+}
+
+//BatchEntityIDs returns the ids of the entities in a batch request. The request body must
+//be either an array of entities or, for delete operations, an array of entity ids.
+func BatchEntityIDs(r Request) ([]string, error) {
+	payload := []json.RawMessage{}
+	err := r.DecodeBodyInto(&payload)
+	if err != nil {
+		return nil, err
+	}
+
+	entityIDs := []string{}
+
+	for _, itemBytes := range payload {
+		entityID := ""
+
+		if len(itemBytes) > 0 && itemBytes[0] == '"' {
+			err = json.Unmarshal(itemBytes, &entityID)
+		} else {
+			entity := &types.BaseEntity{}
+			err = json.Unmarshal(itemBytes, entity)
+			entityID = entity.ID
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		entityIDs = append(entityIDs, entityID)
+	}
+
+	return entityIDs, nil
+}
@@ -0,0 +1,149 @@
+package ngsi
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/iot-for-tillgenglighet/ngsi-ld-golang/pkg/datamodels/fiware"
+)
+
+func TestBatchCreateEntities(t *testing.T) {
+	entities := []interface{}{
+		fiware.NewWeatherObserved("snow_1", 62.39, 17.30, "2021-05-03T10:00:00Z"),
+		fiware.NewWeatherObserved("snow_2", 62.39, 17.30, "2021-05-03T10:00:00Z"),
+		fiware.NewTrafficFlowObserved("tfo_1", 62.39, 17.30, "2021-05-03T10:00:00Z", 1),
+	}
+	jsonBytes, _ := json.Marshal(entities)
+
+	req, _ := http.NewRequest("POST", createURL("/entityOperations/create"), bytes.NewBuffer(jsonBytes))
+	w := httptest.NewRecorder()
+
+	ctxReg := NewContextRegistry()
+	weatherSource := newMockedContextSource("WeatherObserved", "")
+	trafficSource := newMockedContextSource("TrafficFlowObserved", "")
+	ctxReg.Register(weatherSource)
+	ctxReg.Register(trafficSource)
+
+	NewBatchCreateEntitiesHandler(ctxReg).ServeHTTP(w, req)
+
+	if w.Code != http.StatusCreated {
+		t.Error("Wrong response code from batch create. ", w.Code, " is not ", http.StatusCreated)
+	}
+
+	if len(weatherSource.batchOperations) != 1 || weatherSource.batchEntityCount != 2 {
+		t.Errorf("Expected a single batch with two entities, but got %d batches with %d entities",
+			len(weatherSource.batchOperations), weatherSource.batchEntityCount)
+	}
+
+	if len(trafficSource.batchOperations) != 1 || trafficSource.batchEntityCount != 1 {
+		t.Errorf("Expected a single batch with one entity, but got %d batches with %d entities",
+			len(trafficSource.batchOperations), trafficSource.batchEntityCount)
+	}
+}
+
+func TestBatchCreateEntitiesReportsErrorsPerEntity(t *testing.T) {
+	okEntity := fiware.NewWeatherObserved("snow_1", 62.39, 17.30, "2021-05-03T10:00:00Z")
+	failingEntity := fiware.NewWeatherObserved("snow_2", 62.39, 17.30, "2021-05-03T10:00:00Z")
+	unknownEntity := fiware.NewBeach("omaha", "Omaha Beach", nil)
+	jsonBytes, _ := json.Marshal([]interface{}{okEntity, failingEntity, unknownEntity})
+
+	req, _ := http.NewRequest("POST", createURL("/entityOperations/create"), bytes.NewBuffer(jsonBytes))
+	w := httptest.NewRecorder()
+
+	ctxReg := NewContextRegistry()
+	weatherSource := newMockedContextSource("WeatherObserved", "")
+	weatherSource.failingEntities = []string{failingEntity.ID}
+	ctxReg.Register(weatherSource)
+
+	NewBatchCreateEntitiesHandler(ctxReg).ServeHTTP(w, req)
+
+	if w.Code != http.StatusMultiStatus {
+		t.Error("Wrong response code from batch create. ", w.Code, " is not ", http.StatusMultiStatus)
+		return
+	}
+
+	result := BatchOperationResult{}
+	err := json.Unmarshal(w.Body.Bytes(), &result)
+	if err != nil {
+		t.Error("Failed to unmarshal batch operation result: ", err.Error())
+		return
+	}
+
+	if len(result.Success) != 1 || result.Success[0] != okEntity.ID {
+		t.Errorf("Unexpected successful entities in batch operation result: %v", result.Success)
+	}
+
+	if len(result.Errors) != 2 {
+		t.Errorf("Expected two errors in batch operation result, but got %d", len(result.Errors))
+	}
+}
+
+func TestBatchDeleteEntities(t *testing.T) {
+	jsonBytes, _ := json.Marshal([]string{"urn:ngsi-ld:Device:a", "urn:ngsi-ld:Device:b"})
+
+	req, _ := http.NewRequest("POST", createURL("/entityOperations/delete"), bytes.NewBuffer(jsonBytes))
+	w := httptest.NewRecorder()
+
+	ctxReg, ctxSrc := newContextRegistryWithSourceForType("Device")
+
+	NewBatchDeleteEntitiesHandler(ctxReg).ServeHTTP(w, req)
+
+	if w.Code != http.StatusNoContent {
+		t.Error("Wrong response code from batch delete. ", w.Code, " is not ", http.StatusNoContent)
+	}
+
+	if ctxSrc.batchEntityCount != 2 {
+		t.Errorf("Expected two entities to be deleted, but %d were", ctxSrc.batchEntityCount)
+	}
+}
+
+func TestBatchUpsertIsForwardedToRemoteContext(t *testing.T) {
+	mockService := setupMockServiceThatReturns(204, "application/ld+json", "")
+	defer mockService.Close()
+
+	registration, _ := NewCsourceRegistration("WeatherObserved", []string{"temperature"}, mockService.URL, nil)
+	remoteSource, _ := NewRemoteContextSource(registration)
+	ctxReg := NewContextRegistry()
+	ctxReg.Register(remoteSource)
+
+	entities := []interface{}{
+		fiware.NewWeatherObserved("snow_1", 62.39, 17.30, "2021-05-03T10:00:00Z"),
+	}
+	jsonBytes, _ := json.Marshal(entities)
+
+	req, _ := http.NewRequest("POST", createURL("/entityOperations/upsert"), bytes.NewBuffer(jsonBytes))
+	w := httptest.NewRecorder()
+
+	NewBatchUpsertEntitiesHandler(ctxReg).ServeHTTP(w, req)
+
+	if w.Code != http.StatusNoContent {
+		t.Error("Wrong response code from batch upsert. ", w.Code, " is not ", http.StatusNoContent, w.Body.String())
+	}
+}
+
+func TestBatchCreateThroughNotifyingRegistrySendsSingleBatch(t *testing.T) {
+	entities := []interface{}{
+		fiware.NewWeatherObserved("snow_1", 62.39, 17.30, "2021-05-03T10:00:00Z"),
+		fiware.NewWeatherObserved("snow_2", 62.39, 17.30, "2021-05-03T10:00:00Z"),
+		fiware.NewWeatherObserved("snow_3", 62.39, 17.30, "2021-05-03T10:00:00Z"),
+	}
+	jsonBytes, _ := json.Marshal(entities)
+
+	req, _ := http.NewRequest("POST", createURL("/entityOperations/create"), bytes.NewBuffer(jsonBytes))
+	w := httptest.NewRecorder()
+
+	ctxReg := NewContextRegistry()
+	weatherSource := newMockedContextSource("WeatherObserved", "")
+	ctxReg.Register(weatherSource)
+
+	subMgr := NewSubscriptionManager(NewInMemorySubscriptionStore())
+	NewBatchCreateEntitiesHandler(NewNotifyingContextRegistry(ctxReg, subMgr)).ServeHTTP(w, req)
+
+	if len(weatherSource.batchOperations) != 1 || weatherSource.batchEntityCount != 3 {
+		t.Errorf("Expected a single batch with three entities, but got %d batches with %d entities",
+			len(weatherSource.batchOperations), weatherSource.batchEntityCount)
+	}
+}
@@ -0,0 +1,188 @@
+package ngsi
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/iot-for-tillgenglighet/ngsi-ld-golang/pkg/ngsi-ld/geojson"
+)
+
+//entityMerger merges entity fragments from different context sources into single entities,
+//while keeping the order in which the entities were first seen.
+//
+//When an attribute is present in more than one fragment, the instances are matched by their
+//datasetId. Instances with different datasetIds are all kept as a multi-attribute, while the
+//most recent of two instances with the same datasetId is kept, based on observedAt or, if that
+//is missing, modifiedAt. If neither instance is more recent the first one is kept.
+type entityMerger struct {
+	entities []Entity
+	index    map[string]int
+}
+
+func newEntityMerger() *entityMerger {
+	return &entityMerger{entities: []Entity{}, index: map[string]int{}}
+}
+
+func (em *entityMerger) add(entity Entity) {
+	id := entityID(entity)
+	if id == "" {
+		em.entities = append(em.entities, entity)
+		return
+	}
+
+	idx, seen := em.index[id]
+	if !seen {
+		em.index[id] = len(em.entities)
+		em.entities = append(em.entities, entity)
+		return
+	}
+
+	current, err := entityAsMap(em.entities[idx])
+	fragment, fragmentErr := entityAsMap(entity)
+	if err != nil || fragmentErr != nil {
+		return
+	}
+
+	em.entities[idx] = mergeEntityFragment(current, fragment)
+}
+
+//addUnmerged adds an entity that should be passed on as it is, without merging it with other
+//fragments of the same entity
+func (em *entityMerger) addUnmerged(entity Entity) {
+	em.entities = append(em.entities, entity)
+}
+
+func (em *entityMerger) count() int {
+	return len(em.entities)
+}
+
+//mergeEntities merges any fragments of the same entity in a list of entities
+func mergeEntities(entities []Entity) []Entity {
+	merger := newEntityMerger()
+	for _, entity := range entities {
+		merger.add(entity)
+	}
+	return merger.entities
+}
+
+//entityID returns the id of an entity, or an empty string if it can not be merged with other fragments
+func entityID(entity Entity) string {
+	if _, isFeature := entity.(geojson.GeoJSONFeature); isFeature {
+		return ""
+	}
+
+	fragment, ok := entity.(map[string]interface{})
+	if !ok {
+		bytes, err := json.Marshal(entity)
+		if err != nil || json.Unmarshal(bytes, &fragment) != nil {
+			return ""
+		}
+	}
+
+	if fragment["type"] == "Feature" {
+		return ""
+	}
+
+	id, _ := fragment["id"].(string)
+	return id
+}
+
+func mergeEntityFragment(current, fragment map[string]interface{}) map[string]interface{} {
+	merged := map[string]interface{}{}
+	for name, value := range current {
+		merged[name] = value
+	}
+
+	for name, value := range fragment {
+		existing, exists := merged[name]
+		if !exists {
+			merged[name] = value
+			continue
+		}
+
+		if name == "id" || name == "type" || name == "@context" {
+			continue
+		}
+
+		existingInstances, ok := attributeInstances(existing)
+		newInstances, newOK := attributeInstances(value)
+		if !ok || !newOK {
+			continue
+		}
+
+		merged[name] = mergeAttributeInstances(existingInstances, newInstances)
+	}
+
+	return merged
+}
+
+//attributeInstances returns the instances of an attribute, which is either a single object or
+//an array of objects in the case of a multi-attribute
+func attributeInstances(attribute interface{}) ([]map[string]interface{}, bool) {
+	switch a := attribute.(type) {
+	case map[string]interface{}:
+		return []map[string]interface{}{a}, true
+	case []interface{}:
+		instances := []map[string]interface{}{}
+		for _, i := range a {
+			instance, ok := i.(map[string]interface{})
+			if !ok {
+				return nil, false
+			}
+			instances = append(instances, instance)
+		}
+		return instances, true
+	}
+
+	return nil, false
+}
+
+func mergeAttributeInstances(current, fragment []map[string]interface{}) interface{} {
+	merged := append([]map[string]interface{}{}, current...)
+
+	for _, instance := range fragment {
+		datasetID, _ := instance["datasetId"].(string)
+		matched := false
+
+		for idx, existing := range merged {
+			existingDatasetID, _ := existing["datasetId"].(string)
+			if existingDatasetID != datasetID {
+				continue
+			}
+
+			matched = true
+			if instanceTime(instance).After(instanceTime(existing)) {
+				merged[idx] = instance
+			}
+			break
+		}
+
+		if !matched {
+			merged = append(merged, instance)
+		}
+	}
+
+	if len(merged) == 1 {
+		return merged[0]
+	}
+
+	instances := []interface{}{}
+	for _, instance := range merged {
+		instances = append(instances, instance)
+	}
+
+	return instances
+}
+
+//instanceTime returns the time an attribute instance was observed or modified, or the zero time
+func instanceTime(instance map[string]interface{}) time.Time {
+	for _, property := range []string{TemporalPropertyObservedAt, TemporalPropertyModifiedAt} {
+		if value, ok := instance[property].(string); ok {
+			if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+				return t
+			}
+		}
+	}
+
+	return time.Time{}
+}
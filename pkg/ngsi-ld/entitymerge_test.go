@@ -0,0 +1,137 @@
+package ngsi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newFragmentRegistry(t *testing.T, endpoints ...string) ContextRegistry {
+	ctxRegistry := NewContextRegistry()
+
+	for _, endpoint := range endpoints {
+		reg, err := NewCsourceRegistrationFromJSON([]byte(`{"type":"ContextSourceRegistration",
+			"information":[{"entities":[{"idPattern":"^urn:ngsi-ld:Beach:.+","type":"Beach"}]}],
+			"endpoint":"` + endpoint + `"}`))
+		if err != nil {
+			t.Fatal("Failed to create registration: ", err.Error())
+		}
+
+		src, _ := NewRemoteContextSource(reg)
+		ctxRegistry.Register(src)
+	}
+
+	return ctxRegistry
+}
+
+func TestRetrieveEntityMergesFragmentsFromSources(t *testing.T) {
+	poiService := setupMockServiceThatReturns(200, "application/ld+json",
+		`{"id":"urn:ngsi-ld:Beach:1","type":"Beach","name":{"type":"Property","value":"Stranden"}}`)
+	defer poiService.Close()
+	sensorService := setupMockServiceThatReturns(200, "application/ld+json",
+		`{"id":"urn:ngsi-ld:Beach:1","type":"Beach","waterTemperature":{"type":"Property","value":17.2}}`)
+	defer sensorService.Close()
+
+	ctxRegistry := newFragmentRegistry(t, poiService.URL, sensorService.URL)
+
+	req, _ := http.NewRequest("GET", createURL("/entities/urn:ngsi-ld:Beach:1"), nil)
+	w := httptest.NewRecorder()
+	NewRetrieveEntityHandler(ctxRegistry).ServeHTTP(w, req)
+
+	entity := map[string]interface{}{}
+	json.Unmarshal(w.Body.Bytes(), &entity)
+
+	if entity["name"] == nil || entity["waterTemperature"] == nil {
+		t.Error("The fragments from both sources should be merged: ", w.Body.String())
+	}
+}
+
+func TestQueryEntitiesMergesFragmentsFromSources(t *testing.T) {
+	poiService := setupMockServiceThatReturns(200, "application/ld+json",
+		`[{"id":"urn:ngsi-ld:Beach:1","type":"Beach","name":{"type":"Property","value":"Stranden"}}]`)
+	defer poiService.Close()
+	sensorService := setupMockServiceThatReturns(200, "application/ld+json",
+		`[{"id":"urn:ngsi-ld:Beach:1","type":"Beach","waterTemperature":{"type":"Property","value":17.2}}]`)
+	defer sensorService.Close()
+
+	ctxRegistry := newFragmentRegistry(t, poiService.URL, sensorService.URL)
+
+	req, _ := http.NewRequest("GET", createURL("/entities", "type=Beach"), nil)
+	w := httptest.NewRecorder()
+	NewQueryEntitiesHandler(ctxRegistry).ServeHTTP(w, req)
+
+	entities := []map[string]interface{}{}
+	json.Unmarshal(w.Body.Bytes(), &entities)
+
+	if len(entities) != 1 || entities[0]["name"] == nil || entities[0]["waterTemperature"] == nil {
+		t.Error("Expected a single merged entity: ", w.Body.String())
+	}
+}
+
+func TestMostRecentAttributeInstanceWins(t *testing.T) {
+	merged := mergeEntities([]Entity{
+		map[string]interface{}{"id": "urn:ngsi-ld:Beach:1", "temperature": map[string]interface{}{
+			"type": "Property", "value": 12.0, "observedAt": "2020-06-01T12:00:00Z",
+		}},
+		map[string]interface{}{"id": "urn:ngsi-ld:Beach:1", "temperature": map[string]interface{}{
+			"type": "Property", "value": 14.0, "observedAt": "2020-06-01T13:00:00Z",
+		}},
+		map[string]interface{}{"id": "urn:ngsi-ld:Beach:1", "temperature": map[string]interface{}{
+			"type": "Property", "value": 10.0, "modifiedAt": "2020-06-01T11:00:00Z",
+		}},
+	})
+
+	temperature, _ := merged[0].(map[string]interface{})["temperature"].(map[string]interface{})
+	if len(merged) != 1 || temperature["value"] != 14.0 {
+		t.Error("The most recently observed temperature should be kept: ", merged)
+	}
+}
+
+func TestAttributesWithDifferentDatasetIDsAreKept(t *testing.T) {
+	merged := mergeEntities([]Entity{
+		map[string]interface{}{"id": "urn:ngsi-ld:Beach:1", "temperature": map[string]interface{}{
+			"type": "Property", "value": 12.0, "datasetId": "urn:ngsi-ld:Dataset:buoy",
+		}},
+		map[string]interface{}{"id": "urn:ngsi-ld:Beach:1", "temperature": map[string]interface{}{
+			"type": "Property", "value": 14.0, "datasetId": "urn:ngsi-ld:Dataset:satellite",
+		}},
+	})
+
+	instances, _ := merged[0].(map[string]interface{})["temperature"].([]interface{})
+	if len(instances) != 2 {
+		t.Error("Both datasets should be kept as a multi-attribute: ", merged)
+	}
+}
+
+func TestQueryEntitiesMergesFragmentsWhenThePageIsFull(t *testing.T) {
+	poiService := setupMockServiceThatReturns(200, "application/ld+json",
+		`[{"id":"urn:ngsi-ld:Beach:1","type":"Beach","name":{"type":"Property","value":"Stranden"}},
+		  {"id":"urn:ngsi-ld:Beach:2","type":"Beach","name":{"type":"Property","value":"Badet"}}]`)
+	defer poiService.Close()
+	sensorService := setupMockServiceThatReturns(200, "application/ld+json",
+		`[{"id":"urn:ngsi-ld:Beach:1","type":"Beach","waterTemperature":{"type":"Property","value":17.2}}]`)
+	defer sensorService.Close()
+
+	ctxRegistry := newFragmentRegistry(t, poiService.URL, sensorService.URL)
+
+	req, _ := http.NewRequest("GET", createURL("/entities", "type=Beach", "limit=2", "count=true"), nil)
+	w := httptest.NewRecorder()
+	NewQueryEntitiesHandler(ctxRegistry).ServeHTTP(w, req)
+
+	entities := []map[string]interface{}{}
+	json.Unmarshal(w.Body.Bytes(), &entities)
+
+	if len(entities) != 2 || entities[0]["waterTemperature"] == nil {
+		t.Error("Expected the fragments from the later source to be merged into the page: ", w.Body.String())
+	}
+
+	if w.Header().Get(NGSILDResultsCountHeader) != "2" {
+		t.Error("Unexpected results count: ", w.Header().Get(NGSILDResultsCountHeader), " != 2")
+	}
+
+	if links := strings.Join(w.Header()["Link"], ", "); strings.Contains(links, "rel=\"next\"") {
+		t.Error("Unexpected next link when all entities fit on the page: ", links)
+	}
+}
@@ -12,15 +12,25 @@ type ProblemDetails interface {
 	Type() string
 	Title() string
 	Detail() string
+	Instance() string
+	ResponseCode() int
 	MarshalJSON() ([]byte, error)
 	WriteResponse(w http.ResponseWriter)
 }
 
 //ProblemDetailsImpl is an implementation of the ProblemDetails interface
 type ProblemDetailsImpl struct {
-	typ    string
-	title  string
-	detail string
+	typ      string
+	title    string
+	detail   string
+	instance string
+	status   int
+
+	//responseCode is the HTTP status of a response that the problem was received in, which
+	//takes precedence over the advisory status member
+	responseCode int
+
+	extensions map[string]interface{}
 }
 
 const (
@@ -40,6 +50,7 @@ func NewBadRequestData(detail string) *BadRequestData {
 			typ:    "https://uri.etsi.org/ngsi-ld/errors/BadRequestData",
 			title:  "Bad Request Data",
 			detail: detail,
+			status: http.StatusBadRequest,
 		},
 	}
 }
@@ -63,6 +74,7 @@ func NewInvalidRequest(detail string) *InvalidRequest {
 			typ:    "https://uri.etsi.org/ngsi-ld/errors/InvalidRequest",
 			title:  "Invalid Request",
 			detail: detail,
+			status: http.StatusBadRequest,
 		},
 	}
 }
@@ -85,6 +97,7 @@ func NewInternalError(detail string) *InternalError {
 			typ:    "https://uri.etsi.org/ngsi-ld/errors/InternalError",
 			title:  "Internal Error",
 			detail: detail,
+			status: http.StatusInternalServerError,
 		},
 	}
 }
@@ -95,30 +108,404 @@ func ReportNewInternalError(w http.ResponseWriter, detail string) {
 	ie.WriteResponse(w)
 }
 
+//ResourceNotFound reports that the referred entity or element does not exist
+type ResourceNotFound struct {
+	ProblemDetailsImpl
+}
+
+//NewResourceNotFound creates and returns a new instance of a ResourceNotFound with the supplied problem detail
+func NewResourceNotFound(detail string) *ResourceNotFound {
+	return &ResourceNotFound{
+		ProblemDetailsImpl: ProblemDetailsImpl{
+			typ:    "https://uri.etsi.org/ngsi-ld/errors/ResourceNotFound",
+			title:  "Resource Not Found",
+			detail: detail,
+			status: http.StatusNotFound,
+		},
+	}
+}
+
+//ReportNewResourceNotFound creates a ResourceNotFound instance and sends it to the supplied http.ResponseWriter
+func ReportNewResourceNotFound(w http.ResponseWriter, detail string) {
+	rnf := NewResourceNotFound(detail)
+	rnf.WriteResponse(w)
+}
+
+//AlreadyExists reports that the referred element already exists
+type AlreadyExists struct {
+	ProblemDetailsImpl
+}
+
+//NewAlreadyExists creates and returns a new instance of an AlreadyExists with the supplied problem detail
+func NewAlreadyExists(detail string) *AlreadyExists {
+	return &AlreadyExists{
+		ProblemDetailsImpl: ProblemDetailsImpl{
+			typ:    "https://uri.etsi.org/ngsi-ld/errors/AlreadyExists",
+			title:  "Already Exists",
+			detail: detail,
+			status: http.StatusConflict,
+		},
+	}
+}
+
+//ReportNewAlreadyExists creates an AlreadyExists instance and sends it to the supplied http.ResponseWriter
+func ReportNewAlreadyExists(w http.ResponseWriter, detail string) {
+	ae := NewAlreadyExists(detail)
+	ae.WriteResponse(w)
+}
+
+//OperationNotSupported reports that the operation is not supported by the implementation or by the involved context sources
+type OperationNotSupported struct {
+	ProblemDetailsImpl
+}
+
+//NewOperationNotSupported creates and returns a new instance of an OperationNotSupported with the supplied problem detail
+func NewOperationNotSupported(detail string) *OperationNotSupported {
+	return &OperationNotSupported{
+		ProblemDetailsImpl: ProblemDetailsImpl{
+			typ:    "https://uri.etsi.org/ngsi-ld/errors/OperationNotSupported",
+			title:  "Operation Not Supported",
+			detail: detail,
+			status: http.StatusUnprocessableEntity,
+		},
+	}
+}
+
+//ReportNewOperationNotSupported creates an OperationNotSupported instance and sends it to the supplied http.ResponseWriter
+func ReportNewOperationNotSupported(w http.ResponseWriter, detail string) {
+	ons := NewOperationNotSupported(detail)
+	ons.WriteResponse(w)
+}
+
+//TooComplexQuery reports that the query is too complex to be processed
+type TooComplexQuery struct {
+	ProblemDetailsImpl
+}
+
+//NewTooComplexQuery creates and returns a new instance of a TooComplexQuery with the supplied problem detail
+func NewTooComplexQuery(detail string) *TooComplexQuery {
+	return &TooComplexQuery{
+		ProblemDetailsImpl: ProblemDetailsImpl{
+			typ:    "https://uri.etsi.org/ngsi-ld/errors/TooComplexQuery",
+			title:  "Too Complex Query",
+			detail: detail,
+			status: http.StatusForbidden,
+		},
+	}
+}
+
+//ReportNewTooComplexQuery creates a TooComplexQuery instance and sends it to the supplied http.ResponseWriter
+func ReportNewTooComplexQuery(w http.ResponseWriter, detail string) {
+	tcq := NewTooComplexQuery(detail)
+	tcq.WriteResponse(w)
+}
+
+//TooManyResults reports that the request would return more results than the implementation is willing to return
+type TooManyResults struct {
+	ProblemDetailsImpl
+}
+
+//NewTooManyResults creates and returns a new instance of a TooManyResults with the supplied problem detail
+func NewTooManyResults(detail string) *TooManyResults {
+	return &TooManyResults{
+		ProblemDetailsImpl: ProblemDetailsImpl{
+			typ:    "https://uri.etsi.org/ngsi-ld/errors/TooManyResults",
+			title:  "Too Many Results",
+			detail: detail,
+			status: http.StatusForbidden,
+		},
+	}
+}
+
+//ReportNewTooManyResults creates a TooManyResults instance and sends it to the supplied http.ResponseWriter
+func ReportNewTooManyResults(w http.ResponseWriter, detail string) {
+	tmr := NewTooManyResults(detail)
+	tmr.WriteResponse(w)
+}
+
+//LdContextNotAvailable reports that a remote JSON-LD @context that is referenced by the request could not be retrieved
+type LdContextNotAvailable struct {
+	ProblemDetailsImpl
+}
+
+//NewLdContextNotAvailable creates and returns a new instance of an LdContextNotAvailable with the supplied problem detail
+func NewLdContextNotAvailable(detail string) *LdContextNotAvailable {
+	return &LdContextNotAvailable{
+		ProblemDetailsImpl: ProblemDetailsImpl{
+			typ:    "https://uri.etsi.org/ngsi-ld/errors/LdContextNotAvailable",
+			title:  "LD Context Not Available",
+			detail: detail,
+			status: http.StatusServiceUnavailable,
+		},
+	}
+}
+
+//ReportNewLdContextNotAvailable creates an LdContextNotAvailable instance and sends it to the supplied http.ResponseWriter
+func ReportNewLdContextNotAvailable(w http.ResponseWriter, detail string) {
+	lcna := NewLdContextNotAvailable(detail)
+	lcna.WriteResponse(w)
+}
+
+//NoMultiTenantSupport reports that the request refers to a tenant, but multi-tenancy is not supported
+type NoMultiTenantSupport struct {
+	ProblemDetailsImpl
+}
+
+//NewNoMultiTenantSupport creates and returns a new instance of a NoMultiTenantSupport with the supplied problem detail
+func NewNoMultiTenantSupport(detail string) *NoMultiTenantSupport {
+	return &NoMultiTenantSupport{
+		ProblemDetailsImpl: ProblemDetailsImpl{
+			typ:    "https://uri.etsi.org/ngsi-ld/errors/NoMultiTenantSupport",
+			title:  "No Multi Tenant Support",
+			detail: detail,
+			status: http.StatusNotImplemented,
+		},
+	}
+}
+
+//ReportNewNoMultiTenantSupport creates a NoMultiTenantSupport instance and sends it to the supplied http.ResponseWriter
+func ReportNewNoMultiTenantSupport(w http.ResponseWriter, detail string) {
+	nmts := NewNoMultiTenantSupport(detail)
+	nmts.WriteResponse(w)
+}
+
+//NonexistentTenant reports that the tenant referred to by the request does not exist
+type NonexistentTenant struct {
+	ProblemDetailsImpl
+}
+
+//NewNonexistentTenant creates and returns a new instance of a NonexistentTenant with the supplied problem detail
+func NewNonexistentTenant(detail string) *NonexistentTenant {
+	return &NonexistentTenant{
+		ProblemDetailsImpl: ProblemDetailsImpl{
+			typ:    "https://uri.etsi.org/ngsi-ld/errors/NonexistentTenant",
+			title:  "Nonexistent Tenant",
+			detail: detail,
+			status: http.StatusNotFound,
+		},
+	}
+}
+
+//ReportNewNonexistentTenant creates a NonexistentTenant instance and sends it to the supplied http.ResponseWriter
+func ReportNewNonexistentTenant(w http.ResponseWriter, detail string) {
+	nt := NewNonexistentTenant(detail)
+	nt.WriteResponse(w)
+}
+
+//ServiceUnavailable reports that a context source that is needed to complete the operation could
+//not be reached. NGSI-LD does not define a problem type for this, so the type is about:blank as
+//prescribed by RFC7807 for problems that need no further semantics than the HTTP status code.
+type ServiceUnavailable struct {
+	ProblemDetailsImpl
+}
+
+//NewServiceUnavailable creates and returns a new instance of a ServiceUnavailable with the supplied problem detail
+func NewServiceUnavailable(detail string) *ServiceUnavailable {
+	return &ServiceUnavailable{
+		ProblemDetailsImpl: ProblemDetailsImpl{
+			typ:    "about:blank",
+			title:  "Service Unavailable",
+			detail: detail,
+			status: http.StatusServiceUnavailable,
+		},
+	}
+}
+
+//ReportNewServiceUnavailable creates a ServiceUnavailable instance and sends it to the supplied http.ResponseWriter
+func ReportNewServiceUnavailable(w http.ResponseWriter, detail string) {
+	su := NewServiceUnavailable(detail)
+	su.WriteResponse(w)
+}
+
+//GatewayTimeout reports that a context source did not respond in time. Like ServiceUnavailable
+//it uses the about:blank problem type.
+type GatewayTimeout struct {
+	ProblemDetailsImpl
+}
+
+//NewGatewayTimeout creates and returns a new instance of a GatewayTimeout with the supplied problem detail
+func NewGatewayTimeout(detail string) *GatewayTimeout {
+	return &GatewayTimeout{
+		ProblemDetailsImpl: ProblemDetailsImpl{
+			typ:    "about:blank",
+			title:  "Gateway Timeout",
+			detail: detail,
+			status: http.StatusGatewayTimeout,
+		},
+	}
+}
+
+//ReportNewGatewayTimeout creates a GatewayTimeout instance and sends it to the supplied http.ResponseWriter
+func ReportNewGatewayTimeout(w http.ResponseWriter, detail string) {
+	gt := NewGatewayTimeout(detail)
+	gt.WriteResponse(w)
+}
+
+//ProblemError is an error that carries a problem, so that the problem can pass through code that
+//only deals with errors and still be reported to the client as it is. Use errors.As from the
+//standard library to find out if an error, or any error that it wraps, carries a problem.
+type ProblemError struct {
+	Problem ProblemDetails
+}
+
+//NewProblemError creates and returns a new error that carries the supplied problem
+func NewProblemError(problem ProblemDetails) *ProblemError {
+	return &ProblemError{Problem: problem}
+}
+
+func (pe *ProblemError) Error() string {
+	if detail := pe.Problem.Detail(); detail != "" {
+		return detail
+	}
+
+	return pe.Problem.Title()
+}
+
+//NewProblemDetailsFromJSON parses a problem, e.g. from a response by another NGSI-LD implementation.
+//The supplied status, which should be the actual status of that response, is used as the response
+//code. A status member in the problem is advisory only and is kept as it is.
+func NewProblemDetailsFromJSON(data []byte, status int) (ProblemDetails, error) {
+	problem := &ProblemDetailsImpl{}
+
+	err := json.Unmarshal(data, problem)
+	if err != nil {
+		return nil, err
+	}
+
+	if problem.typ == "" {
+		// RFC7807 states that a missing type should be treated as about:blank
+		problem.typ = "about:blank"
+	}
+
+	problem.responseCode = status
+
+	return problem, nil
+}
+
 //ContentType returns the ContentType to be used when returning this problem
 func (p *ProblemDetailsImpl) ContentType() string {
 	return ProblemReportContentType
 }
 
+//problemMembers are the members of a problem details object that are defined by RFC7807
+type problemMembers struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Detail   string `json:"detail"`
+	Instance string `json:"instance,omitempty"`
+	Status   int    `json:"status,omitempty"`
+}
+
 //MarshalJSON is called when a ProblemDetailsImpl instance should be serialized to JSON
 func (p *ProblemDetailsImpl) MarshalJSON() ([]byte, error) {
-	j, err := json.Marshal(struct {
-		Type   string `json:"type"`
-		Title  string `json:"title"`
-		Detail string `json:"detail"`
-	}{
-		Type:   p.typ,
-		Title:  p.title,
-		Detail: p.detail,
-	})
+	members := problemMembers{
+		Type:     p.typ,
+		Title:    p.title,
+		Detail:   p.detail,
+		Instance: p.instance,
+		Status:   p.status,
+	}
+
+	if len(p.extensions) == 0 {
+		return json.Marshal(members)
+	}
+
+	j, err := json.Marshal(members)
 	if err != nil {
 		return nil, err
 	}
-	return j, nil
+
+	merged := map[string]interface{}{}
+	for name, value := range p.extensions {
+		merged[name] = value
+	}
+
+	// The members defined by RFC7807 can not be overridden by extension members
+	json.Unmarshal(j, &merged)
+
+	return json.Marshal(merged)
+}
+
+//UnmarshalJSON is called when a ProblemDetailsImpl instance should be deserialized from JSON
+func (p *ProblemDetailsImpl) UnmarshalJSON(data []byte) error {
+	members := problemMembers{}
+
+	err := json.Unmarshal(data, &members)
+	if err != nil {
+		return err
+	}
+
+	p.typ = members.Type
+	p.title = members.Title
+	p.detail = members.Detail
+	p.instance = members.Instance
+	p.status = members.Status
+	p.extensions = nil
+
+	all := map[string]interface{}{}
+	json.Unmarshal(data, &all)
+
+	for name, value := range all {
+		switch name {
+		case "type", "title", "detail", "instance", "status":
+		default:
+			p.SetExtension(name, value)
+		}
+	}
+
+	return nil
+}
+
+//Type returns the URI reference that identifies the problem type
+func (p *ProblemDetailsImpl) Type() string {
+	return p.typ
+}
+
+//Title returns a short, human-readable summary of the problem type
+func (p *ProblemDetailsImpl) Title() string {
+	return p.title
+}
+
+//Detail returns a human-readable explanation specific to this occurrence of the problem
+func (p *ProblemDetailsImpl) Detail() string {
+	return p.detail
+}
+
+//Instance returns a URI reference that identifies this occurrence of the problem, if any
+func (p *ProblemDetailsImpl) Instance() string {
+	return p.instance
+}
+
+//SetInstance sets the URI reference that identifies this occurrence of the problem
+func (p *ProblemDetailsImpl) SetInstance(instance string) {
+	p.instance = instance
+}
+
+//Extension returns the value of an extension member, or nil if the member does not exist
+func (p *ProblemDetailsImpl) Extension(name string) interface{} {
+	return p.extensions[name]
+}
+
+//SetExtension adds an extension member that will be serialized along with the members
+//defined by RFC7807
+func (p *ProblemDetailsImpl) SetExtension(name string, value interface{}) {
+	if p.extensions == nil {
+		p.extensions = map[string]interface{}{}
+	}
+
+	p.extensions[name] = value
 }
 
 //ResponseCode returns the HTTP response code to be used when returning a specific problem
 func (p *ProblemDetailsImpl) ResponseCode() int {
+	if p.responseCode != 0 {
+		return p.responseCode
+	}
+
+	if p.status != 0 {
+		return p.status
+	}
+
 	return http.StatusBadRequest
 }
 
@@ -0,0 +1,140 @@
+package errors
+
+import (
+	"encoding/json"
+	stderrors "errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestProblemTypesHaveTheExpectedStatusCodes(t *testing.T) {
+	problems := map[ProblemDetails]int{
+		NewBadRequestData("detail"):        http.StatusBadRequest,
+		NewInvalidRequest("detail"):        http.StatusBadRequest,
+		NewInternalError("detail"):         http.StatusInternalServerError,
+		NewResourceNotFound("detail"):      http.StatusNotFound,
+		NewAlreadyExists("detail"):         http.StatusConflict,
+		NewOperationNotSupported("detail"): http.StatusUnprocessableEntity,
+		NewTooComplexQuery("detail"):       http.StatusForbidden,
+		NewTooManyResults("detail"):        http.StatusForbidden,
+		NewLdContextNotAvailable("detail"): http.StatusServiceUnavailable,
+		NewNoMultiTenantSupport("detail"):  http.StatusNotImplemented,
+		NewNonexistentTenant("detail"):     http.StatusNotFound,
+		NewServiceUnavailable("detail"):    http.StatusServiceUnavailable,
+		NewGatewayTimeout("detail"):        http.StatusGatewayTimeout,
+	}
+
+	for problem, status := range problems {
+		if problem.ResponseCode() != status {
+			t.Error("Unexpected response code for ", problem.Type(), ": ", problem.ResponseCode(), " != ", status)
+		}
+
+		if problem.Title() == "" || problem.Detail() != "detail" || problem.ContentType() != ProblemReportContentType {
+			t.Error("Unexpected members in problem ", problem.Type(), ": ", problem.Title(), problem.Detail())
+		}
+	}
+}
+
+func TestWriteResponse(t *testing.T) {
+	w := httptest.NewRecorder()
+	ReportNewResourceNotFound(w, "no entity found")
+
+	if w.Code != http.StatusNotFound || w.Header().Get("Content-Type") != ProblemReportContentType {
+		t.Error("Unexpected response: ", w.Code, w.Header().Get("Content-Type"))
+	}
+
+	members := map[string]interface{}{}
+	json.Unmarshal(w.Body.Bytes(), &members)
+
+	if members["type"] != "https://uri.etsi.org/ngsi-ld/errors/ResourceNotFound" ||
+		members["title"] != "Resource Not Found" || members["detail"] != "no entity found" ||
+		members["status"] != float64(http.StatusNotFound) {
+		t.Error("Unexpected problem in response: ", w.Body.String())
+	}
+
+	if _, ok := members["instance"]; ok {
+		t.Error("An empty instance should not be serialized: ", w.Body.String())
+	}
+}
+
+func TestInstanceAndExtensionMembersAreSerialized(t *testing.T) {
+	problem := NewBadRequestData("bad input")
+	problem.SetInstance("/ngsi-ld/v1/entities/urn:ngsi-ld:Beach:1")
+	problem.SetExtension("attributeName", "temperature")
+	problem.SetExtension("title", "Overridden")
+
+	data, _ := json.Marshal(problem)
+
+	members := map[string]interface{}{}
+	json.Unmarshal(data, &members)
+
+	if members["instance"] != "/ngsi-ld/v1/entities/urn:ngsi-ld:Beach:1" || members["attributeName"] != "temperature" {
+		t.Error("Instance and extension members should be serialized: ", string(data))
+	}
+
+	if members["title"] != "Bad Request Data" {
+		t.Error("Extension members should not override the members defined by RFC7807: ", string(data))
+	}
+}
+
+func TestProblemDetailsFromJSONRoundTrip(t *testing.T) {
+	original := NewTooManyResults("too many")
+	original.SetInstance("urn:problem:1")
+	original.SetExtension("maxLimit", float64(1000))
+
+	data, _ := json.Marshal(original)
+
+	problem, err := NewProblemDetailsFromJSON(data, http.StatusForbidden)
+	if err != nil {
+		t.Fatal("Failed to parse problem: ", err.Error())
+	}
+
+	if problem.Type() != original.Type() || problem.Title() != original.Title() ||
+		problem.Detail() != original.Detail() || problem.Instance() != original.Instance() {
+		t.Error("The problem did not survive a round trip: ", string(data))
+	}
+
+	if impl, ok := problem.(*ProblemDetailsImpl); !ok || impl.Extension("maxLimit") != float64(1000) {
+		t.Error("Extension members should be kept when parsing a problem.")
+	}
+
+	again, _ := json.Marshal(problem)
+	if string(again) != string(data) {
+		t.Error("Unexpected serialization after round trip: ", string(again), " != ", string(data))
+	}
+}
+
+func TestResponseCodeOfParsedProblemIsTheActualStatus(t *testing.T) {
+	problem, _ := NewProblemDetailsFromJSON([]byte(`{"title":"Oops","status":400}`), http.StatusBadGateway)
+
+	if problem.ResponseCode() != http.StatusBadGateway {
+		t.Error("Unexpected response code: ", problem.ResponseCode(), " != ", http.StatusBadGateway)
+	}
+
+	if problem.Type() != "about:blank" {
+		t.Error("A missing type should be treated as about:blank: ", problem.Type())
+	}
+
+	if _, err := NewProblemDetailsFromJSON([]byte(`not json`), http.StatusBadGateway); err == nil {
+		t.Error("Parsing invalid JSON should fail.")
+	}
+}
+
+func TestProblemErrorCanBeFoundWithErrorsAs(t *testing.T) {
+	err := fmt.Errorf("request failed: %w", NewProblemError(NewGatewayTimeout("no response")))
+
+	var problemErr *ProblemError
+	if !stderrors.As(err, &problemErr) || problemErr.Problem.ResponseCode() != http.StatusGatewayTimeout {
+		t.Error("Expected to find the problem in the wrapped error: ", err)
+	}
+
+	if problemErr != nil && problemErr.Error() != "no response" {
+		t.Error("Unexpected error message: ", problemErr.Error())
+	}
+
+	if NewProblemError(NewInternalError("")).Error() != "Internal Error" {
+		t.Error("A problem without detail should use its title as the error message.")
+	}
+}
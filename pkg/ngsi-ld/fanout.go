@@ -0,0 +1,389 @@
+package ngsi
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+//maxConcurrentSourceQueries limits the number of context sources that are queried at the same time
+const maxConcurrentSourceQueries int = 8
+
+type sourceQueryResult struct {
+	entities []Entity
+	//ids are the ids of all the entities that the source passed back, including any entities
+	//that were passed back beyond the ones that were asked for
+	ids []string
+	err error
+
+	//total is the number of matching entities in the source, which is either reported by the
+	//source itself or the number of entities that it passed back
+	total uint64
+	//mayHaveMore is true if the source may have matching entities that it did not pass back
+	mayHaveMore bool
+}
+
+//federatedQueryResult is a page of the combined results from several context sources
+type federatedQueryResult struct {
+	entities []Entity
+	failures []sourceFailure
+
+	//total is the number of matching entities in all sources, and is only set if counted
+	total *uint64
+	//more is true if there may be more entities after this page
+	more bool
+}
+
+//sourceFailure describes a context source that failed to respond to a query
+type sourceFailure struct {
+	source ContextSource
+	err    error
+}
+
+//warning formats the failure as the value of a NGSILD-Warning header, following the format of
+//the Warning header in RFC 7234 with the registration of the failed source as the agent
+func (sf sourceFailure) warning() string {
+	agent := "-"
+	if id := sourceRegistrationID(sf.source); id != "" {
+		agent = id
+	}
+
+	text := strings.Join(strings.Fields(sf.err.Error()), " ")
+
+	return fmt.Sprintf("199 %s %s", agent, strconv.Quote(text))
+}
+
+//sourceRegistrationID returns the registration ID of a context source, looking through any wrappers
+func sourceRegistrationID(src ContextSource) string {
+	rcs, ok := unwrapSource(src, func(s ContextSource) bool {
+		_, ok := s.(RegisteredContextSource)
+		return ok
+	}).(RegisteredContextSource)
+	if !ok {
+		return ""
+	}
+
+	return rcs.RegistrationID()
+}
+
+//queryContextSources passes a query to the context sources concurrently, using a bounded pool of
+//workers, and returns a page of the combined results together with the sources that failed.
+//
+//The entities from all sources are combined into a single stream, ordered first by the order of
+//the sources and then by the order within each source, and the offset and limit are applied to
+//that stream. Each source is therefore asked for its first offset+limit entities. Fragments of
+//the same entity from different sources are merged into the entity where it first appears in the
+//stream.
+//
+//Once the sources before them have provided enough entities to fill the page, outstanding
+//queries are cancelled for the sources that can not provide fragments of the entities on the
+//page, unless the total number of entities should be counted. All queries are cancelled when
+//the supplied context is done, e.g. because the client has disconnected.
+func queryContextSources(ctx context.Context, query Query, sources []ContextSource, offset, limit uint64, count bool) federatedQueryResult {
+	needed := offset + limit
+
+	mu := sync.Mutex{}
+	results := make([]sourceQueryResult, len(sources))
+	done := make([]bool, len(sources))
+	skipped := make([]bool, len(sources))
+
+	contexts := make([]context.Context, len(sources))
+	cancels := make([]context.CancelFunc, len(sources))
+	for idx := range sources {
+		contexts[idx], cancels[idx] = context.WithCancel(ctx)
+		defer cancels[idx]()
+	}
+
+	sourceCompleted := func(idx int, result sourceQueryResult) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		results[idx] = result
+		done[idx] = true
+
+		if count {
+			return
+		}
+
+		page, full := completedPage(sources, results, done, offset, needed)
+		if !full {
+			return
+		}
+
+		for i, src := range sources {
+			if !done[i] && !skipped[i] && !sourceMayProvideFragments(src, page) {
+				skipped[i] = true
+				cancels[i]()
+			}
+		}
+	}
+
+	workers := maxConcurrentSourceQueries
+	if len(sources) < workers {
+		workers = len(sources)
+	}
+
+	jobs := make(chan int)
+	wg := sync.WaitGroup{}
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for idx := range jobs {
+				mu.Lock()
+				skip := skipped[idx]
+				mu.Unlock()
+
+				if !skip {
+					sourceCompleted(idx, querySource(contexts[idx], query, sources[idx], needed))
+				}
+			}
+		}()
+	}
+
+feedWorkers:
+	for idx := range sources {
+		select {
+		case jobs <- idx:
+		case <-ctx.Done():
+			break feedWorkers
+		}
+	}
+
+	close(jobs)
+	wg.Wait()
+
+	merger := newEntityMerger()
+	failures := []sourceFailure{}
+
+	distinct := map[string]bool{}
+	anonymous := uint64(0)
+	unseen := uint64(0)
+	mayHaveMore := false
+
+	for idx, result := range results {
+		if skipped[idx] {
+			// The source was not needed, but it may still have more entities
+			mayHaveMore = true
+			continue
+		}
+
+		if result.err != nil {
+			failures = append(failures, sourceFailure{source: sources[idx], err: result.err})
+			continue
+		}
+
+		for _, entity := range result.entities {
+			if isRedirectSource(sources[idx]) {
+				merger.addUnmerged(entity)
+			} else {
+				merger.add(entity)
+			}
+		}
+
+		for _, id := range result.ids {
+			if id == "" || isRedirectSource(sources[idx]) {
+				anonymous++
+			} else {
+				distinct[id] = true
+			}
+		}
+
+		if result.mayHaveMore {
+			mayHaveMore = true
+			if result.total > uint64(len(result.ids)) {
+				unseen += result.total - uint64(len(result.ids))
+			}
+		}
+	}
+
+	combined := merger.entities
+	page := federatedQueryResult{entities: []Entity{}, failures: failures}
+
+	if offset < uint64(len(combined)) {
+		end := uint64(len(combined))
+		if end > needed {
+			end = needed
+		}
+		page.entities = combined[offset:end]
+	}
+
+	//received is the number of distinct entities that the sources passed back, which may be
+	//more than the ones that were kept since sources may pass back more than they were asked for
+	received := uint64(len(distinct)) + anonymous
+
+	page.more = received > needed || mayHaveMore
+
+	if count {
+		// The entities that the sources did not pass back can not be matched against the ones
+		// that were received, so the count is an upper bound unless all sources passed back
+		// all of their matching entities
+		total := received + unseen
+		page.total = &total
+	}
+
+	return page
+}
+
+//pageEntity identifies an entity on a page that fragments from other sources may be merged into
+type pageEntity struct {
+	id         string
+	entityType string
+}
+
+//completedPage returns the entities on the page if the sources that have completed, before the
+//first source that is still outstanding, have provided enough entities to fill it
+func completedPage(sources []ContextSource, results []sourceQueryResult, done []bool, offset, needed uint64) ([]pageEntity, bool) {
+	page := []pageEntity{}
+	seen := map[string]bool{}
+	position := uint64(0)
+	received := uint64(0)
+
+	for idx, src := range sources {
+		if received >= needed {
+			break
+		}
+
+		if !done[idx] {
+			return nil, false
+		}
+
+		result := results[idx]
+		if result.err != nil {
+			continue
+		}
+
+		for i, id := range result.ids {
+			mergeable := id != "" && !isRedirectSource(src)
+			if mergeable && seen[id] {
+				continue
+			}
+			seen[id] = mergeable
+			received++
+
+			if i < len(result.entities) {
+				if mergeable && position >= offset && position < needed {
+					page = append(page, pageEntity{id: id, entityType: entityTypeName(result.entities[i])})
+				}
+				position++
+			}
+		}
+	}
+
+	return page, received >= needed
+}
+
+//sourceMayProvideFragments returns false if a source can not provide fragments of any of the
+//entities on a page, which means that its results would not change the page
+func sourceMayProvideFragments(src ContextSource, page []pageEntity) bool {
+	if isRedirectSource(src) {
+		return false
+	}
+
+	// The information in a registration shows which entities a remote source may have
+	if reg, ok := sourceRegistration(src); ok {
+		if _, ok := reg.(*ctxSrcReg); ok {
+			for _, claim := range claimsOf([]ContextSource{src}) {
+				for _, entity := range page {
+					if claim.matches(entity.id, entity.entityType) {
+						return true
+					}
+				}
+			}
+			return false
+		}
+	}
+
+	for _, entity := range page {
+		if (entity.entityType == "" || src.ProvidesType(entity.entityType)) && src.ProvidesEntitiesWithMatchingID(entity.id) {
+			return true
+		}
+	}
+
+	return false
+}
+
+//entityTypeName returns the type of an entity, or an empty string if it is not known
+func entityTypeName(entity Entity) string {
+	entityMap, err := entityAsMap(entity)
+	if err != nil {
+		return ""
+	}
+
+	typeName, _ := entityMap["type"].(string)
+	return typeName
+}
+
+//countingContextSource is implemented by context sources that may report the total number of
+//entities that match a query, besides passing back the entities
+type countingContextSource interface {
+	getEntities(query Query, callback QueryEntitiesCallback) (*uint64, error)
+}
+
+//querySource asks a context source for the first entities that match a query. The source is
+//asked for one more entity than needed, so that it can be told whether it has more of them.
+//
+//Remote sources are never asked for more than QueryMaxPaginationLimit entities at a time, since
+//they would reject such a query. Instead they are paged through until they have passed back
+//enough entities or have no more of them.
+func querySource(ctx context.Context, query Query, src ContextSource, needed uint64) sourceQueryResult {
+	entities := []Entity{}
+	ids := []string{}
+
+	callback := func(entity Entity) error {
+		if uint64(len(entities)) < needed {
+			entities = append(entities, entity)
+		}
+		ids = append(ids, entityID(entity))
+		return nil
+	}
+
+	_, paged := remoteSource(src)
+
+	var reported *uint64
+	var err error
+
+	for {
+		fetched := uint64(len(ids))
+
+		limit := needed + 1 - fetched
+		if paged && limit > QueryMaxPaginationLimit {
+			limit = QueryMaxPaginationLimit
+		}
+
+		sourceQuery := queryWithPagination(queryWithContext(query, ctx), fetched, limit)
+
+		if counting, ok := src.(countingContextSource); ok {
+			reported, err = counting.getEntities(sourceQuery, callback)
+		} else if remote, ok := remoteSource(src); ok {
+			reported, err = remote.getEntities(sourceQuery, callback)
+		} else {
+			err = src.GetEntities(sourceQuery, callback)
+		}
+
+		delivered := uint64(len(ids)) - fetched
+
+		// A page with fewer entities than asked for is the last one
+		if err != nil || !paged || delivered < limit || uint64(len(ids)) > needed ||
+			(reported != nil && *reported <= uint64(len(ids))) {
+			break
+		}
+	}
+
+	delivered := uint64(len(ids))
+	result := sourceQueryResult{entities: entities, ids: ids, err: err, total: delivered}
+
+	if reported != nil && *reported > delivered {
+		result.total = *reported
+		result.mayHaveMore = true
+	} else if reported == nil {
+		// A source that passed back more entities than needed has more of them
+		result.mayHaveMore = delivered > needed
+	}
+
+	return result
+}
@@ -0,0 +1,314 @@
+package ngsi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+//newBarrierService returns a context source service that only responds once all the expected
+//requests have arrived, which can only happen if the requests are sent concurrently
+func newBarrierService(arrived *sync.WaitGroup, entityID string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		arrived.Done()
+
+		done := make(chan struct{})
+		go func() {
+			arrived.Wait()
+			close(done)
+		}()
+
+		select {
+		case <-done:
+		case <-time.After(2 * time.Second):
+			w.WriteHeader(http.StatusGatewayTimeout)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/ld+json")
+		w.Write([]byte(`[{"id":"` + entityID + `","type":"Beach"}]`))
+	}))
+}
+
+func TestQueryEntitiesFansOutConcurrently(t *testing.T) {
+	arrived := &sync.WaitGroup{}
+	arrived.Add(3)
+
+	ctxRegistry := NewContextRegistry()
+
+	for i := 0; i < 3; i++ {
+		server := newBarrierService(arrived, fmt.Sprintf("urn:ngsi-ld:Beach:%d", i))
+		defer server.Close()
+		registerTestContextSource(ctxRegistry, "Beach", server.URL)
+	}
+
+	req, _ := http.NewRequest("GET", createURL("/entities", "type=Beach"), nil)
+	w := httptest.NewRecorder()
+	NewQueryEntitiesHandler(ctxRegistry).ServeHTTP(w, req)
+
+	entities := []map[string]interface{}{}
+	json.Unmarshal(w.Body.Bytes(), &entities)
+
+	if w.Code != http.StatusOK || len(entities) != 3 {
+		t.Error("Unexpected response from concurrent query: ", w.Code, w.Body.String())
+	}
+}
+
+func TestQueryEntitiesRespectsLimitAcrossSources(t *testing.T) {
+	ctxRegistry := NewContextRegistry()
+
+	for i := 0; i < 3; i++ {
+		server := setupMockServiceThatReturns(200, "application/ld+json",
+			fmt.Sprintf(`[{"id":"urn:ngsi-ld:Beach:%da","type":"Beach"},{"id":"urn:ngsi-ld:Beach:%db","type":"Beach"}]`, i, i),
+		)
+		defer server.Close()
+		registerTestContextSource(ctxRegistry, "Beach", server.URL)
+	}
+
+	req, _ := http.NewRequest("GET", createURL("/entities", "type=Beach", "limit=3"), nil)
+	w := httptest.NewRecorder()
+	NewQueryEntitiesHandler(ctxRegistry).ServeHTTP(w, req)
+
+	entities := []map[string]interface{}{}
+	json.Unmarshal(w.Body.Bytes(), &entities)
+
+	if len(entities) != 3 {
+		t.Error("Unexpected number of entities returned. ", len(entities), " != 3")
+	}
+}
+
+func TestQueryEntitiesCancelsOutstandingRequestsWhenClientDisconnects(t *testing.T) {
+	cancelled := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			close(cancelled)
+		case <-time.After(2 * time.Second):
+		}
+	}))
+	defer server.Close()
+
+	ctxRegistry := NewContextRegistry()
+	registerTestContextSource(ctxRegistry, "Beach", server.URL)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, "GET", createURL("/entities", "type=Beach"), nil)
+	w := httptest.NewRecorder()
+
+	time.AfterFunc(100*time.Millisecond, cancel)
+	NewQueryEntitiesHandler(ctxRegistry).ServeHTTP(w, req)
+
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Error("The request to the context source was not cancelled.")
+	}
+}
+
+func newPartiallyFailingRegistry(t *testing.T) (ContextRegistry, string, func()) {
+	working := setupMockServiceThatReturns(200, "application/ld+json", `[{"id":"urn:ngsi-ld:Beach:1","type":"Beach"}]`)
+	failing := setupMockServiceThatReturns(400, "application/json", `{"detail":"weather service is down"}`)
+
+	ctxRegistry := NewContextRegistry()
+	registerTestContextSource(ctxRegistry, "Beach", working.URL)
+	location := registerTestContextSource(ctxRegistry, "Beach", failing.URL)
+
+	return ctxRegistry, strings.TrimPrefix(location, "/ngsi-ld/v1/csourceRegistrations/"), func() {
+		working.Close()
+		failing.Close()
+	}
+}
+
+func TestQueryEntitiesFailsWhenAnySourceFails(t *testing.T) {
+	ctxRegistry, _, cleanup := newPartiallyFailingRegistry(t)
+	defer cleanup()
+
+	req, _ := http.NewRequest("GET", createURL("/entities", "type=Beach"), nil)
+	w := httptest.NewRecorder()
+	NewQueryEntitiesHandler(ctxRegistry).ServeHTTP(w, req)
+
+	if w.Code != http.StatusInternalServerError {
+		t.Error("The query should fail when partial results are not enabled: ", w.Code, " != 500")
+	}
+}
+
+func TestQueryEntitiesWithPartialResults(t *testing.T) {
+	ctxRegistry, failingRegistrationID, cleanup := newPartiallyFailingRegistry(t)
+	defer cleanup()
+
+	req, _ := http.NewRequest("GET", createURL("/entities", "type=Beach"), nil)
+	w := httptest.NewRecorder()
+	NewQueryEntitiesHandler(ctxRegistry, WithPartialResults()).ServeHTTP(w, req)
+
+	entities := []map[string]interface{}{}
+	json.Unmarshal(w.Body.Bytes(), &entities)
+
+	if w.Code != http.StatusOK || len(entities) != 1 {
+		t.Error("The entities from the working source should be returned: ", w.Code, w.Body.String())
+	}
+
+	warning := w.Header().Get(NGSILDWarningHeader)
+	if !strings.HasPrefix(warning, "199 "+failingRegistrationID+" ") || !strings.Contains(warning, "weather service is down") {
+		t.Error("Unexpected warning header: ", warning)
+	}
+}
+
+func newPagedRegistry(sources int) (ContextRegistry, func()) {
+	ctxRegistry := NewContextRegistry()
+	servers := []*httptest.Server{}
+
+	for i := 0; i < sources; i++ {
+		server := setupMockServiceThatReturns(200, "application/ld+json",
+			fmt.Sprintf(`[{"id":"urn:ngsi-ld:Beach:%da","type":"Beach"},{"id":"urn:ngsi-ld:Beach:%db","type":"Beach"}]`, i, i),
+		)
+		servers = append(servers, server)
+		registerTestContextSource(ctxRegistry, "Beach", server.URL)
+	}
+
+	return ctxRegistry, func() {
+		for _, server := range servers {
+			server.Close()
+		}
+	}
+}
+
+func TestQueryEntitiesPaginatesAcrossSources(t *testing.T) {
+	ctxRegistry, cleanup := newPagedRegistry(2)
+	defer cleanup()
+
+	req, _ := http.NewRequest("GET", createURL("/entities", "type=Beach", "offset=1", "limit=2"), nil)
+	w := httptest.NewRecorder()
+	NewQueryEntitiesHandler(ctxRegistry).ServeHTTP(w, req)
+
+	entities := []map[string]interface{}{}
+	json.Unmarshal(w.Body.Bytes(), &entities)
+
+	if len(entities) != 2 || entities[0]["id"] != "urn:ngsi-ld:Beach:0b" || entities[1]["id"] != "urn:ngsi-ld:Beach:1a" {
+		t.Error("Unexpected page of entities returned: ", w.Body.String())
+	}
+
+	links := strings.Join(w.Header()["Link"], ", ")
+	if !strings.Contains(links, "offset=0&limit=2>; rel=\"prev\"") || !strings.Contains(links, "offset=3&limit=2>; rel=\"next\"") {
+		t.Error("Unexpected Link headers: ", links)
+	}
+}
+
+func TestQueryEntitiesLastPageHasNoNextLink(t *testing.T) {
+	ctxRegistry, cleanup := newPagedRegistry(2)
+	defer cleanup()
+
+	req, _ := http.NewRequest("GET", createURL("/entities", "type=Beach", "offset=2", "limit=2"), nil)
+	w := httptest.NewRecorder()
+	NewQueryEntitiesHandler(ctxRegistry).ServeHTTP(w, req)
+
+	links := strings.Join(w.Header()["Link"], ", ")
+	if strings.Contains(links, "rel=\"next\"") || !strings.Contains(links, "rel=\"prev\"") {
+		t.Error("Unexpected Link headers on the last page: ", links)
+	}
+}
+
+func TestQueryEntitiesReportsResultsCount(t *testing.T) {
+	ctxRegistry, cleanup := newPagedRegistry(3)
+	defer cleanup()
+
+	req, _ := http.NewRequest("GET", createURL("/entities", "type=Beach", "limit=1", "count=true"), nil)
+	w := httptest.NewRecorder()
+	NewQueryEntitiesHandler(ctxRegistry).ServeHTTP(w, req)
+
+	if w.Header().Get(NGSILDResultsCountHeader) != "6" {
+		t.Error("Unexpected results count: ", w.Header().Get(NGSILDResultsCountHeader), " != 6")
+	}
+}
+
+//newBackendBroker returns a server that handles queries like a broker that uses this library,
+//with a number of beaches in a local context source
+func newBackendBroker(beaches int) *httptest.Server {
+	ctxRegistry := NewContextRegistry()
+	ctxRegistry.Register(NewInMemoryContextSource("Beach"))
+
+	for i := 0; i < beaches; i++ {
+		entity := fmt.Sprintf(`{"id":"urn:ngsi-ld:Beach:%d","type":"Beach"}`, i)
+		req, _ := http.NewRequest("POST", createURL("/entities"), strings.NewReader(entity))
+		NewCreateEntityHandler(ctxRegistry).ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	return httptest.NewServer(NewQueryEntitiesHandler(ctxRegistry))
+}
+
+func TestQueryEntitiesNeverForwardsTooLargeLimits(t *testing.T) {
+	backend := newBackendBroker(3)
+	defer backend.Close()
+
+	ctxRegistry := NewContextRegistry()
+	registerTestContextSource(ctxRegistry, "Beach", backend.URL)
+
+	for params, expected := range map[string]int{"type=Beach": 3, "type=Beach&offset=1&limit=1000": 2} {
+		req, _ := http.NewRequest("GET", createURL("/entities", params), nil)
+		w := httptest.NewRecorder()
+		NewQueryEntitiesHandler(ctxRegistry).ServeHTTP(w, req)
+
+		entities := []map[string]interface{}{}
+		json.Unmarshal(w.Body.Bytes(), &entities)
+
+		if w.Code != http.StatusOK || len(entities) != expected {
+			t.Error("Unexpected response to query ", params, ": ", w.Code, w.Body.String())
+		}
+	}
+}
+
+func registerBeachSource(t *testing.T, ctxRegistry ContextRegistry, idPattern, endpoint string) {
+	reg, err := NewCsourceRegistrationFromJSON([]byte(`{"type":"ContextSourceRegistration",
+		"information":[{"entities":[{"idPattern":"` + idPattern + `","type":"Beach"}]}],
+		"endpoint":"` + endpoint + `"}`))
+	if err != nil {
+		t.Fatal("Failed to create registration: ", err.Error())
+	}
+
+	src, _ := NewRemoteContextSource(reg)
+	ctxRegistry.Register(src)
+}
+
+func TestQueryEntitiesCancelsSlowSourcesThatCanNotChangeThePage(t *testing.T) {
+	fast := setupMockServiceThatReturns(200, "application/ld+json",
+		`[{"id":"urn:ngsi-ld:Beach:a1","type":"Beach"},{"id":"urn:ngsi-ld:Beach:a2","type":"Beach"}]`)
+	defer fast.Close()
+
+	cancelled := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			close(cancelled)
+		case <-time.After(5 * time.Second):
+			w.Header().Add("Content-Type", "application/ld+json")
+			w.Write([]byte(`[]`))
+		}
+	}))
+	defer slow.Close()
+
+	ctxRegistry := NewContextRegistry()
+	registerBeachSource(t, ctxRegistry, "^urn:ngsi-ld:Beach:a.+", fast.URL)
+	registerBeachSource(t, ctxRegistry, "^urn:ngsi-ld:Beach:b.+", slow.URL)
+
+	req, _ := http.NewRequest("GET", createURL("/entities", "type=Beach", "limit=2"), nil)
+	w := httptest.NewRecorder()
+	NewQueryEntitiesHandler(ctxRegistry).ServeHTTP(w, req)
+
+	entities := []map[string]interface{}{}
+	json.Unmarshal(w.Body.Bytes(), &entities)
+
+	if w.Code != http.StatusOK || len(entities) != 2 {
+		t.Error("Unexpected response: ", w.Code, w.Body.String())
+	}
+
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Error("The query to the slow context source was not cancelled.")
+	}
+}
@@ -43,26 +43,9 @@ func (gjgi *geoJSONGeometryImpl) UnmarshalJSON(data []byte) error {
 		return err
 	}
 
-	if temp.Type == "MultiPolygon" {
-		coords := [][][][]float64{}
-		err = json.Unmarshal(temp.Coordinates, &coords)
-		if err != nil {
-			return err
-		}
-
-		gjp := CreateGeoJSONPropertyFromMultiPolygon(coords)
-		gjgi.Geometry = gjp.Value
-	} else if temp.Type == "Point" {
-		coords := [2]float64{}
-		err = json.Unmarshal(temp.Coordinates, &coords)
-		if err != nil {
-			return err
-		}
-
-		gjp := CreateGeoJSONPropertyFromWGS84(coords[0], coords[1])
-		gjgi.Geometry = gjp.Value
-	} else {
-		return fmt.Errorf("unable to unmarshal geometry of type %s", temp.Type)
+	gjgi.Geometry, err = CreateGeoJSONGeometry(temp.Type, temp.Coordinates)
+	if err != nil {
+		return fmt.Errorf("unable to unmarshal geometry: %s", err.Error())
 	}
 
 	return nil
@@ -234,6 +217,91 @@ func (gjpmp *GeoJSONPropertyMultiPolygon) GetAsPoint() GeoJSONPropertyPoint {
 	}
 }
 
+//GeoJSONPropertyMultiPoint is used as the value object for a GeoJSONProperty with several points
+type GeoJSONPropertyMultiPoint struct {
+	Type        string       `json:"type"`
+	Coordinates [][2]float64 `json:"coordinates"`
+}
+
+func (gjpmp *GeoJSONPropertyMultiPoint) GeoPropertyType() string {
+	return gjpmp.Type
+}
+
+func (gjpmp *GeoJSONPropertyMultiPoint) GeoPropertyValue() GeoJSONGeometry {
+	return gjpmp
+}
+
+func (gjpmp *GeoJSONPropertyMultiPoint) GetAsPoint() GeoJSONPropertyPoint {
+	return GeoJSONPropertyPoint{
+		Type:        "Point",
+		Coordinates: gjpmp.Coordinates[0],
+	}
+}
+
+//GeoJSONPropertyLineString is used as the value object for a GeoJSONProperty with a line
+type GeoJSONPropertyLineString struct {
+	Type        string       `json:"type"`
+	Coordinates [][2]float64 `json:"coordinates"`
+}
+
+func (gjpls *GeoJSONPropertyLineString) GeoPropertyType() string {
+	return gjpls.Type
+}
+
+func (gjpls *GeoJSONPropertyLineString) GeoPropertyValue() GeoJSONGeometry {
+	return gjpls
+}
+
+func (gjpls *GeoJSONPropertyLineString) GetAsPoint() GeoJSONPropertyPoint {
+	return GeoJSONPropertyPoint{
+		Type:        "Point",
+		Coordinates: gjpls.Coordinates[0],
+	}
+}
+
+//GeoJSONPropertyMultiLineString is used as the value object for a GeoJSONProperty with several lines
+type GeoJSONPropertyMultiLineString struct {
+	Type        string         `json:"type"`
+	Coordinates [][][2]float64 `json:"coordinates"`
+}
+
+func (gjpmls *GeoJSONPropertyMultiLineString) GeoPropertyType() string {
+	return gjpmls.Type
+}
+
+func (gjpmls *GeoJSONPropertyMultiLineString) GeoPropertyValue() GeoJSONGeometry {
+	return gjpmls
+}
+
+func (gjpmls *GeoJSONPropertyMultiLineString) GetAsPoint() GeoJSONPropertyPoint {
+	return GeoJSONPropertyPoint{
+		Type:        "Point",
+		Coordinates: gjpmls.Coordinates[0][0],
+	}
+}
+
+//GeoJSONPropertyPolygon is used as the value object for a GeoJSONProperty with a polygon. The
+//first linear ring is the exterior ring, and any subsequent rings are holes in the polygon.
+type GeoJSONPropertyPolygon struct {
+	Type        string         `json:"type"`
+	Coordinates [][][2]float64 `json:"coordinates"`
+}
+
+func (gjpp *GeoJSONPropertyPolygon) GeoPropertyType() string {
+	return gjpp.Type
+}
+
+func (gjpp *GeoJSONPropertyPolygon) GeoPropertyValue() GeoJSONGeometry {
+	return gjpp
+}
+
+func (gjpp *GeoJSONPropertyPolygon) GetAsPoint() GeoJSONPropertyPoint {
+	return GeoJSONPropertyPoint{
+		Type:        "Point",
+		Coordinates: gjpp.Coordinates[0][0],
+	}
+}
+
 //GeoJSONProperty is used to encapsulate different GeoJSONGeometry types
 type GeoJSONProperty struct {
 	Property
@@ -271,6 +339,106 @@ func CreateGeoJSONPropertyFromJSON(data []byte) *GeoJSONProperty {
 	return p
 }
 
+//CreateGeoJSONGeometry creates a GeoJSONGeometry of the named type from its JSON encoded
+//coordinates and validates that the coordinates are valid for that type of geometry
+func CreateGeoJSONGeometry(geometryType string, coordinates []byte) (GeoJSONGeometry, error) {
+	var err error
+
+	switch geometryType {
+	case "Point":
+		coords := []float64{}
+		if err = json.Unmarshal(coordinates, &coords); err == nil {
+			if len(coords) < 2 {
+				return nil, fmt.Errorf("a position must have at least two elements, not %d", len(coords))
+			}
+			return CreateGeoJSONPropertyFromWGS84(coords[0], coords[1]).Value, nil
+		}
+	case "MultiPoint":
+		g := &GeoJSONPropertyMultiPoint{Type: geometryType}
+		if err = json.Unmarshal(coordinates, &g.Coordinates); err == nil {
+			if len(g.Coordinates) == 0 {
+				return nil, fmt.Errorf("a MultiPoint must have at least one position")
+			}
+			return g, nil
+		}
+	case "LineString":
+		g := &GeoJSONPropertyLineString{Type: geometryType}
+		if err = json.Unmarshal(coordinates, &g.Coordinates); err == nil {
+			return g, validateLineString(g.Coordinates)
+		}
+	case "MultiLineString":
+		g := &GeoJSONPropertyMultiLineString{Type: geometryType}
+		if err = json.Unmarshal(coordinates, &g.Coordinates); err == nil {
+			if len(g.Coordinates) == 0 {
+				return nil, fmt.Errorf("a MultiLineString must have at least one line")
+			}
+			for _, line := range g.Coordinates {
+				if err = validateLineString(line); err != nil {
+					return nil, err
+				}
+			}
+			return g, nil
+		}
+	case "Polygon":
+		g := &GeoJSONPropertyPolygon{Type: geometryType}
+		if err = json.Unmarshal(coordinates, &g.Coordinates); err == nil {
+			return g, validatePolygon(g.Coordinates)
+		}
+	case "MultiPolygon":
+		coords := [][][][]float64{}
+		if err = json.Unmarshal(coordinates, &coords); err == nil {
+			if len(coords) == 0 {
+				return nil, fmt.Errorf("a MultiPolygon must have at least one polygon")
+			}
+			for _, polygon := range coords {
+				rings := [][][2]float64{}
+				for _, ring := range polygon {
+					positions := [][2]float64{}
+					for _, position := range ring {
+						if len(position) < 2 {
+							return nil, fmt.Errorf("a position must have at least two elements, not %d", len(position))
+						}
+						positions = append(positions, [2]float64{position[0], position[1]})
+					}
+					rings = append(rings, positions)
+				}
+				if err = validatePolygon(rings); err != nil {
+					return nil, err
+				}
+			}
+			return CreateGeoJSONPropertyFromMultiPolygon(coords).Value, nil
+		}
+	default:
+		return nil, fmt.Errorf("unsupported geometry type %s", geometryType)
+	}
+
+	return nil, fmt.Errorf("invalid coordinates for geometry type %s: %s", geometryType, err.Error())
+}
+
+func validateLineString(line [][2]float64) error {
+	if len(line) < 2 {
+		return fmt.Errorf("a LineString must have at least two positions, not %d", len(line))
+	}
+	return nil
+}
+
+func validatePolygon(rings [][][2]float64) error {
+	if len(rings) == 0 {
+		return fmt.Errorf("a Polygon must have at least one linear ring")
+	}
+
+	for _, ring := range rings {
+		if len(ring) < 4 {
+			return fmt.Errorf("a linear ring must have at least four positions, not %d", len(ring))
+		}
+		if ring[0] != ring[len(ring)-1] {
+			return fmt.Errorf("the first and last positions of a linear ring must be equal")
+		}
+	}
+
+	return nil
+}
+
 //CreateGeoJSONPropertyFromWGS84 creates a GeoJSONProperty from a WGS84 coordinate
 func CreateGeoJSONPropertyFromWGS84(longitude, latitude float64) *GeoJSONProperty {
 	p := &GeoJSONProperty{
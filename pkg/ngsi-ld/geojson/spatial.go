@@ -0,0 +1,494 @@
+package geojson
+
+import (
+	"math"
+)
+
+const (
+	//EarthRadiusInMeters is the mean radius of the earth as defined for WGS84
+	EarthRadiusInMeters float64 = 6371008.8
+
+	// Tolerance used when comparing positions, roughly corresponding to 0.1 mm at the equator
+	epsilon float64 = 1e-9
+)
+
+//BoundingBox is the smallest rectangle, in longitude and latitude, that contains a geometry
+type BoundingBox struct {
+	MinLongitude float64
+	MinLatitude  float64
+	MaxLongitude float64
+	MaxLatitude  float64
+}
+
+//Contains returns true if a position is inside or on the edge of the bounding box
+func (bb BoundingBox) Contains(position [2]float64) bool {
+	return position[0] >= bb.MinLongitude-epsilon && position[0] <= bb.MaxLongitude+epsilon &&
+		position[1] >= bb.MinLatitude-epsilon && position[1] <= bb.MaxLatitude+epsilon
+}
+
+//Intersects returns true if two bounding boxes have at least one position in common
+func (bb BoundingBox) Intersects(other BoundingBox) bool {
+	return bb.MinLongitude <= other.MaxLongitude+epsilon && other.MinLongitude <= bb.MaxLongitude+epsilon &&
+		bb.MinLatitude <= other.MaxLatitude+epsilon && other.MinLatitude <= bb.MaxLatitude+epsilon
+}
+
+//shape is a decomposition of any supported geometry into its points, lines and polygons
+type shape struct {
+	points   [][2]float64
+	lines    [][][2]float64
+	polygons [][][][2]float64
+}
+
+//dimension returns 0 for points, 1 for lines and 2 for polygons, or -1 for an empty shape
+func (s *shape) dimension() int {
+	if len(s.polygons) > 0 {
+		return 2
+	} else if len(s.lines) > 0 {
+		return 1
+	} else if len(s.points) > 0 {
+		return 0
+	}
+	return -1
+}
+
+func (s *shape) positions() [][2]float64 {
+	positions := append([][2]float64{}, s.points...)
+	for _, line := range s.lines {
+		positions = append(positions, line...)
+	}
+	for _, polygon := range s.polygons {
+		for _, ring := range polygon {
+			positions = append(positions, ring...)
+		}
+	}
+	return positions
+}
+
+//segments returns all line segments in the shape, including the edges of any polygons
+func (s *shape) segments() [][2][2]float64 {
+	segments := [][2][2]float64{}
+	for _, line := range s.lines {
+		segments = append(segments, lineSegments(line)...)
+	}
+	for _, polygon := range s.polygons {
+		for _, ring := range polygon {
+			segments = append(segments, lineSegments(ring)...)
+		}
+	}
+	return segments
+}
+
+func lineSegments(line [][2]float64) [][2][2]float64 {
+	segments := [][2][2]float64{}
+	for i := 1; i < len(line); i++ {
+		segments = append(segments, [2][2]float64{line[i-1], line[i]})
+	}
+	return segments
+}
+
+func decompose(g GeoJSONGeometry) *shape {
+	s := &shape{}
+
+	if g == nil {
+		return s
+	}
+
+	switch v := g.GeoPropertyValue().(type) {
+	case *GeoJSONPropertyPoint:
+		s.points = append(s.points, v.Coordinates)
+	case *GeoJSONPropertyMultiPoint:
+		s.points = append(s.points, v.Coordinates...)
+	case *GeoJSONPropertyLineString:
+		s.lines = append(s.lines, v.Coordinates)
+	case *GeoJSONPropertyMultiLineString:
+		s.lines = append(s.lines, v.Coordinates...)
+	case *GeoJSONPropertyPolygon:
+		s.polygons = append(s.polygons, v.Coordinates)
+	case *GeoJSONPropertyMultiPolygon:
+		for _, polygon := range v.Coordinates {
+			rings := [][][2]float64{}
+			for _, ring := range polygon {
+				positions := [][2]float64{}
+				for _, position := range ring {
+					if len(position) >= 2 {
+						positions = append(positions, [2]float64{position[0], position[1]})
+					}
+				}
+				rings = append(rings, positions)
+			}
+			s.polygons = append(s.polygons, rings)
+		}
+	}
+
+	return s
+}
+
+//GetBoundingBox returns the bounding box of a geometry
+func GetBoundingBox(g GeoJSONGeometry) BoundingBox {
+	positions := decompose(g).positions()
+
+	if len(positions) == 0 {
+		return BoundingBox{}
+	}
+
+	bb := BoundingBox{
+		MinLongitude: positions[0][0], MinLatitude: positions[0][1],
+		MaxLongitude: positions[0][0], MaxLatitude: positions[0][1],
+	}
+
+	for _, p := range positions[1:] {
+		bb.MinLongitude = math.Min(bb.MinLongitude, p[0])
+		bb.MinLatitude = math.Min(bb.MinLatitude, p[1])
+		bb.MaxLongitude = math.Max(bb.MaxLongitude, p[0])
+		bb.MaxLatitude = math.Max(bb.MaxLatitude, p[1])
+	}
+
+	return bb
+}
+
+//Distance returns the great-circle distance in meters between two WGS84 points
+func Distance(p1, p2 GeoJSONPropertyPoint) float64 {
+	return haversine(p1.Coordinates, p2.Coordinates)
+}
+
+func haversine(a, b [2]float64) float64 {
+	lat1 := a[1] * math.Pi / 180
+	lat2 := b[1] * math.Pi / 180
+	dLat := lat2 - lat1
+	dLon := (b[0] - a[0]) * math.Pi / 180
+
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLon/2)*math.Sin(dLon/2)
+
+	return 2 * EarthRadiusInMeters * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+//DistanceBetween returns the shortest distance in meters between two geometries, or
+//zero if they intersect
+func DistanceBetween(a, b GeoJSONGeometry) float64 {
+	if Intersects(a, b) {
+		return 0
+	}
+
+	sa := decompose(a)
+	sb := decompose(b)
+
+	shortest := math.Inf(1)
+
+	distanceFrom := func(positions [][2]float64, segments [][2][2]float64) {
+		for _, p := range positions {
+			for _, segment := range segments {
+				shortest = math.Min(shortest, distanceToSegment(p, segment))
+			}
+		}
+	}
+
+	pointsAsSegments := func(positions [][2]float64) [][2][2]float64 {
+		segments := [][2][2]float64{}
+		for _, p := range positions {
+			segments = append(segments, [2][2]float64{p, p})
+		}
+		return segments
+	}
+
+	distanceFrom(sa.positions(), append(sb.segments(), pointsAsSegments(sb.points)...))
+	distanceFrom(sb.positions(), append(sa.segments(), pointsAsSegments(sa.points)...))
+
+	return shortest
+}
+
+//distanceToSegment approximates the distance in meters from a position to a line segment by
+//projecting the segment onto a plane centered on the position
+func distanceToSegment(p [2]float64, segment [2][2]float64) float64 {
+	cosLat := math.Cos(p[1] * math.Pi / 180)
+
+	project := func(q [2]float64) (float64, float64) {
+		return (q[0] - p[0]) * cosLat, q[1] - p[1]
+	}
+
+	ax, ay := project(segment[0])
+	bx, by := project(segment[1])
+
+	dx, dy := bx-ax, by-ay
+	t := 0.0
+	if lengthSquared := dx*dx + dy*dy; lengthSquared > 0 {
+		t = math.Max(0, math.Min(1, -(ax*dx+ay*dy)/lengthSquared))
+	}
+
+	closest := [2]float64{p[0] + (ax+t*dx)/cosLat, p[1] + ay + t*dy}
+	if cosLat == 0 {
+		closest = segment[0]
+	}
+
+	return haversine(p, closest)
+}
+
+func equalPositions(a, b [2]float64) bool {
+	return math.Abs(a[0]-b[0]) < epsilon && math.Abs(a[1]-b[1]) < epsilon
+}
+
+func cross(o, a, b [2]float64) float64 {
+	return (a[0]-o[0])*(b[1]-o[1]) - (a[1]-o[1])*(b[0]-o[0])
+}
+
+func positionOnSegment(p [2]float64, segment [2][2]float64) bool {
+	a, b := segment[0], segment[1]
+
+	if math.Abs(cross(a, b, p)) > epsilon {
+		return false
+	}
+
+	return p[0] >= math.Min(a[0], b[0])-epsilon && p[0] <= math.Max(a[0], b[0])+epsilon &&
+		p[1] >= math.Min(a[1], b[1])-epsilon && p[1] <= math.Max(a[1], b[1])+epsilon
+}
+
+func segmentsIntersect(s1, s2 [2][2]float64) bool {
+	return segmentsCross(s1, s2) ||
+		positionOnSegment(s1[0], s2) || positionOnSegment(s1[1], s2) ||
+		positionOnSegment(s2[0], s1) || positionOnSegment(s2[1], s1)
+}
+
+//segmentsCross returns true if two segments intersect at a single position that is not
+//an end point of either of them
+func segmentsCross(s1, s2 [2][2]float64) bool {
+	d1 := cross(s2[0], s2[1], s1[0])
+	d2 := cross(s2[0], s2[1], s1[1])
+	d3 := cross(s1[0], s1[1], s2[0])
+	d4 := cross(s1[0], s1[1], s2[1])
+
+	return ((d1 > epsilon && d2 < -epsilon) || (d1 < -epsilon && d2 > epsilon)) &&
+		((d3 > epsilon && d4 < -epsilon) || (d3 < -epsilon && d4 > epsilon))
+}
+
+func positionOnRing(p [2]float64, ring [][2]float64) bool {
+	for _, segment := range lineSegments(ring) {
+		if positionOnSegment(p, segment) {
+			return true
+		}
+	}
+	return false
+}
+
+//positionInRing uses ray casting to decide if a position is strictly inside a linear ring
+func positionInRing(p [2]float64, ring [][2]float64) bool {
+	inside := false
+
+	for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+		a, b := ring[i], ring[j]
+		if (a[1] > p[1]) != (b[1] > p[1]) &&
+			p[0] < (b[0]-a[0])*(p[1]-a[1])/(b[1]-a[1])+a[0] {
+			inside = !inside
+		}
+	}
+
+	return inside
+}
+
+//positionInPolygon returns true if a position is inside, or on the boundary of, a polygon
+//with an exterior ring and zero or more holes
+func positionInPolygon(p [2]float64, polygon [][][2]float64) bool {
+	if len(polygon) == 0 {
+		return false
+	}
+
+	if positionOnRing(p, polygon[0]) {
+		return true
+	}
+
+	if !positionInRing(p, polygon[0]) {
+		return false
+	}
+
+	for _, hole := range polygon[1:] {
+		if positionInRing(p, hole) && !positionOnRing(p, hole) {
+			return false
+		}
+	}
+
+	return true
+}
+
+//PolygonContainsPoint returns true if the point is inside, or on the boundary of, the polygon
+func PolygonContainsPoint(polygon GeoJSONGeometry, point GeoJSONPropertyPoint) bool {
+	for _, p := range decompose(polygon).polygons {
+		if positionInPolygon(point.Coordinates, p) {
+			return true
+		}
+	}
+	return false
+}
+
+func positionInShape(p [2]float64, s *shape) bool {
+	for _, q := range s.points {
+		if equalPositions(p, q) {
+			return true
+		}
+	}
+
+	for _, line := range s.lines {
+		for _, segment := range lineSegments(line) {
+			if positionOnSegment(p, segment) {
+				return true
+			}
+		}
+	}
+
+	for _, polygon := range s.polygons {
+		if positionInPolygon(p, polygon) {
+			return true
+		}
+	}
+
+	return false
+}
+
+//Intersects returns true if two geometries have at least one position in common
+func Intersects(a, b GeoJSONGeometry) bool {
+	if !GetBoundingBox(a).Intersects(GetBoundingBox(b)) {
+		return false
+	}
+
+	sa := decompose(a)
+	sb := decompose(b)
+
+	for _, p := range sa.positions() {
+		if positionInShape(p, sb) {
+			return true
+		}
+	}
+
+	for _, p := range sb.positions() {
+		if positionInShape(p, sa) {
+			return true
+		}
+	}
+
+	for _, s1 := range sa.segments() {
+		for _, s2 := range sb.segments() {
+			if segmentsIntersect(s1, s2) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+//Disjoint returns true if two geometries do not have any positions in common
+func Disjoint(a, b GeoJSONGeometry) bool {
+	return !Intersects(a, b)
+}
+
+//Contains returns true if no position of geometry b lies outside of geometry a
+func Contains(a, b GeoJSONGeometry) bool {
+	sa := decompose(a)
+	sb := decompose(b)
+
+	if sb.dimension() < 0 || sa.dimension() < sb.dimension() {
+		return false
+	}
+
+	for _, p := range sb.positions() {
+		if !positionInShape(p, sa) {
+			return false
+		}
+	}
+
+	// All the positions of b are within a, but the segments between them may still
+	// pass outside of a if it is concave, has holes or is made up of several parts
+	for _, segment := range sb.segments() {
+		midpoint := [2]float64{(segment[0][0] + segment[1][0]) / 2, (segment[0][1] + segment[1][1]) / 2}
+		if !positionInShape(midpoint, sa) {
+			return false
+		}
+
+		if sa.dimension() == 2 {
+			for _, boundary := range sa.segments() {
+				if segmentsCross(segment, boundary) {
+					return false
+				}
+			}
+		}
+	}
+
+	// The holes of a may still lie inside of b without touching any of its positions or segments
+	if sa.dimension() == 2 && sb.dimension() == 2 {
+		for _, polygon := range sa.polygons {
+			for i := 1; i < len(polygon); i++ {
+				if ringOverlapsInterior(polygon[i], sb) {
+					return false
+				}
+			}
+		}
+	}
+
+	return true
+}
+
+//ringOverlapsInterior returns true if any part of the area enclosed by a ring lies strictly
+//inside one of the polygons of a shape. The ring is tested at its positions, at the midpoints of
+//its segments and at the average of its positions, if that lies inside of the ring.
+func ringOverlapsInterior(ring [][2]float64, s *shape) bool {
+	if len(ring) == 0 {
+		return false
+	}
+
+	candidates := append([][2]float64{}, ring...)
+
+	for _, segment := range lineSegments(ring) {
+		candidates = append(candidates, [2]float64{(segment[0][0] + segment[1][0]) / 2, (segment[0][1] + segment[1][1]) / 2})
+	}
+
+	average := [2]float64{}
+	for _, p := range ring {
+		average[0] += p[0] / float64(len(ring))
+		average[1] += p[1] / float64(len(ring))
+	}
+	if positionInRing(average, ring) {
+		candidates = append(candidates, average)
+	}
+
+	for _, p := range candidates {
+		for _, polygon := range s.polygons {
+			if positionInPolygonInterior(p, polygon) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+//positionInPolygonInterior returns true if a position is inside a polygon, but not on any of its rings
+func positionInPolygonInterior(p [2]float64, polygon [][][2]float64) bool {
+	if !positionInPolygon(p, polygon) {
+		return false
+	}
+
+	for _, ring := range polygon {
+		if positionOnRing(p, ring) {
+			return false
+		}
+	}
+
+	return true
+}
+
+//Within returns true if geometry a is contained by geometry b
+func Within(a, b GeoJSONGeometry) bool {
+	return Contains(b, a)
+}
+
+//Equals returns true if two geometries cover exactly the same positions
+func Equals(a, b GeoJSONGeometry) bool {
+	return decompose(a).dimension() == decompose(b).dimension() && Contains(a, b) && Contains(b, a)
+}
+
+//Overlaps returns true if two geometries of the same dimension intersect, without any of
+//them containing the other
+func Overlaps(a, b GeoJSONGeometry) bool {
+	if decompose(a).dimension() != decompose(b).dimension() {
+		return false
+	}
+
+	return Intersects(a, b) && !Contains(a, b) && !Contains(b, a)
+}
@@ -0,0 +1,140 @@
+package geojson
+
+import (
+	"math"
+	"testing"
+)
+
+func point(lon, lat float64) GeoJSONGeometry {
+	return CreateGeoJSONPropertyFromWGS84(lon, lat)
+}
+
+func polygon(rings ...[][2]float64) GeoJSONGeometry {
+	return &GeoJSONPropertyPolygon{Type: "Polygon", Coordinates: rings}
+}
+
+func line(positions ...[2]float64) GeoJSONGeometry {
+	return &GeoJSONPropertyLineString{Type: "LineString", Coordinates: positions}
+}
+
+func square(minLon, minLat, maxLon, maxLat float64) [][2]float64 {
+	return [][2]float64{{minLon, minLat}, {maxLon, minLat}, {maxLon, maxLat}, {minLon, maxLat}, {minLon, minLat}}
+}
+
+func TestDistance(t *testing.T) {
+	// Sundsvall to Stockholm is roughly 342 km as the crow flies
+	sundsvall := point(17.3069, 62.3908).GetAsPoint()
+	stockholm := point(18.0686, 59.3293).GetAsPoint()
+
+	distance := Distance(sundsvall, stockholm)
+	if math.Abs(distance-342000) > 5000 {
+		t.Errorf("Unexpected distance between Sundsvall and Stockholm: %f", distance)
+	}
+}
+
+func TestDistanceBetweenPointAndLine(t *testing.T) {
+	// One degree of latitude is roughly 111 km
+	road := line([2]float64{17.0, 62.0}, [2]float64{18.0, 62.0})
+	distance := DistanceBetween(point(17.5, 63.0), road)
+
+	if math.Abs(distance-111195) > 100 {
+		t.Errorf("Unexpected distance between point and line: %f", distance)
+	}
+}
+
+func TestPolygonWithHoleContainsPoint(t *testing.T) {
+	p := polygon(square(0, 0, 10, 10), square(4, 4, 6, 6))
+
+	if !PolygonContainsPoint(p, point(2, 2).GetAsPoint()) {
+		t.Error("Expected the point to be inside the polygon")
+	}
+
+	if PolygonContainsPoint(p, point(5, 5).GetAsPoint()) {
+		t.Error("Expected the point in the hole to be outside the polygon")
+	}
+
+	if !PolygonContainsPoint(p, point(10, 5).GetAsPoint()) {
+		t.Error("Expected the point on the boundary to be inside the polygon")
+	}
+}
+
+func TestSpatialPredicatesWithHoles(t *testing.T) {
+	holed := polygon(square(0, 0, 10, 10), square(4, 4, 6, 6))
+
+	testCases := []struct {
+		name      string
+		predicate func(a, b GeoJSONGeometry) bool
+		a, b      GeoJSONGeometry
+		expected  bool
+	}{
+		{"holed contains polygon around the hole", Contains, holed, polygon(square(2, 2, 8, 8)), false},
+		{"polygon around the hole within holed", Within, polygon(square(2, 2, 8, 8)), holed, false},
+		{"holed contains polygon overlapping the hole", Contains, holed, polygon(square(5, 5, 8, 8)), false},
+		{"holed contains polygon beside the hole", Contains, holed, polygon(square(1, 1, 3, 3)), true},
+		{"polygon beside the hole within holed", Within, polygon(square(1, 1, 3, 3)), holed, true},
+		{"holed contains polygon touching the hole", Contains, holed, polygon(square(1, 1, 4, 4)), true},
+		{"holed contains polygon with the same hole", Contains, holed, polygon(square(2, 2, 8, 8), square(4, 4, 6, 6)), true},
+		{"holed equals itself", Equals, holed, polygon(square(0, 0, 10, 10), square(4, 4, 6, 6)), true},
+		{"holed equals polygon without the hole", Equals, holed, polygon(square(0, 0, 10, 10)), false},
+	}
+
+	for _, tc := range testCases {
+		if tc.predicate(tc.a, tc.b) != tc.expected {
+			t.Errorf("Expected %s to be %t", tc.name, tc.expected)
+		}
+	}
+}
+
+func TestCreateGeometryRejectsEmptyMultiPolygon(t *testing.T) {
+	if _, err := CreateGeoJSONGeometry("MultiPolygon", []byte("[]")); err == nil {
+		t.Error("Expected a MultiPolygon without any polygons to be rejected")
+	}
+}
+
+func TestSpatialPredicates(t *testing.T) {
+	outer := polygon(square(0, 0, 10, 10))
+	inner := polygon(square(2, 2, 4, 4))
+	overlapping := polygon(square(8, 8, 12, 12))
+	distant := polygon(square(20, 20, 30, 30))
+	crossingLine := line([2]float64{-5, 5}, [2]float64{15, 5})
+	multiPolygon := CreateGeoJSONPropertyFromMultiPolygon([][][][]float64{
+		{{{0, 0}, {10, 0}, {10, 10}, {0, 10}, {0, 0}}},
+	})
+
+	testCases := []struct {
+		name      string
+		predicate func(a, b GeoJSONGeometry) bool
+		a, b      GeoJSONGeometry
+		expected  bool
+	}{
+		{"outer contains inner", Contains, outer, inner, true},
+		{"inner contains outer", Contains, inner, outer, false},
+		{"inner within outer", Within, inner, outer, true},
+		{"outer contains overlapping", Contains, outer, overlapping, false},
+		{"outer intersects overlapping", Intersects, outer, overlapping, true},
+		{"outer overlaps overlapping", Overlaps, outer, overlapping, true},
+		{"outer overlaps inner", Overlaps, outer, inner, false},
+		{"outer intersects distant", Intersects, outer, distant, false},
+		{"outer disjoint distant", Disjoint, outer, distant, true},
+		{"line intersects outer", Intersects, crossingLine, outer, true},
+		{"line within outer", Within, crossingLine, outer, false},
+		{"outer equals multipolygon", Equals, outer, multiPolygon, true},
+		{"outer equals inner", Equals, outer, inner, false},
+		{"multipolygon contains point", Contains, multiPolygon, point(5, 5), true},
+		{"point within geo property", Within, point(1, 1), multiPolygon, true},
+	}
+
+	for _, tc := range testCases {
+		if tc.predicate(tc.a, tc.b) != tc.expected {
+			t.Errorf("Expected %s to be %t", tc.name, tc.expected)
+		}
+	}
+}
+
+func TestGetBoundingBox(t *testing.T) {
+	bb := GetBoundingBox(line([2]float64{17.0, 62.5}, [2]float64{18.0, 62.0}, [2]float64{17.5, 63.0}))
+
+	if bb.MinLongitude != 17.0 || bb.MinLatitude != 62.0 || bb.MaxLongitude != 18.0 || bb.MaxLatitude != 63.0 {
+		t.Errorf("Unexpected bounding box: %v", bb)
+	}
+}
@@ -0,0 +1,509 @@
+package ngsi
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	//OptionSysAttrs requests that the system generated createdAt and modifiedAt are included
+	OptionSysAttrs string = "sysAttrs"
+	//OptionUpdate makes a batch upsert append attributes instead of replacing existing entities
+	OptionUpdate string = "update"
+)
+
+//NewInMemoryContextSource creates a TemporalContextSource that keeps entities, and all
+//changes to their attributes, in memory. It is intended as a reference implementation and
+//for testing. If no entity types are supplied the source accepts entities of any type.
+func NewInMemoryContextSource(entityTypes ...string) TemporalContextSource {
+	return &inMemoryContextSource{
+		id:       "urn:ngsi-ld:ContextSourceRegistration:" + uuid.New().String(),
+		types:    entityTypes,
+		entities: map[string]*inMemoryEntity{},
+		now:      time.Now,
+	}
+}
+
+type inMemoryEntity struct {
+	id         string
+	typeName   string
+	context    interface{}
+	attributes map[string][]map[string]interface{}
+	names      []string
+}
+
+type inMemoryContextSource struct {
+	id       string
+	mu       sync.RWMutex
+	types    []string
+	entities map[string]*inMemoryEntity
+	ids      []string
+	now      func() time.Time
+}
+
+func (imcs *inMemoryContextSource) RegistrationID() string {
+	return imcs.id
+}
+
+func (imcs *inMemoryContextSource) ProvidesAttribute(attributeName string) bool {
+	return true
+}
+
+func (imcs *inMemoryContextSource) ProvidesEntitiesWithMatchingID(entityID string) bool {
+	imcs.mu.RLock()
+	defer imcs.mu.RUnlock()
+
+	_, exists := imcs.entities[entityID]
+	return exists
+}
+
+func (imcs *inMemoryContextSource) ProvidesType(typeName string) bool {
+	return len(imcs.types) == 0 || containsString(imcs.types, typeName)
+}
+
+func (imcs *inMemoryContextSource) CreateEntity(typeName, entityID string, request Request) error {
+	fragment := map[string]interface{}{}
+	err := request.DecodeBodyInto(&fragment)
+	if err != nil {
+		return err
+	}
+
+	imcs.mu.Lock()
+	defer imcs.mu.Unlock()
+
+	return imcs.create(typeName, entityID, fragment)
+}
+
+func (imcs *inMemoryContextSource) create(typeName, entityID string, fragment map[string]interface{}) error {
+	if _, exists := imcs.entities[entityID]; exists {
+		return fmt.Errorf("an entity with id %s already exists", entityID)
+	}
+
+	if !imcs.ProvidesType(typeName) {
+		return fmt.Errorf("entities of type %s are not provided by this source", typeName)
+	}
+
+	entity := &inMemoryEntity{
+		id:         entityID,
+		typeName:   typeName,
+		context:    fragment["@context"],
+		attributes: map[string][]map[string]interface{}{},
+	}
+
+	imcs.entities[entityID] = entity
+	imcs.ids = append(imcs.ids, entityID)
+
+	imcs.addInstances(entity, fragment, nil)
+
+	return nil
+}
+
+//addInstances records new instances of the attributes in the fragment. If a filter is
+//supplied, only the attributes for which it returns true are added.
+func (imcs *inMemoryContextSource) addInstances(entity *inMemoryEntity, fragment map[string]interface{}, filter func(string) bool) []string {
+	now := imcs.now().UTC().Format(time.RFC3339Nano)
+	added := []string{}
+
+	for name, value := range fragment {
+		if name == "id" || name == "type" || name == "@context" {
+			continue
+		}
+
+		if filter != nil && !filter(name) {
+			continue
+		}
+
+		values, ok := value.([]interface{})
+		if !ok || len(values) == 0 || !isNormalizedAttribute(values[0]) {
+			values = []interface{}{value}
+		}
+
+		for _, v := range values {
+			instance := map[string]interface{}{}
+
+			if isNormalizedAttribute(v) {
+				for key, member := range v.(map[string]interface{}) {
+					instance[key] = member
+				}
+			} else {
+				instance["type"] = "Property"
+				instance["value"] = v
+			}
+
+			instance["instanceId"] = "urn:ngsi-ld:" + uuid.New().String()
+			instance[TemporalPropertyModifiedAt] = now
+			instance[TemporalPropertyCreatedAt] = now
+
+			if history, exists := entity.attributes[name]; exists && len(history) > 0 {
+				instance[TemporalPropertyCreatedAt] = history[0][TemporalPropertyCreatedAt]
+			} else {
+				entity.names = append(entity.names, name)
+			}
+
+			entity.attributes[name] = append(entity.attributes[name], instance)
+		}
+
+		added = append(added, name)
+	}
+
+	return added
+}
+
+func (imcs *inMemoryContextSource) AppendEntityAttributes(entityID string, request Request) (*UpdateResult, error) {
+	fragment := map[string]interface{}{}
+	err := request.DecodeBodyInto(&fragment)
+	if err != nil {
+		return nil, err
+	}
+
+	imcs.mu.Lock()
+	defer imcs.mu.Unlock()
+
+	entity, exists := imcs.entities[entityID]
+	if !exists {
+		return nil, fmt.Errorf("no entity found with id %s", entityID)
+	}
+
+	result := &UpdateResult{Updated: []string{}}
+	noOverwrite := RequestHasOption(request, OptionNoOverwrite)
+
+	result.Updated = imcs.addInstances(entity, fragment, func(name string) bool {
+		if _, exists := entity.attributes[name]; exists && noOverwrite {
+			result.NotUpdated = append(result.NotUpdated, NotUpdatedDetails{
+				AttributeName: name, Reason: "attribute already exists",
+			})
+			return false
+		}
+		return true
+	})
+
+	return result, nil
+}
+
+func (imcs *inMemoryContextSource) UpdateEntityAttributes(entityID string, request Request) error {
+	fragment := map[string]interface{}{}
+	err := request.DecodeBodyInto(&fragment)
+	if err != nil {
+		return err
+	}
+
+	imcs.mu.Lock()
+	defer imcs.mu.Unlock()
+
+	return imcs.update(entityID, fragment)
+}
+
+func (imcs *inMemoryContextSource) update(entityID string, fragment map[string]interface{}) error {
+	entity, exists := imcs.entities[entityID]
+	if !exists {
+		return fmt.Errorf("no entity found with id %s", entityID)
+	}
+
+	imcs.addInstances(entity, fragment, func(name string) bool {
+		_, exists := entity.attributes[name]
+		return exists
+	})
+
+	return nil
+}
+
+func (imcs *inMemoryContextSource) DeleteEntity(entityID string, request Request) error {
+	imcs.mu.Lock()
+	defer imcs.mu.Unlock()
+
+	return imcs.delete(entityID)
+}
+
+func (imcs *inMemoryContextSource) delete(entityID string) error {
+	if _, exists := imcs.entities[entityID]; !exists {
+		return fmt.Errorf("no entity found with id %s", entityID)
+	}
+
+	delete(imcs.entities, entityID)
+
+	for idx, id := range imcs.ids {
+		if id == entityID {
+			imcs.ids = append(imcs.ids[:idx], imcs.ids[idx+1:]...)
+			break
+		}
+	}
+
+	return nil
+}
+
+func (imcs *inMemoryContextSource) GetEntities(query Query, callback QueryEntitiesCallback) error {
+	sysAttrs := RequestHasOption(newRequestWrapper(query.Request()), OptionSysAttrs)
+
+	for _, entity := range imcs.snapshot() {
+		current := entity.current(sysAttrs)
+
+		matches, err := EntityMatchesQuery(query, current)
+		if err != nil {
+			return err
+		}
+
+		if matches {
+			err = callback(current)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (imcs *inMemoryContextSource) RetrieveEntity(entityID string, request Request) (Entity, error) {
+	imcs.mu.RLock()
+	defer imcs.mu.RUnlock()
+
+	entity, exists := imcs.entities[entityID]
+	if !exists {
+		return nil, fmt.Errorf("no entity found with id %s", entityID)
+	}
+
+	return entity.current(RequestHasOption(request, OptionSysAttrs)), nil
+}
+
+func (imcs *inMemoryContextSource) GetTemporalEntities(query Query, callback QueryEntitiesCallback) error {
+	sysAttrs := RequestHasOption(newRequestWrapper(query.Request()), OptionSysAttrs)
+
+	for _, entity := range imcs.snapshot() {
+		matches, err := EntityMatchesQuery(query, entity.current(false))
+		if err != nil {
+			return err
+		}
+
+		if !matches {
+			continue
+		}
+
+		temporalEntity, instanceCount := entity.temporal(query, sysAttrs)
+		if instanceCount > 0 {
+			err = callback(temporalEntity)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (imcs *inMemoryContextSource) RetrieveTemporalEntity(entityID string, query Query) (Entity, error) {
+	imcs.mu.RLock()
+	defer imcs.mu.RUnlock()
+
+	entity, exists := imcs.entities[entityID]
+	if !exists {
+		return nil, nil
+	}
+
+	temporalEntity, _ := entity.temporal(query, RequestHasOption(newRequestWrapper(query.Request()), OptionSysAttrs))
+	return temporalEntity, nil
+}
+
+func (imcs *inMemoryContextSource) CreateEntities(request Request) (*BatchOperationResult, error) {
+	return imcs.executeBatch(request, func(fragment map[string]interface{}) error {
+		typeName, _ := fragment["type"].(string)
+		entityID, _ := fragment["id"].(string)
+		return imcs.create(typeName, entityID, fragment)
+	})
+}
+
+func (imcs *inMemoryContextSource) UpsertEntities(request Request) (*BatchOperationResult, error) {
+	replace := !RequestHasOption(request, OptionUpdate)
+
+	return imcs.executeBatch(request, func(fragment map[string]interface{}) error {
+		typeName, _ := fragment["type"].(string)
+		entityID, _ := fragment["id"].(string)
+
+		entity, exists := imcs.entities[entityID]
+		if !exists {
+			return imcs.create(typeName, entityID, fragment)
+		}
+
+		if replace {
+			for _, name := range entity.names {
+				if _, supplied := fragment[name]; !supplied {
+					delete(entity.attributes, name)
+				}
+			}
+			entity.names = entity.attributeNames()
+		}
+
+		imcs.addInstances(entity, fragment, nil)
+		return nil
+	})
+}
+
+func (imcs *inMemoryContextSource) UpdateEntities(request Request) (*BatchOperationResult, error) {
+	return imcs.executeBatch(request, func(fragment map[string]interface{}) error {
+		entityID, _ := fragment["id"].(string)
+		return imcs.update(entityID, fragment)
+	})
+}
+
+func (imcs *inMemoryContextSource) DeleteEntities(request Request) (*BatchOperationResult, error) {
+	entityIDs := []string{}
+	err := request.DecodeBodyInto(&entityIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	imcs.mu.Lock()
+	defer imcs.mu.Unlock()
+
+	result := &BatchOperationResult{Success: []string{}, Errors: []BatchEntityError{}}
+
+	for _, entityID := range entityIDs {
+		err = imcs.delete(entityID)
+		result.add(entityID, err)
+	}
+
+	return result, nil
+}
+
+func (imcs *inMemoryContextSource) executeBatch(request Request, operation func(map[string]interface{}) error) (*BatchOperationResult, error) {
+	fragments := []map[string]interface{}{}
+	err := request.DecodeBodyInto(&fragments)
+	if err != nil {
+		return nil, err
+	}
+
+	imcs.mu.Lock()
+	defer imcs.mu.Unlock()
+
+	result := &BatchOperationResult{Success: []string{}, Errors: []BatchEntityError{}}
+
+	for _, fragment := range fragments {
+		entityID, _ := fragment["id"].(string)
+		result.add(entityID, operation(fragment))
+	}
+
+	return result, nil
+}
+
+//snapshot returns copies of all entities so that they can be examined without holding the lock
+func (imcs *inMemoryContextSource) snapshot() []*inMemoryEntity {
+	imcs.mu.RLock()
+	defer imcs.mu.RUnlock()
+
+	entities := []*inMemoryEntity{}
+
+	for _, id := range imcs.ids {
+		entity := imcs.entities[id]
+
+		clone := &inMemoryEntity{
+			id:         entity.id,
+			typeName:   entity.typeName,
+			context:    entity.context,
+			attributes: map[string][]map[string]interface{}{},
+			names:      append([]string{}, entity.names...),
+		}
+
+		for name, history := range entity.attributes {
+			clone.attributes[name] = append([]map[string]interface{}{}, history...)
+		}
+
+		entities = append(entities, clone)
+	}
+
+	return entities
+}
+
+func (e *inMemoryEntity) attributeNames() []string {
+	names := []string{}
+	for _, name := range e.names {
+		if _, exists := e.attributes[name]; exists {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func (e *inMemoryEntity) newEntityMap() map[string]interface{} {
+	entity := map[string]interface{}{"id": e.id, "type": e.typeName}
+	if e.context != nil {
+		entity["@context"] = e.context
+	}
+	return entity
+}
+
+//current returns the entity with the latest instance of each of its attributes
+func (e *inMemoryEntity) current(sysAttrs bool) map[string]interface{} {
+	entity := e.newEntityMap()
+
+	for name, history := range e.attributes {
+		if len(history) > 0 {
+			entity[name] = outputInstance(history[len(history)-1], sysAttrs)
+		}
+	}
+
+	return entity
+}
+
+//temporal returns the entity in the temporal representation together with the number of
+//attribute instances that matched the temporal query
+func (e *inMemoryEntity) temporal(query Query, sysAttrs bool) (map[string]interface{}, int) {
+	entity := e.newEntityMap()
+
+	tq := query.Temporal()
+	if tq == nil {
+		tq = &TemporalQuery{TimeProperty: TemporalPropertyObservedAt}
+	}
+
+	instanceCount := 0
+
+	for name, history := range e.attributes {
+		if !attributeRequested(query.EntityAttributes(), name) {
+			continue
+		}
+
+		instances := tq.FilterInstances(history)
+		if len(instances) == 0 {
+			continue
+		}
+
+		output := []interface{}{}
+		for _, instance := range instances {
+			output = append(output, outputInstance(instance, sysAttrs, "instanceId", tq.TimeProperty))
+		}
+
+		entity[name] = output
+		instanceCount += len(instances)
+	}
+
+	return entity, instanceCount
+}
+
+func attributeRequested(attributes []string, name string) bool {
+	for _, attribute := range attributes {
+		if attribute == "" || attribute == name {
+			return true
+		}
+	}
+	return len(attributes) == 0
+}
+
+//outputInstance removes the instance id and the system generated timestamps from an attribute
+//instance, unless sysAttrs is requested or they are explicitly kept
+func outputInstance(instance map[string]interface{}, sysAttrs bool, keep ...string) map[string]interface{} {
+	output := map[string]interface{}{}
+
+	for key, value := range instance {
+		switch key {
+		case "instanceId", TemporalPropertyCreatedAt, TemporalPropertyModifiedAt:
+			if !sysAttrs && !containsString(keep, key) {
+				continue
+			}
+		}
+
+		output[key] = value
+	}
+
+	return output
+}
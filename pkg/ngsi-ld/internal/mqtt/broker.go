@@ -0,0 +1,255 @@
+package mqtt
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"sync"
+)
+
+//ReceivedMessage is a message that has been published to an embedded Broker
+type ReceivedMessage struct {
+	Message
+
+	ClientID        string
+	Username        string
+	ProtocolVersion byte
+}
+
+//Broker is a minimal embedded MQTT broker that accepts connections from publishers and
+//makes the published messages available on a channel. It does not support subscriptions
+//and only exists to test the publishing of notifications.
+type Broker struct {
+	listener net.Listener
+	messages chan ReceivedMessage
+	closing  chan struct{}
+	once     sync.Once
+	wg       sync.WaitGroup
+}
+
+//NewBroker creates a new Broker that listens for connections on the supplied address.
+//Use 127.0.0.1:0 to let the system choose an available port.
+func NewBroker(address string) (*Broker, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &Broker{
+		listener: listener,
+		messages: make(chan ReceivedMessage, 64),
+		closing:  make(chan struct{}),
+	}
+
+	b.wg.Add(1)
+	go b.acceptConnections()
+
+	return b, nil
+}
+
+//URL returns an mqtt:// url that can be used to connect to the broker
+func (b *Broker) URL() string {
+	return "mqtt://" + b.listener.Addr().String()
+}
+
+//Messages returns a channel that receives all messages published to the broker
+func (b *Broker) Messages() <-chan ReceivedMessage {
+	return b.messages
+}
+
+//Close stops the broker and waits for all connections to be closed
+func (b *Broker) Close() error {
+	var err error
+
+	b.once.Do(func() {
+		close(b.closing)
+		err = b.listener.Close()
+		b.wg.Wait()
+	})
+
+	return err
+}
+
+func (b *Broker) acceptConnections() {
+	defer b.wg.Done()
+
+	for {
+		conn, err := b.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		b.wg.Add(1)
+		go b.serve(conn)
+	}
+}
+
+func (b *Broker) serve(conn net.Conn) {
+	defer b.wg.Done()
+	defer conn.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		select {
+		case <-b.closing:
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	reader := bufio.NewReader(conn)
+
+	p, err := readPacket(reader)
+	if err != nil || p.packetType != packetConnect {
+		return
+	}
+
+	session, err := parseConnect(p.body)
+	if err != nil {
+		return
+	}
+
+	connack := []byte{0, 0}
+	if session.ProtocolVersion == ProtocolVersion5 {
+		connack = appendProperties(connack, properties{})
+	}
+
+	if writePacket(conn, packetConnAck, 0, connack) != nil {
+		return
+	}
+
+	for {
+		p, err := readPacket(reader)
+		if err != nil {
+			return
+		}
+
+		switch p.packetType {
+		case packetPublish:
+			msg, packetID, err := parsePublish(p, session.ProtocolVersion)
+			if err != nil {
+				return
+			}
+
+			session.Message = msg
+
+			select {
+			case b.messages <- session:
+			case <-b.closing:
+				return
+			}
+
+			if msg.QoS == 1 {
+				writePacket(conn, packetPubAck, 0, appendUint16([]byte{}, packetID))
+			} else if msg.QoS == 2 {
+				writePacket(conn, packetPubRec, 0, appendUint16([]byte{}, packetID))
+			}
+		case packetPubRel:
+			writePacket(conn, packetPubComp, 0, p.body[:2])
+		case packetPingReq:
+			writePacket(conn, packetPingResp, 0, []byte{})
+		case packetDisconnect:
+			return
+		default:
+			return
+		}
+	}
+}
+
+//parseConnect returns a ReceivedMessage with the client information from a CONNECT packet
+func parseConnect(body []byte) (ReceivedMessage, error) {
+	session := ReceivedMessage{}
+	r := newPacketReader(body)
+
+	protocolName, err := r.readString()
+	if err != nil || protocolName != "MQTT" {
+		return session, fmt.Errorf("unsupported protocol %s", protocolName)
+	}
+
+	session.ProtocolVersion, err = r.ReadByte()
+	if err != nil {
+		return session, err
+	}
+
+	if session.ProtocolVersion != ProtocolVersion311 && session.ProtocolVersion != ProtocolVersion5 {
+		return session, fmt.Errorf("unsupported protocol version %d", session.ProtocolVersion)
+	}
+
+	flags, err := r.ReadByte()
+	if err != nil {
+		return session, err
+	}
+
+	_, err = r.readUint16() // keep alive
+	if err != nil {
+		return session, err
+	}
+
+	if session.ProtocolVersion == ProtocolVersion5 {
+		if _, err = r.readProperties(); err != nil {
+			return session, err
+		}
+	}
+
+	session.ClientID, err = r.readString()
+	if err != nil {
+		return session, err
+	}
+
+	if flags&0x04 != 0 {
+		// Skip the will properties, topic and message
+		if session.ProtocolVersion == ProtocolVersion5 {
+			if _, err = r.readProperties(); err != nil {
+				return session, err
+			}
+		}
+		r.readString()
+		r.readBinary()
+	}
+
+	if flags&0x80 != 0 {
+		session.Username, err = r.readString()
+	}
+
+	return session, err
+}
+
+func parsePublish(p *packet, version byte) (Message, uint16, error) {
+	msg := Message{
+		QoS:    (p.flags >> 1) & 0x03,
+		Retain: p.flags&0x01 != 0,
+	}
+
+	r := newPacketReader(p.body)
+
+	var err error
+	var packetID uint16
+
+	msg.Topic, err = r.readString()
+	if err != nil {
+		return msg, 0, err
+	}
+
+	if msg.QoS > 0 {
+		packetID, err = r.readUint16()
+		if err != nil {
+			return msg, 0, err
+		}
+	}
+
+	if version == ProtocolVersion5 {
+		props, err := r.readProperties()
+		if err != nil {
+			return msg, 0, err
+		}
+		msg.ContentType = props.contentType
+		msg.UserProperties = props.userProperties
+	}
+
+	msg.Payload = make([]byte, r.Len())
+	r.Read(msg.Payload)
+
+	return msg, packetID, nil
+}
@@ -0,0 +1,264 @@
+package mqtt
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+//Message is an application message to be published to an MQTT broker
+type Message struct {
+	Topic   string
+	QoS     byte
+	Retain  bool
+	Payload []byte
+
+	//ContentType and UserProperties are only sent when publishing with MQTT 5
+	ContentType    string
+	UserProperties []UserProperty
+}
+
+//Config contains the settings used when connecting to a broker
+type Config struct {
+	//ProtocolVersion is either ProtocolVersion311 or ProtocolVersion5 (default)
+	ProtocolVersion byte
+	//ClientID is generated if not supplied
+	ClientID string
+	//Timeout limits the total time spent connecting to the broker and publishing
+	Timeout time.Duration
+	//TLSConfig is used when connecting to mqtts:// brokers
+	TLSConfig *tls.Config
+}
+
+//TopicFromURL returns the topic that is part of an mqtt:// or mqtts:// uri
+func TopicFromURL(u *url.URL) string {
+	return strings.TrimPrefix(u.Path, "/")
+}
+
+//Publish connects to the broker in the supplied mqtt:// or mqtts:// uri, publishes a
+//message and disconnects again. If the message does not specify a topic, the topic is
+//taken from the path of the uri. Publish waits for the broker to acknowledge messages
+//with QoS 1 and 2 before returning.
+//
+//Only the parts of the protocol that are needed to publish notifications are implemented, which
+//keeps the module free from third party MQTT clients. The package is internal so that it can be
+//replaced by an established client without affecting users of the module.
+func Publish(brokerURL string, message Message, config Config) error {
+	u, err := url.Parse(brokerURL)
+	if err != nil {
+		return fmt.Errorf("invalid broker url: %s", err.Error())
+	}
+
+	if message.Topic == "" {
+		message.Topic = TopicFromURL(u)
+	}
+
+	if message.Topic == "" {
+		return fmt.Errorf("no topic to publish to")
+	}
+
+	if message.QoS > 2 {
+		return fmt.Errorf("invalid qos %d", message.QoS)
+	}
+
+	if config.ProtocolVersion == 0 {
+		config.ProtocolVersion = ProtocolVersion5
+	}
+
+	if config.ProtocolVersion != ProtocolVersion311 && config.ProtocolVersion != ProtocolVersion5 {
+		return fmt.Errorf("unsupported protocol version %d", config.ProtocolVersion)
+	}
+
+	if config.Timeout == 0 {
+		config.Timeout = 10 * time.Second
+	}
+
+	if config.ClientID == "" {
+		config.ClientID = "ngsi-" + strings.Replace(uuid.New().String(), "-", "", -1)[:16]
+	}
+
+	conn, err := dial(u, config)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(config.Timeout))
+
+	c := &client{conn: conn, reader: bufio.NewReader(conn), version: config.ProtocolVersion}
+
+	err = c.connect(u, config.ClientID)
+	if err != nil {
+		return err
+	}
+
+	err = c.publish(message)
+	if err != nil {
+		return err
+	}
+
+	return writePacket(c.conn, packetDisconnect, 0, []byte{})
+}
+
+func dial(u *url.URL, config Config) (net.Conn, error) {
+	host := u.Host
+
+	switch u.Scheme {
+	case "mqtt":
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "1883")
+		}
+		return net.DialTimeout("tcp", host, config.Timeout)
+	case "mqtts":
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "8883")
+		}
+		dialer := &net.Dialer{Timeout: config.Timeout}
+		return tls.DialWithDialer(dialer, "tcp", host, config.TLSConfig)
+	}
+
+	return nil, fmt.Errorf("unsupported scheme %s", u.Scheme)
+}
+
+type client struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	version byte
+}
+
+func (c *client) connect(u *url.URL, clientID string) error {
+	body := appendString([]byte{}, "MQTT")
+	body = append(body, c.version)
+
+	// Always request a clean session since no state is kept between publications
+	flags := byte(0x02)
+
+	username := ""
+	password, hasPassword := "", false
+
+	if u.User != nil {
+		username = u.User.Username()
+		password, hasPassword = u.User.Password()
+		flags |= 0x80
+		if hasPassword {
+			flags |= 0x40
+		}
+	}
+
+	body = append(body, flags)
+	body = appendUint16(body, 30)
+
+	if c.version == ProtocolVersion5 {
+		body = appendProperties(body, properties{})
+	}
+
+	body = appendString(body, clientID)
+
+	if u.User != nil {
+		body = appendString(body, username)
+		if hasPassword {
+			body = appendString(body, password)
+		}
+	}
+
+	err := writePacket(c.conn, packetConnect, 0, body)
+	if err != nil {
+		return fmt.Errorf("failed to send connect packet: %s", err.Error())
+	}
+
+	p, err := c.expect(packetConnAck)
+	if err != nil {
+		return err
+	}
+
+	if len(p.body) < 2 {
+		return fmt.Errorf("malformed connack packet")
+	}
+
+	if p.body[1] != 0 {
+		return fmt.Errorf("connection refused by broker with reason code %d", p.body[1])
+	}
+
+	return nil
+}
+
+func (c *client) publish(message Message) error {
+	const packetID uint16 = 1
+
+	flags := message.QoS << 1
+	if message.Retain {
+		flags |= 0x01
+	}
+
+	body := appendString([]byte{}, message.Topic)
+
+	if message.QoS > 0 {
+		body = appendUint16(body, packetID)
+	}
+
+	if c.version == ProtocolVersion5 {
+		body = appendProperties(body, properties{
+			contentType:    message.ContentType,
+			userProperties: message.UserProperties,
+		})
+	}
+
+	body = append(body, message.Payload...)
+
+	err := writePacket(c.conn, packetPublish, flags, body)
+	if err != nil {
+		return fmt.Errorf("failed to send publish packet: %s", err.Error())
+	}
+
+	switch message.QoS {
+	case 1:
+		_, err = c.expectAcknowledgement(packetPubAck)
+	case 2:
+		_, err = c.expectAcknowledgement(packetPubRec)
+		if err == nil {
+			err = writePacket(c.conn, packetPubRel, 0x02, appendUint16([]byte{}, packetID))
+			if err == nil {
+				_, err = c.expectAcknowledgement(packetPubComp)
+			}
+		}
+	}
+
+	return err
+}
+
+func (c *client) expect(packetType byte) (*packet, error) {
+	for {
+		p, err := readPacket(c.reader)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read from broker: %s", err.Error())
+		}
+
+		if p.packetType == packetType {
+			return p, nil
+		}
+
+		if p.packetType != packetPingResp {
+			return nil, fmt.Errorf("unexpected packet type %d from broker, expected %d", p.packetType, packetType)
+		}
+	}
+}
+
+//expectAcknowledgement waits for a PUBACK, PUBREC or PUBCOMP and checks its reason code
+func (c *client) expectAcknowledgement(packetType byte) (*packet, error) {
+	p, err := c.expect(packetType)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(p.body) > 2 && p.body[2] >= 0x80 {
+		return nil, fmt.Errorf("message rejected by broker with reason code %d", p.body[2])
+	}
+
+	return p, nil
+}
@@ -0,0 +1,103 @@
+package mqtt
+
+import (
+	"testing"
+	"time"
+)
+
+func publishAndReceive(t *testing.T, url string, message Message, config Config) *ReceivedMessage {
+	broker, err := NewBroker("127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Failed to start broker: ", err.Error())
+	}
+	defer broker.Close()
+
+	err = Publish(broker.URL()+url, message, config)
+	if err != nil {
+		t.Error("Publish failed: ", err.Error())
+		return nil
+	}
+
+	select {
+	case received := <-broker.Messages():
+		return &received
+	case <-time.After(5 * time.Second):
+		t.Error("No message received by the broker.")
+	}
+
+	return nil
+}
+
+func TestPublishWithMQTT5UserProperties(t *testing.T) {
+	message := Message{
+		QoS:            1,
+		Payload:        []byte(`{"id":"urn:ngsi-ld:Notification:1"}`),
+		ContentType:    "application/json",
+		UserProperties: []UserProperty{{Key: "x-tenant", Value: "city"}},
+	}
+
+	received := publishAndReceive(t, "/notifications/weather", message, Config{})
+	if received == nil {
+		return
+	}
+
+	if received.Topic != "notifications/weather" || received.QoS != 1 || received.ProtocolVersion != ProtocolVersion5 {
+		t.Error("Unexpected message received: ", received.Topic, received.QoS, received.ProtocolVersion)
+	}
+
+	if len(received.UserProperties) != 1 || received.UserProperties[0].Value != "city" {
+		t.Error("User properties not received as expected: ", received.UserProperties)
+	}
+
+	if received.ContentType != "application/json" || string(received.Payload) != string(message.Payload) {
+		t.Error("Unexpected content received: ", received.ContentType, string(received.Payload))
+	}
+}
+
+func TestPublishWithMQTT311AndQoS2(t *testing.T) {
+	message := Message{QoS: 2, Payload: []byte("hello")}
+
+	received := publishAndReceive(t, "/test", message, Config{ProtocolVersion: ProtocolVersion311})
+	if received == nil {
+		return
+	}
+
+	if received.ProtocolVersion != ProtocolVersion311 || received.QoS != 2 || string(received.Payload) != "hello" {
+		t.Error("Unexpected message received: ", received.ProtocolVersion, received.QoS, string(received.Payload))
+	}
+}
+
+func TestPublishSendsCredentialsFromURL(t *testing.T) {
+	broker, _ := NewBroker("127.0.0.1:0")
+	defer broker.Close()
+
+	url := "mqtt://user:secret@" + broker.URL()[len("mqtt://"):] + "/test"
+
+	err := Publish(url, Message{Payload: []byte("hello")}, Config{})
+	if err != nil {
+		t.Error("Publish failed: ", err.Error())
+		return
+	}
+
+	received := <-broker.Messages()
+	if received.Username != "user" {
+		t.Error("Unexpected username received: ", received.Username)
+	}
+}
+
+func TestPublishWithoutTopicFails(t *testing.T) {
+	err := Publish("mqtt://127.0.0.1:1", Message{Payload: []byte("hello")}, Config{})
+	if err == nil {
+		t.Error("Publish without a topic should fail.")
+	}
+}
+
+func TestVarIntEncoding(t *testing.T) {
+	for _, value := range []int{0, 127, 128, 16383, 16384, 268435455} {
+		encoded := appendVarInt([]byte{}, value)
+		decoded, err := readVarInt(newPacketReader(encoded))
+		if err != nil || decoded != value {
+			t.Error("Variable byte integer not encoded correctly. ", decoded, " != ", value)
+		}
+	}
+}
@@ -0,0 +1,256 @@
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const (
+	//ProtocolVersion311 is the protocol level used by MQTT 3.1.1
+	ProtocolVersion311 byte = 4
+	//ProtocolVersion5 is the protocol level used by MQTT 5.0
+	ProtocolVersion5 byte = 5
+)
+
+const (
+	packetConnect    byte = 1
+	packetConnAck    byte = 2
+	packetPublish    byte = 3
+	packetPubAck     byte = 4
+	packetPubRec     byte = 5
+	packetPubRel     byte = 6
+	packetPubComp    byte = 7
+	packetPingReq    byte = 12
+	packetPingResp   byte = 13
+	packetDisconnect byte = 14
+)
+
+const (
+	propertyPayloadFormat        byte = 0x01
+	propertyMessageExpiry        byte = 0x02
+	propertyContentType          byte = 0x03
+	propertyResponseTopic        byte = 0x08
+	propertyCorrelationData      byte = 0x09
+	propertySubscriptionID       byte = 0x0B
+	propertySessionExpiry        byte = 0x11
+	propertyAssignedClientID     byte = 0x12
+	propertyServerKeepAlive      byte = 0x13
+	propertyReasonString         byte = 0x1F
+	propertyReceiveMaximum       byte = 0x21
+	propertyTopicAliasMaximum    byte = 0x22
+	propertyTopicAlias           byte = 0x23
+	propertyMaximumQoS           byte = 0x24
+	propertyRetainAvailable      byte = 0x25
+	propertyUserProperty         byte = 0x26
+	propertyMaximumPacketSize    byte = 0x27
+	propertyWildcardAvailable    byte = 0x28
+	propertySubscriptionIDAvail  byte = 0x29
+	propertySharedSubscriptionOK byte = 0x2A
+)
+
+//UserProperty is a key/value pair that is sent along with an MQTT 5 message
+type UserProperty struct {
+	Key   string
+	Value string
+}
+
+//packet is a decoded MQTT control packet
+type packet struct {
+	packetType byte
+	flags      byte
+	body       []byte
+}
+
+func writePacket(w io.Writer, packetType, flags byte, body []byte) error {
+	header := []byte{packetType<<4 | flags}
+	header = appendVarInt(header, len(body))
+
+	_, err := w.Write(append(header, body...))
+	return err
+}
+
+func readPacket(r *bufio.Reader) (*packet, error) {
+	first, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	length, err := readVarInt(r)
+	if err != nil {
+		return nil, err
+	}
+
+	body := make([]byte, length)
+	_, err = io.ReadFull(r, body)
+	if err != nil {
+		return nil, err
+	}
+
+	return &packet{packetType: first >> 4, flags: first & 0x0F, body: body}, nil
+}
+
+func appendVarInt(b []byte, value int) []byte {
+	for {
+		encoded := byte(value % 128)
+		value = value / 128
+		if value > 0 {
+			encoded |= 0x80
+		}
+		b = append(b, encoded)
+		if value == 0 {
+			return b
+		}
+	}
+}
+
+func readVarInt(r io.ByteReader) (int, error) {
+	value := 0
+	multiplier := 1
+
+	for i := 0; i < 4; i++ {
+		encoded, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+
+		value += int(encoded&0x7F) * multiplier
+		if encoded&0x80 == 0 {
+			return value, nil
+		}
+
+		multiplier *= 128
+	}
+
+	return 0, fmt.Errorf("malformed variable byte integer")
+}
+
+func appendString(b []byte, s string) []byte {
+	return appendBinary(b, []byte(s))
+}
+
+func appendBinary(b []byte, data []byte) []byte {
+	b = appendUint16(b, uint16(len(data)))
+	return append(b, data...)
+}
+
+func appendUint16(b []byte, value uint16) []byte {
+	return append(b, byte(value>>8), byte(value))
+}
+
+//packetReader decodes the fields of a packet body
+type packetReader struct {
+	*bytes.Reader
+}
+
+func newPacketReader(body []byte) *packetReader {
+	return &packetReader{Reader: bytes.NewReader(body)}
+}
+
+func (pr *packetReader) readUint16() (uint16, error) {
+	var value uint16
+	err := binary.Read(pr, binary.BigEndian, &value)
+	return value, err
+}
+
+func (pr *packetReader) readUint32() (uint32, error) {
+	var value uint32
+	err := binary.Read(pr, binary.BigEndian, &value)
+	return value, err
+}
+
+func (pr *packetReader) readBinary() ([]byte, error) {
+	length, err := pr.readUint16()
+	if err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, length)
+	_, err = io.ReadFull(pr, data)
+	return data, err
+}
+
+func (pr *packetReader) readString() (string, error) {
+	data, err := pr.readBinary()
+	return string(data), err
+}
+
+//properties contains the MQTT 5 properties that are used by this package
+type properties struct {
+	contentType    string
+	userProperties []UserProperty
+}
+
+func appendProperties(b []byte, props properties) []byte {
+	encoded := []byte{}
+
+	if props.contentType != "" {
+		encoded = append(encoded, propertyContentType)
+		encoded = appendString(encoded, props.contentType)
+	}
+
+	for _, up := range props.userProperties {
+		encoded = append(encoded, propertyUserProperty)
+		encoded = appendString(encoded, up.Key)
+		encoded = appendString(encoded, up.Value)
+	}
+
+	b = appendVarInt(b, len(encoded))
+	return append(b, encoded...)
+}
+
+func (pr *packetReader) readProperties() (properties, error) {
+	props := properties{}
+
+	length, err := readVarInt(pr)
+	if err != nil {
+		return props, err
+	}
+
+	data := make([]byte, length)
+	_, err = io.ReadFull(pr, data)
+	if err != nil {
+		return props, err
+	}
+
+	r := newPacketReader(data)
+
+	for r.Len() > 0 {
+		identifier, _ := r.ReadByte()
+
+		switch identifier {
+		case propertyPayloadFormat, propertyMaximumQoS, propertyRetainAvailable, propertyWildcardAvailable,
+			propertySubscriptionIDAvail, propertySharedSubscriptionOK:
+			_, err = r.ReadByte()
+		case propertyServerKeepAlive, propertyReceiveMaximum, propertyTopicAliasMaximum, propertyTopicAlias:
+			_, err = r.readUint16()
+		case propertyMessageExpiry, propertySessionExpiry, propertyMaximumPacketSize:
+			_, err = r.readUint32()
+		case propertySubscriptionID:
+			_, err = readVarInt(r)
+		case propertyResponseTopic, propertyAssignedClientID, propertyReasonString:
+			_, err = r.readString()
+		case propertyCorrelationData:
+			_, err = r.readBinary()
+		case propertyContentType:
+			props.contentType, err = r.readString()
+		case propertyUserProperty:
+			up := UserProperty{}
+			up.Key, err = r.readString()
+			if err == nil {
+				up.Value, err = r.readString()
+				props.userProperties = append(props.userProperties, up)
+			}
+		default:
+			return props, fmt.Errorf("unsupported property identifier 0x%02X", identifier)
+		}
+
+		if err != nil {
+			return props, fmt.Errorf("malformed property 0x%02X: %s", identifier, err.Error())
+		}
+	}
+
+	return props, nil
+}
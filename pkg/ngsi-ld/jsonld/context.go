@@ -0,0 +1,280 @@
+package jsonld
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+//maxContextDepth limits how deeply remote contexts may refer to other remote contexts
+const maxContextDepth int = 8
+
+//Context is a processed JSON-LD @context that maps terms to IRIs
+type Context struct {
+	terms map[string]string
+	vocab string
+
+	//inverse maps IRIs to the terms that expand to them
+	inverse map[string]string
+}
+
+var coreContext *Context
+
+func init() {
+	document := struct {
+		Context interface{} `json:"@context"`
+	}{}
+
+	err := json.Unmarshal([]byte(coreContextDocument), &document)
+	if err != nil {
+		panic("the bundled core context is invalid: " + err.Error())
+	}
+
+	coreContext, err = NewContext(document.Context, nil)
+	if err != nil {
+		panic("the bundled core context is invalid: " + err.Error())
+	}
+}
+
+//CoreContext returns the bundled NGSI-LD core context
+func CoreContext() *Context {
+	return coreContext
+}
+
+//NewContext processes the value of a @context member on top of the core context. The value may
+//be a URL, an object with term definitions or an array of those. Remote contexts, other than the
+//core context, are retrieved with the supplied loader, or with DefaultLoader if loader is nil.
+func NewContext(value interface{}, loader Loader) (*Context, error) {
+	if loader == nil {
+		loader = DefaultLoader
+	}
+
+	ctx := &Context{terms: map[string]string{}}
+	if coreContext != nil {
+		for term, iri := range coreContext.terms {
+			ctx.terms[term] = iri
+		}
+		ctx.vocab = coreContext.vocab
+	}
+
+	err := ctx.process(value, loader, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx.resolveTerms()
+
+	return ctx, nil
+}
+
+func (c *Context) process(value interface{}, loader Loader, depth int) error {
+	if depth > maxContextDepth {
+		return fmt.Errorf("too many nested remote contexts")
+	}
+
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case string:
+		return c.processRemote(v, loader, depth)
+	case []interface{}:
+		for _, item := range v {
+			if err := c.process(item, loader, depth); err != nil {
+				return err
+			}
+		}
+		return nil
+	case map[string]interface{}:
+		return c.processDefinitions(v)
+	}
+
+	return fmt.Errorf("invalid @context value of type %T", value)
+}
+
+func (c *Context) processRemote(url string, loader Loader, depth int) error {
+	if coreContextURLs[url] {
+		return nil
+	}
+
+	data, err := loader(url)
+	if err != nil {
+		return &LoadError{URL: url, Err: err}
+	}
+
+	document := struct {
+		Context interface{} `json:"@context"`
+	}{}
+
+	err = json.Unmarshal(data, &document)
+	if err != nil || document.Context == nil {
+		return &LoadError{URL: url, Err: fmt.Errorf("the document does not contain a @context")}
+	}
+
+	return c.process(document.Context, loader, depth+1)
+}
+
+func (c *Context) processDefinitions(definitions map[string]interface{}) error {
+	for term, definition := range definitions {
+		if term == "@vocab" {
+			vocab, _ := definition.(string)
+			c.vocab = vocab
+			continue
+		}
+
+		if strings.HasPrefix(term, "@") {
+			continue
+		}
+
+		switch d := definition.(type) {
+		case nil:
+			delete(c.terms, term)
+		case string:
+			c.terms[term] = d
+		case map[string]interface{}:
+			id, ok := d["@id"].(string)
+			if !ok {
+				return fmt.Errorf("the definition of term %s has no @id", term)
+			}
+			c.terms[term] = id
+		default:
+			return fmt.Errorf("invalid definition of term %s", term)
+		}
+	}
+
+	return nil
+}
+
+//resolveTerms expands compact IRIs and references to other terms in the term definitions, and
+//builds the inverse map that is used when compacting
+func (c *Context) resolveTerms() {
+	for i := 0; i < maxContextDepth; i++ {
+		changed := false
+
+		for term, iri := range c.terms {
+			resolved := c.resolve(iri)
+			if resolved != iri && resolved != term {
+				c.terms[term] = resolved
+				changed = true
+			}
+		}
+
+		if !changed {
+			break
+		}
+	}
+
+	// Definitions that are neither IRIs nor keywords are relative to the vocabulary
+	for term, iri := range c.terms {
+		if c.vocab != "" && !strings.Contains(iri, ":") && !strings.HasPrefix(iri, "@") {
+			c.terms[term] = c.vocab + iri
+		}
+	}
+
+	c.inverse = map[string]string{}
+
+	terms := make([]string, 0, len(c.terms))
+	for term := range c.terms {
+		terms = append(terms, term)
+	}
+
+	// Shorter terms are preferred when several terms expand to the same IRI
+	sort.Slice(terms, func(i, j int) bool {
+		if len(terms[i]) != len(terms[j]) {
+			return len(terms[i]) < len(terms[j])
+		}
+		return terms[i] < terms[j]
+	})
+
+	for _, term := range terms {
+		iri := c.terms[term]
+		if _, exists := c.inverse[iri]; !exists {
+			c.inverse[iri] = term
+		}
+	}
+}
+
+func (c *Context) resolve(value string) string {
+	if strings.HasPrefix(value, "@") {
+		return value
+	}
+
+	if idx := strings.Index(value, ":"); idx > 0 {
+		prefix, suffix := value[:idx], value[idx+1:]
+		if strings.HasPrefix(suffix, "//") {
+			return value
+		}
+		if iri, ok := c.terms[prefix]; ok && prefix != value {
+			return iri + suffix
+		}
+		return value
+	}
+
+	if iri, ok := c.terms[value]; ok {
+		return iri
+	}
+
+	return value
+}
+
+//Expand returns the IRI of an entity type or attribute name. Terms that are not defined in the
+//context are expanded using the vocabulary, while absolute and compact IRIs are left as they are
+//or have their prefix expanded.
+func (c *Context) Expand(term string) string {
+	if term == "" || strings.HasPrefix(term, "@") {
+		return term
+	}
+
+	if iri, ok := c.terms[term]; ok {
+		return iri
+	}
+
+	if strings.Contains(term, ":") {
+		return c.resolve(term)
+	}
+
+	if c.vocab != "" {
+		return c.vocab + term
+	}
+
+	return term
+}
+
+//Compact returns the shortest term or compact IRI that expands to the supplied IRI
+func (c *Context) Compact(iri string) string {
+	if iri == "" || strings.HasPrefix(iri, "@") {
+		return iri
+	}
+
+	if term, ok := c.inverse[iri]; ok {
+		return term
+	}
+
+	if c.vocab != "" && strings.HasPrefix(iri, c.vocab) {
+		term := strings.TrimPrefix(iri, c.vocab)
+		if _, defined := c.terms[term]; !defined && term != "" && !strings.Contains(term, ":") {
+			return term
+		}
+	}
+
+	compacted := iri
+	for term, prefix := range c.terms {
+		if !strings.HasSuffix(prefix, "/") && !strings.HasSuffix(prefix, "#") {
+			continue
+		}
+
+		if strings.HasPrefix(iri, prefix) && len(iri) > len(prefix) {
+			candidate := term + ":" + strings.TrimPrefix(iri, prefix)
+			if len(candidate) < len(compacted) || (len(candidate) == len(compacted) && candidate < compacted) {
+				compacted = candidate
+			}
+		}
+	}
+
+	return compacted
+}
+
+//Translate expands a term using one context and compacts the result using another
+func Translate(term string, from, to *Context) string {
+	return to.Compact(from.Expand(term))
+}
@@ -0,0 +1,102 @@
+package jsonld
+
+import (
+	"errors"
+	"testing"
+)
+
+const fiwareTemperature string = "https://uri.fiware.org/ns/data-models#temperature"
+
+func TestTermsAreExpandedUsingTheDefaultVocabulary(t *testing.T) {
+	iri := CoreContext().Expand("temperature")
+
+	if iri != DefaultVocabulary+"temperature" {
+		t.Error("Unexpected expansion: ", iri)
+	}
+
+	if CoreContext().Compact(iri) != "temperature" {
+		t.Error("Unexpected compaction: ", CoreContext().Compact(iri))
+	}
+}
+
+func TestCoreTermsAreExpanded(t *testing.T) {
+	if CoreContext().Expand("location") != "https://uri.etsi.org/ngsi-ld/location" {
+		t.Error("Unexpected expansion of location: ", CoreContext().Expand("location"))
+	}
+}
+
+func TestCustomContextIsUsedForExpansionAndCompaction(t *testing.T) {
+	ctx, err := NewContext(map[string]interface{}{
+		"fiware":  "https://uri.fiware.org/ns/data-models#",
+		"temp":    "fiware:temperature",
+		"Weather": map[string]interface{}{"@id": "fiware:WeatherObserved"},
+	}, nil)
+	if err != nil {
+		t.Fatal("Failed to create context: ", err.Error())
+	}
+
+	if ctx.Expand("temp") != fiwareTemperature {
+		t.Error("Unexpected expansion of temp: ", ctx.Expand("temp"))
+	}
+
+	if ctx.Expand(fiwareTemperature) != fiwareTemperature || ctx.Expand("fiware:temperature") != fiwareTemperature {
+		t.Error("Absolute and compact IRIs should expand to the same IRI.")
+	}
+
+	if Translate("Weather", ctx, CoreContext()) != "https://uri.fiware.org/ns/data-models#WeatherObserved" {
+		t.Error("Unexpected translation of Weather: ", Translate("Weather", ctx, CoreContext()))
+	}
+
+	if ctx.Compact(fiwareTemperature) != "temp" {
+		t.Error("Unexpected compaction: ", ctx.Compact(fiwareTemperature))
+	}
+}
+
+func TestRemoteContextsAreLoaded(t *testing.T) {
+	loader := NewStaticLoader(map[string][]byte{
+		"https://example.org/context.jsonld": []byte(`{"@context":{"temperature":"` + fiwareTemperature + `"}}`),
+	}, nil)
+
+	ctx, err := NewContext([]interface{}{"https://example.org/context.jsonld", CoreContextURL}, loader)
+	if err != nil {
+		t.Fatal("Failed to create context: ", err.Error())
+	}
+
+	if ctx.Expand("temperature") != fiwareTemperature {
+		t.Error("Unexpected expansion: ", ctx.Expand("temperature"))
+	}
+}
+
+func TestUnavailableContextReportsLoadError(t *testing.T) {
+	_, err := NewContext("https://example.org/missing.jsonld", NewStaticLoader(nil, nil))
+
+	var loadErr *LoadError
+	if !errors.As(err, &loadErr) || loadErr.URL != "https://example.org/missing.jsonld" {
+		t.Error("Expected a LoadError, but got ", err)
+	}
+}
+
+func TestTranslateEntity(t *testing.T) {
+	ctx, _ := NewContext(map[string]interface{}{"temperature": fiwareTemperature}, nil)
+
+	entity := map[string]interface{}{
+		"@context": map[string]interface{}{"temperature": fiwareTemperature},
+		"id":       "urn:ngsi-ld:Beach:1",
+		"type":     "Beach",
+		"temperature": map[string]interface{}{
+			"type": "Property", "value": 17.0,
+			"temperature": map[string]interface{}{"type": "Property", "value": 16.0},
+		},
+	}
+
+	translated := TranslateEntity(entity, ctx, CoreContext())
+
+	attribute, ok := translated[fiwareTemperature].(map[string]interface{})
+	if !ok || translated["type"] != "Beach" || translated["@context"] != nil {
+		t.Fatal("Unexpected translated entity: ", translated)
+	}
+
+	if _, ok := attribute[fiwareTemperature]; !ok || attribute["value"] != 17.0 {
+		t.Error("Sub-attributes should be translated, but not the members of the attribute: ", attribute)
+	}
+}
@@ -0,0 +1,125 @@
+package jsonld
+
+//CoreContextURL is the URL of the NGSI-LD core context that is used when a request does not
+//supply a context of its own
+const CoreContextURL string = "https://uri.etsi.org/ngsi-ld/v1/ngsi-ld-core-context.jsonld"
+
+//DefaultVocabulary is the vocabulary that terms that are not defined by any context expand to
+const DefaultVocabulary string = "https://uri.etsi.org/ngsi-ld/default-context/"
+
+//coreContextURLs are the published URLs of the core context, which are never fetched since
+//the core context is bundled with the package
+var coreContextURLs = map[string]bool{
+	CoreContextURL: true,
+	"https://uri.etsi.org/ngsi-ld/v1/ngsi-ld-core-context-v1.3.jsonld": true,
+	"https://uri.etsi.org/ngsi-ld/v1/ngsi-ld-core-context-v1.4.jsonld": true,
+	"https://uri.etsi.org/ngsi-ld/v1/ngsi-ld-core-context-v1.5.jsonld": true,
+	"https://uri.etsi.org/ngsi-ld/v1/ngsi-ld-core-context-v1.6.jsonld": true,
+}
+
+//coreContextDocument contains the term definitions of the NGSI-LD core context that are
+//relevant when expanding and compacting entity types and attribute names
+const coreContextDocument string = `{
+  "@context": {
+    "ngsi-ld": "https://uri.etsi.org/ngsi-ld/",
+    "geojson": "https://purl.org/geojson/vocab#",
+    "id": "@id",
+    "type": "@type",
+    "Attribute": "ngsi-ld:Attribute",
+    "AttributeList": "ngsi-ld:AttributeList",
+    "ContextSourceNotification": "ngsi-ld:ContextSourceNotification",
+    "ContextSourceRegistration": "ngsi-ld:ContextSourceRegistration",
+    "Date": "ngsi-ld:Date",
+    "DateTime": "ngsi-ld:DateTime",
+    "EntityType": "ngsi-ld:EntityType",
+    "EntityTypeInfo": "ngsi-ld:EntityTypeInfo",
+    "EntityTypeList": "ngsi-ld:EntityTypeList",
+    "Feature": "geojson:Feature",
+    "FeatureCollection": "geojson:FeatureCollection",
+    "GeoProperty": "ngsi-ld:GeoProperty",
+    "GeometryCollection": "geojson:GeometryCollection",
+    "LineString": "geojson:LineString",
+    "MultiLineString": "geojson:MultiLineString",
+    "MultiPoint": "geojson:MultiPoint",
+    "MultiPolygon": "geojson:MultiPolygon",
+    "Notification": "ngsi-ld:Notification",
+    "Point": "geojson:Point",
+    "Polygon": "geojson:Polygon",
+    "Property": "ngsi-ld:Property",
+    "Relationship": "ngsi-ld:Relationship",
+    "Subscription": "ngsi-ld:Subscription",
+    "TemporalProperty": "ngsi-ld:TemporalProperty",
+    "Time": "ngsi-ld:Time",
+    "accept": "ngsi-ld:accept",
+    "attributeCount": "attributeCount",
+    "attributeDetails": "attributeDetails",
+    "attributeList": {"@id": "ngsi-ld:attributeList", "@type": "@vocab"},
+    "attributeName": {"@id": "ngsi-ld:attributeName", "@type": "@vocab"},
+    "attributeNames": {"@id": "ngsi-ld:attributeNames", "@type": "@vocab"},
+    "attributeTypes": {"@id": "ngsi-ld:attributeTypes", "@type": "@vocab"},
+    "attributes": {"@id": "ngsi-ld:attributes", "@type": "@vocab"},
+    "bbox": {"@container": "@list", "@id": "geojson:bbox"},
+    "coordinates": {"@container": "@list", "@id": "geojson:coordinates"},
+    "createdAt": {"@id": "ngsi-ld:createdAt", "@type": "DateTime"},
+    "datasetId": {"@id": "ngsi-ld:datasetId", "@type": "@id"},
+    "description": "http://purl.org/dc/terms/description",
+    "detail": "ngsi-ld:detail",
+    "endAt": {"@id": "ngsi-ld:endAt", "@type": "DateTime"},
+    "endTimeAt": {"@id": "ngsi-ld:endTimeAt", "@type": "DateTime"},
+    "endpoint": "ngsi-ld:endpoint",
+    "entities": "ngsi-ld:entities",
+    "entityCount": "ngsi-ld:entityCount",
+    "error": "ngsi-ld:error",
+    "expiresAt": {"@id": "ngsi-ld:expiresAt", "@type": "DateTime"},
+    "features": {"@container": "@set", "@id": "geojson:features"},
+    "format": "ngsi-ld:format",
+    "geoQ": "ngsi-ld:geoQ",
+    "geometry": "geojson:geometry",
+    "geoproperty": "ngsi-ld:geoproperty",
+    "georel": "ngsi-ld:georel",
+    "idPattern": "ngsi-ld:idPattern",
+    "information": "ngsi-ld:information",
+    "instanceId": {"@id": "ngsi-ld:instanceId", "@type": "@id"},
+    "isActive": "ngsi-ld:isActive",
+    "lastFailure": {"@id": "ngsi-ld:lastFailure", "@type": "DateTime"},
+    "lastNotification": {"@id": "ngsi-ld:lastNotification", "@type": "DateTime"},
+    "lastSuccess": {"@id": "ngsi-ld:lastSuccess", "@type": "DateTime"},
+    "location": "ngsi-ld:location",
+    "managementInterval": "ngsi-ld:managementInterval",
+    "modifiedAt": {"@id": "ngsi-ld:modifiedAt", "@type": "DateTime"},
+    "name": "ngsi-ld:name",
+    "notification": "ngsi-ld:notification",
+    "notifiedAt": {"@id": "ngsi-ld:notifiedAt", "@type": "DateTime"},
+    "object": {"@id": "ngsi-ld:hasObject", "@type": "@id"},
+    "observationInterval": "ngsi-ld:observationInterval",
+    "observationSpace": "ngsi-ld:observationSpace",
+    "observedAt": {"@id": "ngsi-ld:observedAt", "@type": "DateTime"},
+    "operationSpace": "ngsi-ld:operationSpace",
+    "properties": "geojson:properties",
+    "propertyNames": {"@id": "ngsi-ld:propertyNames", "@type": "@vocab"},
+    "q": "ngsi-ld:q",
+    "reason": "ngsi-ld:reason",
+    "relationshipNames": {"@id": "ngsi-ld:relationshipNames", "@type": "@vocab"},
+    "startAt": {"@id": "ngsi-ld:startAt", "@type": "DateTime"},
+    "status": "ngsi-ld:status",
+    "subscriptionId": {"@id": "ngsi-ld:subscriptionId", "@type": "@id"},
+    "success": {"@id": "ngsi-ld:success", "@type": "@id"},
+    "tenant": {"@id": "ngsi-ld:tenant", "@type": "@id"},
+    "throttling": "ngsi-ld:throttling",
+    "timeAt": {"@id": "ngsi-ld:timeAt", "@type": "DateTime"},
+    "timeInterval": "ngsi-ld:timeInterval",
+    "timeproperty": "ngsi-ld:timeproperty",
+    "timerel": "ngsi-ld:timerel",
+    "timesSent": "ngsi-ld:timesSent",
+    "title": "ngsi-ld:title",
+    "typeList": {"@id": "ngsi-ld:typeList", "@type": "@vocab"},
+    "typeName": {"@id": "ngsi-ld:typeName", "@type": "@vocab"},
+    "typeNames": {"@id": "ngsi-ld:typeNames", "@type": "@vocab"},
+    "unitCode": "ngsi-ld:unitCode",
+    "updated": "ngsi-ld:updated",
+    "uri": "ngsi-ld:uri",
+    "value": "ngsi-ld:hasValue",
+    "watchedAttributes": {"@id": "ngsi-ld:watchedAttributes", "@type": "@vocab"},
+    "@vocab": "https://uri.etsi.org/ngsi-ld/default-context/"
+  }
+}`
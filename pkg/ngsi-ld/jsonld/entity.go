@@ -0,0 +1,94 @@
+package jsonld
+
+//entityMembers are the members of an entity that are not attributes
+var entityMembers = map[string]bool{
+	"@context":   true,
+	"id":         true,
+	"type":       true,
+	"scope":      true,
+	"createdAt":  true,
+	"modifiedAt": true,
+	"deletedAt":  true,
+}
+
+//attributeMembers are the members of an attribute that are not sub-attributes
+var attributeMembers = map[string]bool{
+	"@context":      true,
+	"type":          true,
+	"value":         true,
+	"values":        true,
+	"object":        true,
+	"objects":       true,
+	"languageMap":   true,
+	"datasetId":     true,
+	"instanceId":    true,
+	"observedAt":    true,
+	"createdAt":     true,
+	"modifiedAt":    true,
+	"deletedAt":     true,
+	"unitCode":      true,
+	"previousValue": true,
+}
+
+//TranslateEntity returns a copy of an entity where the entity type and the names of the
+//attributes and sub-attributes have been expanded using one context and compacted using another.
+//Any @context member is removed, since it no longer describes the entity.
+func TranslateEntity(entity map[string]interface{}, from, to *Context) map[string]interface{} {
+	translated := map[string]interface{}{}
+
+	for name, value := range entity {
+		switch {
+		case name == "@context":
+			continue
+		case name == "type":
+			translated[name] = translateTypes(value, from, to)
+		case entityMembers[name]:
+			translated[name] = value
+		default:
+			translated[Translate(name, from, to)] = translateAttribute(value, from, to)
+		}
+	}
+
+	return translated
+}
+
+//translateTypes translates an entity type, or a list of entity types
+func translateTypes(value interface{}, from, to *Context) interface{} {
+	switch v := value.(type) {
+	case string:
+		return Translate(v, from, to)
+	case []interface{}:
+		types := []interface{}{}
+		for _, t := range v {
+			types = append(types, translateTypes(t, from, to))
+		}
+		return types
+	}
+
+	return value
+}
+
+//translateAttribute translates the sub-attributes of an attribute, which may be a single
+//instance or an array of instances
+func translateAttribute(value interface{}, from, to *Context) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		attribute := map[string]interface{}{}
+		for name, member := range v {
+			if attributeMembers[name] {
+				attribute[name] = member
+			} else {
+				attribute[Translate(name, from, to)] = translateAttribute(member, from, to)
+			}
+		}
+		return attribute
+	case []interface{}:
+		instances := []interface{}{}
+		for _, instance := range v {
+			instances = append(instances, translateAttribute(instance, from, to))
+		}
+		return instances
+	}
+
+	return value
+}
@@ -0,0 +1,226 @@
+package jsonld
+
+import (
+	"container/list"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Loader retrieves the remote JSON-LD document at the supplied URL
+type Loader func(url string) ([]byte, error)
+
+//DefaultLoader is used to retrieve remote contexts when no other loader is supplied. Since the
+//URLs of remote contexts are supplied by clients, it does not retrieve any documents unless it
+//is replaced by a loader that allows the hosts that contexts should be retrieved from.
+var DefaultLoader Loader = NewCachingLoader(&http.Client{Timeout: 10 * time.Second}, LoaderConfig{})
+
+//LoaderConfig restricts where a caching loader may retrieve documents from, and how many of
+//them that it keeps in memory
+type LoaderConfig struct {
+	//AllowedHosts are the hosts that documents may be retrieved from, including any port. No
+	//documents are retrieved if the list is empty.
+	AllowedHosts []string
+	//AllowHTTP permits documents to be retrieved over plain HTTP. Only HTTPS is used by default.
+	AllowHTTP bool
+
+	//MaxDocumentSize is the largest document, in bytes, that is retrieved. Defaults to 1 MiB.
+	MaxDocumentSize int64
+	//CacheSize is the number of documents that are kept in memory. Defaults to 100.
+	CacheSize int
+	//CacheTTL is the time that a document is kept before it is retrieved again. Defaults to one hour.
+	CacheTTL time.Duration
+}
+
+//LoadError is returned when a remote context could not be retrieved
+type LoadError struct {
+	URL string
+	Err error
+}
+
+func (le *LoadError) Error() string {
+	return fmt.Sprintf("failed to load context %s: %s", le.URL, le.Err.Error())
+}
+
+func (le *LoadError) Unwrap() error {
+	return le.Err
+}
+
+//NewCachingLoader returns a loader that retrieves documents over HTTP using the supplied client,
+//but only from the hosts that the config allows, and keeps the most recently used documents that
+//were successfully retrieved in memory
+func NewCachingLoader(client *http.Client, config LoaderConfig) Loader {
+	if config.MaxDocumentSize <= 0 {
+		config.MaxDocumentSize = 1024 * 1024
+	}
+
+	if config.CacheSize <= 0 {
+		config.CacheSize = 100
+	}
+
+	if config.CacheTTL <= 0 {
+		config.CacheTTL = time.Hour
+	}
+
+	// Redirects are followed only as long as they stay on the allowed hosts
+	restricted := *client
+	restricted.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if err := config.allows(req.URL); err != nil {
+			return err
+		}
+		if len(via) >= 10 {
+			return fmt.Errorf("stopped after 10 redirects")
+		}
+		return nil
+	}
+
+	cache := newDocumentCache(config.CacheSize, config.CacheTTL)
+
+	return func(documentURL string) ([]byte, error) {
+		if document, ok := cache.get(documentURL, time.Now()); ok {
+			return document, nil
+		}
+
+		u, err := url.Parse(documentURL)
+		if err != nil {
+			return nil, err
+		}
+
+		if err = config.allows(u); err != nil {
+			return nil, err
+		}
+
+		req, err := http.NewRequest(http.MethodGet, documentURL, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", "application/ld+json, application/json")
+
+		response, err := restricted.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer response.Body.Close()
+
+		if response.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("unexpected response code %d", response.StatusCode)
+		}
+
+		if response.ContentLength > config.MaxDocumentSize {
+			return nil, fmt.Errorf("the document is larger than %d bytes", config.MaxDocumentSize)
+		}
+
+		document, err := ioutil.ReadAll(io.LimitReader(response.Body, config.MaxDocumentSize+1))
+		if err != nil {
+			return nil, err
+		}
+
+		if int64(len(document)) > config.MaxDocumentSize {
+			return nil, fmt.Errorf("the document is larger than %d bytes", config.MaxDocumentSize)
+		}
+
+		cache.put(documentURL, document, time.Now())
+
+		return document, nil
+	}
+}
+
+//allows returns an error if documents may not be retrieved from the supplied URL
+func (config LoaderConfig) allows(u *url.URL) error {
+	if u.Scheme != "https" && !(u.Scheme == "http" && config.AllowHTTP) {
+		return fmt.Errorf("retrieving documents over %s is not allowed", u.Scheme)
+	}
+
+	for _, host := range config.AllowedHosts {
+		if strings.EqualFold(host, u.Host) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("retrieving documents from %s is not allowed", u.Host)
+}
+
+//documentCache keeps a limited number of documents, and evicts the least recently used document
+//when it is full. Documents also expire a fixed time after they were retrieved.
+type documentCache struct {
+	mu       sync.Mutex
+	capacity int
+	ttl      time.Duration
+	order    *list.List
+	entries  map[string]*list.Element
+}
+
+type cachedDocument struct {
+	url       string
+	document  []byte
+	expiresAt time.Time
+}
+
+func newDocumentCache(capacity int, ttl time.Duration) *documentCache {
+	return &documentCache{
+		capacity: capacity,
+		ttl:      ttl,
+		order:    list.New(),
+		entries:  map[string]*list.Element{},
+	}
+}
+
+func (dc *documentCache) get(url string, now time.Time) ([]byte, bool) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+
+	element, ok := dc.entries[url]
+	if !ok {
+		return nil, false
+	}
+
+	cached := element.Value.(*cachedDocument)
+	if !now.Before(cached.expiresAt) {
+		dc.order.Remove(element)
+		delete(dc.entries, url)
+		return nil, false
+	}
+
+	dc.order.MoveToFront(element)
+
+	return cached.document, true
+}
+
+func (dc *documentCache) put(url string, document []byte, now time.Time) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+
+	if element, ok := dc.entries[url]; ok {
+		dc.order.Remove(element)
+	}
+
+	dc.entries[url] = dc.order.PushFront(&cachedDocument{url: url, document: document, expiresAt: now.Add(dc.ttl)})
+
+	for dc.order.Len() > dc.capacity {
+		oldest := dc.order.Back()
+		dc.order.Remove(oldest)
+		delete(dc.entries, oldest.Value.(*cachedDocument).url)
+	}
+}
+
+//NewStaticLoader returns a loader that serves the supplied documents, which makes it possible to
+//use contexts without retrieving them. Any other document is retrieved with the fallback loader,
+//unless it is nil.
+func NewStaticLoader(documents map[string][]byte, fallback Loader) Loader {
+	return func(url string) ([]byte, error) {
+		if document, ok := documents[url]; ok {
+			return document, nil
+		}
+
+		if fallback == nil {
+			return nil, fmt.Errorf("no document available for %s", url)
+		}
+
+		return fallback(url)
+	}
+}
@@ -0,0 +1,83 @@
+package jsonld
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newContextServer(requests *int, document string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*requests++
+		w.Header().Add("Content-Type", "application/ld+json")
+		w.Write([]byte(document))
+	}))
+}
+
+func TestCachingLoaderOnlyRetrievesFromAllowedHosts(t *testing.T) {
+	requests := 0
+	server := newContextServer(&requests, `{"@context":{}}`)
+	defer server.Close()
+
+	loader := NewCachingLoader(server.Client(), LoaderConfig{AllowHTTP: true})
+
+	if _, err := loader(server.URL + "/context.jsonld"); err == nil || requests != 0 {
+		t.Error("Documents should not be retrieved from hosts that are not allowed.")
+	}
+
+	u, _ := url.Parse(server.URL)
+	loader = NewCachingLoader(server.Client(), LoaderConfig{AllowedHosts: []string{u.Host}, AllowHTTP: true})
+
+	if _, err := loader(server.URL + "/context.jsonld"); err != nil {
+		t.Error("Failed to retrieve document from an allowed host: ", err.Error())
+	}
+}
+
+func TestCachingLoaderRejectsLargeDocuments(t *testing.T) {
+	requests := 0
+	server := newContextServer(&requests, `{"@context":{"temperature":"`+strings.Repeat("x", 100)+`"}}`)
+	defer server.Close()
+
+	u, _ := url.Parse(server.URL)
+	loader := NewCachingLoader(server.Client(), LoaderConfig{AllowedHosts: []string{u.Host}, AllowHTTP: true, MaxDocumentSize: 50})
+
+	if _, err := loader(server.URL + "/context.jsonld"); err == nil {
+		t.Error("Documents that are larger than the maximum size should be rejected.")
+	}
+}
+
+func TestCachingLoaderEvictsLeastRecentlyUsedDocuments(t *testing.T) {
+	requests := 0
+	server := newContextServer(&requests, `{"@context":{}}`)
+	defer server.Close()
+
+	u, _ := url.Parse(server.URL)
+	loader := NewCachingLoader(server.Client(), LoaderConfig{AllowedHosts: []string{u.Host}, AllowHTTP: true, CacheSize: 2})
+
+	for _, path := range []string{"/a", "/b", "/a", "/c", "/a", "/b"} {
+		loader(server.URL + path)
+	}
+
+	// /a is kept since it was used recently, while /b is evicted by /c and retrieved again
+	if requests != 4 {
+		t.Error("Unexpected number of requests: ", requests, " != 4")
+	}
+}
+
+func TestCachedDocumentsExpire(t *testing.T) {
+	cache := newDocumentCache(10, time.Minute)
+	now := time.Now()
+
+	cache.put("https://example.org/context.jsonld", []byte(`{}`), now)
+
+	if _, ok := cache.get("https://example.org/context.jsonld", now.Add(30*time.Second)); !ok {
+		t.Error("The document should still be cached.")
+	}
+
+	if _, ok := cache.get("https://example.org/context.jsonld", now.Add(2*time.Minute)); ok {
+		t.Error("The document should have expired.")
+	}
+}
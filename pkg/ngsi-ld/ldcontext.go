@@ -0,0 +1,304 @@
+package ngsi
+
+import (
+	"bytes"
+	"encoding/json"
+	stderrors "errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+
+	"github.com/iot-for-tillgenglighet/ngsi-ld-golang/pkg/ngsi-ld/errors"
+	"github.com/iot-for-tillgenglighet/ngsi-ld-golang/pkg/ngsi-ld/jsonld"
+)
+
+//JSONLDContextLinkRel is the relation type of a Link header that refers to a JSON-LD context
+const JSONLDContextLinkRel string = "http://www.w3.org/ns/json-ld#context"
+
+//ContextLoader is used to retrieve the remote JSON-LD contexts that requests refer to. The
+//NGSI-LD core context is bundled and is never retrieved. Other remote contexts are only
+//retrieved if this is set to a loader that allows them, such as one from jsonld.NewCachingLoader.
+var ContextLoader jsonld.Loader
+
+//contextParameters are the query parameters that contain entity types or attribute names
+var contextParameters = []string{"type", "attrs"}
+
+//requestContext returns the JSON-LD context that a request refers to in a Link header, or the
+//core context if the request does not refer to a context
+func requestContext(r *http.Request) (*jsonld.Context, error) {
+	for _, header := range r.Header["Link"] {
+		for _, link := range strings.Split(header, ",") {
+			parts := strings.Split(link, ";")
+			target := strings.TrimSpace(parts[0])
+
+			if !strings.HasPrefix(target, "<") || !strings.HasSuffix(target, ">") {
+				continue
+			}
+
+			for _, param := range parts[1:] {
+				param = strings.TrimSpace(param)
+				if param == `rel="`+JSONLDContextLinkRel+`"` || param == "rel="+JSONLDContextLinkRel {
+					return jsonld.NewContext(strings.Trim(target, "<>"), ContextLoader)
+				}
+			}
+		}
+	}
+
+	return jsonld.CoreContext(), nil
+}
+
+//normalizeRequest translates the entity types and attribute names in the query parameters and
+//body of a request from the JSON-LD context of the request to the core context, so that they can
+//be compared with the names that context sources have registered. The context is removed from
+//the request, which means that it can still be forwarded to remote context sources, and the
+//context is returned so that the response can be translated back.
+func normalizeRequest(r *http.Request) (*jsonld.Context, error) {
+	ctx, err := requestContext(r)
+	if err != nil {
+		return nil, err
+	}
+
+	core := jsonld.CoreContext()
+
+	// Names are translated even without a context, since clients may use expanded names
+	r.URL.RawQuery = translateContextParameters(r.URL.RawQuery, ctx, core)
+
+	translated := ctx != core
+
+	if r.Body != nil {
+		body, _ := ioutil.ReadAll(r.Body)
+		r.Body.Close()
+
+		body, bodyCtx, err := normalizeBody(body, ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		if bodyCtx != nil {
+			ctx = bodyCtx
+			translated = true
+		}
+
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		r.ContentLength = int64(len(body))
+	}
+
+	r.Header.Del("Link")
+
+	// A JSON-LD body without a @context is not valid, so the translated body is sent as plain JSON
+	if translated && strings.HasPrefix(r.Header.Get("Content-Type"), "application/ld+json") {
+		r.Header.Set("Content-Type", "application/json")
+	}
+
+	return ctx, nil
+}
+
+//normalizeBody translates an entity, an entity fragment or an array of entities. The context of
+//the first entity with an inline @context is returned, since that is the context the client uses.
+func normalizeBody(body []byte, ctx *jsonld.Context) ([]byte, *jsonld.Context, error) {
+	var payload interface{}
+
+	// Numbers are kept as they are, since large integers would lose precision as float64
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	if len(bytes.TrimSpace(body)) == 0 || decoder.Decode(&payload) != nil {
+		return body, nil, nil
+	}
+
+	var bodyCtx *jsonld.Context
+	translated := ctx != jsonld.CoreContext()
+
+	normalize := func(entity map[string]interface{}) (map[string]interface{}, error) {
+		entityCtx := ctx
+
+		if inline, ok := entity["@context"]; ok {
+			var err error
+			entityCtx, err = jsonld.NewContext(inline, ContextLoader)
+			if err != nil {
+				return nil, err
+			}
+
+			if bodyCtx == nil {
+				bodyCtx = entityCtx
+			}
+			translated = true
+		}
+
+		normalized := jsonld.TranslateEntity(entity, entityCtx, jsonld.CoreContext())
+
+		// Entities without a context may still use expanded names, which are compacted
+		if !translated && !reflect.DeepEqual(normalized, entity) {
+			translated = true
+		}
+
+		return normalized, nil
+	}
+
+	switch p := payload.(type) {
+	case map[string]interface{}:
+		entity, err := normalize(p)
+		if err != nil {
+			return nil, nil, err
+		}
+		payload = entity
+	case []interface{}:
+		for idx, item := range p {
+			if entity, ok := item.(map[string]interface{}); ok {
+				normalized, err := normalize(entity)
+				if err != nil {
+					return nil, nil, err
+				}
+				p[idx] = normalized
+			}
+		}
+	default:
+		return body, nil, nil
+	}
+
+	if !translated {
+		return body, nil, nil
+	}
+
+	normalized, err := json.Marshal(payload)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return normalized, bodyCtx, nil
+}
+
+//translateContextParameters translates the comma separated names in the query parameters that
+//contain entity types or attribute names, as well as the attribute names in the q parameter, and
+//keeps the other parameters, and the parameters where nothing was translated, exactly as they are
+func translateContextParameters(rawQuery string, from, to *jsonld.Context) string {
+	params := strings.Split(rawQuery, "&")
+
+	translate := func(name string) string {
+		return translateName(name, from, to)
+	}
+
+	for idx, param := range params {
+		kv := strings.SplitN(param, "=", 2)
+		if len(kv) != 2 || (!isContextParameter(kv[0]) && kv[0] != "q") {
+			continue
+		}
+
+		value, err := url.QueryUnescape(kv[1])
+		if err != nil {
+			continue
+		}
+
+		var translated string
+
+		if kv[0] == "q" {
+			translated = translateQueryAttributes(value, translate)
+		} else {
+			names := strings.Split(value, ",")
+			for i, name := range names {
+				names[i] = translate(name)
+			}
+			translated = strings.Join(names, ",")
+		}
+
+		if translated != value {
+			params[idx] = kv[0] + "=" + url.QueryEscape(translated)
+		}
+	}
+
+	return strings.Join(params, "&")
+}
+
+//translateName translates an entity type or attribute name between two contexts. Names that
+//are keywords in the target context, such as id and type, are left as they are.
+func translateName(name string, from, to *jsonld.Context) string {
+	translated := jsonld.Translate(name, from, to)
+	if strings.HasPrefix(translated, "@") {
+		return name
+	}
+	return translated
+}
+
+func isContextParameter(name string) bool {
+	for _, p := range contextParameters {
+		if p == name {
+			return true
+		}
+	}
+	return false
+}
+
+//compactEntity translates an entity from the core context to the context of a client
+func compactEntity(entity Entity, ctx *jsonld.Context) Entity {
+	if ctx == jsonld.CoreContext() || entityID(entity) == "" {
+		return entity
+	}
+
+	entityMap, err := entityAsMap(entity)
+	if err != nil {
+		return entity
+	}
+
+	return jsonld.TranslateEntity(entityMap, jsonld.CoreContext(), ctx)
+}
+
+//reportContextError reports a context that could not be retrieved as LdContextNotAvailable, and
+//any other problem with a context as BadRequestData
+func reportContextError(w http.ResponseWriter, err error) {
+	var loadErr *jsonld.LoadError
+	if stderrors.As(err, &loadErr) {
+		errors.ReportNewLdContextNotAvailable(w, loadErr.Error())
+		return
+	}
+
+	errors.ReportNewBadRequestData(w, fmt.Sprintf("Invalid @context: %s", err.Error()))
+}
+
+//normalizeRegistration translates the entity types and attribute names of a registration from
+//the context that it was created with, which is either an inline @context or the context that
+//the request refers to, to the core context
+func normalizeRegistration(reg CsourceRegistration, body []byte, r *http.Request) error {
+	csr, ok := reg.(*ctxSrcReg)
+	if !ok {
+		return nil
+	}
+
+	ctx, err := requestContext(r)
+	if err != nil {
+		return err
+	}
+
+	inline := struct {
+		Context interface{} `json:"@context"`
+	}{}
+	if json.Unmarshal(body, &inline) == nil && inline.Context != nil {
+		ctx, err = jsonld.NewContext(inline.Context, ContextLoader)
+		if err != nil {
+			return err
+		}
+	}
+
+	core := jsonld.CoreContext()
+	if ctx == core {
+		return nil
+	}
+
+	translate := func(names []string) {
+		for idx, name := range names {
+			names[idx] = jsonld.Translate(name, ctx, core)
+		}
+	}
+
+	for i := range csr.Information {
+		info := &csr.Information[i]
+		for j := range info.Entities {
+			info.Entities[j].Type = jsonld.Translate(info.Entities[j].Type, ctx, core)
+		}
+		translate(info.PropertyNames)
+		translate(info.RelationshipNames)
+	}
+
+	return nil
+}
@@ -0,0 +1,152 @@
+package ngsi
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/iot-for-tillgenglighet/ngsi-ld-golang/pkg/ngsi-ld/jsonld"
+)
+
+const fiwareTemperature string = "https://uri.fiware.org/ns/data-models#temperature"
+
+func useTestContext() func() {
+	previous := ContextLoader
+	ContextLoader = jsonld.NewStaticLoader(map[string][]byte{
+		"https://example.org/context.jsonld": []byte(`{"@context":{"temperature":"` + fiwareTemperature + `"}}`),
+	}, previous)
+
+	return func() {
+		ContextLoader = previous
+	}
+}
+
+func TestQueryIsTranslatedToTheRegisteredAttributeNames(t *testing.T) {
+	defer useTestContext()()
+
+	var forwarded *http.Request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r
+		w.Header().Add("Content-Type", "application/ld+json")
+		w.Write([]byte(`[{"id":"urn:ngsi-ld:Beach:1","type":"Beach","` + fiwareTemperature + `":{"type":"Property","value":17.2}}]`))
+	}))
+	defer server.Close()
+
+	reg, _ := NewCsourceRegistrationFromJSON([]byte(`{"type":"ContextSourceRegistration",
+		"information":[{"entities":[{"type":"Beach"}],"propertyNames":["` + fiwareTemperature + `"]}],
+		"endpoint":"` + server.URL + `"}`))
+	src, _ := NewRemoteContextSource(reg)
+	ctxRegistry := NewContextRegistry()
+	ctxRegistry.Register(src)
+
+	req, _ := http.NewRequest("GET", createURL("/entities", "type=Beach", "attrs=temperature"), nil)
+	req.Header.Add("Link", `<https://example.org/context.jsonld>; rel="`+JSONLDContextLinkRel+`"; type="application/ld+json"`)
+	w := httptest.NewRecorder()
+	NewQueryEntitiesHandler(ctxRegistry).ServeHTTP(w, req)
+
+	if forwarded == nil {
+		t.Fatal("The query was not forwarded to the context source: ", w.Code, w.Body.String())
+	}
+
+	if queryParameters(forwarded).Get("attrs") != fiwareTemperature || forwarded.Header.Get("Link") != "" {
+		t.Error("The forwarded query should use the expanded attribute name: ", forwarded.URL.RawQuery)
+	}
+
+	entities := []map[string]interface{}{}
+	json.Unmarshal(w.Body.Bytes(), &entities)
+
+	if len(entities) != 1 || entities[0]["temperature"] == nil {
+		t.Error("The response should be compacted using the context of the client: ", w.Body.String())
+	}
+}
+
+func TestEntityWithInlineContextIsStoredWithExpandedNames(t *testing.T) {
+	ctxRegistry := NewContextRegistry()
+	ctxRegistry.Register(NewInMemoryContextSource("Beach"))
+
+	entity := `{"@context":{"temperature":"` + fiwareTemperature + `"},"id":"urn:ngsi-ld:Beach:1","type":"Beach",
+		"temperature":{"type":"Property","value":17.2}}`
+	req, _ := http.NewRequest("POST", createURL("/entities"), bytes.NewBuffer([]byte(entity)))
+	req.Header.Add("Content-Type", "application/ld+json")
+	w := httptest.NewRecorder()
+	NewCreateEntityHandler(ctxRegistry).ServeHTTP(w, req)
+
+	if w.Code != http.StatusCreated {
+		t.Fatal("Failed to create entity: ", w.Code, w.Body.String())
+	}
+
+	req, _ = http.NewRequest("GET", createURL("/entities/urn:ngsi-ld:Beach:1"), nil)
+	w = httptest.NewRecorder()
+	NewRetrieveEntityHandler(ctxRegistry).ServeHTTP(w, req)
+
+	if !strings.Contains(w.Body.String(), fiwareTemperature) {
+		t.Error("A client without a context should see the expanded attribute name: ", w.Body.String())
+	}
+}
+
+func TestUnavailableContextIsReported(t *testing.T) {
+	req, _ := http.NewRequest("GET", createURL("/entities", "type=Beach"), nil)
+	req.Header.Add("Link", `<https://example.org/missing.jsonld>; rel="`+JSONLDContextLinkRel+`"`)
+	w := httptest.NewRecorder()
+	NewQueryEntitiesHandler(NewContextRegistry()).ServeHTTP(w, req)
+
+	if w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), "LdContextNotAvailable") {
+		t.Error("Expected a LdContextNotAvailable problem: ", w.Code, w.Body.String())
+	}
+}
+
+func TestExpandedTypeIsTranslatedWithoutContext(t *testing.T) {
+	ctxRegistry := NewContextRegistry()
+	ctxRegistry.Register(NewInMemoryContextSource("Beach"))
+
+	entity := `{"id":"urn:ngsi-ld:Beach:1","type":"Beach","name":{"type":"Property","value":"Stranden"}}`
+	req, _ := http.NewRequest("POST", createURL("/entities"), bytes.NewBuffer([]byte(entity)))
+	w := httptest.NewRecorder()
+	NewCreateEntityHandler(ctxRegistry).ServeHTTP(w, req)
+
+	req, _ = http.NewRequest("GET", createURL("/entities", "type=https://uri.etsi.org/ngsi-ld/default-context/Beach"), nil)
+	w = httptest.NewRecorder()
+	NewQueryEntitiesHandler(ctxRegistry).ServeHTTP(w, req)
+
+	entities := []map[string]interface{}{}
+	json.Unmarshal(w.Body.Bytes(), &entities)
+
+	if len(entities) != 1 {
+		t.Error("The expanded entity type should match the compacted type: ", w.Body.String())
+	}
+}
+
+func TestAttributeNamesInQAreTranslated(t *testing.T) {
+	defer useTestContext()()
+
+	var forwarded *http.Request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r
+		w.Header().Add("Content-Type", "application/ld+json")
+		w.Write([]byte(`[]`))
+	}))
+	defer server.Close()
+
+	reg, _ := NewCsourceRegistrationFromJSON([]byte(`{"type":"ContextSourceRegistration",
+		"information":[{"entities":[{"type":"Beach"}],"propertyNames":["` + fiwareTemperature + `"]}],
+		"endpoint":"` + server.URL + `"}`))
+	src, _ := NewRemoteContextSource(reg)
+	ctxRegistry := NewContextRegistry()
+	ctxRegistry.Register(src)
+
+	req, _ := http.NewRequest("GET", createURL("/entities", "type=Beach", "q=temperature>20;name==%22urn:a%22"), nil)
+	req.Header.Add("Link", `<https://example.org/context.jsonld>; rel="`+JSONLDContextLinkRel+`"; type="application/ld+json"`)
+	w := httptest.NewRecorder()
+	NewQueryEntitiesHandler(ctxRegistry).ServeHTTP(w, req)
+
+	if forwarded == nil {
+		t.Fatal("The query was not forwarded to the context source: ", w.Code, w.Body.String())
+	}
+
+	if q := queryParameters(forwarded).Get("q"); q != fiwareTemperature+`>20;name=="urn:a"` {
+		t.Error("The attribute names in q should be translated: ", q)
+	}
+}
@@ -0,0 +1,107 @@
+package ngsi
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+
+	"github.com/iot-for-tillgenglighet/ngsi-ld-golang/pkg/ngsi-ld/internal/mqtt"
+)
+
+const (
+	//NotifierInfoMQTTVersion selects the MQTT version to use for notifications, either
+	//mqtt3.1.1 or mqtt5.0 (default)
+	NotifierInfoMQTTVersion string = "MQTT-Version"
+	//NotifierInfoMQTTQoS selects the QoS level (0, 1 or 2) to use for notifications
+	NotifierInfoMQTTQoS string = "MQTT-QoS"
+
+	//MQTTVersion311 is the MQTT-Version value for MQTT 3.1.1
+	MQTTVersion311 string = "mqtt3.1.1"
+	//MQTTVersion5 is the MQTT-Version value for MQTT 5.0
+	MQTTVersion5 string = "mqtt5.0"
+)
+
+//mqttSettings contains the publication settings derived from a notification endpoint
+type mqttSettings struct {
+	version    byte
+	qos        byte
+	properties []mqtt.UserProperty
+}
+
+func newMQTTSettings(endpoint NotificationEndpoint) (*mqttSettings, error) {
+	settings := &mqttSettings{version: mqtt.ProtocolVersion5}
+
+	for _, info := range endpoint.NotifierInfo {
+		switch info.Key {
+		case NotifierInfoMQTTVersion:
+			if info.Value == MQTTVersion311 {
+				settings.version = mqtt.ProtocolVersion311
+			} else if info.Value != MQTTVersion5 {
+				return nil, fmt.Errorf("unsupported %s %s", NotifierInfoMQTTVersion, info.Value)
+			}
+		case NotifierInfoMQTTQoS:
+			qos, err := strconv.Atoi(info.Value)
+			if err != nil || qos < 0 || qos > 2 {
+				return nil, fmt.Errorf("invalid %s %s", NotifierInfoMQTTQoS, info.Value)
+			}
+			settings.qos = byte(qos)
+		default:
+			settings.properties = append(settings.properties, mqtt.UserProperty{Key: info.Key, Value: info.Value})
+		}
+	}
+
+	for _, info := range endpoint.ReceiverInfo {
+		settings.properties = append(settings.properties, mqtt.UserProperty{Key: info.Key, Value: info.Value})
+	}
+
+	return settings, nil
+}
+
+func validateMQTTEndpoint(u *url.URL, endpoint NotificationEndpoint) error {
+	if mqtt.TopicFromURL(u) == "" {
+		return fmt.Errorf("the notification endpoint uri %s must contain a topic", endpoint.URI)
+	}
+
+	_, err := newMQTTSettings(endpoint)
+	return err
+}
+
+//publishNotification publishes a notification to the topic in an mqtt:// or mqtts:// endpoint.
+//With MQTT 5 the receiverInfo and notifierInfo are sent as user properties, while MQTT 3.1.1
+//notifications are wrapped in an object with the same information in its metadata member.
+func publishNotification(endpoint NotificationEndpoint, notification *Notification) error {
+	settings, err := newMQTTSettings(endpoint)
+	if err != nil {
+		return err
+	}
+
+	contentType := endpoint.Accept
+	if contentType == "" {
+		contentType = "application/json"
+	}
+
+	message := mqtt.Message{QoS: settings.qos}
+
+	if settings.version == mqtt.ProtocolVersion5 {
+		message.ContentType = contentType
+		message.UserProperties = settings.properties
+		message.Payload, err = json.Marshal(notification)
+	} else {
+		metadata := map[string]string{"Content-Type": contentType}
+		for _, property := range settings.properties {
+			metadata[property.Key] = property.Value
+		}
+
+		message.Payload, err = json.Marshal(map[string]interface{}{
+			"metadata": metadata,
+			"body":     notification,
+		})
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return mqtt.Publish(endpoint.URI, message, mqtt.Config{ProtocolVersion: settings.version})
+}
@@ -0,0 +1,324 @@
+package ngsi
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+//Notification is sent to the endpoint of a subscription when a matching entity has changed
+type Notification struct {
+	ID             string                   `json:"id"`
+	Type           string                   `json:"type"`
+	SubscriptionID string                   `json:"subscriptionId"`
+	NotifiedAt     string                   `json:"notifiedAt"`
+	Data           []map[string]interface{} `json:"data"`
+}
+
+func newNotification(subscription *Subscription, entity map[string]interface{}, now time.Time) *Notification {
+	return &Notification{
+		ID:             "urn:ngsi-ld:Notification:" + uuid.New().String(),
+		Type:           "Notification",
+		SubscriptionID: subscription.ID,
+		NotifiedAt:     now.UTC().Format(time.RFC3339Nano),
+		Data:           []map[string]interface{}{notificationData(subscription.Notification, entity)},
+	}
+}
+
+//notificationData returns a copy of the entity that only contains the attributes requested
+//by the subscription, in the requested format
+func notificationData(params NotificationParams, entity map[string]interface{}) map[string]interface{} {
+	data := map[string]interface{}{}
+
+	for key, value := range entity {
+		if key == "id" || key == "type" || key == "@context" {
+			data[key] = value
+			continue
+		}
+
+		if len(params.Attributes) > 0 && !containsString(params.Attributes, key) {
+			continue
+		}
+
+		if params.Format == NotificationFormatKeyValues {
+			value = attributeValue(value)
+		}
+
+		data[key] = value
+	}
+
+	return data
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+//deliver sends a notification to an endpoint using the protocol given by the uri scheme
+func (sm *subscriptionManager) deliver(endpoint NotificationEndpoint, notification *Notification) error {
+	u, err := url.Parse(endpoint.URI)
+	if err != nil {
+		return err
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		return sm.postNotification(endpoint, notification)
+	case "mqtt", "mqtts":
+		return publishNotification(endpoint, notification)
+	}
+
+	return fmt.Errorf("unsupported notification endpoint scheme %s", u.Scheme)
+}
+
+func (sm *subscriptionManager) postNotification(endpoint NotificationEndpoint, notification *Notification) error {
+	body, err := json.Marshal(notification)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, endpoint.URI, bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+
+	contentType := endpoint.Accept
+	if contentType == "" {
+		contentType = "application/json"
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("User-Agent", "ngsi-context-broker/0.1")
+
+	for _, info := range endpoint.ReceiverInfo {
+		req.Header.Set(info.Key, info.Value)
+	}
+
+	response, err := sm.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	ioutil.ReadAll(response.Body)
+
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return fmt.Errorf("notification endpoint responded with status code %d", response.StatusCode)
+	}
+
+	return nil
+}
+
+//NewNotifyingContextRegistry wraps a context registry so that successful create, update and
+//append operations on its context sources are reported to the subscription manager
+func NewNotifyingContextRegistry(ctxReg ContextRegistry, subMgr SubscriptionManager) ContextRegistry {
+	return &notifyingRegistry{ContextRegistry: ctxReg, subMgr: subMgr}
+}
+
+type notifyingRegistry struct {
+	ContextRegistry
+	subMgr SubscriptionManager
+}
+
+func (nr *notifyingRegistry) wrap(sources []ContextSource) []ContextSource {
+	wrapped := []ContextSource{}
+	for _, src := range sources {
+		wrapped = append(wrapped, &notifyingContextSource{ContextSource: src, subMgr: nr.subMgr})
+	}
+	return wrapped
+}
+
+func (nr *notifyingRegistry) GetContextSourcesForQuery(query Query) []ContextSource {
+	return nr.wrap(nr.ContextRegistry.GetContextSourcesForQuery(query))
+}
+
+func (nr *notifyingRegistry) GetContextSourcesForEntity(entityID string) []ContextSource {
+	return nr.wrap(nr.ContextRegistry.GetContextSourcesForEntity(entityID))
+}
+
+func (nr *notifyingRegistry) GetContextSourcesForEntityType(entityType string) []ContextSource {
+	return nr.wrap(nr.ContextRegistry.GetContextSourcesForEntityType(entityType))
+}
+
+func (nr *notifyingRegistry) ContextSource(registrationID string) (ContextSource, bool) {
+	src, ok := nr.ContextRegistry.ContextSource(registrationID)
+	if !ok {
+		return nil, false
+	}
+	return &notifyingContextSource{ContextSource: src, subMgr: nr.subMgr}, true
+}
+
+func (nr *notifyingRegistry) ContextSources() []ContextSource {
+	return nr.wrap(nr.ContextRegistry.ContextSources())
+}
+
+type notifyingContextSource struct {
+	ContextSource
+	subMgr SubscriptionManager
+}
+
+func (ncs *notifyingContextSource) unwrap() ContextSource {
+	return ncs.ContextSource
+}
+
+func (ncs *notifyingContextSource) RegistrationID() string {
+	if rcs, ok := ncs.ContextSource.(RegisteredContextSource); ok {
+		return rcs.RegistrationID()
+	}
+	return ""
+}
+
+func (ncs *notifyingContextSource) CreateEntity(typeName, entityID string, request Request) error {
+	fragment, _ := requestFragment(request)
+
+	err := ncs.ContextSource.CreateEntity(typeName, entityID, request)
+	if err == nil {
+		ncs.entityChanged(entityID, request, fragment, false)
+	}
+
+	return err
+}
+
+func (ncs *notifyingContextSource) UpdateEntityAttributes(entityID string, request Request) error {
+	fragment, _ := requestFragment(request)
+
+	err := ncs.ContextSource.UpdateEntityAttributes(entityID, request)
+	if err == nil {
+		ncs.entityChanged(entityID, request, fragment, true)
+	}
+
+	return err
+}
+
+func (ncs *notifyingContextSource) AppendEntityAttributes(entityID string, request Request) (*UpdateResult, error) {
+	fragment, _ := requestFragment(request)
+
+	result, err := ncs.ContextSource.AppendEntityAttributes(entityID, request)
+	if err == nil {
+		if result != nil {
+			appended := map[string]interface{}{}
+			for _, attributeName := range result.Updated {
+				appended[attributeName] = fragment[attributeName]
+			}
+			fragment = appended
+		}
+		ncs.entityChanged(entityID, request, fragment, true)
+	}
+
+	return result, err
+}
+
+func (ncs *notifyingContextSource) CreateEntities(request Request) (*BatchOperationResult, error) {
+	return ncs.batchChanged(request, false, ncs.ContextSource.CreateEntities)
+}
+
+func (ncs *notifyingContextSource) UpsertEntities(request Request) (*BatchOperationResult, error) {
+	return ncs.batchChanged(request, true, ncs.ContextSource.UpsertEntities)
+}
+
+func (ncs *notifyingContextSource) UpdateEntities(request Request) (*BatchOperationResult, error) {
+	return ncs.batchChanged(request, true, ncs.ContextSource.UpdateEntities)
+}
+
+func (ncs *notifyingContextSource) batchChanged(request Request, retrieve bool, operation func(Request) (*BatchOperationResult, error)) (*BatchOperationResult, error) {
+	fragments := []map[string]interface{}{}
+	request.DecodeBodyInto(&fragments)
+
+	result, err := operation(request)
+	if err != nil {
+		return result, err
+	}
+
+	failed := map[string]bool{}
+	if result != nil {
+		for _, entityError := range result.Errors {
+			failed[entityError.EntityID] = true
+		}
+	}
+
+	for _, fragment := range fragments {
+		entityID, _ := fragment["id"].(string)
+		if entityID != "" && !failed[entityID] {
+			ncs.entityChanged(entityID, request, fragment, retrieve)
+		}
+	}
+
+	return result, err
+}
+
+//entityChanged reports a changed entity to the subscription manager. When only a fragment
+//of the entity is known, the complete entity is retrieved from the context source if possible.
+func (ncs *notifyingContextSource) entityChanged(entityID string, request Request, fragment map[string]interface{}, retrieve bool) {
+	changedAttributes := []string{}
+	for key := range fragment {
+		if key != "id" && key != "type" && key != "@context" {
+			changedAttributes = append(changedAttributes, key)
+		}
+	}
+
+	var entityMap map[string]interface{}
+
+	if retrieve {
+		retrieved, err := ncs.ContextSource.RetrieveEntity(entityID, newRetrieveRequest(entityID, request))
+		if err == nil && retrieved != nil {
+			entityMap, _ = entityAsMap(retrieved)
+		}
+	}
+
+	if entityMap == nil {
+		entityMap = map[string]interface{}{}
+		for key, value := range fragment {
+			entityMap[key] = value
+		}
+	}
+
+	entityMap["id"] = entityID
+	if _, ok := entityMap["type"]; !ok && fragment["type"] != nil {
+		entityMap["type"] = fragment["type"]
+	}
+
+	ncs.subMgr.EntityChanged(entityMap, changedAttributes)
+}
+
+func requestFragment(request Request) (map[string]interface{}, error) {
+	fragment := map[string]interface{}{}
+	err := request.DecodeBodyInto(&fragment)
+	return fragment, err
+}
+
+//newRetrieveRequest creates a GET request for a single entity, based on the request that
+//modified it, so that the current state of the entity can be retrieved from its source
+func newRetrieveRequest(entityID string, request Request) Request {
+	r := request.Request()
+	req := r.Clone(r.Context())
+
+	basePath := req.URL.Path
+	for _, resource := range []string{"/entities", "/entityOperations"} {
+		if idx := strings.Index(basePath, resource); idx >= 0 {
+			basePath = basePath[:idx]
+			break
+		}
+	}
+
+	req.Method = http.MethodGet
+	req.URL.Path = basePath + "/entities/" + entityID
+	req.URL.RawPath = ""
+	req.URL.RawQuery = ""
+	req.RequestURI = ""
+	req.Body = ioutil.NopCloser(bytes.NewBuffer([]byte{}))
+	req.ContentLength = 0
+	req.Header.Del("Content-Type")
+	req.Header.Del("Content-Length")
+
+	return newRequestWrapper(req)
+}
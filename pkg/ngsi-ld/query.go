@@ -1,11 +1,15 @@
 package ngsi
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
 	"strconv"
 	"strings"
+
+	"github.com/iot-for-tillgenglighet/ngsi-ld-golang/pkg/ngsi-ld/geojson"
 )
 
 //Query is an interface to be used when passing queries to context registries and sources
@@ -13,12 +17,18 @@ type Query interface {
 	HasDeviceReference() bool
 	Device() string
 
+	HasFilter() bool
+	Filter() QueryExpression
+
 	PaginationLimit() uint64
 	PaginationOffset() uint64
 
 	IsGeoQuery() bool
 	Geo() *GeoQuery
 
+	IsTemporalQuery() bool
+	Temporal() *TemporalQuery
+
 	EntityAttributes() []string
 	EntityTypes() []string
 
@@ -26,62 +36,173 @@ type Query interface {
 }
 
 const (
-	//GeoSpatialRelationNearPoint describes a relation as a max or min distance from a Point
+	//GeoSpatialRelationNearPoint describes a relation as a max or min distance from a geometry
 	GeoSpatialRelationNearPoint = "near"
-	//GeoSpatialRelationWithinRect describes a relation as an overlapping polygon
-	GeoSpatialRelationWithinRect = "within"
+	//GeoSpatialRelationWithin describes a relation where an entity is within the query geometry
+	GeoSpatialRelationWithin = "within"
+	//GeoSpatialRelationWithinRect is kept for backwards compatibility. Use GeoSpatialRelationWithin instead.
+	GeoSpatialRelationWithinRect = GeoSpatialRelationWithin
+	//GeoSpatialRelationContains describes a relation where an entity contains the query geometry
+	GeoSpatialRelationContains = "contains"
+	//GeoSpatialRelationIntersects describes a relation where an entity intersects with the query geometry
+	GeoSpatialRelationIntersects = "intersects"
+	//GeoSpatialRelationEquals describes a relation where an entity and the query geometry are equal
+	GeoSpatialRelationEquals = "equals"
+	//GeoSpatialRelationDisjoint describes a relation where an entity does not intersect the query geometry
+	GeoSpatialRelationDisjoint = "disjoint"
+	//GeoSpatialRelationOverlaps describes a relation where an entity and the query geometry partially overlap
+	GeoSpatialRelationOverlaps = "overlaps"
 
 	//QueryDefaultPaginationLimit defines the limit that should be used for GET operations
 	//when the client does not supply a value
 	QueryDefaultPaginationLimit = uint64(1000)
+	//QueryMaxPaginationLimit is the largest limit that a client may supply. Queries with a larger
+	//limit are rejected with a TooManyResults problem, which is why queries that are forwarded to
+	//remote context sources are paged so that they never ask for more entities than this.
+	QueryMaxPaginationLimit = uint64(1000)
 )
 
 //GeoQuery contains information about a geo-query that may be used for subscriptions
 //or when querying entitites
 type GeoQuery struct {
-	Geometry    string    `json:"geometry"`
-	Coordinates []float64 `json:"coordinates"`
-	GeoRel      string    `json:"georel"`
-	GeoProperty *string   `json:"geoproperty,omitempty"`
+	Geometry    geojson.GeoJSONGeometry
+	GeoRel      string
+	GeoProperty *string
 
-	distance uint32
+	distance    uint32
+	maxDistance bool
 }
 
-//Distance returns the required distance in meters from a near Point and a boolean
-//flag indicating if it is inclusive or exclusive
+//Distance returns the required distance in meters from a near geometry and a boolean flag
+//that is true if it is a maxDistance (inclusive) and false if it is a minDistance (exclusive)
 func (gq *GeoQuery) Distance() (uint32, bool) {
-	return gq.distance, true
+	return gq.distance, gq.maxDistance
 }
 
 //Point extracts the position in the enclosed geometry
 func (gq *GeoQuery) Point() (float64, float64, error) {
-	if len(gq.Coordinates) == 2 {
-		return gq.Coordinates[0], gq.Coordinates[1], nil
+	if gq.Geometry != nil && gq.Geometry.GeoPropertyType() == "Point" {
+		point := gq.Geometry.GetAsPoint()
+		return point.Coordinates[0], point.Coordinates[1], nil
+	}
+
+	return 0, 0, errors.New("the GeoQuery does not contain a Point geometry")
+}
+
+//Matches returns true if the supplied geometry fulfills the geospatial relationship with
+//the geometry in this GeoQuery
+func (gq *GeoQuery) Matches(geometry geojson.GeoJSONGeometry) bool {
+	if geometry == nil || gq.Geometry == nil {
+		return false
+	}
+
+	switch gq.GeoRel {
+	case GeoSpatialRelationNearPoint:
+		distance := geojson.DistanceBetween(geometry, gq.Geometry)
+		if gq.maxDistance {
+			return distance <= float64(gq.distance)
+		}
+		return distance >= float64(gq.distance)
+	case GeoSpatialRelationWithin:
+		return geojson.Within(geometry, gq.Geometry)
+	case GeoSpatialRelationContains:
+		return geojson.Contains(geometry, gq.Geometry)
+	case GeoSpatialRelationIntersects:
+		return geojson.Intersects(geometry, gq.Geometry)
+	case GeoSpatialRelationEquals:
+		return geojson.Equals(geometry, gq.Geometry)
+	case GeoSpatialRelationDisjoint:
+		return geojson.Disjoint(geometry, gq.Geometry)
+	case GeoSpatialRelationOverlaps:
+		return geojson.Overlaps(geometry, gq.Geometry)
+	}
+
+	return false
+}
+
+//GeoRelation returns the full georel value, including any distance modifier
+func (gq *GeoQuery) GeoRelation() string {
+	if gq.GeoRel == GeoSpatialRelationNearPoint {
+		modifier := "minDistance"
+		if gq.maxDistance {
+			modifier = "maxDistance"
+		}
+		return fmt.Sprintf("%s;%s==%d", gq.GeoRel, modifier, gq.distance)
+	}
+
+	return gq.GeoRel
+}
+
+//MarshalJSON returns the GeoQuery in the JSON representation used in subscriptions
+func (gq *GeoQuery) MarshalJSON() ([]byte, error) {
+	tmp := struct {
+		Geometry    string          `json:"geometry"`
+		Coordinates json.RawMessage `json:"coordinates"`
+		GeoRel      string          `json:"georel"`
+		GeoProperty *string         `json:"geoproperty,omitempty"`
+	}{
+		GeoRel:      gq.GeoRelation(),
+		GeoProperty: gq.GeoProperty,
+	}
+
+	if gq.Geometry != nil {
+		geometryBytes, err := json.Marshal(gq.Geometry)
+		if err != nil {
+			return nil, err
+		}
+
+		geometry := struct {
+			Type        string          `json:"type"`
+			Coordinates json.RawMessage `json:"coordinates"`
+		}{}
+		json.Unmarshal(geometryBytes, &geometry)
+
+		tmp.Geometry = geometry.Type
+		tmp.Coordinates = geometry.Coordinates
 	}
 
-	return 0, 0, errors.New("invalid number of coordinates in GeoQuery for a Point geometry")
+	return json.Marshal(&tmp)
 }
 
-//Rectangle extracts the two positions (opposing corners) within the enclosed geometry
-func (gq *GeoQuery) Rectangle() (float64, float64, float64, float64, error) {
-	if len(gq.Coordinates) == 6 {
-		//TODO: Use all coordinates and allow for more elaborate polygons. For now we just
-		// 		pick the first and the third coordinates and form a rect from them
-		return gq.Coordinates[0], gq.Coordinates[1], gq.Coordinates[4], gq.Coordinates[5], nil
+//UnmarshalJSON parses and validates a GeoQuery in the JSON representation used in subscriptions
+func (gq *GeoQuery) UnmarshalJSON(data []byte) error {
+	tmp := struct {
+		Geometry    string          `json:"geometry"`
+		Coordinates json.RawMessage `json:"coordinates"`
+		GeoRel      string          `json:"georel"`
+		GeoProperty *string         `json:"geoproperty,omitempty"`
+	}{}
+
+	err := json.Unmarshal(data, &tmp)
+	if err != nil {
+		return err
+	}
+
+	// The coordinates may also be sent as a string with a JSON encoded array
+	coordinates := string(tmp.Coordinates)
+	if strings.HasPrefix(coordinates, "\"") {
+		json.Unmarshal(tmp.Coordinates, &coordinates)
 	}
 
-	return 0, 0, 0, 0, fmt.Errorf("invalid number of coordinates in GeoQuery for a Polygon geometry")
+	parsed, err := newGeoQuery(tmp.GeoRel, tmp.Geometry, coordinates, tmp.GeoProperty)
+	if err != nil {
+		return err
+	}
+
+	*gq = *parsed
+
+	return nil
 }
 
 func newQueryFromParameters(req *http.Request, types []string, attributes []string, q string) (Query, error) {
 
 	var err error
 
-	const refDevicePrefix string = "refDevice==\""
-
 	qw := &queryWrapper{request: req, types: types, attributes: attributes}
 
-	limitparam := req.URL.Query().Get("limit")
+	params := queryParameters(req)
+
+	limitparam := params.Get("limit")
 	if limitparam != "" {
 		limit, err := strconv.ParseInt(limitparam, 10, 64)
 		if err != nil {
@@ -92,7 +213,7 @@ func newQueryFromParameters(req *http.Request, types []string, attributes []stri
 		}
 	}
 
-	offsetparam := req.URL.Query().Get("offset")
+	offsetparam := params.Get("offset")
 	if offsetparam != "" {
 		offset, err := strconv.ParseInt(offsetparam, 10, 64)
 		if err != nil {
@@ -103,38 +224,54 @@ func newQueryFromParameters(req *http.Request, types []string, attributes []stri
 		}
 	}
 
-	if strings.HasPrefix(q, refDevicePrefix) {
-		splitElems := strings.Split(q, "\"")
-		qw.device = &splitElems[1]
+	if q != "" {
+		qw.filter, err = ParseQueryExpression(q)
+		if err != nil {
+			return nil, fmt.Errorf("invalid query expression: %s", err.Error())
+		}
+
+		// The device reference is kept as a convenience for context sources
+		// that only need to filter their entities on the refDevice attribute
+		qw.device = deviceReferenceFromExpression(qw.filter)
 	}
 
-	georel := req.URL.Query().Get("georel")
+	georel := params.Get("georel")
 	if len(georel) > 0 {
-		qw.geoQuery, err = newGeoQueryFromHTTPRequest(georel, req)
-	}
+		var geoproperty *string
+		if gp := params.Get("geoproperty"); gp != "" {
+			geoproperty = &gp
+		}
 
-	return qw, err
-}
+		qw.geoQuery, err = newGeoQuery(georel, params.Get("geometry"), params.Get("coordinates"), geoproperty)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-func newGeoQueryFromHTTPRequest(georel string, req *http.Request) (*GeoQuery, error) {
+	qw.temporalQuery, err = newTemporalQueryFromParameters(params)
+	if err != nil {
+		return nil, err
+	}
 
-	var err error
+	return qw, nil
+}
 
-	if georel == GeoSpatialRelationNearPoint {
-		geoQuery := &GeoQuery{Geometry: "Point", GeoRel: GeoSpatialRelationNearPoint}
+func newGeoQuery(georel, geometry, coordinates string, geoproperty *string) (*GeoQuery, error) {
+	relation := strings.Split(georel, ";")
+	geoQuery := &GeoQuery{GeoRel: relation[0], GeoProperty: geoproperty}
 
-		if req.URL.Query().Get("geometry") != "Point" {
-			return nil, errors.New("the geospatial relationship near is only defined for the geometry type Point")
+	switch geoQuery.GeoRel {
+	case GeoSpatialRelationNearPoint:
+		if len(relation) != 2 {
+			return nil, errors.New("the geospatial relationship near requires either a maxDistance or a minDistance")
 		}
 
-		distanceString := req.URL.Query().Get("maxDistance")
-		if len(distanceString) < 2 || !strings.HasPrefix(distanceString, "=") {
-			return nil, errors.New("required parameter maxDistance missing or invalid")
+		modifier := strings.SplitN(relation[1], "==", 2)
+		if len(modifier) != 2 || (modifier[0] != "maxDistance" && modifier[0] != "minDistance") {
+			return nil, fmt.Errorf("invalid distance modifier %s for the geospatial relationship near", relation[1])
 		}
 
-		distanceString = distanceString[1:]
-		distance, err := strconv.Atoi(distanceString)
-
+		distance, err := strconv.ParseFloat(modifier[1], 64)
 		if err != nil {
 			return nil, errors.New("Failed to parse distance: " + err.Error())
 		}
@@ -144,136 +281,35 @@ func newGeoQueryFromHTTPRequest(georel string, req *http.Request) (*GeoQuery, er
 		}
 
 		geoQuery.distance = uint32(distance)
-
-		geoQuery.Coordinates, err = parseGeometryCoordinates(req.URL.Query().Get("coordinates"))
-		if err != nil {
-			return nil, err
-		}
-
-		if len(geoQuery.Coordinates) != 2 {
-			return nil, fmt.Errorf("expected one position for a Point geometry, but got %d", len(geoQuery.Coordinates)/2)
-		}
-
-		return geoQuery, nil
-	} else if georel == GeoSpatialRelationWithinRect {
-		geoQuery := &GeoQuery{Geometry: "Polygon", GeoRel: GeoSpatialRelationWithinRect}
-
-		if req.URL.Query().Get("geometry") != "Polygon" {
-			return nil, errors.New("the geospatial relationship \"within\" is only defined for the geometry type Polygon")
-		}
-
-		geoQuery.Coordinates, err = parseGeometryCoordinates(req.URL.Query().Get("coordinates"))
-		if err != nil {
-			return nil, err
+		geoQuery.maxDistance = (modifier[0] == "maxDistance")
+	case GeoSpatialRelationWithin, GeoSpatialRelationContains, GeoSpatialRelationIntersects,
+		GeoSpatialRelationEquals, GeoSpatialRelationDisjoint, GeoSpatialRelationOverlaps:
+		if len(relation) != 1 {
+			return nil, fmt.Errorf("the geospatial relationship %s does not accept any modifiers", geoQuery.GeoRel)
 		}
+	default:
+		return nil, fmt.Errorf("unknown geospatial relationship %s", georel)
+	}
 
-		if len(geoQuery.Coordinates) != 6 {
-			return nil, fmt.Errorf("the geospatial relationship \"within\" is only implemented for the Polygon type with five positions describing a bounding rect, but %d positions were received", len(geoQuery.Coordinates)/2)
-		}
+	if geometry == "" || coordinates == "" {
+		return nil, errors.New("a geo-query requires both geometry and coordinates")
+	}
 
-		return geoQuery, nil
+	var err error
+	geoQuery.Geometry, err = parseGeometry(geometry, coordinates)
+	if err != nil {
+		return nil, err
 	}
 
-	return nil, errors.New("only the geo-spatial relationships \"near\" and \"within\" are supported at this time")
+	return geoQuery, nil
 }
 
-func parseGeometryCoordinates(coordparameter string) ([]float64, error) {
-	coordinates := []float64{}
-
-	const init = 0
-	const prelon = 1
-	const lonint = 2
-	const londec = 3
-	const prelat = 4
-	const latint = 5
-	const latdec = 6
-
-	state := init
-
-	lon := 0.0
-	lat := 0.0
-
-	intpart := 0
-	decpart := 0.0
-	decfactor := 1.0
-
-	pdepth := 0
-
-	for i := range coordparameter {
-		b := coordparameter[i]
-
-		if state == init {
-			if b != '[' {
-				return nil, errors.New("coordinates string must start with a [")
-			}
-			state = prelon
-			pdepth++
-			continue
-		}
-
-		if b == '[' {
-			if state != prelon {
-				return nil, fmt.Errorf("unexpected [ at position %d in %s", i, coordparameter)
-			}
-			pdepth++
-		} else if b == ']' {
-			pdepth--
-
-			if pdepth < 0 {
-				return nil, fmt.Errorf("unexpected ] at position %d in %s", i, coordparameter)
-			}
-
-			if state == latint || state == latdec {
-				lat = float64(intpart) + decpart
-				intpart = 0
-				decpart = 0.0
-				decfactor = 1.0
-
-				coordinates = append(coordinates, lon, lat)
-				state = prelon
-			}
-
-			if pdepth == 0 {
-				break
-			}
-		} else if b >= '0' && b <= '9' {
-			if state == prelon {
-				state = lonint
-			} else if state == prelat {
-				state = latint
-			}
-
-			if state == latint || state == lonint {
-				intpart = (intpart * 10) + int(b-'0')
-			} else if state == latdec || state == londec {
-				decfactor /= 10.0
-				decpart += float64(b-'0') * decfactor
-			}
-		} else if b == '.' {
-			if state == latint {
-				state = latdec
-			} else if state == lonint {
-				state = londec
-			}
-		} else if b == ',' {
-			if state == lonint || state == londec {
-				lon = float64(intpart) + decpart
-				intpart = 0
-				decpart = 0.0
-				decfactor = 1.0
-
-				state = prelat
-			}
-		} else {
-			return nil, fmt.Errorf("invalid byte '%c' found at position %d in %s", b, i, coordparameter)
-		}
-	}
-
-	if pdepth > 0 {
-		return nil, fmt.Errorf("missing ] at end of coordinates array %s", coordparameter)
+func parseGeometry(geometry, coordinates string) (geojson.GeoJSONGeometry, error) {
+	g, err := geojson.CreateGeoJSONGeometry(geometry, []byte(coordinates))
+	if err != nil {
+		return nil, fmt.Errorf("invalid geometry in geo-query: %s", err.Error())
 	}
-
-	return coordinates, nil
+	return g, nil
 }
 
 type queryWrapper struct {
@@ -281,17 +317,27 @@ type queryWrapper struct {
 	types      []string
 	attributes []string
 	device     *string
+	filter     QueryExpression
 
 	limit  uint64
 	offset uint64
 
-	geoQuery *GeoQuery
+	geoQuery      *GeoQuery
+	temporalQuery *TemporalQuery
 }
 
 func (q *queryWrapper) HasDeviceReference() bool {
 	return q.device != nil
 }
 
+func (q *queryWrapper) HasFilter() bool {
+	return q.filter != nil
+}
+
+func (q *queryWrapper) Filter() QueryExpression {
+	return q.filter
+}
+
 func (q *queryWrapper) IsGeoQuery() bool {
 	return q.Geo() != nil
 }
@@ -300,6 +346,14 @@ func (q *queryWrapper) Geo() *GeoQuery {
 	return q.geoQuery
 }
 
+func (q *queryWrapper) IsTemporalQuery() bool {
+	return q.temporalQuery != nil
+}
+
+func (q *queryWrapper) Temporal() *TemporalQuery {
+	return q.temporalQuery
+}
+
 func (q *queryWrapper) Device() string {
 	return *q.device
 }
@@ -327,3 +381,50 @@ func (q *queryWrapper) PaginationOffset() uint64 {
 func (q *queryWrapper) Request() *http.Request {
 	return q.request
 }
+
+//queryWithContext returns a copy of a query with its own copy of the request, bound to the
+//supplied context. This allows a query to be passed to several context sources concurrently,
+//since remote sources modify the request before forwarding it.
+func queryWithContext(query Query, ctx context.Context) Query {
+	if qw, ok := query.(*queryWrapper); ok && qw.request != nil {
+		clone := *qw
+		clone.request = qw.request.Clone(ctx)
+		return &clone
+	}
+
+	return query
+}
+
+//queryWithPagination returns a copy of a query where the offset and limit, as well as the
+//corresponding parameters in the request that is forwarded to remote sources, are replaced
+func queryWithPagination(query Query, offset, limit uint64) Query {
+	qw, ok := query.(*queryWrapper)
+	if !ok || qw.request == nil {
+		return query
+	}
+
+	clone := *qw
+	clone.offset = offset
+	clone.limit = limit
+	clone.request = qw.request.Clone(qw.request.Context())
+	clone.request.URL.RawQuery = replacePaginationParameters(qw.request.URL.RawQuery, offset, limit)
+
+	return &clone
+}
+
+//replacePaginationParameters replaces the offset and limit parameters in a raw query string.
+//The other parameters are kept exactly as they are, since they may contain characters such as
+//semicolons that would not survive being parsed and encoded again.
+func replacePaginationParameters(rawQuery string, offset, limit uint64) string {
+	params := []string{}
+
+	for _, param := range strings.Split(rawQuery, "&") {
+		if param != "" && !strings.HasPrefix(param, "offset=") && !strings.HasPrefix(param, "limit=") {
+			params = append(params, param)
+		}
+	}
+
+	params = append(params, fmt.Sprintf("offset=%d", offset), fmt.Sprintf("limit=%d", limit))
+
+	return strings.Join(params, "&")
+}
@@ -1,26 +1,64 @@
 package ngsi
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"testing"
+
+	"github.com/iot-for-tillgenglighet/ngsi-ld-golang/pkg/datamodels/fiware"
+	"github.com/iot-for-tillgenglighet/ngsi-ld-golang/pkg/ngsi-ld/geojson"
 )
 
 func TestGeoCoordinatesParser(t *testing.T) {
-	coords, err := parseGeometryCoordinates("[[2.4,2.1],[3.3,3.7]]")
+	geometry, err := parseGeometry("LineString", "[[2.4,2.1],[3.3,3.7]]")
 	if err != nil {
 		t.Error("Got error from coordinates parser", err)
+		return
 	}
 
-	if len(coords) != 4 {
-		t.Error("Expected 2 coordinates, got", len(coords)/2)
+	line, ok := geometry.(*geojson.GeoJSONPropertyLineString)
+	if !ok {
+		t.Error("Expected a LineString geometry")
+	} else if len(line.Coordinates) != 2 {
+		t.Error("Expected 2 coordinates, got", len(line.Coordinates))
 	} else {
-		if coords[0] != 2.4 || coords[1] != 2.1 {
-			t.Error(fmt.Sprintf("First position should be (2.4,2.1) and not (%f,%f)", coords[0], coords[1]))
+		if line.Coordinates[0][0] != 2.4 || line.Coordinates[0][1] != 2.1 {
+			t.Error(fmt.Sprintf("First position should be (2.4,2.1) and not (%f,%f)", line.Coordinates[0][0], line.Coordinates[0][1]))
 		}
 	}
 }
 
+func TestGeoQueryJSONRoundTrip(t *testing.T) {
+	geoQ := `{"geometry":"Point","coordinates":[17.3,62.4],"georel":"near;maxDistance==2000","geoproperty":"location"}`
+
+	geoQuery := &GeoQuery{}
+	err := json.Unmarshal([]byte(geoQ), geoQuery)
+	if err != nil {
+		t.Error("Failed to unmarshal geo query: ", err.Error())
+		return
+	}
+
+	distance, isMaxDistance := geoQuery.Distance()
+	if geoQuery.GeoRel != GeoSpatialRelationNearPoint || distance != 2000 || !isMaxDistance {
+		t.Errorf("Unexpected georel in unmarshaled geo query: %s", geoQuery.GeoRelation())
+	}
+
+	jsonBytes, _ := json.Marshal(geoQuery)
+	if string(jsonBytes) != geoQ {
+		t.Errorf("Marshaled geo query %s does not match %s", string(jsonBytes), geoQ)
+	}
+}
+
+func TestQueryParametersWithUnencodedSemicolons(t *testing.T) {
+	req, _ := http.NewRequest("GET", createURL("/entities", "type=WeatherObserved", "q=temperature>20;snowHeight<5"), nil)
+
+	params := queryParameters(req)
+	if params.Get("q") != "temperature>20;snowHeight<5" {
+		t.Errorf("Unexpected value of q parameter: %s", params.Get("q"))
+	}
+}
+
 func TestCreateQueryFromParameters(t *testing.T) {
 	req, _ := http.NewRequest("GET", createURL("/entities", "limit=2", "offset=5"), nil)
 
@@ -33,3 +71,43 @@ func TestCreateQueryFromParameters(t *testing.T) {
 		t.Error("newQueryFromParameters failed to parse correct pagination offset")
 	}
 }
+
+func TestGeoQueryMatches(t *testing.T) {
+	geoQuery, err := newGeoQuery("near;maxDistance==2000", "Point", "[17.3069,62.3908]", nil)
+	if err != nil {
+		t.Error("Failed to create geo query: ", err.Error())
+		return
+	}
+
+	if !geoQuery.Matches(geojson.CreateGeoJSONPropertyFromWGS84(17.31, 62.40)) {
+		t.Error("Expected a point within 2 km to match the geo query")
+	}
+
+	if geoQuery.Matches(geojson.CreateGeoJSONPropertyFromWGS84(17.40, 62.40)) {
+		t.Error("Expected a point more than 2 km away to not match the geo query")
+	}
+
+	geoQuery, _ = newGeoQuery("within", "Polygon", "[[[17,62],[18,62],[18,63],[17,63],[17,62]]]", nil)
+
+	if !geoQuery.Matches(geojson.CreateGeoJSONPropertyFromWGS84(17.31, 62.40)) {
+		t.Error("Expected a point inside the polygon to match the geo query")
+	}
+}
+
+func TestEntityMatchesGeoQuery(t *testing.T) {
+	req, _ := http.NewRequest("GET", createURL(
+		"/entities", "georel=within", "geometry=Polygon", "coordinates=[[[17,62],[18,62],[18,63],[17,63],[17,62]]]",
+	), nil)
+	query, _ := newQueryFromParameters(req, []string{"WeatherObserved"}, []string{""}, "")
+
+	inside := fiware.NewWeatherObserved("snow_1", 62.39, 17.30, "2021-05-03T10:00:00Z")
+	outside := fiware.NewWeatherObserved("snow_2", 59.33, 18.07, "2021-05-03T10:00:00Z")
+
+	if matches, _ := EntityMatchesQuery(query, inside); !matches {
+		t.Error("Expected the entity inside the polygon to match the query")
+	}
+
+	if matches, _ := EntityMatchesQuery(query, outside); matches {
+		t.Error("Expected the entity outside the polygon to not match the query")
+	}
+}
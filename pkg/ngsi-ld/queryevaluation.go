@@ -0,0 +1,422 @@
+package ngsi
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/iot-for-tillgenglighet/ngsi-ld-golang/pkg/ngsi-ld/geojson"
+)
+
+//EntityMatchesQuery returns true if the entity is of one of the types in the query and
+//matches the query's filter expression and geo-query (if any). The entity may be any type
+//that can be serialized to JSON, such as the entities in the fiware and diwise packages,
+//or a generic map[string]interface{} in either normalized or keyValues form.
+func EntityMatchesQuery(query Query, entity Entity) (bool, error) {
+	entityMap, err := entityAsMap(entity)
+	if err != nil {
+		return false, err
+	}
+
+	typeMatches := false
+	for _, typeName := range query.EntityTypes() {
+		if typeName == "" || typeName == entityMap["type"] {
+			typeMatches = true
+			break
+		}
+	}
+
+	if !typeMatches {
+		return false, nil
+	}
+
+	if query.IsGeoQuery() && !query.Geo().Matches(entityGeometry(entityMap, query.Geo().GeoProperty)) {
+		return false, nil
+	}
+
+	if !query.HasFilter() {
+		return true, nil
+	}
+
+	return evaluateExpression(query.Filter(), entityMap), nil
+}
+
+//entityGeometry returns the geometry of the named geoproperty of an entity, or of the
+//location property if no name is supplied
+func entityGeometry(entity map[string]interface{}, geoproperty *string) geojson.GeoJSONGeometry {
+	propertyName := "location"
+	if geoproperty != nil {
+		propertyName = *geoproperty
+	}
+
+	values, found := resolveAttributeValues(AttributePath{Name: propertyName}, entity)
+	if !found || len(values) == 0 {
+		return nil
+	}
+
+	geometryBytes, err := json.Marshal(values[0])
+	if err != nil {
+		return nil
+	}
+
+	geometry := struct {
+		Type        string          `json:"type"`
+		Coordinates json.RawMessage `json:"coordinates"`
+	}{}
+
+	err = json.Unmarshal(geometryBytes, &geometry)
+	if err != nil {
+		return nil
+	}
+
+	g, err := geojson.CreateGeoJSONGeometry(geometry.Type, geometry.Coordinates)
+	if err != nil {
+		return nil
+	}
+
+	return g
+}
+
+//EntityMatchesExpression evaluates a parsed query language expression against an entity
+func EntityMatchesExpression(expr QueryExpression, entity Entity) (bool, error) {
+	entityMap, err := entityAsMap(entity)
+	if err != nil {
+		return false, err
+	}
+
+	return evaluateExpression(expr, entityMap), nil
+}
+
+//entityAsMap converts an entity into its generic JSON representation. GeoJSON features are
+//unwrapped so that their properties can be evaluated just like normal entity attributes.
+func entityAsMap(entity Entity) (map[string]interface{}, error) {
+	entityMap, ok := entity.(map[string]interface{})
+
+	if !ok {
+		entityBytes, err := json.Marshal(entity)
+		if err != nil {
+			return nil, fmt.Errorf("unable to convert entity to json: %s", err.Error())
+		}
+
+		entityMap = map[string]interface{}{}
+		err = json.Unmarshal(entityBytes, &entityMap)
+		if err != nil {
+			return nil, fmt.Errorf("unable to convert entity to a generic map: %s", err.Error())
+		}
+	}
+
+	if entityMap["type"] == "Feature" {
+		if properties, ok := entityMap["properties"].(map[string]interface{}); ok {
+			featureMap := map[string]interface{}{"id": entityMap["id"]}
+			for k, v := range properties {
+				featureMap[k] = v
+			}
+			entityMap = featureMap
+		}
+	}
+
+	return entityMap, nil
+}
+
+func evaluateExpression(expr QueryExpression, entity map[string]interface{}) bool {
+	switch e := expr.(type) {
+	case *QueryLogicalExpression:
+		for _, sub := range e.Expressions {
+			matches := evaluateExpression(sub, entity)
+			if e.Operator == QueryOperatorAnd && !matches {
+				return false
+			} else if e.Operator == QueryOperatorOr && matches {
+				return true
+			}
+		}
+		return e.Operator == QueryOperatorAnd
+	case *QueryTerm:
+		return evaluateTerm(e, entity)
+	}
+
+	return false
+}
+
+func evaluateTerm(term *QueryTerm, entity map[string]interface{}) bool {
+	values, found := resolveAttributeValues(term.Attribute, entity)
+
+	if term.Operator == "" {
+		return found
+	}
+
+	if !found {
+		return false
+	}
+
+	if term.Operator == QueryOperatorUnequal {
+		for _, v := range values {
+			if termMatchesValue(term, QueryOperatorEqual, v) {
+				return false
+			}
+		}
+		return true
+	}
+
+	for _, v := range values {
+		if termMatchesValue(term, term.Operator, v) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func termMatchesValue(term *QueryTerm, operator string, value interface{}) bool {
+	if term.Pattern != nil {
+		text, ok := value.(string)
+		if !ok {
+			return false
+		}
+		matches := term.Pattern.MatchString(text)
+		if operator == QueryOperatorNotMatchPattern {
+			return !matches
+		}
+		return matches
+	}
+
+	if term.Range != nil {
+		lower, ok := compareValues(value, term.Range.Min)
+		if !ok || lower < 0 {
+			return false
+		}
+		upper, ok := compareValues(value, term.Range.Max)
+		return ok && upper <= 0
+	}
+
+	for _, qv := range term.Values {
+		cmp, ok := compareValues(value, qv)
+		if !ok {
+			continue
+		}
+
+		switch operator {
+		case QueryOperatorEqual:
+			if cmp == 0 {
+				return true
+			}
+		case QueryOperatorGreaterThan:
+			return cmp > 0
+		case QueryOperatorGreaterOrEqual:
+			return cmp >= 0
+		case QueryOperatorLessThan:
+			return cmp < 0
+		case QueryOperatorLessOrEqual:
+			return cmp <= 0
+		}
+	}
+
+	return false
+}
+
+//resolveAttributeValues follows an attribute path into an entity and returns the value(s)
+//found at the end of it. Multiple values are returned for multi-attributes and array values.
+func resolveAttributeValues(path AttributePath, entity map[string]interface{}) ([]interface{}, bool) {
+	attribute, ok := entity[path.Name]
+	if !ok {
+		return nil, false
+	}
+
+	instances := []interface{}{attribute}
+	if list, ok := attribute.([]interface{}); ok && len(list) > 0 && isNormalizedAttribute(list[0]) {
+		// Multi-attributes are represented as arrays of attribute instances
+		instances = list
+	}
+
+	values := []interface{}{}
+
+	for _, instance := range instances {
+		current := instance
+
+		for _, sub := range path.SubAttributes {
+			current, ok = memberOf(current, sub)
+			if !ok {
+				break
+			}
+		}
+
+		if !ok {
+			continue
+		}
+
+		current = attributeValue(current)
+
+		for _, member := range path.ValuePath {
+			current, ok = memberOf(current, member)
+			if !ok {
+				break
+			}
+		}
+
+		if !ok {
+			continue
+		}
+
+		if list, isList := current.([]interface{}); isList {
+			for _, item := range list {
+				values = append(values, attributeValue(item))
+			}
+		} else {
+			values = append(values, current)
+		}
+	}
+
+	return values, len(values) > 0
+}
+
+func isNormalizedAttribute(v interface{}) bool {
+	attribute, ok := v.(map[string]interface{})
+	if !ok {
+		return false
+	}
+
+	switch attribute["type"] {
+	case "Property", "Relationship", "GeoProperty", "LanguageProperty":
+		return true
+	}
+
+	return false
+}
+
+//attributeValue returns the value of a normalized Property, the object of a Relationship
+//or the contents of a typed JSON-LD value such as a DateTime. Values in keyValues form
+//are returned as is.
+func attributeValue(v interface{}) interface{} {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return v
+	}
+
+	if isNormalizedAttribute(m) {
+		if m["type"] == "Relationship" {
+			return m["object"]
+		}
+		return attributeValue(m["value"])
+	}
+
+	if typedValue, ok := m["@value"]; ok {
+		return typedValue
+	}
+
+	return v
+}
+
+func memberOf(v interface{}, name string) (interface{}, bool) {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+
+	member, ok := m[name]
+	if !ok && isNormalizedAttribute(m) {
+		// Sub-attributes are not available in the keyValues form, so fall back to
+		// looking for the member inside the value instead
+		member, ok = memberOf(attributeValue(m), name)
+	}
+
+	return member, ok
+}
+
+//compareValues compares an entity value with a query value and returns -1, 0 or 1 if the
+//entity value is less than, equal to or greater than the query value. The returned flag
+//is false if the values are not comparable.
+func compareValues(value interface{}, qv QueryValue) (int, bool) {
+	switch qv.Type {
+	case QueryValueNumber:
+		var number float64
+		switch v := value.(type) {
+		case float64:
+			number = v
+		case string:
+			var err error
+			number, err = strconv.ParseFloat(v, 64)
+			if err != nil {
+				return 0, false
+			}
+		default:
+			return 0, false
+		}
+		return compareFloats(number, qv.Number), true
+	case QueryValueString, QueryValueURI:
+		text, ok := value.(string)
+		if !ok {
+			return 0, false
+		}
+		return strings.Compare(text, qv.Text), true
+	case QueryValueBoolean:
+		b, ok := value.(bool)
+		if !ok {
+			if text, isString := value.(string); isString {
+				b, ok = (text == "true"), (text == "true" || text == "false")
+			}
+		}
+		if !ok || b != qv.Boolean {
+			return 1, ok
+		}
+		return 0, true
+	case QueryValueDateTime, QueryValueDate, QueryValueTime:
+		text, ok := value.(string)
+		if !ok {
+			return 0, false
+		}
+		return compareTemporalValues(text, qv)
+	}
+
+	return 0, false
+}
+
+func compareFloats(a, b float64) int {
+	if a < b {
+		return -1
+	} else if a > b {
+		return 1
+	}
+	return 0
+}
+
+func compareTemporalValues(text string, qv QueryValue) (int, bool) {
+	var t time.Time
+	var err error
+
+	switch qv.Type {
+	case QueryValueDateTime:
+		t, err = time.Parse(time.RFC3339Nano, text)
+	case QueryValueDate:
+		t, err = time.Parse(time.RFC3339Nano, text)
+		if err == nil {
+			t = t.UTC()
+			t = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+		} else {
+			t, err = time.Parse("2006-01-02", text)
+		}
+	case QueryValueTime:
+		t, err = time.Parse(time.RFC3339Nano, text)
+		if err == nil {
+			t = t.UTC()
+			t = time.Date(0, 1, 1, t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC)
+		} else {
+			t, err = time.Parse("15:04:05.999999999Z07:00", text)
+		}
+	}
+
+	if err != nil {
+		return 0, false
+	}
+
+	reference := qv.Time.UTC()
+	t = t.UTC()
+
+	if t.Before(reference) {
+		return -1, true
+	} else if t.After(reference) {
+		return 1, true
+	}
+
+	return 0, true
+}
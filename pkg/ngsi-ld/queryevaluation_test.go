@@ -0,0 +1,121 @@
+package ngsi
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/iot-for-tillgenglighet/ngsi-ld-golang/pkg/datamodels/fiware"
+	"github.com/iot-for-tillgenglighet/ngsi-ld-golang/pkg/ngsi-ld/geojson"
+	"github.com/iot-for-tillgenglighet/ngsi-ld-golang/pkg/ngsi-ld/types"
+)
+
+func TestEntityMatchesExpressionWithDatamodelStructs(t *testing.T) {
+	wo := fiware.NewWeatherObserved("snow_1", 62.39, 17.30, "2021-05-03T10:00:00Z")
+	wo.Temperature = types.NewNumberProperty(21.5)
+	wo.SnowHeight = types.NewNumberProperty(2)
+
+	beach := fiware.NewBeach("omaha", "Omaha Beach", geojson.CreateGeoJSONPropertyFromWGS84(17.3, 62.4))
+
+	testCases := []struct {
+		q        string
+		entity   Entity
+		expected bool
+	}{
+		{"temperature>20;snowHeight<5", wo, true},
+		{"temperature>20;snowHeight>5", wo, false},
+		{"temperature>30|snowHeight==2", wo, true},
+		{"temperature==20..22", wo, true},
+		{"temperature!=20..22", wo, false},
+		{"refDevice==urn:ngsi-ld:Device:snow_1", wo, true},
+		{"dateObserved>2021-05-03T09:00:00Z", wo, true},
+		{"dateObserved<2021-05-03T09:00:00Z", wo, false},
+		{"dateObserved==2021-05-03", wo, true},
+		{"waterTemperature", wo, false},
+		{"name~=.*Beach", beach, true},
+		{"name~=(?i)^(utah|omaha).*", beach, true},
+		{"name!~=.*Beach", beach, false},
+		{"name==\"Omaha Beach\",\"Utah Beach\"", beach, true},
+		{"name==\"Gold Beach\",\"Utah Beach\"", beach, false},
+	}
+
+	for _, tc := range testCases {
+		expr, err := ParseQueryExpression(tc.q)
+		if err != nil {
+			t.Errorf("Failed to parse query %s: %s", tc.q, err.Error())
+			continue
+		}
+
+		matches, err := EntityMatchesExpression(expr, tc.entity)
+		if err != nil {
+			t.Errorf("Failed to evaluate query %s: %s", tc.q, err.Error())
+		} else if matches != tc.expected {
+			t.Errorf("Query %s evaluated to %t, expected %t", tc.q, matches, tc.expected)
+		}
+	}
+}
+
+func TestEntityMatchesExpressionWithGenericMaps(t *testing.T) {
+	normalized := map[string]interface{}{
+		"id":   "urn:ngsi-ld:Beach:omaha",
+		"type": "Beach",
+		"waterTemperature": map[string]interface{}{
+			"type": "Property", "value": 7.2, "observedAt": "2021-05-03T10:00:00Z",
+			"accuracy": map[string]interface{}{"type": "Property", "value": 0.1},
+		},
+		"address": map[string]interface{}{
+			"type": "Property", "value": map[string]interface{}{"addressLocality": "Sundsvall"},
+		},
+	}
+
+	keyValues := map[string]interface{}{
+		"id":               "urn:ngsi-ld:Beach:omaha",
+		"type":             "Beach",
+		"waterTemperature": "7.2",
+		"address":          map[string]interface{}{"addressLocality": "Sundsvall"},
+		"isOpen":           true,
+	}
+
+	testCases := []struct {
+		q        string
+		entity   Entity
+		expected bool
+	}{
+		{"waterTemperature>5", normalized, true},
+		{"waterTemperature.accuracy<0.5", normalized, true},
+		{"waterTemperature.observedAt>=2021-05-03T10:00:00Z", normalized, true},
+		{"address[addressLocality]==\"Sundsvall\"", normalized, true},
+		{"waterTemperature>5", keyValues, true},
+		{"address[addressLocality]==\"Sundsvall\"", keyValues, true},
+		{"isOpen==true", keyValues, true},
+		{"isOpen==false", keyValues, false},
+	}
+
+	for _, tc := range testCases {
+		expr, _ := ParseQueryExpression(tc.q)
+
+		matches, err := EntityMatchesExpression(expr, tc.entity)
+		if err != nil {
+			t.Errorf("Failed to evaluate query %s: %s", tc.q, err.Error())
+		} else if matches != tc.expected {
+			t.Errorf("Query %s evaluated to %t, expected %t", tc.q, matches, tc.expected)
+		}
+	}
+}
+
+func TestEntityMatchesQueryChecksEntityType(t *testing.T) {
+	req, _ := http.NewRequest("GET", createURL("/entities"), nil)
+	query, _ := newQueryFromParameters(req, []string{"Beach"}, []string{""}, "waterTemperature>5")
+
+	beach := fiware.NewBeach("omaha", "Omaha Beach", nil)
+	beach.WaterTemperature = types.NewNumberProperty(7.2)
+
+	if matches, _ := EntityMatchesQuery(query, beach); !matches {
+		t.Error("Expected the beach to match the query")
+	}
+
+	wqo := fiware.NewWaterQualityObserved("sensor", 62.39, 17.30, "2021-05-03T10:00:00Z")
+
+	if matches, _ := EntityMatchesQuery(query, wqo); matches {
+		t.Error("Expected an entity of another type to not match the query")
+	}
+}
@@ -0,0 +1,580 @@
+package ngsi
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	//QueryOperatorAnd is the logical operator used to require that all terms match
+	QueryOperatorAnd = ";"
+	//QueryOperatorOr is the logical operator used to require that at least one term matches
+	QueryOperatorOr = "|"
+
+	//QueryOperatorEqual matches values that are equal to a value, a list of values or a range
+	QueryOperatorEqual = "=="
+	//QueryOperatorUnequal matches values that are not equal to a value, a list of values or a range
+	QueryOperatorUnequal = "!="
+	//QueryOperatorGreaterThan matches values that are greater than a value
+	QueryOperatorGreaterThan = ">"
+	//QueryOperatorGreaterOrEqual matches values that are greater than or equal to a value
+	QueryOperatorGreaterOrEqual = ">="
+	//QueryOperatorLessThan matches values that are less than a value
+	QueryOperatorLessThan = "<"
+	//QueryOperatorLessOrEqual matches values that are less than or equal to a value
+	QueryOperatorLessOrEqual = "<="
+	//QueryOperatorMatchPattern matches string values against a regular expression
+	QueryOperatorMatchPattern = "~="
+	//QueryOperatorNotMatchPattern matches string values that do not match a regular expression
+	QueryOperatorNotMatchPattern = "!~="
+)
+
+//QueryValueType describes what kind of value a QueryValue holds
+type QueryValueType int
+
+const (
+	//QueryValueNumber is a numeric value, such as 20 or -3.5
+	QueryValueNumber QueryValueType = iota
+	//QueryValueString is a quoted string value, such as "Stranden"
+	QueryValueString
+	//QueryValueBoolean is either true or false
+	QueryValueBoolean
+	//QueryValueDateTime is a date and time value, such as 2021-05-03T10:00:00Z
+	QueryValueDateTime
+	//QueryValueDate is a date value, such as 2021-05-03
+	QueryValueDate
+	//QueryValueTime is a time value, such as 10:00:00Z
+	QueryValueTime
+	//QueryValueURI is an unquoted URI, such as urn:ngsi-ld:Device:mydevice
+	QueryValueURI
+)
+
+//QueryExpression is a node in the syntax tree that is created when parsing the q parameter
+//of a query. It is either a QueryLogicalExpression or a QueryTerm.
+type QueryExpression interface {
+	String() string
+}
+
+//QueryLogicalExpression combines two or more expressions using either the AND (;) or OR (|) operator
+type QueryLogicalExpression struct {
+	Operator    string
+	Expressions []QueryExpression
+}
+
+func (qle *QueryLogicalExpression) String() string {
+	terms := []string{}
+	for _, e := range qle.Expressions {
+		if _, ok := e.(*QueryLogicalExpression); ok {
+			terms = append(terms, "("+e.String()+")")
+		} else {
+			terms = append(terms, e.String())
+		}
+	}
+	return strings.Join(terms, qle.Operator)
+}
+
+//AttributePath identifies an attribute, and optionally a sub-attribute (using . notation) or a
+//member of a structured value (using [ ] notation), that a QueryTerm applies to
+type AttributePath struct {
+	Name          string
+	SubAttributes []string
+	ValuePath     []string
+}
+
+func (ap AttributePath) String() string {
+	path := ap.Name
+	for _, s := range ap.SubAttributes {
+		path = path + "." + s
+	}
+	for _, v := range ap.ValuePath {
+		path = path + "[" + v + "]"
+	}
+	return path
+}
+
+//QueryValue is a typed value that an attribute should be compared to
+type QueryValue struct {
+	Type    QueryValueType
+	Number  float64
+	Text    string
+	Boolean bool
+	Time    time.Time
+}
+
+func (qv QueryValue) String() string {
+	if qv.Type == QueryValueString {
+		return strconv.Quote(qv.Text)
+	}
+	return qv.Text
+}
+
+//QueryRange is an inclusive range of values, such as 10..20
+type QueryRange struct {
+	Min QueryValue
+	Max QueryValue
+}
+
+//QueryTerm is a single condition for an attribute. A term without an operator only
+//requires that the attribute exists. Equality operators may be used together with a
+//single value, a list of values or a range, while the pattern operators use a regexp.
+type QueryTerm struct {
+	Attribute AttributePath
+	Operator  string
+	Values    []QueryValue
+	Range     *QueryRange
+	Pattern   *regexp.Regexp
+}
+
+func (qt *QueryTerm) String() string {
+	term := qt.Attribute.String()
+
+	if qt.Operator == "" {
+		return term
+	}
+
+	term = term + qt.Operator
+
+	if qt.Pattern != nil {
+		return term + qt.Pattern.String()
+	} else if qt.Range != nil {
+		return term + qt.Range.Min.String() + ".." + qt.Range.Max.String()
+	}
+
+	values := []string{}
+	for _, v := range qt.Values {
+		values = append(values, v.String())
+	}
+
+	return term + strings.Join(values, ",")
+}
+
+//ParseQueryExpression parses a string in the NGSI-LD query language, such as the
+//q parameter in a query, and returns the resulting syntax tree
+func ParseQueryExpression(q string) (QueryExpression, error) {
+	p := &queryParser{q: q}
+
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	if !p.atEnd() {
+		return nil, p.errorf("unexpected character '%c'", p.peek())
+	}
+
+	return expr, nil
+}
+
+//translateQueryAttributes replaces the attribute and sub-attribute names in a query expression,
+//while keeping the rest of the expression exactly as it is. Expressions that can not be parsed
+//are returned unchanged, so that they can be rejected with a proper error when they are used.
+func translateQueryAttributes(q string, translate func(string) string) string {
+	p := &queryParser{q: q}
+
+	if _, err := p.parseOr(); err != nil || !p.atEnd() {
+		return q
+	}
+
+	for idx := len(p.attributeNames) - 1; idx >= 0; idx-- {
+		start, end := p.attributeNames[idx][0], p.attributeNames[idx][1]
+		q = q[:start] + translate(q[start:end]) + q[end:]
+	}
+
+	return q
+}
+
+type queryParser struct {
+	q   string
+	pos int
+
+	//attributeNames are the start and end positions of the attribute and sub-attribute names
+	//in the query, which makes it possible to translate the names without changing anything else
+	attributeNames [][2]int
+}
+
+func (p *queryParser) atEnd() bool {
+	return p.pos >= len(p.q)
+}
+
+func (p *queryParser) peek() byte {
+	if p.atEnd() {
+		return 0
+	}
+	return p.q[p.pos]
+}
+
+func (p *queryParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("%s at position %d in query %s", fmt.Sprintf(format, args...), p.pos, p.q)
+}
+
+func (p *queryParser) parseOr() (QueryExpression, error) {
+	return p.parseLogical(QueryOperatorOr, p.parseAnd)
+}
+
+func (p *queryParser) parseAnd() (QueryExpression, error) {
+	return p.parseLogical(QueryOperatorAnd, p.parsePrimary)
+}
+
+func (p *queryParser) parseLogical(operator string, parseOperand func() (QueryExpression, error)) (QueryExpression, error) {
+	expr, err := parseOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	expressions := []QueryExpression{expr}
+
+	for !p.atEnd() && p.peek() == operator[0] {
+		p.pos++
+		expr, err = parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		expressions = append(expressions, expr)
+	}
+
+	if len(expressions) == 1 {
+		return expressions[0], nil
+	}
+
+	return &QueryLogicalExpression{Operator: operator, Expressions: expressions}, nil
+}
+
+func (p *queryParser) parsePrimary() (QueryExpression, error) {
+	if p.atEnd() {
+		return nil, p.errorf("unexpected end of query")
+	}
+
+	if p.peek() == '(' {
+		p.pos++
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ')' {
+			return nil, p.errorf("missing )")
+		}
+		p.pos++
+		return expr, nil
+	}
+
+	return p.parseTerm()
+}
+
+func isAttributeNameChar(b byte) bool {
+	return (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z') || (b >= '0' && b <= '9') ||
+		b == '_' || b == '-' || b == ':' || b == '@' || b == '#' || b == '/'
+}
+
+//iriSchemeRegexp matches the start of an expanded attribute name, such as https://example.org/ns#temp
+var iriSchemeRegexp = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9+\-]*://`)
+
+func (p *queryParser) parseAttributeName() (string, error) {
+	start := p.pos
+	for !p.atEnd() && isAttributeNameChar(p.peek()) {
+		p.pos++
+	}
+
+	// The dots in an expanded attribute name are part of the name, so such a name can not
+	// be followed by sub-attributes
+	if iriSchemeRegexp.MatchString(p.q[start:p.pos]) {
+		for !p.atEnd() && (isAttributeNameChar(p.peek()) || p.peek() == '.') {
+			p.pos++
+		}
+	}
+
+	if start == p.pos {
+		if p.atEnd() {
+			return "", p.errorf("expected attribute name but found end of query")
+		}
+		return "", p.errorf("expected attribute name but found '%c'", p.peek())
+	}
+
+	return p.q[start:p.pos], nil
+}
+
+func (p *queryParser) parseAttributePath() (AttributePath, error) {
+	path := AttributePath{}
+
+	var err error
+	start := p.pos
+	path.Name, err = p.parseAttributeName()
+	if err != nil {
+		return path, err
+	}
+	p.attributeNames = append(p.attributeNames, [2]int{start, p.pos})
+
+	for p.peek() == '.' {
+		p.pos++
+		start = p.pos
+		subAttribute, err := p.parseAttributeName()
+		if err != nil {
+			return path, err
+		}
+		p.attributeNames = append(p.attributeNames, [2]int{start, p.pos})
+		path.SubAttributes = append(path.SubAttributes, subAttribute)
+	}
+
+	for p.peek() == '[' {
+		p.pos++
+		member, err := p.parseAttributeName()
+		if err != nil {
+			return path, err
+		}
+		if p.peek() != ']' {
+			return path, p.errorf("missing ]")
+		}
+		p.pos++
+		path.ValuePath = append(path.ValuePath, member)
+	}
+
+	return path, nil
+}
+
+func (p *queryParser) parseOperator() string {
+	operators := []string{
+		QueryOperatorNotMatchPattern, QueryOperatorEqual, QueryOperatorUnequal,
+		QueryOperatorGreaterOrEqual, QueryOperatorLessOrEqual, QueryOperatorMatchPattern,
+		QueryOperatorGreaterThan, QueryOperatorLessThan,
+	}
+
+	for _, op := range operators {
+		if strings.HasPrefix(p.q[p.pos:], op) {
+			p.pos += len(op)
+			return op
+		}
+	}
+
+	return ""
+}
+
+func (p *queryParser) parseTerm() (QueryExpression, error) {
+	attribute, err := p.parseAttributePath()
+	if err != nil {
+		return nil, err
+	}
+
+	term := &QueryTerm{Attribute: attribute}
+
+	if p.atEnd() || p.peek() == ';' || p.peek() == '|' || p.peek() == ')' {
+		return term, nil
+	}
+
+	term.Operator = p.parseOperator()
+	if term.Operator == "" {
+		return nil, p.errorf("unexpected character '%c' after attribute %s", p.peek(), attribute.String())
+	}
+
+	if term.Operator == QueryOperatorMatchPattern || term.Operator == QueryOperatorNotMatchPattern {
+		term.Pattern, err = p.parsePattern()
+		return term, err
+	}
+
+	value, err := p.parseValue()
+	if err != nil {
+		return nil, err
+	}
+
+	term.Values = []QueryValue{value}
+
+	isEqualityOperator := (term.Operator == QueryOperatorEqual || term.Operator == QueryOperatorUnequal)
+
+	if strings.HasPrefix(p.q[p.pos:], "..") {
+		if !isEqualityOperator {
+			return nil, p.errorf("ranges can only be used with the == and != operators")
+		}
+
+		p.pos += 2
+		max, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+
+		if value.Type == QueryValueBoolean || value.Type == QueryValueURI || value.Type != max.Type {
+			return nil, p.errorf("invalid range %s..%s", value.String(), max.String())
+		}
+
+		term.Range = &QueryRange{Min: value, Max: max}
+		term.Values = nil
+		return term, nil
+	}
+
+	for p.peek() == ',' {
+		if !isEqualityOperator {
+			return nil, p.errorf("value lists can only be used with the == and != operators")
+		}
+
+		p.pos++
+		value, err = p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		term.Values = append(term.Values, value)
+	}
+
+	if !isEqualityOperator && (value.Type == QueryValueBoolean || value.Type == QueryValueURI) {
+		return nil, p.errorf("the %s operator requires a comparable value", term.Operator)
+	}
+
+	return term, nil
+}
+
+//parsePattern reads a regular expression that ends at a logical operator or at an unbalanced
+//closing parenthesis. This means that any alternation (|) must be put inside parentheses.
+func (p *queryParser) parsePattern() (*regexp.Regexp, error) {
+	start := p.pos
+	depth := 0
+	escaped := false
+
+	for ; !p.atEnd(); p.pos++ {
+		b := p.peek()
+
+		if escaped {
+			escaped = false
+			continue
+		}
+
+		if b == '\\' {
+			escaped = true
+		} else if b == '(' {
+			depth++
+		} else if b == ')' {
+			if depth == 0 {
+				break
+			}
+			depth--
+		} else if (b == ';' || b == '|') && depth == 0 {
+			break
+		}
+	}
+
+	pattern := p.q[start:p.pos]
+	if pattern == "" {
+		return nil, p.errorf("missing regular expression")
+	}
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, p.errorf("invalid regular expression %s (%s)", pattern, err.Error())
+	}
+
+	return re, nil
+}
+
+func (p *queryParser) parseValue() (QueryValue, error) {
+	if p.atEnd() {
+		return QueryValue{}, p.errorf("expected a value but found end of query")
+	}
+
+	if p.peek() == '"' {
+		return p.parseQuotedString()
+	}
+
+	start := p.pos
+	for !p.atEnd() {
+		b := p.peek()
+		if b == ';' || b == '|' || b == ')' || b == ',' || strings.HasPrefix(p.q[p.pos:], "..") {
+			break
+		}
+		p.pos++
+	}
+
+	raw := p.q[start:p.pos]
+	if raw == "" {
+		return QueryValue{}, p.errorf("expected a value")
+	}
+
+	value := QueryValue{Text: raw}
+
+	if raw == "true" || raw == "false" {
+		value.Type = QueryValueBoolean
+		value.Boolean = (raw == "true")
+		return value, nil
+	}
+
+	if number, err := strconv.ParseFloat(raw, 64); err == nil {
+		value.Type = QueryValueNumber
+		value.Number = number
+		return value, nil
+	}
+
+	if t, err := time.Parse(time.RFC3339Nano, raw); err == nil {
+		value.Type = QueryValueDateTime
+		value.Time = t
+		return value, nil
+	}
+
+	if t, err := time.Parse("2006-01-02", raw); err == nil {
+		value.Type = QueryValueDate
+		value.Time = t
+		return value, nil
+	}
+
+	for _, layout := range []string{"15:04:05.999999999Z07:00", "15:04:05.999999999"} {
+		if t, err := time.Parse(layout, raw); err == nil {
+			value.Type = QueryValueTime
+			value.Time = t
+			return value, nil
+		}
+	}
+
+	if strings.Contains(raw, ":") && !strings.ContainsAny(raw, " \"<>\\^`{}") {
+		value.Type = QueryValueURI
+		return value, nil
+	}
+
+	return QueryValue{}, fmt.Errorf("invalid value %s in query %s (string values must be quoted)", raw, p.q)
+}
+
+func (p *queryParser) parseQuotedString() (QueryValue, error) {
+	// Skip the leading quote
+	p.pos++
+
+	text := strings.Builder{}
+	escaped := false
+
+	for !p.atEnd() {
+		b := p.peek()
+		p.pos++
+
+		if escaped {
+			text.WriteByte(b)
+			escaped = false
+		} else if b == '\\' {
+			escaped = true
+		} else if b == '"' {
+			return QueryValue{Type: QueryValueString, Text: text.String()}, nil
+		} else {
+			text.WriteByte(b)
+		}
+	}
+
+	return QueryValue{}, p.errorf("missing \" at end of string value")
+}
+
+//deviceReferenceFromExpression looks for a refDevice=="<device id>" term that must be
+//matched for the whole expression to match, and returns the device id if found
+func deviceReferenceFromExpression(expr QueryExpression) *string {
+	switch e := expr.(type) {
+	case *QueryTerm:
+		if e.Attribute.Name == "refDevice" && len(e.Attribute.SubAttributes) == 0 &&
+			e.Operator == QueryOperatorEqual && len(e.Values) == 1 {
+			if e.Values[0].Type == QueryValueString || e.Values[0].Type == QueryValueURI {
+				device := e.Values[0].Text
+				return &device
+			}
+		}
+	case *QueryLogicalExpression:
+		if e.Operator == QueryOperatorAnd {
+			for _, sub := range e.Expressions {
+				if device := deviceReferenceFromExpression(sub); device != nil {
+					return device
+				}
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,132 @@
+package ngsi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestParseQueryExpressions(t *testing.T) {
+	expressions := []string{
+		"temperature>20",
+		"temperature>20;snowHeight<5",
+		"temperature>20|snowHeight<5",
+		"(temperature>20|snowHeight<5);name==\"Stranden\"",
+		"name~=.*strand.*",
+		"name!~=(?i)(omaha|utah)",
+		"temperature==15..25",
+		"name==\"Stranden\",\"Omaha\"",
+		"refDevice==urn:ngsi-ld:Device:mydevice",
+		"dateObserved>=2021-05-03T10:00:00Z",
+		"dateObserved==2021-05-01..2021-05-31",
+		"isOpen==true",
+		"address[city]==\"Sundsvall\"",
+		"temperature.accuracy<0.5",
+		"waterTemperature",
+	}
+
+	for _, q := range expressions {
+		expr, err := ParseQueryExpression(q)
+		if err != nil {
+			t.Errorf("Failed to parse query expression %s: %s", q, err.Error())
+		} else if expr.String() != q {
+			t.Errorf("Parsed expression %s does not match the original query %s", expr.String(), q)
+		}
+	}
+}
+
+func TestParseQueryWithExpandedAttributeName(t *testing.T) {
+	expr, err := ParseQueryExpression("https://example.org/ns#temp>20")
+	if err != nil {
+		t.Error("Failed to parse query expression: ", err.Error())
+		return
+	}
+
+	term, ok := expr.(*QueryTerm)
+	if !ok || term.Attribute.Name != "https://example.org/ns#temp" || len(term.Attribute.SubAttributes) != 0 {
+		t.Errorf("Expected the expanded attribute name to be kept whole, but got %s", expr.String())
+	}
+
+	translated := translateQueryAttributes("https://example.org/ns#temp>20;temperature.accuracy<0.5", func(name string) string {
+		return "<" + name + ">"
+	})
+
+	if translated != "<https://example.org/ns#temp>>20;<temperature>.<accuracy><0.5" {
+		t.Error("Unexpected translation of expanded attribute names: ", translated)
+	}
+}
+
+func TestParseQueryExpressionPrecedence(t *testing.T) {
+	expr, err := ParseQueryExpression("a==1|b==2;c==3")
+	if err != nil {
+		t.Error("Failed to parse query expression: ", err.Error())
+		return
+	}
+
+	or, ok := expr.(*QueryLogicalExpression)
+	if !ok || or.Operator != QueryOperatorOr || len(or.Expressions) != 2 {
+		t.Errorf("Expected an OR expression with two operands, but got %s", expr.String())
+		return
+	}
+
+	and, ok := or.Expressions[1].(*QueryLogicalExpression)
+	if !ok || and.Operator != QueryOperatorAnd {
+		t.Errorf("Expected the second operand to be an AND expression, but got %s", or.Expressions[1].String())
+	}
+}
+
+func TestParseMalformedQueryExpressions(t *testing.T) {
+	expressions := []string{
+		"",
+		"temperature>",
+		"temperature>>20",
+		"(temperature>20",
+		"temperature>20)",
+		"temperature>20;",
+		"name==Stranden",
+		"temperature>15..25",
+		"temperature<1,2",
+		"name~=(unclosed",
+		"address[city==\"Sundsvall\"",
+		"name==\"Stranden",
+	}
+
+	for _, q := range expressions {
+		_, err := ParseQueryExpression(q)
+		if err == nil {
+			t.Errorf("Expected parsing of malformed query expression %s to fail", q)
+		}
+	}
+}
+
+func TestQueryWithDeviceReferenceInCompoundExpression(t *testing.T) {
+	req, _ := http.NewRequest("GET", createURL("/entities"), nil)
+
+	query, err := newQueryFromParameters(
+		req, []string{"WeatherObserved"}, []string{""}, "snowHeight>0;refDevice==\"urn:ngsi-ld:Device:snow\"",
+	)
+	if err != nil {
+		t.Error("newQueryFromParameters failed with " + err.Error())
+		return
+	}
+
+	if !query.HasDeviceReference() || query.Device() != "urn:ngsi-ld:Device:snow" {
+		t.Error("Failed to derive the device reference from the query expression")
+	}
+
+	if !query.HasFilter() {
+		t.Error("Expected the query to have a filter")
+	}
+}
+
+func TestGetEntitiesWithMalformedQueryFails(t *testing.T) {
+	req, _ := http.NewRequest("GET", createURL("/entities", "type=WeatherObserved", "q="+url.QueryEscape("temperature>>20")), nil)
+	w := httptest.NewRecorder()
+
+	NewQueryEntitiesHandler(NewContextRegistry()).ServeHTTP(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Error("Wrong response code for malformed query. ", w.Code, " is not ", http.StatusBadRequest)
+	}
+}
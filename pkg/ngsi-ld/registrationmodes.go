@@ -0,0 +1,365 @@
+package ngsi
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+)
+
+//sourceMode returns the registration mode of a context source. Sources without a registration,
+//such as local in-memory sources, are treated as inclusive.
+func sourceMode(src ContextSource) string {
+	if reg, ok := sourceRegistration(src); ok {
+		if csr, ok := reg.(*ctxSrcReg); ok && csr.Mode != "" {
+			return csr.Mode
+		}
+	}
+	return RegistrationModeInclusive
+}
+
+//sourcesForReading selects the context sources that should be used to read entities, given
+//all the sources that match a request.
+//
+//Exclusive sources come first, and only take precedence for the entities and attributes that
+//they register, which are hidden from the other sources. Redirect sources come next, and in the
+//same way take precedence over inclusive sources for the information that they register, so
+//that their results are never merged with local information. Auxiliary sources are always
+//included, but after the other sources, as they only augment them.
+func sourcesForReading(sources []ContextSource) []ContextSource {
+	return selectSourcesByMode(sources, true)
+}
+
+//sourcesForWriting selects the context sources that should be used to create, update or delete
+//entities. The same precedence as for reading applies, but auxiliary sources are never written to.
+func sourcesForWriting(sources []ContextSource) []ContextSource {
+	return selectSourcesByMode(sources, false)
+}
+
+func selectSourcesByMode(sources []ContextSource, includeAuxiliary bool) []ContextSource {
+	byMode := map[string][]ContextSource{}
+
+	for _, src := range sources {
+		mode := sourceMode(src)
+		byMode[mode] = append(byMode[mode], src)
+	}
+
+	selected := []ContextSource{}
+	claims := sourceClaims{}
+
+	// Each mode is hidden from the information claimed by the modes that take precedence over it
+	addSources := func(sources []ContextSource) {
+		for _, src := range sources {
+			if len(claims) > 0 {
+				src = &claimTrimmingSource{ContextSource: src, claims: claims}
+			}
+			selected = append(selected, src)
+		}
+	}
+
+	addSources(byMode[RegistrationModeExclusive])
+	claims = claimsOf(byMode[RegistrationModeExclusive])
+
+	addSources(byMode[RegistrationModeRedirect])
+	claims = append(claims, claimsOf(byMode[RegistrationModeRedirect])...)
+
+	addSources(byMode[RegistrationModeInclusive])
+
+	if includeAuxiliary {
+		addSources(byMode[RegistrationModeAuxiliary])
+	}
+
+	return selected
+}
+
+//isRedirectSource returns true if the results of a context source should be passed on without
+//being merged with the results of other sources
+func isRedirectSource(src ContextSource) bool {
+	return sourceMode(src) == RegistrationModeRedirect
+}
+
+//sourceClaim is the information that an exclusive or redirect registration claims, i.e. the
+//registered attributes of the registered entities, or all of their attributes if no attributes
+//are registered
+type sourceClaim struct {
+	entities   []EntityInfo
+	attributes map[string]bool
+}
+
+type sourceClaims []sourceClaim
+
+func claimsOf(sources []ContextSource) sourceClaims {
+	claims := sourceClaims{}
+
+	for _, src := range sources {
+		reg, _ := sourceRegistration(src)
+		csr, ok := reg.(*ctxSrcReg)
+		if !ok {
+			continue
+		}
+
+		for _, info := range csr.Information {
+			claim := sourceClaim{entities: info.Entities}
+
+			names := append(append([]string{}, info.PropertyNames...), info.RelationshipNames...)
+			if len(names) > 0 {
+				claim.attributes = map[string]bool{}
+				for _, name := range names {
+					claim.attributes[name] = true
+				}
+			}
+
+			claims = append(claims, claim)
+		}
+	}
+
+	return claims
+}
+
+//matches returns true if the claim covers an entity. An empty entity type matches any type,
+//since the type is not known when an entity is only referred to by its id.
+func (c sourceClaim) matches(entityID, entityType string) bool {
+	if len(c.entities) == 0 {
+		return true
+	}
+
+	for _, info := range c.entities {
+		if entityType != "" && info.Type != entityType {
+			continue
+		}
+
+		if info.ID != nil {
+			if *info.ID == entityID {
+				return true
+			}
+		} else if info.regexpForID == nil || info.regexpForID.MatchString(entityID) {
+			return true
+		}
+	}
+
+	return false
+}
+
+//claimsEntity returns true if all the attributes of an entity are claimed
+func (claims sourceClaims) claimsEntity(entityID, entityType string) bool {
+	for _, claim := range claims {
+		if claim.attributes == nil && claim.matches(entityID, entityType) {
+			return true
+		}
+	}
+	return false
+}
+
+//claimedAttributes returns the names of the attributes of an entity that are claimed
+func (claims sourceClaims) claimedAttributes(entityID, entityType string) map[string]bool {
+	claimed := map[string]bool{}
+	for _, claim := range claims {
+		if claim.matches(entityID, entityType) {
+			for name := range claim.attributes {
+				claimed[name] = true
+			}
+		}
+	}
+	return claimed
+}
+
+//trim removes the claimed attributes from an entity, or an entity fragment with the supplied
+//id and type. False is returned if the entity is claimed as a whole.
+func (claims sourceClaims) trim(entity map[string]interface{}, entityID, entityType string) bool {
+	if id, ok := entity["id"].(string); ok {
+		entityID = id
+	}
+	if typ, ok := entity["type"].(string); ok {
+		entityType = typ
+	}
+
+	if claims.claimsEntity(entityID, entityType) {
+		return false
+	}
+
+	for name := range claims.claimedAttributes(entityID, entityType) {
+		delete(entity, name)
+	}
+
+	return true
+}
+
+//claimTrimmingSource hides the information that is claimed by exclusive or redirect registrations
+//from a context source that they take precedence over, both when reading from and when writing to the source.
+//Entities that are claimed as a whole are neither read from nor written to the source.
+type claimTrimmingSource struct {
+	ContextSource
+	claims sourceClaims
+}
+
+func (s *claimTrimmingSource) unwrap() ContextSource {
+	return s.ContextSource
+}
+
+func (s *claimTrimmingSource) trimEntity(entity Entity) (Entity, bool) {
+	entityMap, err := entityAsMap(entity)
+	if err != nil {
+		return entity, true
+	}
+
+	if !s.claims.trim(entityMap, "", "") {
+		return nil, false
+	}
+
+	return entityMap, true
+}
+
+func (s *claimTrimmingSource) trimmingCallback(callback QueryEntitiesCallback) QueryEntitiesCallback {
+	return func(entity Entity) error {
+		if trimmed, ok := s.trimEntity(entity); ok {
+			return callback(trimmed)
+		}
+		return nil
+	}
+}
+
+func (s *claimTrimmingSource) GetEntities(query Query, callback QueryEntitiesCallback) error {
+	return s.ContextSource.GetEntities(query, s.trimmingCallback(callback))
+}
+
+//getEntities passes on the total number of entities reported by a remote source, which may
+//include entities that are claimed as a whole
+func (s *claimTrimmingSource) getEntities(query Query, callback QueryEntitiesCallback) (*uint64, error) {
+	if counting, ok := s.ContextSource.(countingContextSource); ok {
+		return counting.getEntities(query, s.trimmingCallback(callback))
+	}
+
+	if remote, ok := remoteSource(s.ContextSource); ok {
+		return remote.getEntities(query, s.trimmingCallback(callback))
+	}
+
+	return nil, s.GetEntities(query, callback)
+}
+
+func (s *claimTrimmingSource) RetrieveEntity(entityID string, request Request) (Entity, error) {
+	if s.claims.claimsEntity(entityID, "") {
+		return nil, nil
+	}
+
+	entity, err := s.ContextSource.RetrieveEntity(entityID, request)
+	if err != nil || entity == nil {
+		return entity, err
+	}
+
+	trimmed, ok := s.trimEntity(entity)
+	if !ok {
+		return nil, nil
+	}
+
+	return trimmed, nil
+}
+
+func (s *claimTrimmingSource) CreateEntity(typeName, entityID string, request Request) error {
+	if s.claims.claimsEntity(entityID, typeName) {
+		return nil
+	}
+	return s.ContextSource.CreateEntity(typeName, entityID, s.trimmedRequest(request, entityID, typeName))
+}
+
+func (s *claimTrimmingSource) UpdateEntityAttributes(entityID string, request Request) error {
+	if s.claims.claimsEntity(entityID, "") {
+		return nil
+	}
+	return s.ContextSource.UpdateEntityAttributes(entityID, s.trimmedRequest(request, entityID, ""))
+}
+
+func (s *claimTrimmingSource) AppendEntityAttributes(entityID string, request Request) (*UpdateResult, error) {
+	if s.claims.claimsEntity(entityID, "") {
+		return &UpdateResult{Updated: []string{}, NotUpdated: []NotUpdatedDetails{}}, nil
+	}
+	return s.ContextSource.AppendEntityAttributes(entityID, s.trimmedRequest(request, entityID, ""))
+}
+
+func (s *claimTrimmingSource) DeleteEntity(entityID string, request Request) error {
+	if s.claims.claimsEntity(entityID, "") {
+		return nil
+	}
+	return s.ContextSource.DeleteEntity(entityID, request)
+}
+
+func (s *claimTrimmingSource) CreateEntities(request Request) (*BatchOperationResult, error) {
+	return s.forwardBatch(request, s.ContextSource.CreateEntities)
+}
+
+func (s *claimTrimmingSource) UpsertEntities(request Request) (*BatchOperationResult, error) {
+	return s.forwardBatch(request, s.ContextSource.UpsertEntities)
+}
+
+func (s *claimTrimmingSource) UpdateEntities(request Request) (*BatchOperationResult, error) {
+	return s.forwardBatch(request, s.ContextSource.UpdateEntities)
+}
+
+func (s *claimTrimmingSource) DeleteEntities(request Request) (*BatchOperationResult, error) {
+	return s.forwardBatch(request, s.ContextSource.DeleteEntities)
+}
+
+//trimmedRequest returns a copy of a request with the claimed attributes removed from its body,
+//or the request itself if nothing is claimed
+func (s *claimTrimmingSource) trimmedRequest(request Request, entityID, entityType string) Request {
+	body, _ := ioutil.ReadAll(request.BodyReader())
+
+	payload := map[string]interface{}{}
+	if json.Unmarshal(body, &payload) != nil {
+		return request
+	}
+
+	if len(s.claims.claimedAttributes(entityID, entityType)) == 0 {
+		return request
+	}
+
+	s.claims.trim(payload, entityID, entityType)
+
+	return requestWithBody(request, payload)
+}
+
+//forwardBatch removes the claimed information from the entities in a batch, and only forwards
+//the batch if any entities remain
+func (s *claimTrimmingSource) forwardBatch(request Request, forward func(Request) (*BatchOperationResult, error)) (*BatchOperationResult, error) {
+	items := []json.RawMessage{}
+	if err := request.DecodeBodyInto(&items); err != nil {
+		return forward(request)
+	}
+
+	remaining := []interface{}{}
+
+	for _, item := range items {
+		entityID := ""
+		if json.Unmarshal(item, &entityID) == nil {
+			if !s.claims.claimsEntity(entityID, "") {
+				remaining = append(remaining, entityID)
+			}
+			continue
+		}
+
+		entity := map[string]interface{}{}
+		if json.Unmarshal(item, &entity) != nil {
+			remaining = append(remaining, item)
+			continue
+		}
+
+		if s.claims.trim(entity, "", "") {
+			remaining = append(remaining, entity)
+		}
+	}
+
+	if len(remaining) == 0 {
+		return &BatchOperationResult{Success: []string{}, Errors: []BatchEntityError{}}, nil
+	}
+
+	return forward(requestWithBody(request, remaining))
+}
+
+//requestWithBody returns a copy of a request with a new JSON body
+func requestWithBody(request Request, payload interface{}) Request {
+	body, _ := json.Marshal(payload)
+
+	req := request.Request().Clone(request.Request().Context())
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+
+	return newRequestWrapper(req)
+}
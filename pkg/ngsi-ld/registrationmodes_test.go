@@ -0,0 +1,177 @@
+package ngsi
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func newModeTestSource(t *testing.T, mode, endpoint string) ContextSource {
+	reg, err := NewCsourceRegistrationFromJSON([]byte(`{"type":"ContextSourceRegistration",
+		"information":[{"entities":[{"type":"Beach"}]}],"endpoint":"` + endpoint + `","mode":"` + mode + `"}`))
+	if err != nil {
+		t.Fatal("Failed to create registration: ", err.Error())
+	}
+
+	src, _ := NewRemoteContextSource(reg)
+	return src
+}
+
+func TestExclusiveSourcesTakePrecedence(t *testing.T) {
+	inclusive := NewInMemoryContextSource("Beach")
+	exclusive := newModeTestSource(t, RegistrationModeExclusive, "lolcathost")
+	auxiliary := newModeTestSource(t, RegistrationModeAuxiliary, "lolcathost")
+
+	sources := []ContextSource{inclusive, auxiliary, exclusive}
+
+	reading := sourcesForReading(sources)
+	if len(reading) != 3 || reading[0] != exclusive || innermostSource(reading[1]) != inclusive || innermostSource(reading[2]) != auxiliary {
+		t.Error("Reads should use the exclusive source followed by the other sources.")
+	}
+
+	if entity, _ := reading[1].RetrieveEntity("urn:ngsi-ld:Beach:1", nil); entity != nil {
+		t.Error("Beaches claimed by the exclusive source should be hidden from the inclusive source.")
+	}
+
+	writing := sourcesForWriting(sources)
+	if len(writing) != 2 || writing[0] != exclusive || innermostSource(writing[1]) != inclusive {
+		t.Error("Writes should use the exclusive source followed by the inclusive source.")
+	}
+}
+
+func TestRedirectSourcesAreNotMergedWithLocalSources(t *testing.T) {
+	redirect := newModeTestSource(t, RegistrationModeRedirect, "lolcathost")
+
+	inclusive := NewInMemoryContextSource("Beach")
+
+	reading := sourcesForReading([]ContextSource{inclusive, redirect})
+	if len(reading) != 2 || reading[0] != redirect || innermostSource(reading[1]) != inclusive {
+		t.Error("Reads should use the redirect source followed by the inclusive source.")
+	}
+
+	if entity, _ := reading[1].RetrieveEntity("urn:ngsi-ld:Beach:1", nil); entity != nil {
+		t.Error("Beaches claimed by the redirect source should be hidden from the inclusive source.")
+	}
+}
+
+func TestRedirectSourcesOnlyTakePrecedenceForTheirInformation(t *testing.T) {
+	server := setupMockServiceThatReturns(http.StatusOK, "application/ld+json",
+		`[{"id":"urn:ngsi-ld:Beach:1","type":"Beach"}]`)
+	defer server.Close()
+
+	ctxRegistry := NewContextRegistry()
+	ctxRegistry.Register(NewInMemoryContextSource("WeatherObserved"))
+	ctxRegistry.Register(newModeTestSource(t, RegistrationModeRedirect, server.URL))
+
+	entity := `{"id":"urn:ngsi-ld:WeatherObserved:1","type":"WeatherObserved"}`
+	req, _ := http.NewRequest("POST", createURL("/entities"), bytes.NewBuffer([]byte(entity)))
+	NewCreateEntityHandler(ctxRegistry).ServeHTTP(httptest.NewRecorder(), req)
+
+	req, _ = http.NewRequest("GET", createURL("/entities", "type=Beach,WeatherObserved"), nil)
+	w := httptest.NewRecorder()
+	NewQueryEntitiesHandler(ctxRegistry).ServeHTTP(w, req)
+
+	entities := []map[string]interface{}{}
+	json.Unmarshal(w.Body.Bytes(), &entities)
+
+	if len(entities) != 2 {
+		t.Error("Expected both the redirected beach and the local weather observation: ", w.Body.String())
+	}
+}
+
+func TestAuxiliarySourcesAreOnlyUsedForReads(t *testing.T) {
+	requests := int32(0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Header().Add("Content-Type", "application/ld+json")
+		w.Write([]byte("[]"))
+	}))
+	defer server.Close()
+
+	ctxRegistry := NewContextRegistry()
+	ctxRegistry.Register(NewInMemoryContextSource("Beach"))
+	ctxRegistry.Register(newModeTestSource(t, RegistrationModeAuxiliary, server.URL))
+
+	entity := `{"id":"urn:ngsi-ld:Beach:1","type":"Beach"}`
+	req, _ := http.NewRequest("POST", createURL("/entities"), bytes.NewBuffer([]byte(entity)))
+	w := httptest.NewRecorder()
+	NewCreateEntityHandler(ctxRegistry).ServeHTTP(w, req)
+
+	if w.Code != http.StatusCreated || atomic.LoadInt32(&requests) != 0 {
+		t.Error("The entity should be created without involving the auxiliary source.")
+	}
+
+	req, _ = http.NewRequest("GET", createURL("/entities", "type=Beach"), nil)
+	w = httptest.NewRecorder()
+	NewQueryEntitiesHandler(ctxRegistry).ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK || atomic.LoadInt32(&requests) != 1 {
+		t.Error("The auxiliary source should be queried when reading entities.")
+	}
+}
+
+func TestExclusiveSourcesOnlyClaimTheirAttributes(t *testing.T) {
+	server := setupMockServiceThatReturns(http.StatusOK, "application/ld+json",
+		`[{"id":"urn:ngsi-ld:Beach:1","type":"Beach","waterTemperature":{"type":"Property","value":17.0,"observedAt":"2020-06-01T12:00:00Z"}}]`)
+	defer server.Close()
+
+	reg, _ := NewCsourceRegistrationFromJSON([]byte(`{"type":"ContextSourceRegistration",
+		"information":[{"entities":[{"type":"Beach"}],"propertyNames":["waterTemperature"]}],
+		"endpoint":"` + server.URL + `","mode":"exclusive"}`))
+	exclusive, _ := NewRemoteContextSource(reg)
+
+	ctxRegistry := NewContextRegistry()
+	ctxRegistry.Register(NewInMemoryContextSource("Beach"))
+
+	entity := `{"id":"urn:ngsi-ld:Beach:1","type":"Beach","name":{"type":"Property","value":"Stranden"},
+		"waterTemperature":{"type":"Property","value":12.0,"observedAt":"2020-06-01T13:00:00Z"}}`
+	req, _ := http.NewRequest("POST", createURL("/entities"), bytes.NewBuffer([]byte(entity)))
+	w := httptest.NewRecorder()
+	NewCreateEntityHandler(ctxRegistry).ServeHTTP(w, req)
+
+	ctxRegistry.Register(exclusive)
+
+	req, _ = http.NewRequest("GET", createURL("/entities", "type=Beach"), nil)
+	w = httptest.NewRecorder()
+	NewQueryEntitiesHandler(ctxRegistry).ServeHTTP(w, req)
+
+	entities := []map[string]interface{}{}
+	json.Unmarshal(w.Body.Bytes(), &entities)
+
+	if len(entities) != 1 || entities[0]["name"] == nil {
+		t.Error("The attributes that are not claimed should still be read from the inclusive source: ", w.Body.String())
+		return
+	}
+
+	temperature, _ := entities[0]["waterTemperature"].(map[string]interface{})
+	if temperature["value"] != 17.0 {
+		t.Error("The claimed attribute should only be read from the exclusive source: ", w.Body.String())
+	}
+}
+
+func TestEntitiesFromRedirectSourcesAreNotMerged(t *testing.T) {
+	first := setupMockServiceThatReturns(http.StatusOK, "application/ld+json",
+		`[{"id":"urn:ngsi-ld:Beach:1","type":"Beach","name":{"type":"Property","value":"Stranden"}}]`)
+	defer first.Close()
+	second := setupMockServiceThatReturns(http.StatusOK, "application/ld+json",
+		`[{"id":"urn:ngsi-ld:Beach:1","type":"Beach","waterTemperature":{"type":"Property","value":17.0}}]`)
+	defer second.Close()
+
+	ctxRegistry := NewContextRegistry()
+	ctxRegistry.Register(newModeTestSource(t, RegistrationModeRedirect, first.URL))
+	ctxRegistry.Register(newModeTestSource(t, RegistrationModeRedirect, second.URL))
+
+	req, _ := http.NewRequest("GET", createURL("/entities", "type=Beach"), nil)
+	w := httptest.NewRecorder()
+	NewQueryEntitiesHandler(ctxRegistry).ServeHTTP(w, req)
+
+	entities := []map[string]interface{}{}
+	json.Unmarshal(w.Body.Bytes(), &entities)
+
+	if len(entities) != 2 {
+		t.Error("The entities from redirect sources should be passed on as they are: ", w.Body.String())
+	}
+}
@@ -0,0 +1,178 @@
+package ngsi
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+//RegistrationMonitorConfig controls how often a RegistrationMonitor checks the registered
+//context sources and whether their endpoints should be probed for availability
+type RegistrationMonitorConfig struct {
+	//Interval is the time between two checks. Defaults to one minute.
+	Interval time.Duration
+
+	//HealthChecks enables probing of the endpoints of remote context sources
+	HealthChecks bool
+	//HealthCheckPath is appended to the endpoint of a context source when probing it
+	HealthCheckPath string
+	//HealthCheckTimeout is the maximum time to wait for a probe. Defaults to five seconds.
+	HealthCheckTimeout time.Duration
+	//FailureThreshold is the number of consecutive failures, counting both probes and requests,
+	//after which a failed probe opens the circuit breaker for the endpoint of a context source,
+	//which makes the source unavailable. Defaults to three.
+	FailureThreshold int
+}
+
+//RegistrationMonitor periodically removes expired registrations from a context registry
+//and, if enabled, keeps track of the availability of remote context sources
+type RegistrationMonitor interface {
+	Check()
+	Stop()
+}
+
+//StartRegistrationMonitor creates a RegistrationMonitor and starts checking the registry in
+//the background until the monitor is stopped
+func StartRegistrationMonitor(ctxReg ContextRegistry, config RegistrationMonitorConfig) RegistrationMonitor {
+	if config.Interval <= 0 {
+		config.Interval = time.Minute
+	}
+
+	if config.HealthCheckTimeout <= 0 {
+		config.HealthCheckTimeout = 5 * time.Second
+	}
+
+	if config.FailureThreshold <= 0 {
+		config.FailureThreshold = 3
+	}
+
+	monitor := &registrationMonitor{
+		ctxReg: ctxReg,
+		config: config,
+		client: &http.Client{Timeout: config.HealthCheckTimeout},
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+
+	go monitor.run()
+
+	return monitor
+}
+
+type registrationMonitor struct {
+	ctxReg ContextRegistry
+	config RegistrationMonitorConfig
+	client *http.Client
+
+	stopOnce sync.Once
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+func (m *registrationMonitor) run() {
+	defer close(m.done)
+
+	ticker := time.NewTicker(m.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			m.Check()
+		case <-m.stop:
+			return
+		}
+	}
+}
+
+//Check purges expired registrations and probes the remaining remote context sources
+func (m *registrationMonitor) Check() {
+	PurgeExpiredRegistrations(m.ctxReg, time.Now())
+
+	if !m.config.HealthChecks {
+		return
+	}
+
+	wg := sync.WaitGroup{}
+
+	for _, src := range m.ctxReg.ContextSources() {
+		remote, ok := remoteSource(src)
+		if !ok {
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			remote.recordHealthCheck(m.probe(remote.registration.Endpoint()), m.config.FailureThreshold)
+		}()
+	}
+
+	wg.Wait()
+}
+
+//probe considers an endpoint to be healthy if it responds without a server error
+func (m *registrationMonitor) probe(endpoint string) bool {
+	probeURL := strings.TrimSuffix(endpoint, "/") + m.config.HealthCheckPath
+
+	response, err := m.client.Get(probeURL)
+	if err != nil {
+		return false
+	}
+	response.Body.Close()
+
+	return response.StatusCode < http.StatusInternalServerError
+}
+
+//Stop stops the background checks and waits for any ongoing check to complete
+func (m *registrationMonitor) Stop() {
+	m.stopOnce.Do(func() {
+		close(m.stop)
+	})
+	<-m.done
+}
+
+//PurgeExpiredRegistrations unregisters all context sources with a registration that has
+//expired at the given time, and returns the IDs of the removed registrations
+func PurgeExpiredRegistrations(ctxReg ContextRegistry, now time.Time) []string {
+	purged := []string{}
+
+	for _, src := range ctxReg.ContextSources() {
+		reg, ok := sourceRegistration(src)
+		if ok && registrationExpired(reg, now) {
+			ctxReg.Unregister(reg.ID())
+			purged = append(purged, reg.ID())
+		}
+	}
+
+	return purged
+}
+
+func registrationExpired(reg CsourceRegistration, now time.Time) bool {
+	expiresAt := reg.ExpiresAt()
+	return expiresAt != nil && !now.Before(*expiresAt)
+}
+
+//sourceIsUsable returns false for context sources with an expired registration and for remote
+//context sources that have been marked as unavailable by the health checks
+func sourceIsUsable(src ContextSource, now time.Time) bool {
+	if reg, ok := sourceRegistration(src); ok && registrationExpired(reg, now) {
+		return false
+	}
+
+	if remote, ok := remoteSource(src); ok && !remote.Available() {
+		return false
+	}
+
+	return true
+}
+
+//remoteSource returns the remote context source behind a context source, looking through any wrappers
+func remoteSource(src ContextSource) (*remoteContextSource, bool) {
+	remote, ok := unwrapSource(src, func(s ContextSource) bool {
+		_, ok := s.(*remoteContextSource)
+		return ok
+	}).(*remoteContextSource)
+	return remote, ok
+}
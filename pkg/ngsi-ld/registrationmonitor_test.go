@@ -0,0 +1,129 @@
+package ngsi
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newExpiringRegistration(t *testing.T, endpoint string, expiresAt time.Time) CsourceRegistration {
+	reg, err := NewCsourceRegistrationFromJSON([]byte(`{"type":"ContextSourceRegistration",
+		"information":[{"entities":[{"type":"Road"}],"propertyNames":["x"]}],
+		"endpoint":"` + endpoint + `","expiresAt":"` + expiresAt.Format(time.RFC3339) + `"}`))
+	if err != nil {
+		t.Fatal("Failed to create registration: ", err.Error())
+	}
+	return reg
+}
+
+func TestExpiredRegistrationsAreSkippedAndPurged(t *testing.T) {
+	ctxRegistry := NewContextRegistry()
+
+	expired := newExpiringRegistration(t, "lolcathost", time.Now().Add(-time.Minute))
+	src, _ := NewRemoteContextSource(expired)
+	ctxRegistry.Register(src)
+
+	valid := newExpiringRegistration(t, "lolcathost", time.Now().Add(time.Hour))
+	src, _ = NewRemoteContextSource(valid)
+	ctxRegistry.Register(src)
+
+	if len(ctxRegistry.GetContextSourcesForEntityType("Road")) != 1 {
+		t.Error("The expired registration should not be used for lookups.")
+	}
+
+	purged := PurgeExpiredRegistrations(ctxRegistry, time.Now())
+	if len(purged) != 1 || purged[0] != expired.ID() {
+		t.Error("Unexpected registrations purged: ", purged)
+	}
+
+	if len(ctxRegistry.ContextSources()) != 1 {
+		t.Error("The valid registration should remain after purging.")
+	}
+}
+
+func TestRegisterExpiredContextSourceFails(t *testing.T) {
+	body := `{"type":"ContextSourceRegistration","information":[{"entities":[{"type":"Road"}]}],
+		"endpoint":"lolcathost","expiresAt":"2020-01-01T00:00:00Z"}`
+	req, _ := http.NewRequest("POST", createURL("/csourceRegistrations"), bytes.NewBuffer([]byte(body)))
+	w := httptest.NewRecorder()
+
+	NewRegisterContextSourceHandler(NewContextRegistry()).ServeHTTP(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Error("Wrong status code returned. ", w.Code, " != expected 400")
+	}
+}
+
+func TestHealthChecksMarkSourcesUnavailableAndRestoreThem(t *testing.T) {
+	healthy := int32(0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&healthy) == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	ctxRegistry := NewContextRegistry()
+	registerTestContextSource(ctxRegistry, "Road", server.URL)
+
+	monitor := StartRegistrationMonitor(ctxRegistry, RegistrationMonitorConfig{
+		Interval:         time.Hour,
+		HealthChecks:     true,
+		FailureThreshold: 2,
+	})
+	defer monitor.Stop()
+
+	monitor.Check()
+	if len(ctxRegistry.GetContextSourcesForEntityType("Road")) != 1 {
+		t.Error("A single failed health check should not make the source unavailable.")
+	}
+
+	monitor.Check()
+	if len(ctxRegistry.GetContextSourcesForEntityType("Road")) != 0 {
+		t.Error("The source should be unavailable after repeated failures.")
+	}
+
+	if len(ctxRegistry.ContextSources()) != 1 {
+		t.Error("An unavailable source should remain registered.")
+	}
+
+	atomic.StoreInt32(&healthy, 1)
+	monitor.Check()
+	if len(ctxRegistry.GetContextSourcesForEntityType("Road")) != 1 {
+		t.Error("The source should be available again after a successful health check.")
+	}
+}
+
+func TestAvailabilityIsKeptWhenSourceIsRecreated(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	ctxRegistry := NewContextRegistry()
+	location := registerTestContextSource(ctxRegistry, "Road", server.URL)
+
+	monitor := StartRegistrationMonitor(ctxRegistry, RegistrationMonitorConfig{
+		Interval:         time.Hour,
+		HealthChecks:     true,
+		FailureThreshold: 1,
+	})
+	defer monitor.Stop()
+
+	monitor.Check()
+
+	req, _ := http.NewRequest("PATCH", "http://localhost:8080"+location, bytes.NewBuffer([]byte(`{"registrationName":"roads"}`)))
+	w := httptest.NewRecorder()
+	NewUpdateContextSourceRegistrationHandler(ctxRegistry).ServeHTTP(w, req)
+
+	if w.Code != http.StatusNoContent {
+		t.Error("Failed to update registration: ", w.Code, w.Body.String())
+	}
+
+	if len(ctxRegistry.GetContextSourcesForEntityType("Road")) != 0 {
+		t.Error("The updated source should still be unavailable.")
+	}
+}
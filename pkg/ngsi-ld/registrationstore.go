@@ -0,0 +1,218 @@
+package ngsi
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+//RegistrationStore persists context source registrations so that they survive restarts
+type RegistrationStore interface {
+	Load() ([]CsourceRegistration, error)
+	Save(registration CsourceRegistration) error
+	Delete(registrationID string) error
+}
+
+//NewContextRegistryWithStore creates a context registry that saves the registrations of remote
+//context sources to the given store, and registers all previously stored registrations again.
+//Since registering and unregistering sources never fails, errors from the store while doing
+//so are passed to onStoreError instead. A nil onStoreError ignores such errors.
+func NewContextRegistryWithStore(store RegistrationStore, onStoreError func(error)) (ContextRegistry, error) {
+	registrations, err := store.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	r := &registry{}
+
+	for _, registration := range registrations {
+		remoteCtxSrc, err := NewRemoteContextSource(registration)
+		if err != nil {
+			return nil, err
+		}
+		r.Register(remoteCtxSrc)
+	}
+
+	// Attach the store only after the stored registrations have been loaded, so that they
+	// are not needlessly written back again
+	r.store = store
+	r.onStoreError = onStoreError
+
+	return r, nil
+}
+
+//persist saves the current registration with the given ID if the registry has a store, or
+//deletes it from the store if it is no longer registered. Since the store is updated after the
+//registry has been, it is always the latest state that is saved, even when several changes to
+//the same registration race. Sources without a registration, such as local in-memory sources,
+//are never persisted.
+func (r *registry) persist(registrationID string) {
+	if r.store == nil {
+		return
+	}
+
+	r.storeMu.Lock()
+	defer r.storeMu.Unlock()
+
+	source, found := r.ContextSource(registrationID)
+	if !found {
+		r.storeError(r.store.Delete(registrationID))
+		return
+	}
+
+	if registration, ok := sourceRegistration(source); ok {
+		r.storeError(r.store.Save(registration))
+	}
+}
+
+func (r *registry) storeError(err error) {
+	if err != nil && r.onStoreError != nil {
+		r.onStoreError(err)
+	}
+}
+
+//NewFileRegistrationStore creates a RegistrationStore that keeps all registrations as a JSON
+//array in a single file. The file is created when the first registration is saved.
+func NewFileRegistrationStore(path string) RegistrationStore {
+	return &fileRegistrationStore{path: path}
+}
+
+type fileRegistrationStore struct {
+	mu   sync.Mutex
+	path string
+}
+
+func (frs *fileRegistrationStore) Load() ([]CsourceRegistration, error) {
+	frs.mu.Lock()
+	defer frs.mu.Unlock()
+
+	records, err := frs.read()
+	if err != nil {
+		return nil, err
+	}
+
+	registrations := []CsourceRegistration{}
+
+	for _, id := range sortedKeys(records) {
+		// Registrations are recreated from JSON so that any idPatterns are compiled again
+		reg, err := NewCsourceRegistrationFromJSON(records[id])
+		if err != nil {
+			return nil, fmt.Errorf("failed to load registration %s: %s", id, err.Error())
+		}
+		registrations = append(registrations, reg)
+	}
+
+	return registrations, nil
+}
+
+func (frs *fileRegistrationStore) Save(registration CsourceRegistration) error {
+	frs.mu.Lock()
+	defer frs.mu.Unlock()
+
+	records, err := frs.read()
+	if err != nil {
+		return err
+	}
+
+	record, err := json.Marshal(registration)
+	if err != nil {
+		return err
+	}
+
+	records[registration.ID()] = record
+
+	return frs.write(records)
+}
+
+func (frs *fileRegistrationStore) Delete(registrationID string) error {
+	frs.mu.Lock()
+	defer frs.mu.Unlock()
+
+	records, err := frs.read()
+	if err != nil {
+		return err
+	}
+
+	if _, exists := records[registrationID]; !exists {
+		return nil
+	}
+
+	delete(records, registrationID)
+
+	return frs.write(records)
+}
+
+func (frs *fileRegistrationStore) read() (map[string]json.RawMessage, error) {
+	records := map[string]json.RawMessage{}
+
+	contents, err := ioutil.ReadFile(frs.path)
+	if os.IsNotExist(err) {
+		return records, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read registrations from %s: %s", frs.path, err.Error())
+	}
+
+	list := []json.RawMessage{}
+	err = json.Unmarshal(contents, &list)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse registrations in %s: %s", frs.path, err.Error())
+	}
+
+	for _, record := range list {
+		id := struct {
+			ID string `json:"id"`
+		}{}
+		json.Unmarshal(record, &id)
+		records[id.ID] = record
+	}
+
+	return records, nil
+}
+
+//write replaces the contents of the file by writing to a temporary file that is then renamed,
+//so that a crash while writing never leaves a partially written file behind
+func (frs *fileRegistrationStore) write(records map[string]json.RawMessage) error {
+	list := []json.RawMessage{}
+	for _, id := range sortedKeys(records) {
+		list = append(list, records[id])
+	}
+
+	contents, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(frs.path), filepath.Base(frs.path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to save registrations: %s", err.Error())
+	}
+
+	_, err = tmp.Write(contents)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.Rename(tmp.Name(), frs.path)
+	}
+
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to save registrations: %s", err.Error())
+	}
+
+	return nil
+}
+
+func sortedKeys(records map[string]json.RawMessage) []string {
+	keys := []string{}
+	for key := range records {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,130 @@
+package ngsi
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/iot-for-tillgenglighet/ngsi-ld-golang/pkg/datamodels/fiware"
+)
+
+func newTestRegistrationStore(t *testing.T) (RegistrationStore, func()) {
+	dir, err := ioutil.TempDir("", "registrations")
+	if err != nil {
+		t.Fatal("Failed to create temporary directory: ", err.Error())
+	}
+
+	return NewFileRegistrationStore(filepath.Join(dir, "registrations.json")), func() { os.RemoveAll(dir) }
+}
+
+func TestRegistrationsWithIDPatternSurviveRestart(t *testing.T) {
+	store, cleanup := newTestRegistrationStore(t)
+	defer cleanup()
+
+	ctxRegistry, err := NewContextRegistryWithStore(store, func(err error) { t.Error(err.Error()) })
+	if err != nil {
+		t.Fatal("Failed to create registry: ", err.Error())
+	}
+
+	regex := fmt.Sprintf("^%s.+", fiware.DeviceIDPrefix)
+	registrationBody, _ := NewCsourceRegistration("A", []string{"a"}, "lolcathost", &regex)
+	jsonBytes, _ := json.Marshal(registrationBody)
+	req, _ := http.NewRequest("POST", createURL("/csourceRegistrations"), bytes.NewBuffer(jsonBytes))
+	w := httptest.NewRecorder()
+	NewRegisterContextSourceHandler(ctxRegistry).ServeHTTP(w, req)
+
+	// Simulate a restart by creating a new registry from the same store
+	restarted, err := NewContextRegistryWithStore(store, nil)
+	if err != nil {
+		t.Fatal("Failed to reload registry: ", err.Error())
+	}
+
+	sources := restarted.GetContextSourcesForEntity(fiware.DeviceIDPrefix + "mydevice")
+	if len(sources) != 1 {
+		t.Error("The stored registration was not reloaded with a working idPattern.")
+		return
+	}
+
+	registrationID := strings.TrimPrefix(w.Header().Get("Location"), "/ngsi-ld/v1/csourceRegistrations/")
+	if _, found := restarted.ContextSource(registrationID); !found {
+		t.Error("The reloaded registration did not keep its ID ", registrationID)
+	}
+}
+
+func TestUnregisterRemovesStoredRegistration(t *testing.T) {
+	store, cleanup := newTestRegistrationStore(t)
+	defer cleanup()
+
+	ctxRegistry, _ := NewContextRegistryWithStore(store, nil)
+	location := registerTestContextSource(ctxRegistry, "Point", "lolcathost")
+	registerTestContextSource(ctxRegistry, "Road", "lolcathost")
+
+	ctxRegistry.Unregister(strings.TrimPrefix(location, "/ngsi-ld/v1/csourceRegistrations/"))
+
+	registrations, err := store.Load()
+	if err != nil || len(registrations) != 1 {
+		t.Error("Unexpected number of stored registrations: ", len(registrations), " != 1")
+	}
+}
+
+func TestInvalidRegistrationFileFailsToLoad(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "registrations")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "registrations.json")
+	ioutil.WriteFile(path, []byte("not json"), 0644)
+
+	if _, err := NewContextRegistryWithStore(NewFileRegistrationStore(path), nil); err == nil {
+		t.Error("Creating a registry from an invalid registration file should fail.")
+	}
+}
+
+type blockingRegistrationStore struct {
+	saving  chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingRegistrationStore) Load() ([]CsourceRegistration, error) {
+	return []CsourceRegistration{}, nil
+}
+
+func (s *blockingRegistrationStore) Save(registration CsourceRegistration) error {
+	s.saving <- struct{}{}
+	<-s.release
+	return nil
+}
+
+func (s *blockingRegistrationStore) Delete(registrationID string) error {
+	return nil
+}
+
+func TestLookupsAreNotBlockedBySlowStore(t *testing.T) {
+	store := &blockingRegistrationStore{saving: make(chan struct{}), release: make(chan struct{})}
+	ctxRegistry, _ := NewContextRegistryWithStore(store, nil)
+
+	go registerTestContextSource(ctxRegistry, "Point", "lolcathost")
+	<-store.saving
+	defer close(store.release)
+
+	looked := make(chan int)
+	go func() {
+		looked <- len(ctxRegistry.GetContextSourcesForEntityType("Point"))
+	}()
+
+	select {
+	case count := <-looked:
+		if count != 1 {
+			t.Error("The registered source should be found while it is being saved.")
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("Looking up context sources should not wait for the store.")
+	}
+}
@@ -0,0 +1,375 @@
+package ngsi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	stderrors "errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/iot-for-tillgenglighet/ngsi-ld-golang/pkg/ngsi-ld/errors"
+)
+
+const (
+	//ContextSourceInfoTimeout is a contextSourceInfo key that overrides the request timeout for
+	//a registration. The value is an ISO 8601 duration without years or months, e.g. PT5S.
+	ContextSourceInfoTimeout = "timeout"
+	//ContextSourceInfoMaxRetries is a contextSourceInfo key that overrides the number of times
+	//an idempotent request is retried for a registration
+	ContextSourceInfoMaxRetries = "maxRetries"
+)
+
+//RemoteSourceConfig controls how requests are forwarded to remote context sources
+type RemoteSourceConfig struct {
+	//Timeout is the maximum duration of a single attempt to forward a request
+	Timeout time.Duration
+	//MaxRetries is the number of times a failed idempotent request is retried
+	MaxRetries int
+	//InitialBackoff is the delay before the first retry. The delay is doubled for every
+	//following retry, up to MaxBackoff.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+
+	//FailureThreshold is the number of consecutive failures after which the circuit breaker
+	//for an endpoint opens and requests fail immediately
+	FailureThreshold int
+	//OpenDuration is the time that a circuit breaker stays open before a new request is let through
+	OpenDuration time.Duration
+}
+
+//DefaultRemoteSourceConfig is used by remote context sources, unless the timeout or number of
+//retries is overridden in the contextSourceInfo of their registration
+var DefaultRemoteSourceConfig = RemoteSourceConfig{
+	Timeout:          10 * time.Second,
+	MaxRetries:       2,
+	InitialBackoff:   100 * time.Millisecond,
+	MaxBackoff:       2 * time.Second,
+	FailureThreshold: 5,
+	OpenDuration:     30 * time.Second,
+}
+
+//remoteSourceConfig returns the default configuration with any overrides from the registration
+func remoteSourceConfig(registration CsourceRegistration) RemoteSourceConfig {
+	config := DefaultRemoteSourceConfig
+
+	csr, ok := registration.(*ctxSrcReg)
+	if !ok {
+		return config
+	}
+
+	for _, info := range csr.ContextSourceInfo {
+		switch info.Key {
+		case ContextSourceInfoTimeout:
+			if timeout, err := parseTimeout(info.Value); err == nil {
+				config.Timeout = timeout
+			}
+		case ContextSourceInfoMaxRetries:
+			if retries, err := strconv.Atoi(info.Value); err == nil && retries >= 0 {
+				config.MaxRetries = retries
+			}
+		}
+	}
+
+	return config
+}
+
+//validateRemoteSourceConfig checks the contextSourceInfo entries that configure the forwarding of requests
+func validateRemoteSourceConfig(info []KeyValuePair) error {
+	for _, kvp := range info {
+		switch kvp.Key {
+		case ContextSourceInfoTimeout:
+			if _, err := parseTimeout(kvp.Value); err != nil {
+				return err
+			}
+		case ContextSourceInfoMaxRetries:
+			if retries, err := strconv.Atoi(kvp.Value); err != nil || retries < 0 {
+				return fmt.Errorf("invalid %s %s", ContextSourceInfoMaxRetries, kvp.Value)
+			}
+		}
+	}
+
+	return nil
+}
+
+func parseTimeout(value string) (time.Duration, error) {
+	period, err := parseAggregationPeriod(value)
+	if err != nil {
+		return 0, err
+	}
+
+	if period.years != 0 || period.months != 0 || period.isZero() {
+		return 0, fmt.Errorf("invalid %s %s", ContextSourceInfoTimeout, value)
+	}
+
+	return time.Duration(period.days)*24*time.Hour + period.duration, nil
+}
+
+//reportSourceError writes the problem carried by an error from a context source to the response,
+//and reports any other error using the supplied function with the detail prefixed by prefix
+func reportSourceError(w http.ResponseWriter, prefix string, err error, report func(http.ResponseWriter, string)) {
+	var failure *errors.ProblemError
+	if stderrors.As(err, &failure) {
+		failure.Problem.WriteResponse(w)
+		return
+	}
+
+	report(w, prefix+err.Error())
+}
+
+//circuitBreaker keeps track of consecutive failures for an endpoint, and is the only record of
+//the availability of the endpoint. Failed requests and failed health checks both count, so that
+//all context sources with the same endpoint, including sources that are re-created when their
+//registration is updated, share the same view of it. While the breaker is open all requests fail
+//immediately. Once it has been open for long enough, a single trial request is let through, and
+//the outcome of that request, or of the next health check, decides if the breaker closes again.
+type circuitBreaker struct {
+	mu            sync.Mutex
+	failures      int
+	open          bool
+	openUntil     time.Time
+	trialInFlight bool
+}
+
+var circuitBreakers = struct {
+	sync.Mutex
+	byEndpoint map[string]*circuitBreaker
+}{byEndpoint: map[string]*circuitBreaker{}}
+
+func circuitBreakerFor(u *url.URL) *circuitBreaker {
+	endpoint := u.Scheme + "://" + u.Host
+
+	circuitBreakers.Lock()
+	defer circuitBreakers.Unlock()
+
+	cb, ok := circuitBreakers.byEndpoint[endpoint]
+	if !ok {
+		cb = &circuitBreaker{}
+		circuitBreakers.byEndpoint[endpoint] = cb
+	}
+
+	return cb
+}
+
+func (cb *circuitBreaker) allow(now time.Time) bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if !cb.open {
+		return true
+	}
+
+	if now.Before(cb.openUntil) || cb.trialInFlight {
+		return false
+	}
+
+	cb.trialInFlight = true
+	return true
+}
+
+//available returns true if a request to the endpoint would be let through at the given time
+func (cb *circuitBreaker) available(now time.Time) bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	return !cb.open || (!now.Before(cb.openUntil) && !cb.trialInFlight)
+}
+
+//record updates the breaker with the outcome of a request or health check. The breaker opens
+//for openDuration once threshold consecutive failures have been recorded.
+func (cb *circuitBreaker) record(success bool, now time.Time, threshold int, openDuration time.Duration) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.trialInFlight = false
+
+	if success {
+		cb.failures = 0
+		cb.open = false
+		return
+	}
+
+	cb.failures++
+	if cb.failures >= threshold {
+		cb.open = true
+		cb.openUntil = now.Add(openDuration)
+	}
+}
+
+//abandon lets another trial request through when the outcome of a request is unknown
+func (cb *circuitBreaker) abandon() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.trialInFlight = false
+}
+
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+//proxy forwards a request to the remote context source. Every attempt is limited by the
+//configured timeout, idempotent requests are retried with an exponential backoff, and requests
+//to an endpoint that keeps failing are stopped by a circuit breaker.
+func (rcs *remoteContextSource) proxy(u *url.URL, req *http.Request) (remoteResponse, error) {
+	var body []byte
+	if req.Body != nil {
+		body, _ = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+	}
+
+	config := rcs.config
+	breaker := circuitBreakerFor(u)
+
+	attempts := 1
+	if isIdempotent(req.Method) {
+		attempts += config.MaxRetries
+	}
+
+	backoff := config.InitialBackoff
+
+	for attempt := 1; ; attempt++ {
+		if !breaker.allow(time.Now()) {
+			return remoteResponse{}, errors.NewProblemError(errors.NewServiceUnavailable(
+				fmt.Sprintf("context source %s is unavailable after repeated failures", u.Host),
+			))
+		}
+
+		response, transportErr := forwardRequest(u, req, body, config.Timeout)
+
+		if req.Context().Err() != nil {
+			// The original request was cancelled, which says nothing about the health of the source
+			breaker.abandon()
+			return response, req.Context().Err()
+		}
+
+		failed := transportErr != nil || response.responseCode >= http.StatusInternalServerError
+		breaker.record(!failed, time.Now(), config.FailureThreshold, config.OpenDuration)
+
+		if failed && attempt < attempts {
+			select {
+			case <-time.After(backoff):
+			case <-req.Context().Done():
+				return response, req.Context().Err()
+			}
+
+			backoff *= 2
+			if backoff > config.MaxBackoff {
+				backoff = config.MaxBackoff
+			}
+			continue
+		}
+
+		if transportErr != nil {
+			return response, transportFailure(u, transportErr)
+		}
+
+		return response, responseError(response)
+	}
+}
+
+//forwardRequest makes a single attempt to forward a request, using a copy of the request so
+//that it can be attempted again
+func forwardRequest(u *url.URL, req *http.Request, body []byte, timeout time.Duration) (remoteResponse, error) {
+	ctx, cancel := context.WithTimeout(req.Context(), timeout)
+	defer cancel()
+
+	outreq := req.Clone(ctx)
+	if body != nil {
+		outreq.Body = ioutil.NopCloser(bytes.NewReader(body))
+		outreq.ContentLength = int64(len(body))
+	}
+
+	var proxyErr error
+
+	response := remoteResponse{}
+	proxy := httputil.NewSingleHostReverseProxy(u)
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		proxyErr = err
+	}
+	proxy.ServeHTTP(&response, outreq)
+
+	if proxyErr != nil && ctx.Err() == context.DeadlineExceeded {
+		proxyErr = context.DeadlineExceeded
+	}
+
+	return response, proxyErr
+}
+
+func transportFailure(u *url.URL, err error) error {
+	if err == context.DeadlineExceeded {
+		return errors.NewProblemError(errors.NewGatewayTimeout(
+			fmt.Sprintf("context source %s did not respond in time", u.Host),
+		))
+	}
+
+	return errors.NewProblemError(errors.NewServiceUnavailable(
+		fmt.Sprintf("failed to reach context source %s: %s", u.Host, err.Error()),
+	))
+}
+
+//requestFailure wraps the error from a failed request to a context source. The status code is
+//only included if the context source responded, since the circuit breaker or the transport may
+//fail the request before it is sent.
+func requestFailure(attempt string, response remoteResponse, err error) error {
+	if response.responseCode == 0 {
+		return fmt.Errorf("%s failed: %w", attempt, err)
+	}
+
+	return fmt.Errorf("%s failed with status code %d: %w", attempt, response.responseCode, err)
+}
+
+func responseError(response remoteResponse) error {
+	if response.responseCode < http.StatusBadRequest {
+		return nil
+	}
+
+	if problem, ok := remoteProblem(response); ok {
+		return errors.NewProblemError(problem)
+	}
+
+	if len(response.bytes) > 0 {
+		return fmt.Errorf("%s", string(response.bytes))
+	}
+
+	return fmt.Errorf("received %d response with empty body", response.responseCode)
+}
+
+//remoteProblem parses the problem in an error response from a context source. Problems are
+//normally sent as application/problem+json, but a plain JSON body is also accepted as long as
+//it identifies the problem type.
+func remoteProblem(response remoteResponse) (errors.ProblemDetails, bool) {
+	contentType := response.Header().Get("Content-Type")
+	isProblem := strings.HasPrefix(contentType, errors.ProblemReportContentType)
+
+	if !isProblem {
+		if !strings.HasPrefix(contentType, "application/json") {
+			return nil, false
+		}
+
+		members := struct {
+			Type string `json:"type"`
+		}{}
+		if json.Unmarshal(response.bytes, &members) != nil || members.Type == "" {
+			return nil, false
+		}
+	}
+
+	problem, err := errors.NewProblemDetailsFromJSON(response.bytes, response.responseCode)
+	if err != nil {
+		return nil, false
+	}
+
+	return problem, true
+}
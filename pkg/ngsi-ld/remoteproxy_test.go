@@ -0,0 +1,210 @@
+package ngsi
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	ngsierrors "github.com/iot-for-tillgenglighet/ngsi-ld-golang/pkg/ngsi-ld/errors"
+)
+
+func newConfiguredRemoteRegistry(t *testing.T, endpoint string, sourceInfo string) ContextRegistry {
+	reg, err := NewCsourceRegistrationFromJSON([]byte(`{"type":"ContextSourceRegistration",
+		"information":[{"entities":[{"idPattern":"^urn:ngsi-ld:Beach:.+","type":"Beach"}]}],
+		"endpoint":"` + endpoint + `","contextSourceInfo":[` + sourceInfo + `]}`))
+	if err != nil {
+		t.Fatal("Failed to create registration: ", err.Error())
+	}
+
+	src, _ := NewRemoteContextSource(reg)
+	ctxRegistry := NewContextRegistry()
+	ctxRegistry.Register(src)
+
+	return ctxRegistry
+}
+
+func retrieveBeach(ctxRegistry ContextRegistry) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("GET", createURL("/entities/urn:ngsi-ld:Beach:1"), nil)
+	w := httptest.NewRecorder()
+	NewRetrieveEntityHandler(ctxRegistry).ServeHTTP(w, req)
+	return w
+}
+
+func TestSlowContextSourceReportsGatewayTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+	defer server.Close()
+
+	ctxRegistry := newConfiguredRemoteRegistry(t, server.URL,
+		`{"key":"timeout","value":"PT0.1S"},{"key":"maxRetries","value":"0"}`)
+
+	w := retrieveBeach(ctxRegistry)
+
+	if w.Code != http.StatusGatewayTimeout {
+		t.Error("Wrong status code returned. ", w.Code, " != expected 504")
+	}
+}
+
+func TestIdempotentRequestsAreRetried(t *testing.T) {
+	requests := int32(0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Add("Content-Type", "application/ld+json")
+		w.Write([]byte(`{"id":"urn:ngsi-ld:Beach:1","type":"Beach"}`))
+	}))
+	defer server.Close()
+
+	w := retrieveBeach(newConfiguredRemoteRegistry(t, server.URL, ""))
+
+	if w.Code != http.StatusOK || atomic.LoadInt32(&requests) != 3 {
+		t.Error("The request should succeed after two retries: ", w.Code, " ", atomic.LoadInt32(&requests))
+	}
+}
+
+func TestNonIdempotentRequestsAreNotRetried(t *testing.T) {
+	requests := int32(0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	ctxRegistry := newConfiguredRemoteRegistry(t, server.URL, "")
+
+	req, _ := http.NewRequest("PATCH", createURL("/entities/urn:ngsi-ld:Beach:1/attrs/"), bytes.NewBuffer([]byte(`{}`)))
+	w := httptest.NewRecorder()
+	NewUpdateEntityAttributesHandler(ctxRegistry).ServeHTTP(w, req)
+
+	if atomic.LoadInt32(&requests) != 1 {
+		t.Error("A PATCH request should not be retried. ", atomic.LoadInt32(&requests), " != 1")
+	}
+}
+
+func TestCircuitBreakerOpensAfterRepeatedFailures(t *testing.T) {
+	requests := int32(0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	ctxRegistry := newConfiguredRemoteRegistry(t, server.URL, `{"key":"maxRetries","value":"0"}`)
+
+	for i := 0; i < DefaultRemoteSourceConfig.FailureThreshold; i++ {
+		retrieveBeach(ctxRegistry)
+	}
+
+	retrieveBeach(ctxRegistry)
+
+	if atomic.LoadInt32(&requests) != int32(DefaultRemoteSourceConfig.FailureThreshold) {
+		t.Error("No requests should be forwarded while the circuit is open.")
+	}
+
+	if len(ctxRegistry.GetContextSourcesForEntity("urn:ngsi-ld:Beach:1")) != 0 {
+		t.Error("A source should be unavailable while the circuit for its endpoint is open.")
+	}
+}
+
+func TestInvalidTimeoutInRegistrationIsRejected(t *testing.T) {
+	_, err := NewCsourceRegistrationFromJSON([]byte(`{"type":"ContextSourceRegistration",
+		"information":[{"entities":[{"type":"Beach"}]}],"endpoint":"lolcathost",
+		"contextSourceInfo":[{"key":"timeout","value":"P1M"}]}`))
+
+	if err == nil {
+		t.Error("A timeout with calendar months should be rejected.")
+	}
+}
+
+func TestProblemsFromContextSourcesAreRelayed(t *testing.T) {
+	server := setupMockServiceThatReturns(http.StatusNotFound, ngsierrors.ProblemReportContentType,
+		`{"type":"https://uri.etsi.org/ngsi-ld/errors/ResourceNotFound","title":"Resource Not Found","detail":"no such beach"}`)
+	defer server.Close()
+
+	ctxRegistry := newConfiguredRemoteRegistry(t, server.URL, "")
+
+	req, _ := http.NewRequest("PATCH", createURL("/entities/urn:ngsi-ld:Beach:1/attrs/"), bytes.NewBuffer([]byte(`{}`)))
+	w := httptest.NewRecorder()
+	NewUpdateEntityAttributesHandler(ctxRegistry).ServeHTTP(w, req)
+
+	problem := map[string]interface{}{}
+	json.Unmarshal(w.Body.Bytes(), &problem)
+
+	if w.Code != http.StatusNotFound || problem["type"] != "https://uri.etsi.org/ngsi-ld/errors/ResourceNotFound" || problem["detail"] != "no such beach" {
+		t.Error("The problem from the context source should be relayed as is: ", w.Code, w.Body.String())
+	}
+}
+
+func TestErrorsFromContextSourcesCarryTheirProblem(t *testing.T) {
+	server := setupMockServiceThatReturns(http.StatusConflict, "application/json",
+		`{"type":"https://uri.etsi.org/ngsi-ld/errors/AlreadyExists","title":"Already Exists"}`)
+	defer server.Close()
+
+	reg, _ := NewCsourceRegistrationFromJSON([]byte(`{"type":"ContextSourceRegistration",
+		"information":[{"entities":[{"type":"Beach"}]}],"endpoint":"` + server.URL + `"}`))
+	src, _ := NewRemoteContextSource(reg)
+
+	req, _ := http.NewRequest("POST", createURL("/entities"), bytes.NewBuffer([]byte(`{"id":"urn:ngsi-ld:Beach:1","type":"Beach"}`)))
+	err := src.CreateEntity("Beach", "urn:ngsi-ld:Beach:1", newRequestWrapper(req))
+
+	var problemErr *ngsierrors.ProblemError
+	if !errors.As(err, &problemErr) || problemErr.Problem.ResponseCode() != http.StatusConflict {
+		t.Error("The error should carry the problem from the context source: ", err)
+	}
+}
+
+func TestErrorsOnlyIncludeTheStatusCodeOfActualResponses(t *testing.T) {
+	server := setupMockServiceThatReturns(http.StatusConflict, "application/json", `{}`)
+	defer server.Close()
+
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	unreachable.Close()
+
+	create := func(endpoint string) error {
+		reg, _ := NewCsourceRegistrationFromJSON([]byte(`{"type":"ContextSourceRegistration",
+			"information":[{"entities":[{"type":"Beach"}]}],"endpoint":"` + endpoint + `"}`))
+		src, _ := NewRemoteContextSource(reg)
+
+		req, _ := http.NewRequest("POST", createURL("/entities"), bytes.NewBuffer([]byte(`{"id":"urn:ngsi-ld:Beach:1","type":"Beach"}`)))
+		return src.CreateEntity("Beach", "urn:ngsi-ld:Beach:1", newRequestWrapper(req))
+	}
+
+	if err := create(server.URL); err == nil || !strings.Contains(err.Error(), "status code 409") {
+		t.Error("The error should include the status code of the response: ", err)
+	}
+
+	if err := create(unreachable.URL); err == nil || strings.Contains(err.Error(), "status code") {
+		t.Error("The error should not include a status code when there was no response: ", err)
+	}
+}
+
+func TestStatusInRelayedProblemIsAdvisory(t *testing.T) {
+	server := setupMockServiceThatReturns(http.StatusNotFound, ngsierrors.ProblemReportContentType,
+		`{"type":"https://uri.etsi.org/ngsi-ld/errors/ResourceNotFound","title":"Resource Not Found","status":200}`)
+	defer server.Close()
+
+	ctxRegistry := newConfiguredRemoteRegistry(t, server.URL, "")
+
+	req, _ := http.NewRequest("PATCH", createURL("/entities/urn:ngsi-ld:Beach:1/attrs/"), bytes.NewBuffer([]byte(`{}`)))
+	w := httptest.NewRecorder()
+	NewUpdateEntityAttributesHandler(ctxRegistry).ServeHTTP(w, req)
+
+	problem := map[string]interface{}{}
+	json.Unmarshal(w.Body.Bytes(), &problem)
+
+	if w.Code != http.StatusNotFound || problem["status"] != 200.0 {
+		t.Error("The actual response code should be used and the status member kept as is: ", w.Code, w.Body.String())
+	}
+}
@@ -6,6 +6,14 @@ import (
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	//OptionNoOverwrite tells a context source that existing attributes must not be
+	//replaced when attributes are appended to an entity
+	OptionNoOverwrite string = "noOverwrite"
 )
 
 //Request is an interface to be used when passing header and body information for NGSI-LD API requests
@@ -42,3 +50,45 @@ func (r *requestWrapper) BodyReader() io.Reader {
 func (r *requestWrapper) DecodeBodyInto(v interface{}) error {
 	return json.NewDecoder(r.BodyReader()).Decode(v)
 }
+
+//RequestHasOption returns true if the supplied option is one of the comma separated values
+//in the options parameter of the request
+func RequestHasOption(r Request, option string) bool {
+	for _, o := range strings.Split(queryParameters(r.Request()).Get("options"), ",") {
+		if o == option {
+			return true
+		}
+	}
+	return false
+}
+
+//queryParameters parses the query parameters of a request. Unlike http.Request.URL.Query it
+//only splits parameters on & since the NGSI-LD query language and georel parameter use ;
+//as a separator, and those are not always URL encoded by clients.
+func queryParameters(req *http.Request) url.Values {
+	params := url.Values{}
+
+	for _, param := range strings.Split(req.URL.RawQuery, "&") {
+		if param == "" {
+			continue
+		}
+
+		kv := strings.SplitN(param, "=", 2)
+		key, err := url.QueryUnescape(kv[0])
+		if err != nil {
+			continue
+		}
+
+		value := ""
+		if len(kv) == 2 {
+			value, err = url.QueryUnescape(kv[1])
+			if err != nil {
+				continue
+			}
+		}
+
+		params.Add(key, value)
+	}
+
+	return params
+}
@@ -0,0 +1,703 @@
+package ngsi
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/iot-for-tillgenglighet/ngsi-ld-golang/pkg/ngsi-ld/errors"
+)
+
+const (
+	//SubscriptionStatusActive is the status of a subscription that may trigger notifications
+	SubscriptionStatusActive string = "active"
+	//SubscriptionStatusPaused is the status of a subscription that has been deactivated using isActive
+	SubscriptionStatusPaused string = "paused"
+	//SubscriptionStatusExpired is the status of a subscription with an expiresAt in the past
+	SubscriptionStatusExpired string = "expired"
+
+	//NotificationFormatNormalized sends entities with all their properties and relationships
+	NotificationFormatNormalized string = "normalized"
+	//NotificationFormatKeyValues sends entities in the simplified key/value representation
+	NotificationFormatKeyValues string = "keyValues"
+)
+
+//ErrSubscriptionNotFound is returned when a subscription with the requested id does not exist
+var ErrSubscriptionNotFound = fmt.Errorf("subscription not found")
+
+//ErrSubscriptionAlreadyExists is returned when a subscription with the same id already exists
+var ErrSubscriptionAlreadyExists = fmt.Errorf("subscription already exists")
+
+//EntityInfo selects entities by type and, optionally, by id or id pattern
+type EntityInfo struct {
+	ID        *string `json:"id,omitempty"`
+	IDPattern *string `json:"idPattern,omitempty"`
+	Type      string  `json:"type"`
+
+	regexpForID *regexp.Regexp
+}
+
+func (ei *EntityInfo) compile() error {
+	if ei.IDPattern != nil {
+		var err error
+		ei.regexpForID, err = regexp.CompilePOSIX(*ei.IDPattern)
+		if err != nil {
+			return fmt.Errorf("invalid idPattern %s: %s", *ei.IDPattern, err.Error())
+		}
+	}
+	return nil
+}
+
+//Matches returns true if an entity with the supplied id and type is selected by this EntityInfo
+func (ei *EntityInfo) Matches(entityID, entityType string) bool {
+	if ei.Type != entityType {
+		return false
+	}
+
+	if ei.ID != nil {
+		return *ei.ID == entityID
+	}
+
+	if ei.regexpForID != nil {
+		return ei.regexpForID.MatchString(entityID)
+	}
+
+	return true
+}
+
+//KeyValuePair is used for the receiverInfo and notifierInfo lists in notification endpoints
+type KeyValuePair struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+//NotificationEndpoint describes where, and how, notifications should be sent
+type NotificationEndpoint struct {
+	URI          string         `json:"uri"`
+	Accept       string         `json:"accept,omitempty"`
+	ReceiverInfo []KeyValuePair `json:"receiverInfo,omitempty"`
+	NotifierInfo []KeyValuePair `json:"notifierInfo,omitempty"`
+}
+
+//NotificationParams contains the parameters for, and status of, the notifications of a subscription
+type NotificationParams struct {
+	Attributes []string             `json:"attributes,omitempty"`
+	Format     string               `json:"format,omitempty"`
+	Endpoint   NotificationEndpoint `json:"endpoint"`
+
+	Status           string `json:"status,omitempty"`
+	TimesSent        uint64 `json:"timesSent,omitempty"`
+	LastNotification string `json:"lastNotification,omitempty"`
+	LastFailure      string `json:"lastFailure,omitempty"`
+	LastSuccess      string `json:"lastSuccess,omitempty"`
+}
+
+//Subscription is a request from a client to be notified about changes to entities
+type Subscription struct {
+	ID                string             `json:"id"`
+	Type              string             `json:"type"`
+	SubscriptionName  string             `json:"subscriptionName,omitempty"`
+	Description       string             `json:"description,omitempty"`
+	Entities          []EntityInfo       `json:"entities,omitempty"`
+	WatchedAttributes []string           `json:"watchedAttributes,omitempty"`
+	Q                 string             `json:"q,omitempty"`
+	GeoQ              *GeoQuery          `json:"geoQ,omitempty"`
+	IsActive          *bool              `json:"isActive,omitempty"`
+	Notification      NotificationParams `json:"notification"`
+	ExpiresAt         string             `json:"expiresAt,omitempty"`
+	Throttling        float64            `json:"throttling,omitempty"`
+	Status            string             `json:"status,omitempty"`
+
+	filter    QueryExpression
+	expiresAt *time.Time
+}
+
+//NewSubscriptionFromJSON unpacks a byte buffer into a Subscription and validates its contents
+func NewSubscriptionFromJSON(jsonBytes []byte) (*Subscription, error) {
+	subscription := &Subscription{}
+	err := json.Unmarshal(jsonBytes, subscription)
+	if err != nil {
+		return nil, err
+	}
+
+	if subscription.ID == "" {
+		subscription.ID = "urn:ngsi-ld:Subscription:" + uuid.New().String()
+	}
+
+	err = subscription.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return subscription, nil
+}
+
+func (s *Subscription) validate() error {
+	if s.Type != "Subscription" {
+		return fmt.Errorf("the type of a subscription must be Subscription, not \"%s\"", s.Type)
+	}
+
+	if _, err := url.ParseRequestURI(s.ID); err != nil {
+		return fmt.Errorf("the subscription id %s is not a valid URI", s.ID)
+	}
+
+	if len(s.Entities) == 0 && len(s.WatchedAttributes) == 0 {
+		return fmt.Errorf("a subscription must specify at least one of entities or watchedAttributes")
+	}
+
+	for idx := range s.Entities {
+		if s.Entities[idx].Type == "" {
+			return fmt.Errorf("all entities in a subscription must specify a type")
+		}
+		if err := s.Entities[idx].compile(); err != nil {
+			return err
+		}
+	}
+
+	s.filter = nil
+	if s.Q != "" {
+		var err error
+		s.filter, err = ParseQueryExpression(s.Q)
+		if err != nil {
+			return fmt.Errorf("invalid query expression: %s", err.Error())
+		}
+	}
+
+	format := s.Notification.Format
+	if format != "" && format != NotificationFormatNormalized && format != NotificationFormatKeyValues {
+		return fmt.Errorf("unsupported notification format %s", format)
+	}
+
+	if err := validateNotificationEndpoint(s.Notification.Endpoint); err != nil {
+		return err
+	}
+
+	s.expiresAt = nil
+	if s.ExpiresAt != "" {
+		expiresAt, err := time.Parse(time.RFC3339Nano, s.ExpiresAt)
+		if err != nil {
+			return fmt.Errorf("invalid expiresAt %s: %s", s.ExpiresAt, err.Error())
+		}
+		s.expiresAt = &expiresAt
+	}
+
+	if s.Throttling < 0 {
+		return fmt.Errorf("throttling must be a non negative number of seconds")
+	}
+
+	return nil
+}
+
+func validateNotificationEndpoint(endpoint NotificationEndpoint) error {
+	u, err := url.Parse(endpoint.URI)
+	if err != nil || endpoint.URI == "" {
+		return fmt.Errorf("invalid notification endpoint uri \"%s\"", endpoint.URI)
+	}
+
+	if u.Host == "" {
+		return fmt.Errorf("the notification endpoint uri %s must contain a host", endpoint.URI)
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		return nil
+	case "mqtt", "mqtts":
+		return validateMQTTEndpoint(u, endpoint)
+	}
+
+	return fmt.Errorf("unsupported notification endpoint scheme %s", u.Scheme)
+}
+
+//CurrentStatus returns active, paused or expired depending on the isActive flag and expiresAt
+func (s *Subscription) CurrentStatus(now time.Time) string {
+	if s.expiresAt != nil && !now.Before(*s.expiresAt) {
+		return SubscriptionStatusExpired
+	}
+
+	if s.IsActive != nil && !*s.IsActive {
+		return SubscriptionStatusPaused
+	}
+
+	return SubscriptionStatusActive
+}
+
+//matchesEntity checks the entities, watchedAttributes, q and geoQ of the subscription
+func (s *Subscription) matchesEntity(entity map[string]interface{}, changedAttributes []string) bool {
+	entityID, _ := entity["id"].(string)
+	entityType, _ := entity["type"].(string)
+
+	if len(s.Entities) > 0 {
+		selected := false
+		for idx := range s.Entities {
+			if s.Entities[idx].Matches(entityID, entityType) {
+				selected = true
+				break
+			}
+		}
+		if !selected {
+			return false
+		}
+	}
+
+	if len(s.WatchedAttributes) > 0 {
+		watched := false
+		for _, changed := range changedAttributes {
+			for _, attributeName := range s.WatchedAttributes {
+				if changed == attributeName {
+					watched = true
+				}
+			}
+		}
+		if !watched {
+			return false
+		}
+	}
+
+	if s.filter != nil && !evaluateExpression(s.filter, entity) {
+		return false
+	}
+
+	if s.GeoQ != nil && !s.GeoQ.Matches(entityGeometry(entity, s.GeoQ.GeoProperty)) {
+		return false
+	}
+
+	return true
+}
+
+//SubscriptionStore stores subscriptions on behalf of a SubscriptionManager
+type SubscriptionStore interface {
+	Add(subscription Subscription) error
+	Get(id string) (Subscription, error)
+	List() []Subscription
+	Replace(subscription Subscription) error
+	Remove(id string) error
+}
+
+//NewInMemorySubscriptionStore creates a SubscriptionStore that keeps all subscriptions in memory
+func NewInMemorySubscriptionStore() SubscriptionStore {
+	return &inMemorySubscriptionStore{subscriptions: map[string]Subscription{}}
+}
+
+type inMemorySubscriptionStore struct {
+	mu            sync.RWMutex
+	subscriptions map[string]Subscription
+}
+
+func (ims *inMemorySubscriptionStore) Add(subscription Subscription) error {
+	ims.mu.Lock()
+	defer ims.mu.Unlock()
+
+	if _, exists := ims.subscriptions[subscription.ID]; exists {
+		return ErrSubscriptionAlreadyExists
+	}
+
+	ims.subscriptions[subscription.ID] = subscription
+	return nil
+}
+
+func (ims *inMemorySubscriptionStore) Get(id string) (Subscription, error) {
+	ims.mu.RLock()
+	defer ims.mu.RUnlock()
+
+	subscription, exists := ims.subscriptions[id]
+	if !exists {
+		return Subscription{}, ErrSubscriptionNotFound
+	}
+
+	return subscription, nil
+}
+
+func (ims *inMemorySubscriptionStore) List() []Subscription {
+	ims.mu.RLock()
+	defer ims.mu.RUnlock()
+
+	subscriptions := []Subscription{}
+	for _, s := range ims.subscriptions {
+		subscriptions = append(subscriptions, s)
+	}
+
+	sort.Slice(subscriptions, func(i, j int) bool {
+		return subscriptions[i].ID < subscriptions[j].ID
+	})
+
+	return subscriptions
+}
+
+func (ims *inMemorySubscriptionStore) Replace(subscription Subscription) error {
+	ims.mu.Lock()
+	defer ims.mu.Unlock()
+
+	if _, exists := ims.subscriptions[subscription.ID]; !exists {
+		return ErrSubscriptionNotFound
+	}
+
+	ims.subscriptions[subscription.ID] = subscription
+	return nil
+}
+
+func (ims *inMemorySubscriptionStore) Remove(id string) error {
+	ims.mu.Lock()
+	defer ims.mu.Unlock()
+
+	if _, exists := ims.subscriptions[id]; !exists {
+		return ErrSubscriptionNotFound
+	}
+
+	delete(ims.subscriptions, id)
+	return nil
+}
+
+//SubscriptionManager keeps track of subscriptions and notifies subscribers about entity changes
+type SubscriptionManager interface {
+	CreateSubscription(subscription *Subscription) error
+	RetrieveSubscription(id string) (*Subscription, error)
+	ListSubscriptions() []Subscription
+	UpdateSubscription(id string, patch []byte) (*Subscription, error)
+	DeleteSubscription(id string) error
+
+	EntityChanged(entity Entity, changedAttributes []string)
+}
+
+//NewSubscriptionManager creates a SubscriptionManager that stores its subscriptions in the
+//supplied store and sends notifications using HTTP POST requests
+func NewSubscriptionManager(store SubscriptionStore) SubscriptionManager {
+	return &subscriptionManager{
+		store:  store,
+		client: &http.Client{Timeout: 10 * time.Second},
+		now:    time.Now,
+	}
+}
+
+type subscriptionManager struct {
+	// mu serializes updates of the notification status of subscriptions
+	mu     sync.Mutex
+	store  SubscriptionStore
+	client *http.Client
+	now    func() time.Time
+}
+
+func (sm *subscriptionManager) CreateSubscription(subscription *Subscription) error {
+	err := subscription.validate()
+	if err != nil {
+		return err
+	}
+
+	subscription.Status = ""
+	subscription.Notification.Status = ""
+	subscription.Notification.TimesSent = 0
+	subscription.Notification.LastNotification = ""
+	subscription.Notification.LastSuccess = ""
+	subscription.Notification.LastFailure = ""
+
+	return sm.store.Add(*subscription)
+}
+
+func (sm *subscriptionManager) RetrieveSubscription(id string) (*Subscription, error) {
+	subscription, err := sm.store.Get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	subscription.Status = subscription.CurrentStatus(sm.now())
+	return &subscription, nil
+}
+
+func (sm *subscriptionManager) ListSubscriptions() []Subscription {
+	subscriptions := sm.store.List()
+	now := sm.now()
+
+	for idx := range subscriptions {
+		subscriptions[idx].Status = subscriptions[idx].CurrentStatus(now)
+	}
+
+	return subscriptions
+}
+
+func (sm *subscriptionManager) UpdateSubscription(id string, patch []byte) (*Subscription, error) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	current, err := sm.store.Get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	fragment := map[string]json.RawMessage{}
+	err = json.Unmarshal(patch, &fragment)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := fragment["id"]; ok {
+		return nil, fmt.Errorf("the id of a subscription can not be changed")
+	}
+
+	currentBytes, _ := json.Marshal(current)
+	merged := map[string]json.RawMessage{}
+	json.Unmarshal(currentBytes, &merged)
+
+	for key, value := range fragment {
+		if string(value) == "null" {
+			delete(merged, key)
+		} else {
+			merged[key] = value
+		}
+	}
+
+	mergedBytes, _ := json.Marshal(merged)
+
+	updated := Subscription{}
+	err = json.Unmarshal(mergedBytes, &updated)
+	if err != nil {
+		return nil, err
+	}
+
+	err = updated.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	// The notification status is maintained by the broker and can not be patched
+	updated.Status = ""
+	updated.Notification.Status = current.Notification.Status
+	updated.Notification.TimesSent = current.Notification.TimesSent
+	updated.Notification.LastNotification = current.Notification.LastNotification
+	updated.Notification.LastSuccess = current.Notification.LastSuccess
+	updated.Notification.LastFailure = current.Notification.LastFailure
+
+	err = sm.store.Replace(updated)
+	if err != nil {
+		return nil, err
+	}
+
+	updated.Status = updated.CurrentStatus(sm.now())
+	return &updated, nil
+}
+
+func (sm *subscriptionManager) DeleteSubscription(id string) error {
+	return sm.store.Remove(id)
+}
+
+//EntityChanged matches an entity that has been created or modified against all active
+//subscriptions, and sends notifications to the ones that match
+func (sm *subscriptionManager) EntityChanged(entity Entity, changedAttributes []string) {
+	entityMap, err := entityAsMap(entity)
+	if err != nil {
+		return
+	}
+
+	now := sm.now()
+
+	for _, subscription := range sm.store.List() {
+		if subscription.CurrentStatus(now) != SubscriptionStatusActive {
+			continue
+		}
+
+		if !subscription.matchesEntity(entityMap, changedAttributes) {
+			continue
+		}
+
+		if sm.beginNotification(subscription.ID, now) {
+			notification := newNotification(&subscription, entityMap, now)
+			go sm.sendNotification(subscription, notification)
+		}
+	}
+}
+
+//beginNotification checks the throttling of the subscription and, if a notification
+//may be sent, records the time of the notification
+func (sm *subscriptionManager) beginNotification(id string, now time.Time) bool {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	subscription, err := sm.store.Get(id)
+	if err != nil {
+		return false
+	}
+
+	if subscription.Throttling > 0 && subscription.Notification.LastNotification != "" {
+		last, err := time.Parse(time.RFC3339Nano, subscription.Notification.LastNotification)
+		throttling := time.Duration(subscription.Throttling * float64(time.Second))
+		if err == nil && now.Before(last.Add(throttling)) {
+			return false
+		}
+	}
+
+	subscription.Notification.LastNotification = now.UTC().Format(time.RFC3339Nano)
+	subscription.Notification.TimesSent++
+
+	return sm.store.Replace(subscription) == nil
+}
+
+func (sm *subscriptionManager) sendNotification(subscription Subscription, notification *Notification) {
+	err := sm.deliver(subscription.Notification.Endpoint, notification)
+
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	current, getErr := sm.store.Get(subscription.ID)
+	if getErr != nil {
+		return
+	}
+
+	timestamp := sm.now().UTC().Format(time.RFC3339Nano)
+
+	if err != nil {
+		current.Notification.Status = "failed"
+		current.Notification.LastFailure = timestamp
+	} else {
+		current.Notification.Status = "ok"
+		current.Notification.LastSuccess = timestamp
+	}
+
+	sm.store.Replace(current)
+}
+
+//NewCreateSubscriptionHandler handles POST requests for subscriptions
+func NewCreateSubscriptionHandler(subMgr SubscriptionManager) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		subscription, err := NewSubscriptionFromJSON(body)
+
+		if err != nil {
+			errors.ReportNewBadRequestData(
+				w,
+				"Failed to create subscription from payload: "+err.Error(),
+			)
+			return
+		}
+
+		err = subMgr.CreateSubscription(subscription)
+		if err == ErrSubscriptionAlreadyExists {
+			errors.ReportNewAlreadyExists(w, fmt.Sprintf("A subscription with id %s already exists", subscription.ID))
+			return
+		} else if err != nil {
+			errors.ReportNewBadRequestData(w, "Failed to create subscription: "+err.Error())
+			return
+		}
+
+		w.Header().Add("Location", strings.TrimSuffix(r.URL.Path, "/")+"/"+subscription.ID)
+		w.WriteHeader(http.StatusCreated)
+	})
+}
+
+func subscriptionIDFromPath(path string) string {
+	subscriptionsIdx := strings.Index(path, "/subscriptions/")
+	if subscriptionsIdx == -1 {
+		return ""
+	}
+	return strings.TrimSuffix(path[subscriptionsIdx+15:], "/")
+}
+
+//NewRetrieveSubscriptionHandler handles GET requests for a single subscription
+func NewRetrieveSubscriptionHandler(subMgr SubscriptionManager) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		subscriptionID := subscriptionIDFromPath(r.URL.Path)
+
+		if subscriptionID == "" {
+			errors.ReportNewBadRequestData(
+				w,
+				"The supplied URL is invalid.",
+			)
+			return
+		}
+
+		subscription, err := subMgr.RetrieveSubscription(subscriptionID)
+		if err != nil {
+			errors.ReportNewResourceNotFound(w, fmt.Sprintf("No subscription found with id %s", subscriptionID))
+			return
+		}
+
+		bytes, _ := json.MarshalIndent(subscription, "", "  ")
+
+		w.Header().Add("Content-Type", "application/json")
+		w.Write(bytes)
+	})
+}
+
+//NewQuerySubscriptionsHandler handles GET requests for all subscriptions
+func NewQuerySubscriptionsHandler(subMgr SubscriptionManager) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query, err := newQueryFromParameters(r, []string{""}, []string{""}, "")
+		if err != nil {
+			errors.ReportNewBadRequestData(w, err.Error())
+			return
+		}
+
+		subscriptions := subMgr.ListSubscriptions()
+
+		offset := query.PaginationOffset()
+		if offset > uint64(len(subscriptions)) {
+			offset = uint64(len(subscriptions))
+		}
+
+		end := offset + query.PaginationLimit()
+		if end > uint64(len(subscriptions)) {
+			end = uint64(len(subscriptions))
+		}
+
+		bytes, _ := json.MarshalIndent(subscriptions[offset:end], "", "  ")
+
+		w.Header().Add("Content-Type", "application/json")
+		w.Write(bytes)
+	})
+}
+
+//NewUpdateSubscriptionHandler handles PATCH requests for subscriptions
+func NewUpdateSubscriptionHandler(subMgr SubscriptionManager) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		subscriptionID := subscriptionIDFromPath(r.URL.Path)
+
+		if subscriptionID == "" {
+			errors.ReportNewBadRequestData(
+				w,
+				"The supplied URL is invalid.",
+			)
+			return
+		}
+
+		body, _ := ioutil.ReadAll(r.Body)
+
+		_, err := subMgr.UpdateSubscription(subscriptionID, body)
+		if err == ErrSubscriptionNotFound {
+			errors.ReportNewResourceNotFound(w, fmt.Sprintf("No subscription found with id %s", subscriptionID))
+			return
+		} else if err != nil {
+			errors.ReportNewBadRequestData(w, "Failed to update subscription: "+err.Error())
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+//NewDeleteSubscriptionHandler handles DELETE requests for subscriptions
+func NewDeleteSubscriptionHandler(subMgr SubscriptionManager) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		subscriptionID := subscriptionIDFromPath(r.URL.Path)
+
+		if subscriptionID == "" {
+			errors.ReportNewBadRequestData(
+				w,
+				"The supplied URL is invalid.",
+			)
+			return
+		}
+
+		err := subMgr.DeleteSubscription(subscriptionID)
+		if err != nil {
+			errors.ReportNewResourceNotFound(w, fmt.Sprintf("No subscription found with id %s", subscriptionID))
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
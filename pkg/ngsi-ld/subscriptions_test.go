@@ -0,0 +1,278 @@
+package ngsi
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/iot-for-tillgenglighet/ngsi-ld-golang/pkg/datamodels/fiware"
+	"github.com/iot-for-tillgenglighet/ngsi-ld-golang/pkg/ngsi-ld/internal/mqtt"
+)
+
+const testSubscriptionJSON string = `{
+	"id": "urn:ngsi-ld:Subscription:sub1",
+	"type": "Subscription",
+	"entities": [{"type": "Device"}],
+	"notification": {
+		"format": "keyValues",
+		"endpoint": {"uri": "%s", "accept": "application/json"}
+	}
+}`
+
+func newTestSubscriptionJSON(endpoint string) []byte {
+	return []byte(strings.Replace(testSubscriptionJSON, "%s", endpoint, 1))
+}
+
+func createTestSubscription(subMgr SubscriptionManager, endpoint string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("POST", createURL("/subscriptions"), bytes.NewBuffer(newTestSubscriptionJSON(endpoint)))
+	w := httptest.NewRecorder()
+	NewCreateSubscriptionHandler(subMgr).ServeHTTP(w, req)
+	return w
+}
+
+func TestCreateSubscription(t *testing.T) {
+	subMgr := NewSubscriptionManager(NewInMemorySubscriptionStore())
+
+	w := createTestSubscription(subMgr, "http://localhost:1234/notify")
+
+	if w.Code != http.StatusCreated {
+		t.Error("Handler did not return the expected status code. ", w.Code, " != ", http.StatusCreated)
+	}
+
+	if w.Header().Get("Location") != "/ngsi-ld/v1/subscriptions/urn:ngsi-ld:Subscription:sub1" {
+		t.Error("Unexpected Location header: ", w.Header().Get("Location"))
+	}
+
+	req, _ := http.NewRequest("GET", createURL("/subscriptions/urn:ngsi-ld:Subscription:sub1"), nil)
+	w = httptest.NewRecorder()
+	NewRetrieveSubscriptionHandler(subMgr).ServeHTTP(w, req)
+
+	subscription := &Subscription{}
+	json.Unmarshal(w.Body.Bytes(), subscription)
+
+	if subscription.ID != "urn:ngsi-ld:Subscription:sub1" || subscription.Status != SubscriptionStatusActive {
+		t.Error("Unexpected subscription retrieved: ", w.Body.String())
+	}
+}
+
+func TestCreateSubscriptionWithoutEntitiesOrWatchedAttributesFails(t *testing.T) {
+	subMgr := NewSubscriptionManager(NewInMemorySubscriptionStore())
+	body := `{"type":"Subscription","notification":{"endpoint":{"uri":"http://localhost/notify"}}}`
+
+	req, _ := http.NewRequest("POST", createURL("/subscriptions"), bytes.NewBuffer([]byte(body)))
+	w := httptest.NewRecorder()
+	NewCreateSubscriptionHandler(subMgr).ServeHTTP(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Error("Handler did not return the expected status code. ", w.Code, " != ", http.StatusBadRequest)
+	}
+}
+
+func TestCreateSubscriptionWithExistingIDFails(t *testing.T) {
+	subMgr := NewSubscriptionManager(NewInMemorySubscriptionStore())
+
+	createTestSubscription(subMgr, "http://localhost:1234/notify")
+	w := createTestSubscription(subMgr, "http://localhost:1234/notify")
+
+	if w.Code != http.StatusConflict {
+		t.Error("Handler did not return the expected status code. ", w.Code, " != ", http.StatusConflict)
+	}
+}
+
+func TestUpdateSubscriptionCanPauseIt(t *testing.T) {
+	subMgr := NewSubscriptionManager(NewInMemorySubscriptionStore())
+	createTestSubscription(subMgr, "http://localhost:1234/notify")
+
+	req, _ := http.NewRequest("PATCH", createURL("/subscriptions/urn:ngsi-ld:Subscription:sub1"), bytes.NewBuffer([]byte(`{"isActive":false}`)))
+	w := httptest.NewRecorder()
+	NewUpdateSubscriptionHandler(subMgr).ServeHTTP(w, req)
+
+	if w.Code != http.StatusNoContent {
+		t.Error("Handler did not return the expected status code. ", w.Code, " != ", http.StatusNoContent)
+	}
+
+	subscription, _ := subMgr.RetrieveSubscription("urn:ngsi-ld:Subscription:sub1")
+	if subscription.Status != SubscriptionStatusPaused {
+		t.Error("Subscription status not updated as expected. ", subscription.Status, " != ", SubscriptionStatusPaused)
+	}
+}
+
+func TestDeleteSubscription(t *testing.T) {
+	subMgr := NewSubscriptionManager(NewInMemorySubscriptionStore())
+	createTestSubscription(subMgr, "http://localhost:1234/notify")
+
+	for _, expectedCode := range []int{http.StatusNoContent, http.StatusNotFound} {
+		req, _ := http.NewRequest("DELETE", createURL("/subscriptions/urn:ngsi-ld:Subscription:sub1"), nil)
+		w := httptest.NewRecorder()
+		NewDeleteSubscriptionHandler(subMgr).ServeHTTP(w, req)
+
+		if w.Code != expectedCode {
+			t.Error("Handler did not return the expected status code. ", w.Code, " != ", expectedCode)
+		}
+	}
+}
+
+func TestQuerySubscriptions(t *testing.T) {
+	subMgr := NewSubscriptionManager(NewInMemorySubscriptionStore())
+	createTestSubscription(subMgr, "http://localhost:1234/notify")
+
+	req, _ := http.NewRequest("GET", createURL("/subscriptions"), nil)
+	w := httptest.NewRecorder()
+	NewQuerySubscriptionsHandler(subMgr).ServeHTTP(w, req)
+
+	subscriptions := []Subscription{}
+	json.Unmarshal(w.Body.Bytes(), &subscriptions)
+
+	if len(subscriptions) != 1 {
+		t.Error("Unexpected number of subscriptions returned. ", len(subscriptions), " != 1")
+	}
+}
+
+func TestSubscriptionStatusIsExpiredAfterExpiresAt(t *testing.T) {
+	subscription, err := NewSubscriptionFromJSON([]byte(`{
+		"type":"Subscription","watchedAttributes":["temperature"],"expiresAt":"2020-01-01T00:00:00Z",
+		"notification":{"endpoint":{"uri":"http://localhost/notify"}}}`))
+
+	if err != nil {
+		t.Error("Failed to create subscription: ", err.Error())
+		return
+	}
+
+	if subscription.CurrentStatus(time.Now()) != SubscriptionStatusExpired {
+		t.Error("Subscription is not expired as expected.")
+	}
+}
+
+func TestSubscriptionMatchesEntityWithQ(t *testing.T) {
+	subscription, _ := NewSubscriptionFromJSON([]byte(`{
+		"type":"Subscription","entities":[{"type":"WeatherObserved"}],"q":"temperature>20",
+		"watchedAttributes":["temperature"],"notification":{"endpoint":{"uri":"http://localhost/notify"}}}`))
+
+	entity := map[string]interface{}{
+		"id": "urn:ngsi-ld:WeatherObserved:w1", "type": "WeatherObserved",
+		"temperature": map[string]interface{}{"type": "Property", "value": 12.0},
+	}
+
+	if subscription.matchesEntity(entity, []string{"temperature"}) {
+		t.Error("Subscription should not match an entity with temperature 12.")
+	}
+
+	entity["temperature"] = map[string]interface{}{"type": "Property", "value": 22.0}
+
+	if !subscription.matchesEntity(entity, []string{"temperature"}) {
+		t.Error("Subscription should match an entity with temperature 22.")
+	}
+
+	if subscription.matchesEntity(entity, []string{"humidity"}) {
+		t.Error("Subscription should not match when no watched attribute has changed.")
+	}
+}
+
+func TestThrottlingLimitsNotifications(t *testing.T) {
+	subMgr := NewSubscriptionManager(NewInMemorySubscriptionStore()).(*subscriptionManager)
+
+	subscription, _ := NewSubscriptionFromJSON(newTestSubscriptionJSON("http://localhost/notify"))
+	subscription.Throttling = 10
+	subMgr.CreateSubscription(subscription)
+
+	now := time.Now()
+
+	if !subMgr.beginNotification(subscription.ID, now) {
+		t.Error("First notification should not be throttled.")
+	}
+
+	if subMgr.beginNotification(subscription.ID, now.Add(5*time.Second)) {
+		t.Error("Second notification within the throttling period should be throttled.")
+	}
+
+	if !subMgr.beginNotification(subscription.ID, now.Add(11*time.Second)) {
+		t.Error("Notification after the throttling period should not be throttled.")
+	}
+}
+
+func TestNotificationIsSentWhenEntityIsCreated(t *testing.T) {
+	notifications := make(chan Notification, 1)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		notification := Notification{}
+		json.Unmarshal(body, &notification)
+		notifications <- notification
+	}))
+	defer server.Close()
+
+	subMgr := NewSubscriptionManager(NewInMemorySubscriptionStore())
+	createTestSubscription(subMgr, server.URL+"/notify")
+
+	ctxReg, _ := newContextRegistryWithSourceForType("Device")
+	ctxReg = NewNotifyingContextRegistry(ctxReg, subMgr)
+
+	byteReader, _ := newEntityAsByteBuffer(fiware.DeviceIDPrefix + "livboj")
+	req, _ := http.NewRequest("POST", createURL("/entities"), byteReader)
+	w := httptest.NewRecorder()
+	NewCreateEntityHandler(ctxReg).ServeHTTP(w, req)
+
+	select {
+	case notification := <-notifications:
+		if notification.SubscriptionID != "urn:ngsi-ld:Subscription:sub1" || len(notification.Data) != 1 {
+			t.Error("Unexpected notification received: ", notification)
+		} else if notification.Data[0]["id"] != fiware.DeviceIDPrefix+"livboj" {
+			t.Error("Unexpected entity in notification: ", notification.Data[0])
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("No notification received within the expected time.")
+	}
+}
+
+func TestNotificationIsPublishedToMQTTBroker(t *testing.T) {
+	broker, err := mqtt.NewBroker("127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Failed to start embedded broker: ", err.Error())
+	}
+	defer broker.Close()
+
+	subMgr := NewSubscriptionManager(NewInMemorySubscriptionStore())
+	subscription, _ := NewSubscriptionFromJSON(newTestSubscriptionJSON(broker.URL() + "/notifications"))
+	subscription.Notification.Endpoint.NotifierInfo = []KeyValuePair{{Key: NotifierInfoMQTTQoS, Value: "1"}}
+	subscription.Notification.Endpoint.ReceiverInfo = []KeyValuePair{{Key: "x-tenant", Value: "city"}}
+
+	err = subMgr.CreateSubscription(subscription)
+	if err != nil {
+		t.Error("Failed to create subscription: ", err.Error())
+		return
+	}
+
+	subMgr.EntityChanged(fiware.NewDevice("livboj", "on"), []string{"value"})
+
+	select {
+	case msg := <-broker.Messages():
+		if msg.Topic != "notifications" || msg.QoS != 1 {
+			t.Error("Unexpected topic or qos: ", msg.Topic, msg.QoS)
+		}
+		if len(msg.UserProperties) != 1 || msg.UserProperties[0].Key != "x-tenant" {
+			t.Error("Receiver info not sent as user properties: ", msg.UserProperties)
+		}
+		notification := Notification{}
+		json.Unmarshal(msg.Payload, &notification)
+		if notification.SubscriptionID != subscription.ID || notification.Data[0]["value"] != "on" {
+			t.Error("Unexpected notification published: ", string(msg.Payload))
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("No notification published within the expected time.")
+	}
+}
+
+func TestMQTTSubscriptionWithInvalidQoSFails(t *testing.T) {
+	subscription, _ := NewSubscriptionFromJSON(newTestSubscriptionJSON("mqtt://localhost/notifications"))
+	subscription.Notification.Endpoint.NotifierInfo = []KeyValuePair{{Key: NotifierInfoMQTTQoS, Value: "3"}}
+
+	subMgr := NewSubscriptionManager(NewInMemorySubscriptionStore())
+	if subMgr.CreateSubscription(subscription) == nil {
+		t.Error("Subscription with an invalid MQTT-QoS should not be accepted.")
+	}
+}
@@ -0,0 +1,507 @@
+package ngsi
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/iot-for-tillgenglighet/ngsi-ld-golang/pkg/ngsi-ld/errors"
+)
+
+const (
+	//TemporalRelationBefore matches attribute instances with a time before timeAt
+	TemporalRelationBefore = "before"
+	//TemporalRelationAfter matches attribute instances with a time after timeAt
+	TemporalRelationAfter = "after"
+	//TemporalRelationBetween matches attribute instances with a time between timeAt and endTimeAt
+	TemporalRelationBetween = "between"
+
+	//TemporalPropertyObservedAt is the default time property used in temporal queries
+	TemporalPropertyObservedAt = "observedAt"
+	//TemporalPropertyCreatedAt selects the time an attribute instance was created
+	TemporalPropertyCreatedAt = "createdAt"
+	//TemporalPropertyModifiedAt selects the time an attribute instance was modified
+	TemporalPropertyModifiedAt = "modifiedAt"
+
+	//OptionTemporalValues requests the simplified temporal representation of entities
+	OptionTemporalValues string = "temporalValues"
+	//OptionAggregatedValues requests the aggregated temporal representation of entities
+	OptionAggregatedValues string = "aggregatedValues"
+)
+
+//TemporalQuery restricts which attribute instances that are returned from a temporal query
+type TemporalQuery struct {
+	TimeRel      string
+	TimeAt       time.Time
+	EndTimeAt    time.Time
+	TimeProperty string
+	LastN        uint64
+
+	AggrMethods        []string
+	AggrPeriodDuration string
+}
+
+func newTemporalQueryFromParameters(params url.Values) (*TemporalQuery, error) {
+	timerel := params.Get("timerel")
+	timeproperty := params.Get("timeproperty")
+	lastN := params.Get("lastN")
+	aggrMethods := params.Get("aggrMethods")
+	aggrPeriodDuration := params.Get("aggrPeriodDuration")
+
+	if timerel == "" && timeproperty == "" && lastN == "" && aggrMethods == "" && aggrPeriodDuration == "" {
+		return nil, nil
+	}
+
+	tq := &TemporalQuery{TimeRel: timerel, TimeProperty: TemporalPropertyObservedAt}
+
+	if aggrMethods != "" {
+		for _, method := range strings.Split(aggrMethods, ",") {
+			if !isAggregationMethod(method) {
+				return nil, fmt.Errorf("unknown aggregation method %s", method)
+			}
+			tq.AggrMethods = append(tq.AggrMethods, method)
+		}
+	}
+
+	if aggrPeriodDuration != "" {
+		if _, err := parseAggregationPeriod(aggrPeriodDuration); err != nil {
+			return nil, err
+		}
+		tq.AggrPeriodDuration = aggrPeriodDuration
+	}
+
+	if timeproperty != "" {
+		if timeproperty != TemporalPropertyObservedAt && timeproperty != TemporalPropertyCreatedAt && timeproperty != TemporalPropertyModifiedAt {
+			return nil, fmt.Errorf("invalid timeproperty %s", timeproperty)
+		}
+		tq.TimeProperty = timeproperty
+	}
+
+	if lastN != "" {
+		n, err := strconv.ParseUint(lastN, 10, 64)
+		if err != nil || n == 0 {
+			return nil, fmt.Errorf("lastN must be a positive integer, not %s", lastN)
+		}
+		tq.LastN = n
+	}
+
+	if timerel == "" {
+		return tq, nil
+	}
+
+	if timerel != TemporalRelationBefore && timerel != TemporalRelationAfter && timerel != TemporalRelationBetween {
+		return nil, fmt.Errorf("unknown temporal relationship %s", timerel)
+	}
+
+	var err error
+
+	tq.TimeAt, err = time.Parse(time.RFC3339Nano, params.Get("timeAt"))
+	if err != nil {
+		return nil, fmt.Errorf("the temporal relationship %s requires a valid timeAt: %s", timerel, err.Error())
+	}
+
+	if timerel == TemporalRelationBetween {
+		tq.EndTimeAt, err = time.Parse(time.RFC3339Nano, params.Get("endTimeAt"))
+		if err != nil {
+			return nil, fmt.Errorf("the temporal relationship between requires a valid endTimeAt: %s", err.Error())
+		}
+
+		if !tq.EndTimeAt.After(tq.TimeAt) {
+			return nil, fmt.Errorf("endTimeAt must be later than timeAt")
+		}
+	}
+
+	return tq, nil
+}
+
+//Matches returns true if the supplied time fulfills the temporal relationship of the query
+func (tq *TemporalQuery) Matches(t time.Time) bool {
+	switch tq.TimeRel {
+	case TemporalRelationBefore:
+		return t.Before(tq.TimeAt)
+	case TemporalRelationAfter:
+		return t.After(tq.TimeAt)
+	case TemporalRelationBetween:
+		return !t.Before(tq.TimeAt) && t.Before(tq.EndTimeAt)
+	}
+
+	return true
+}
+
+//FilterInstances returns the attribute instances that match the temporal query, sorted by
+//the time property, and limited to the lastN most recent instances if requested
+func (tq *TemporalQuery) FilterInstances(instances []map[string]interface{}) []map[string]interface{} {
+	type timedInstance struct {
+		instance map[string]interface{}
+		time     time.Time
+	}
+
+	matching := []timedInstance{}
+
+	for _, instance := range instances {
+		timestamp, _ := instance[tq.TimeProperty].(string)
+		t, err := time.Parse(time.RFC3339Nano, timestamp)
+
+		if err != nil {
+			if tq.TimeRel == "" {
+				matching = append(matching, timedInstance{instance: instance})
+			}
+			continue
+		}
+
+		if tq.Matches(t) {
+			matching = append(matching, timedInstance{instance: instance, time: t})
+		}
+	}
+
+	sort.SliceStable(matching, func(i, j int) bool {
+		return matching[i].time.Before(matching[j].time)
+	})
+
+	if tq.LastN > 0 && uint64(len(matching)) > tq.LastN {
+		matching = matching[uint64(len(matching))-tq.LastN:]
+	}
+
+	result := []map[string]interface{}{}
+	for _, m := range matching {
+		result = append(result, m.instance)
+	}
+
+	return result
+}
+
+//TemporalContextSource is implemented by context sources that keep track of the evolution of
+//their entities over time. Temporal entities are returned in the temporal representation, i.e.
+//with each attribute as an array of attribute instances. A source that does not know of an
+//entity returns nil from RetrieveTemporalEntity, and only returns errors for actual failures.
+type TemporalContextSource interface {
+	ContextSource
+
+	GetTemporalEntities(query Query, callback QueryEntitiesCallback) error
+	RetrieveTemporalEntity(entityID string, query Query) (Entity, error)
+}
+
+//innermostSource returns the source that is decorated by any wrappers, which identifies the
+//source even when a registry wraps it anew for every lookup
+func innermostSource(src ContextSource) ContextSource {
+	return unwrapSource(src, func(s ContextSource) bool {
+		_, wrapped := s.(wrappedContextSource)
+		return !wrapped
+	})
+}
+
+//temporalSource returns the source as a TemporalContextSource, looking through any wrappers
+func temporalSource(src ContextSource) (TemporalContextSource, bool) {
+	tcs, ok := unwrapSource(src, func(s ContextSource) bool {
+		_, ok := s.(TemporalContextSource)
+		return ok
+	}).(TemporalContextSource)
+	return tcs, ok
+}
+
+//NewQueryTemporalEntitiesHandler handles GET requests for the temporal evolution of entities
+func NewQueryTemporalEntitiesHandler(ctxReg ContextRegistry) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ldContext, err := normalizeRequest(r)
+		if err != nil {
+			reportContextError(w, err)
+			return
+		}
+
+		params := queryParameters(r)
+
+		entityTypeNames := params.Get("type")
+		attributeNames := params.Get("attrs")
+
+		if entityTypeNames == "" && attributeNames == "" {
+			errors.ReportNewBadRequestData(
+				w,
+				"A request for temporal entities MUST specify at least one of type or attrs.",
+			)
+			return
+		}
+
+		if params.Get("timerel") == "" {
+			errors.ReportNewBadRequestData(
+				w,
+				"A request for temporal entities MUST specify a timerel.",
+			)
+			return
+		}
+
+		entityTypes := strings.Split(entityTypeNames, ",")
+		attributes := strings.Split(attributeNames, ",")
+
+		query, err := newQueryFromParameters(r, entityTypes, attributes, params.Get("q"))
+		if err != nil {
+			errors.ReportNewBadRequestData(
+				w, err.Error(),
+			)
+			return
+		}
+
+		if query.PaginationLimit() > QueryMaxPaginationLimit {
+			errors.ReportNewTooManyResults(
+				w,
+				fmt.Sprintf("The limit may not be larger than %d.", QueryMaxPaginationLimit),
+			)
+			return
+		}
+
+		representation, err := temporalRepresentation(newRequestWrapper(r), query)
+		if err != nil {
+			errors.ReportNewBadRequestData(w, err.Error())
+			return
+		}
+
+		var entities = []Entity{}
+		var entityCount = uint64(0)
+
+		contextSources := sourcesForReading(ctxReg.GetContextSourcesForQuery(query))
+		temporalSources := 0
+
+		var representationErr error
+
+		for _, source := range contextSources {
+			tcs, ok := temporalSource(source)
+			if !ok {
+				continue
+			}
+			temporalSources++
+
+			err = tcs.GetTemporalEntities(query, func(entity Entity) error {
+				if entityCount < query.PaginationLimit() {
+					represented, err := temporalEntityRepresentation(entity, query, representation)
+					if err != nil {
+						representationErr = err
+						return err
+					}
+
+					entities = append(entities, compactEntity(represented, ldContext))
+					entityCount++
+				}
+				return nil
+			})
+			if err != nil {
+				break
+			}
+		}
+
+		if representationErr != nil {
+			errors.ReportNewTooComplexQuery(w, representationErr.Error())
+			return
+		}
+
+		if err != nil {
+			errors.ReportNewInternalError(
+				w,
+				"An internal error was encountered when trying to get temporal entities from the context source: "+err.Error(),
+			)
+			return
+		}
+
+		if len(contextSources) > 0 && temporalSources == 0 {
+			errors.ReportNewOperationNotSupported(
+				w,
+				"None of the matching context sources support temporal queries.",
+			)
+			return
+		}
+
+		bytes, err := json.MarshalIndent(entities, "", "  ")
+		if err != nil {
+			errors.ReportNewInternalError(w, "Failed to encode response.")
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/ld+json;charset=utf-8")
+		w.Write(bytes)
+	})
+}
+
+//NewRetrieveTemporalEntityHandler handles GET requests for the temporal evolution of a single entity
+func NewRetrieveTemporalEntityHandler(ctxReg ContextRegistry) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ldContext, err := normalizeRequest(r)
+		if err != nil {
+			reportContextError(w, err)
+			return
+		}
+
+		entitiesIdx := strings.Index(r.URL.Path, "/temporal/entities/")
+		if entitiesIdx == -1 {
+			errors.ReportNewBadRequestData(
+				w,
+				"The supplied URL is invalid.",
+			)
+			return
+		}
+
+		entityID := strings.TrimSuffix(r.URL.Path[entitiesIdx+19:], "/")
+		if entityID == "" {
+			errors.ReportNewBadRequestData(w, "The supplied URL is invalid.")
+			return
+		}
+
+		params := queryParameters(r)
+		attributes := strings.Split(params.Get("attrs"), ",")
+
+		query, err := newQueryFromParameters(r, []string{""}, attributes, "")
+		if err != nil {
+			errors.ReportNewBadRequestData(w, err.Error())
+			return
+		}
+
+		representation, err := temporalRepresentation(newRequestWrapper(r), query)
+		if err != nil {
+			errors.ReportNewBadRequestData(w, err.Error())
+			return
+		}
+
+		var entity Entity
+		var firstErr error
+
+		contextSources := sourcesForReading(ctxReg.GetContextSourcesForEntity(entityID))
+		temporalSources := 0
+
+		for _, source := range contextSources {
+			tcs, ok := temporalSource(source)
+			if !ok {
+				continue
+			}
+			temporalSources++
+
+			entity, err = tcs.RetrieveTemporalEntity(entityID, query)
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				continue
+			}
+
+			if entity != nil {
+				break
+			}
+		}
+
+		if len(contextSources) > 0 && temporalSources == 0 {
+			errors.ReportNewOperationNotSupported(
+				w,
+				fmt.Sprintf("None of the context sources for entity %s support temporal retrieval.", entityID),
+			)
+			return
+		}
+
+		if entity == nil && firstErr != nil {
+			reportSourceError(w, "Failed to retrieve temporal entity: ", firstErr, errors.ReportNewInternalError)
+			return
+		}
+
+		if entity == nil {
+			errors.ReportNewResourceNotFound(w, fmt.Sprintf("No temporal data found for entity %s", entityID))
+			return
+		}
+
+		represented, err := temporalEntityRepresentation(entity, query, representation)
+		if err != nil {
+			errors.ReportNewTooComplexQuery(w, err.Error())
+			return
+		}
+
+		bytes, err := json.MarshalIndent(compactEntity(represented, ldContext), "", "  ")
+		if err != nil {
+			errors.ReportNewInternalError(w, "Failed to encode response.")
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/ld+json;charset=utf-8")
+		w.Write(bytes)
+	})
+}
+
+//temporalRepresentation returns the representation requested using the options parameter
+func temporalRepresentation(r Request, query Query) (string, error) {
+	if RequestHasOption(r, OptionAggregatedValues) {
+		if !query.IsTemporalQuery() || len(query.Temporal().AggrMethods) == 0 {
+			return "", fmt.Errorf("the aggregated temporal representation requires aggrMethods")
+		}
+		return OptionAggregatedValues, nil
+	}
+
+	if RequestHasOption(r, OptionTemporalValues) {
+		return OptionTemporalValues, nil
+	}
+
+	return "", nil
+}
+
+//temporalEntityRepresentation converts a temporal entity into the simplified or aggregated
+//representation if requested. In the simplified representation each attribute is reduced
+//to a list of [value, time] pairs. An error is returned if the entity is too complex to aggregate.
+func temporalEntityRepresentation(entity Entity, query Query, representation string) (Entity, error) {
+	if representation == "" {
+		return entity, nil
+	}
+
+	entityMap, err := entityAsMap(entity)
+	if err != nil {
+		return entity, nil
+	}
+
+	tq := query.Temporal()
+	if tq == nil {
+		tq = &TemporalQuery{TimeProperty: TemporalPropertyObservedAt}
+	}
+
+	result := map[string]interface{}{}
+
+	for key, value := range entityMap {
+		if key == "id" || key == "type" || key == "@context" {
+			result[key] = value
+			continue
+		}
+
+		if representation == OptionAggregatedValues {
+			result[key], err = aggregateAttribute(value, tq)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		instances, ok := value.([]interface{})
+		if !ok {
+			instances = []interface{}{value}
+		}
+
+		attributeType := "Property"
+		membersName := "values"
+		pairs := [][]interface{}{}
+
+		for _, i := range instances {
+			instance, ok := i.(map[string]interface{})
+			if !ok {
+				continue
+			}
+
+			if t, ok := instance["type"].(string); ok {
+				attributeType = t
+			}
+
+			if attributeType == "Relationship" {
+				membersName = "objects"
+			}
+
+			pairs = append(pairs, []interface{}{attributeValue(instance), instance[tq.TimeProperty]})
+		}
+
+		result[key] = map[string]interface{}{"type": attributeType, membersName: pairs}
+	}
+
+	return result, nil
+}
@@ -0,0 +1,318 @@
+package ngsi
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	ngsierrors "github.com/iot-for-tillgenglighet/ngsi-ld-golang/pkg/ngsi-ld/errors"
+)
+
+const temporalTestEntityID string = "urn:ngsi-ld:WeatherObserved:station1"
+
+func newTemporalTestRegistry(t *testing.T) ContextRegistry {
+	ctxReg := NewContextRegistry()
+	ctxReg.Register(NewInMemoryContextSource("WeatherObserved"))
+
+	entity := `{"id":"` + temporalTestEntityID + `","type":"WeatherObserved",
+		"temperature":{"type":"Property","value":10.5,"observedAt":"2020-10-01T12:00:00Z"}}`
+
+	req, _ := http.NewRequest("POST", createURL("/entities"), bytes.NewBuffer([]byte(entity)))
+	w := httptest.NewRecorder()
+	NewCreateEntityHandler(ctxReg).ServeHTTP(w, req)
+
+	if w.Code != http.StatusCreated {
+		t.Fatal("Failed to create temporal test entity: ", w.Code, w.Body.String())
+	}
+
+	for _, observation := range []string{
+		`{"temperature":{"type":"Property","value":11.5,"observedAt":"2020-10-01T13:00:00Z"}}`,
+		`{"temperature":{"type":"Property","value":12.5,"observedAt":"2020-10-01T14:00:00Z"}}`,
+	} {
+		req, _ = http.NewRequest("PATCH", createURL("/entities/"+temporalTestEntityID+"/attrs/"), bytes.NewBuffer([]byte(observation)))
+		w = httptest.NewRecorder()
+		NewUpdateEntityAttributesHandler(ctxReg).ServeHTTP(w, req)
+	}
+
+	return ctxReg
+}
+
+func queryTemporalEntities(ctxReg ContextRegistry, params ...string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("GET", createURL("/temporal/entities", params...), nil)
+	w := httptest.NewRecorder()
+	NewQueryTemporalEntitiesHandler(ctxReg).ServeHTTP(w, req)
+	return w
+}
+
+func TestQueryTemporalEntitiesAfterTime(t *testing.T) {
+	ctxReg := newTemporalTestRegistry(t)
+
+	w := queryTemporalEntities(ctxReg, "type=WeatherObserved", "timerel=after", "timeAt=2020-10-01T12:30:00Z")
+
+	entities := []map[string][]map[string]interface{}{}
+	json.Unmarshal(w.Body.Bytes(), &entities)
+
+	if len(entities) != 1 {
+		t.Error("Unexpected number of temporal entities returned. ", len(entities), " != 1")
+		return
+	}
+
+	if len(entities[0]["temperature"]) != 2 {
+		t.Error("Unexpected number of attribute instances. ", len(entities[0]["temperature"]), " != 2")
+	}
+}
+
+func TestQueryTemporalEntitiesBetweenWithLastN(t *testing.T) {
+	ctxReg := newTemporalTestRegistry(t)
+
+	w := queryTemporalEntities(ctxReg,
+		"type=WeatherObserved", "timerel=between", "timeAt=2020-10-01T11:00:00Z",
+		"endTimeAt=2020-10-01T15:00:00Z", "lastN=1",
+	)
+
+	entities := []map[string][]map[string]interface{}{}
+	json.Unmarshal(w.Body.Bytes(), &entities)
+
+	if len(entities) != 1 || len(entities[0]["temperature"]) != 1 {
+		t.Error("Unexpected response: ", w.Body.String())
+		return
+	}
+
+	if entities[0]["temperature"][0]["value"] != 12.5 {
+		t.Error("lastN did not return the latest instance: ", entities[0]["temperature"][0])
+	}
+}
+
+func TestQueryTemporalEntitiesWithoutTimerelFails(t *testing.T) {
+	ctxReg := newTemporalTestRegistry(t)
+
+	w := queryTemporalEntities(ctxReg, "type=WeatherObserved")
+
+	if w.Code != http.StatusBadRequest {
+		t.Error("Handler did not return the expected status code. ", w.Code, " != ", http.StatusBadRequest)
+	}
+}
+
+func TestQueryTemporalEntitiesWithInvalidTimeAtFails(t *testing.T) {
+	ctxReg := newTemporalTestRegistry(t)
+
+	w := queryTemporalEntities(ctxReg, "type=WeatherObserved", "timerel=before", "timeAt=yesterday")
+
+	if w.Code != http.StatusBadRequest {
+		t.Error("Handler did not return the expected status code. ", w.Code, " != ", http.StatusBadRequest)
+	}
+}
+
+func TestRetrieveTemporalEntityWithTemporalValues(t *testing.T) {
+	ctxReg := newTemporalTestRegistry(t)
+
+	req, _ := http.NewRequest("GET", createURL("/temporal/entities/"+temporalTestEntityID, "options=temporalValues"), nil)
+	w := httptest.NewRecorder()
+	NewRetrieveTemporalEntityHandler(ctxReg).ServeHTTP(w, req)
+
+	entity := struct {
+		ID          string `json:"id"`
+		Temperature struct {
+			Type   string          `json:"type"`
+			Values [][]interface{} `json:"values"`
+		} `json:"temperature"`
+	}{}
+
+	json.Unmarshal(w.Body.Bytes(), &entity)
+
+	if entity.ID != temporalTestEntityID || len(entity.Temperature.Values) != 3 {
+		t.Error("Unexpected temporal entity returned: ", w.Body.String())
+		return
+	}
+
+	if entity.Temperature.Values[0][0] != 10.5 || entity.Temperature.Values[0][1] != "2020-10-01T12:00:00Z" {
+		t.Error("Unexpected first temporal value: ", entity.Temperature.Values[0])
+	}
+}
+
+func TestRetrieveUnknownTemporalEntityFails(t *testing.T) {
+	ctxReg := newTemporalTestRegistry(t)
+
+	req, _ := http.NewRequest("GET", createURL("/temporal/entities/urn:ngsi-ld:WeatherObserved:unknown"), nil)
+	w := httptest.NewRecorder()
+	NewRetrieveTemporalEntityHandler(ctxReg).ServeHTTP(w, req)
+
+	if w.Code != http.StatusNotFound {
+		t.Error("Handler did not return the expected status code. ", w.Code, " != ", http.StatusNotFound)
+	}
+}
+
+type failingTemporalSource struct {
+	*mockCtxSource
+	err error
+}
+
+func (s *failingTemporalSource) GetTemporalEntities(query Query, callback QueryEntitiesCallback) error {
+	return s.err
+}
+
+func (s *failingTemporalSource) RetrieveTemporalEntity(entityID string, query Query) (Entity, error) {
+	return nil, s.err
+}
+
+func TestRetrieveTemporalEntityReportsSourceFailures(t *testing.T) {
+	testCases := []struct {
+		err      error
+		expected int
+	}{
+		{fmt.Errorf("the database is gone"), http.StatusInternalServerError},
+		{ngsierrors.NewProblemError(ngsierrors.NewServiceUnavailable("try again later")), http.StatusServiceUnavailable},
+		{ngsierrors.NewProblemError(ngsierrors.NewGatewayTimeout("no response")), http.StatusGatewayTimeout},
+	}
+
+	for _, tc := range testCases {
+		ctxReg := NewContextRegistry()
+		ctxReg.Register(&failingTemporalSource{mockCtxSource: newMockedContextSource("Device", ""), err: tc.err})
+
+		req, _ := http.NewRequest("GET", createURL("/temporal/entities/urn:ngsi-ld:Device:1"), nil)
+		w := httptest.NewRecorder()
+		NewRetrieveTemporalEntityHandler(ctxReg).ServeHTTP(w, req)
+
+		if w.Code != tc.expected {
+			t.Error("Handler did not return the expected status code. ", w.Code, " != ", tc.expected)
+		}
+	}
+}
+
+func TestRetrieveTemporalEntityFromNonTemporalSourceIsNotSupported(t *testing.T) {
+	ctxReg := NewContextRegistry()
+	ctxReg.Register(newMockedContextSource("Device", ""))
+
+	req, _ := http.NewRequest("GET", createURL("/temporal/entities/urn:ngsi-ld:Device:1"), nil)
+	w := httptest.NewRecorder()
+	NewRetrieveTemporalEntityHandler(ctxReg).ServeHTTP(w, req)
+
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Error("Handler did not return the expected status code. ", w.Code, " != ", http.StatusUnprocessableEntity)
+	}
+}
+
+func TestTemporalQueryParameters(t *testing.T) {
+	params := url.Values{}
+	params.Set("timerel", "between")
+	params.Set("timeAt", "2020-10-01T12:00:00Z")
+
+	_, err := newTemporalQueryFromParameters(params)
+	if err == nil {
+		t.Error("A between query without an endTimeAt should fail.")
+	}
+
+	params.Set("endTimeAt", "2020-10-01T13:00:00Z")
+	params.Set("timeproperty", "modifiedAt")
+
+	tq, err := newTemporalQueryFromParameters(params)
+	if err != nil || tq.TimeProperty != TemporalPropertyModifiedAt {
+		t.Error("Failed to parse a valid temporal query.")
+	}
+}
+
+func TestQueryTemporalEntitiesWithAggregatedValues(t *testing.T) {
+	ctxReg := newTemporalTestRegistry(t)
+
+	w := queryTemporalEntities(ctxReg,
+		"type=WeatherObserved", "timerel=after", "timeAt=2020-10-01T12:00:00Z",
+		"options=aggregatedValues", "aggrMethods=avg,max,totalCount", "aggrPeriodDuration=PT3H",
+	)
+
+	entities := []struct {
+		Temperature struct {
+			Avg        [][]interface{} `json:"avg"`
+			Max        [][]interface{} `json:"max"`
+			TotalCount [][]interface{} `json:"totalCount"`
+		} `json:"temperature"`
+	}{}
+	json.Unmarshal(w.Body.Bytes(), &entities)
+
+	if len(entities) != 1 || len(entities[0].Temperature.Avg) != 1 {
+		t.Error("Unexpected aggregated response: ", w.Body.String())
+		return
+	}
+
+	// Only the two instances after timeAt should be included, and both fall within the first period
+	avg := entities[0].Temperature.Avg[0]
+	if avg[0] != 12.0 || avg[1] != "2020-10-01T12:00:00Z" || avg[2] != "2020-10-01T15:00:00Z" {
+		t.Error("Unexpected average: ", avg)
+	}
+
+	if entities[0].Temperature.Max[0][0] != 12.5 || entities[0].Temperature.TotalCount[0][0] != 2.0 {
+		t.Error("Unexpected max or totalCount: ", entities[0].Temperature.Max, entities[0].Temperature.TotalCount)
+	}
+}
+
+func TestAggregatedValuesWithoutMethodsFails(t *testing.T) {
+	ctxReg := newTemporalTestRegistry(t)
+
+	w := queryTemporalEntities(ctxReg,
+		"type=WeatherObserved", "timerel=after", "timeAt=2020-10-01T12:00:00Z", "options=aggregatedValues",
+	)
+
+	if w.Code != http.StatusBadRequest {
+		t.Error("Handler did not return the expected status code. ", w.Code, " != ", http.StatusBadRequest)
+	}
+}
+
+func TestAggregationPeriodsFollowTheCalendar(t *testing.T) {
+	period, err := parseAggregationPeriod("P1MT12H")
+	if err != nil {
+		t.Error("Failed to parse aggregation period: ", err.Error())
+		return
+	}
+
+	start := time.Date(2020, time.February, 1, 0, 0, 0, 0, time.UTC)
+	expected := time.Date(2020, time.March, 1, 12, 0, 0, 0, time.UTC)
+
+	if !period.nth(start, 1).Equal(expected) {
+		t.Error("Unexpected end of period: ", period.nth(start, 1), " != ", expected)
+	}
+
+	for _, invalid := range []string{"P", "PT", "1D", "P1H"} {
+		if _, err := parseAggregationPeriod(invalid); err == nil {
+			t.Error("Parsing should fail for invalid duration ", invalid)
+		}
+	}
+}
+
+func TestAggregationSkipsEmptyPeriods(t *testing.T) {
+	period, _ := parseAggregationPeriod("PT1H")
+	start := time.Date(2020, time.October, 1, 0, 0, 0, 0, time.UTC)
+	values := []timedValue{
+		{value: 1.0, time: start.Add(30 * time.Minute)},
+		{value: 2.0, time: start.Add(5*time.Hour + 10*time.Minute)},
+	}
+
+	buckets, err := bucketsForPeriod(values, period, &TemporalQuery{TimeRel: TemporalRelationAfter, TimeAt: start})
+	if err != nil || len(buckets) != 2 {
+		t.Error("Expected two buckets, one for each value: ", buckets, err)
+		return
+	}
+
+	if !buckets[1].start.Equal(start.Add(5*time.Hour)) || !buckets[1].end.Equal(start.Add(6*time.Hour)) {
+		t.Error("Unexpected period for the second value: ", buckets[1].start, " - ", buckets[1].end)
+	}
+}
+
+func TestAggregationOverTooManyPeriodsIsTooComplex(t *testing.T) {
+	ctxReg := newTemporalTestRegistry(t)
+
+	w := queryTemporalEntities(ctxReg,
+		"type=WeatherObserved", "timerel=after", "timeAt=1970-01-01T00:00:00Z",
+		"options=aggregatedValues", "aggrMethods=totalCount", "aggrPeriodDuration=PT1S",
+	)
+
+	problem := map[string]interface{}{}
+	json.Unmarshal(w.Body.Bytes(), &problem)
+
+	if problem["type"] != "https://uri.etsi.org/ngsi-ld/errors/TooComplexQuery" {
+		t.Error("An aggregation over too many periods should be rejected: ", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,314 @@
+package ngsi
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	//AggregationMethodTotalCount counts the number of attribute instances in a period
+	AggregationMethodTotalCount = "totalCount"
+	//AggregationMethodDistinctCount counts the number of distinct values in a period
+	AggregationMethodDistinctCount = "distinctCount"
+	//AggregationMethodSum sums the numeric values in a period
+	AggregationMethodSum = "sum"
+	//AggregationMethodAvg calculates the average of the numeric values in a period
+	AggregationMethodAvg = "avg"
+	//AggregationMethodMin returns the smallest numeric value in a period
+	AggregationMethodMin = "min"
+	//AggregationMethodMax returns the largest numeric value in a period
+	AggregationMethodMax = "max"
+	//AggregationMethodStdDev calculates the standard deviation of the numeric values in a period
+	AggregationMethodStdDev = "stddev"
+	//AggregationMethodSumSq sums the squares of the numeric values in a period
+	AggregationMethodSumSq = "sumsq"
+)
+
+var aggregationMethods = []string{
+	AggregationMethodTotalCount, AggregationMethodDistinctCount, AggregationMethodSum, AggregationMethodAvg,
+	AggregationMethodMin, AggregationMethodMax, AggregationMethodStdDev, AggregationMethodSumSq,
+}
+
+func isAggregationMethod(method string) bool {
+	return containsString(aggregationMethods, method)
+}
+
+//aggregationPeriod is an ISO 8601 duration. Years, months and days are kept apart from the
+//rest of the duration so that periods follow the calendar rather than a fixed number of hours.
+type aggregationPeriod struct {
+	years    int
+	months   int
+	days     int
+	duration time.Duration
+}
+
+var iso8601DurationRegexp = regexp.MustCompile(
+	`^P(?:(\d+)Y)?(?:(\d+)M)?(?:(\d+)W)?(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+(?:\.\d+)?)S)?)?$`,
+)
+
+func parseAggregationPeriod(s string) (*aggregationPeriod, error) {
+	match := iso8601DurationRegexp.FindStringSubmatch(s)
+	if match == nil || s == "P" || s[len(s)-1] == 'T' {
+		return nil, fmt.Errorf("invalid ISO 8601 duration %s", s)
+	}
+
+	number := func(idx int) int {
+		n, _ := strconv.Atoi(match[idx])
+		return n
+	}
+
+	period := &aggregationPeriod{
+		years:  number(1),
+		months: number(2),
+		days:   number(3)*7 + number(4),
+		duration: time.Duration(number(5))*time.Hour +
+			time.Duration(number(6))*time.Minute,
+	}
+
+	if match[7] != "" {
+		seconds, _ := strconv.ParseFloat(match[7], 64)
+		period.duration += time.Duration(seconds * float64(time.Second))
+	}
+
+	return period, nil
+}
+
+func (p *aggregationPeriod) isZero() bool {
+	return p.years == 0 && p.months == 0 && p.days == 0 && p.duration == 0
+}
+
+//nth returns the start of the n:th period after start
+func (p *aggregationPeriod) nth(start time.Time, n int) time.Time {
+	return start.AddDate(n*p.years, n*p.months, n*p.days).Add(time.Duration(n) * p.duration)
+}
+
+//approximateSeconds returns the length of the period in seconds, using the average length of
+//years and months for calendar periods. Periods without years or months have an exact length.
+func (p *aggregationPeriod) approximateSeconds() float64 {
+	const day = 24 * 60 * 60
+	return float64(p.years)*day*365.2425 + float64(p.months)*day*365.2425/12 +
+		float64(p.days)*day + p.duration.Seconds()
+}
+
+//index returns the number of the period that contains t, counting from the period that starts
+//at start. The index is calculated directly instead of by stepping through all the periods in
+//between, and false is returned if t is more than maxAggregationPeriods periods after start.
+func (p *aggregationPeriod) index(start, t time.Time) (int, bool) {
+	elapsed := float64(t.Unix()-start.Unix()) + float64(t.Nanosecond()-start.Nanosecond())/1e9
+
+	estimate := elapsed / p.approximateSeconds()
+	if estimate >= maxAggregationPeriods {
+		return 0, false
+	}
+
+	n := int(math.Max(estimate, 0))
+
+	// Calendar periods vary in length, so the estimate may be off by a period or so
+	for n > 0 && p.nth(start, n).After(t) {
+		n--
+	}
+	for n < maxAggregationPeriods && !p.nth(start, n+1).After(t) {
+		n++
+	}
+
+	return n, n < maxAggregationPeriods
+}
+
+//maxAggregationPeriods limits how many periods the values of an attribute may span, since each
+//period could become a bucket in the response
+const maxAggregationPeriods = 10000
+
+//errTooManyAggregationPeriods is returned when the values of an attribute span too many periods
+var errTooManyAggregationPeriods = fmt.Errorf("the aggregated values span more than %d periods", maxAggregationPeriods)
+
+type timedValue struct {
+	value interface{}
+	time  time.Time
+}
+
+//aggregateAttribute converts the instances of a temporal attribute into the aggregated
+//representation. Attributes that have already been aggregated by the context source are
+//returned unchanged.
+func aggregateAttribute(value interface{}, tq *TemporalQuery) (interface{}, error) {
+	instances, ok := value.([]interface{})
+	if !ok {
+		if m, isMap := value.(map[string]interface{}); isMap && isAggregatedAttribute(m) {
+			return value, nil
+		}
+		instances = []interface{}{value}
+	}
+
+	attributeType := "Property"
+	values := []timedValue{}
+
+	for _, i := range instances {
+		instance, ok := i.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		if t, ok := instance["type"].(string); ok {
+			attributeType = t
+		}
+
+		timestamp, _ := instance[tq.TimeProperty].(string)
+		t, err := time.Parse(time.RFC3339Nano, timestamp)
+		if err != nil {
+			continue
+		}
+
+		values = append(values, timedValue{value: attributeValue(instance), time: t.UTC()})
+	}
+
+	sort.SliceStable(values, func(i, j int) bool {
+		return values[i].time.Before(values[j].time)
+	})
+
+	result := map[string]interface{}{"type": attributeType}
+	for _, method := range tq.AggrMethods {
+		result[method] = [][]interface{}{}
+	}
+
+	if len(values) == 0 {
+		return result, nil
+	}
+
+	period := &aggregationPeriod{}
+	if tq.AggrPeriodDuration != "" {
+		period, _ = parseAggregationPeriod(tq.AggrPeriodDuration)
+	}
+
+	buckets, err := bucketsForPeriod(values, period, tq)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, bucket := range buckets {
+		for _, method := range tq.AggrMethods {
+			aggregated, ok := aggregate(method, bucket.values)
+			if ok {
+				result[method] = append(result[method].([][]interface{}), []interface{}{
+					aggregated,
+					bucket.start.Format(time.RFC3339Nano),
+					bucket.end.Format(time.RFC3339Nano),
+				})
+			}
+		}
+	}
+
+	return result, nil
+}
+
+func isAggregatedAttribute(attribute map[string]interface{}) bool {
+	for _, method := range aggregationMethods {
+		if _, ok := attribute[method]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+type aggregationBucket struct {
+	start  time.Time
+	end    time.Time
+	values []timedValue
+}
+
+//bucketsForPeriod splits the sorted values into consecutive periods. The first period starts
+//at timeAt if the query has a lower bound, and otherwise at the time of the first value.
+//A zero period aggregates all values into a single bucket. Only periods that contain values
+//are returned, and values that span too many periods are rejected.
+func bucketsForPeriod(values []timedValue, period *aggregationPeriod, tq *TemporalQuery) ([]aggregationBucket, error) {
+	start := values[0].time
+	if tq.TimeRel == TemporalRelationAfter || tq.TimeRel == TemporalRelationBetween {
+		start = tq.TimeAt.UTC()
+	}
+
+	if period.isZero() {
+		end := values[len(values)-1].time
+		if tq.TimeRel == TemporalRelationBetween {
+			end = tq.EndTimeAt.UTC()
+		}
+		return []aggregationBucket{{start: start, end: end, values: values}}, nil
+	}
+
+	buckets := []aggregationBucket{}
+
+	for _, v := range values {
+		last := len(buckets) - 1
+		if last < 0 || !v.time.Before(buckets[last].end) {
+			n, ok := period.index(start, v.time)
+			if !ok {
+				return nil, errTooManyAggregationPeriods
+			}
+
+			buckets = append(buckets, aggregationBucket{start: period.nth(start, n), end: period.nth(start, n+1)})
+			last++
+		}
+		buckets[last].values = append(buckets[last].values, v)
+	}
+
+	return buckets, nil
+}
+
+//aggregate applies an aggregation method to the values of a period. The returned flag is
+//false if the method could not be applied, e.g. when calculating the sum of text values.
+func aggregate(method string, values []timedValue) (interface{}, bool) {
+	switch method {
+	case AggregationMethodTotalCount:
+		return len(values), true
+	case AggregationMethodDistinctCount:
+		distinct := map[string]bool{}
+		for _, v := range values {
+			key, _ := json.Marshal(v.value)
+			distinct[string(key)] = true
+		}
+		return len(distinct), true
+	}
+
+	numbers := []float64{}
+	for _, v := range values {
+		if number, ok := v.value.(float64); ok {
+			numbers = append(numbers, number)
+		}
+	}
+
+	if len(numbers) == 0 {
+		return nil, false
+	}
+
+	sum, sumsq := 0.0, 0.0
+	min, max := numbers[0], numbers[0]
+
+	for _, n := range numbers {
+		sum += n
+		sumsq += n * n
+		min = math.Min(min, n)
+		max = math.Max(max, n)
+	}
+
+	avg := sum / float64(len(numbers))
+
+	switch method {
+	case AggregationMethodSum:
+		return sum, true
+	case AggregationMethodAvg:
+		return avg, true
+	case AggregationMethodMin:
+		return min, true
+	case AggregationMethodMax:
+		return max, true
+	case AggregationMethodSumSq:
+		return sumsq, true
+	case AggregationMethodStdDev:
+		variance := sumsq/float64(len(numbers)) - avg*avg
+		return math.Sqrt(math.Max(variance, 0)), true
+	}
+
+	return nil, false
+}